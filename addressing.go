@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 )
 
@@ -11,30 +12,110 @@ type Addressing struct {
 	LocalIPAddr     net.IP
 
 	VPNEndpointStartPort int
+
+	// TunnelBaseNet is the network that the addresses within tunnels are
+	// allocated from. If nil, DefaultTunnelBasePrefix is used.
+	TunnelBaseNet *net.IPNet
+
+	// TunnelSubnets is set if each tunnel gets its own /30 network
+	// rather than a pair of unrelated host addresses. See
+	// VPNTopologySubnet.
+	TunnelSubnets bool
+
+	// LocalEndpointId, if set, overrides the endpoint id derived from
+	// LocalIPAddr. See Config.EndpointIdOverrideValue.
+	LocalEndpointId *EndpointId
+}
+
+// tunnelIdBits is the number of bits that TunnelInternalIPs needs below
+// the tunnel base prefix: ten for each of the two endpoint ids, plus two
+// more for the host part of each /30 if TunnelSubnets is set.
+const (
+	tunnelIdBits       = 20
+	tunnelSubnetIdBits = tunnelIdBits + 2
+)
+
+// NewAddressing builds the addressing scheme described by the given
+// configuration, for a node whose local address is the given one.
+func NewAddressing(config *Config, localIP net.IP) (*Addressing, error) {
+	tunnelBaseNet, err := config.TunnelBaseNet()
+	if err != nil {
+		return nil, err
+	}
+	localEndpointId, err := config.EndpointIdOverrideValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Addressing{
+		CommonPrefixLen:      config.CommonPrefixLen,
+		RegionPrefixLen:      config.RegionPrefixLen,
+		DCPrefixLen:          config.DCPrefixLen,
+		LocalIPAddr:          localIP,
+		VPNEndpointStartPort: config.VPNEndpointStartPort,
+		TunnelBaseNet:        tunnelBaseNet,
+		TunnelSubnets:        config.VPNTopology == VPNTopologySubnet,
+		LocalEndpointId:      localEndpointId,
+	}, nil
 }
 
 func (ing *Addressing) Address(addr string) Address {
 	ip := net.ParseIP(addr)
-	return Address{ing, ip}
+	return Address{ing: ing, IP: ip}
 }
 
 func (ing *Addressing) IPAddress(addr net.IP) Address {
-	return Address{ing, addr}
+	return Address{ing: ing, IP: addr}
 }
 
 func (ing *Addressing) LocalAddress() Address {
-	return Address{ing, ing.LocalIPAddr}
+	ret := Address{ing: ing, IP: ing.LocalIPAddr}
+	if ing.LocalEndpointId != nil {
+		ret = ret.WithEndpointId(*ing.LocalEndpointId)
+	}
+	return ret
 }
 
 type Address struct {
 	ing *Addressing
 	IP  net.IP
+
+	// idOverride is the endpoint id to use instead of the one derived
+	// from IP, if overridden is set. See WithEndpointId.
+	idOverride EndpointId
+	overridden bool
+}
+
+// WithEndpointId returns a copy of the address whose endpoint id is the
+// given one rather than the one derived from the IP address. This exists
+// only so that several nodes can share a datacenter for development; see
+// Config.EndpointIdOverrideValue.
+func (addr Address) WithEndpointId(id EndpointId) Address {
+	addr.idOverride = id
+	addr.overridden = true
+	return addr
 }
 
 func (addr Address) String() string {
 	return addr.IP.String()
 }
 
+// bits returns the length of the address in bits, which is 32 for an
+// IPv4 address and 128 for an IPv6 address.
+func (addr Address) bits() int {
+	if addr.IP.To4() != nil {
+		return 32
+	}
+	return 128
+}
+
+// mask returns the mask for the given prefix length of the address, or
+// nil if the address is too short for the prefix. This can happen only
+// if an endpoint uses a different address family than we were configured
+// for.
+func (addr Address) mask(prefixLen int) net.IPMask {
+	return net.CIDRMask(prefixLen, addr.bits())
+}
+
 func (addr Address) RegionId() string {
 	prefixLen := addr.ing.RegionPrefixLen
 	if addr.IP == nil {
@@ -42,7 +123,10 @@ func (addr Address) RegionId() string {
 		return ""
 	}
 
-	mask := net.CIDRMask(prefixLen, 32)
+	mask := addr.mask(prefixLen)
+	if mask == nil {
+		return ""
+	}
 	return addr.IP.Mask(mask).String()
 }
 
@@ -53,10 +137,30 @@ func (addr Address) DatacenterId() string {
 		return ""
 	}
 
-	mask := net.CIDRMask(prefixLen, 32)
+	mask := addr.mask(prefixLen)
+	if mask == nil {
+		return ""
+	}
 	return addr.IP.Mask(mask).String()
 }
 
+// DatacenterNetwork returns the network of the datacenter that the address
+// belongs to, or nil if there is no address.
+func (addr Address) DatacenterNetwork() *net.IPNet {
+	if addr.IP == nil {
+		return nil
+	}
+
+	mask := addr.mask(addr.ing.DCPrefixLen)
+	if mask == nil {
+		return nil
+	}
+	return &net.IPNet{
+		IP:   addr.IP.Mask(mask),
+		Mask: mask,
+	}
+}
+
 // EndpointId returns the unique identifier for this endpoint, which
 // is made from the bits in the endpoint's private IP address
 // between the common prefix and the datacenter prefix. In other words,
@@ -67,6 +171,10 @@ func (addr Address) DatacenterId() string {
 // there should be only one endpoint per datacenter. If not, behavior is
 // undefined and tunnel instability is the likely result.
 func (addr Address) EndpointId() EndpointId {
+	if addr.overridden {
+		return addr.idOverride
+	}
+
 	commonPrefixLen := addr.ing.CommonPrefixLen
 	dcPrefixLen := addr.ing.DCPrefixLen
 	ip := addr.IP
@@ -79,13 +187,14 @@ func (addr Address) EndpointId() EndpointId {
 	// These cases should've been caught during config validation, so
 	// we won't go out of our way to report it but we will check
 	// so that we won't crash if these assumptions are violated.
-	if commonPrefixLen >= 24 || commonPrefixLen >= dcPrefixLen || (dcPrefixLen-commonPrefixLen) > 10 {
+	bits := addr.bits()
+	if commonPrefixLen >= bits-8 || commonPrefixLen >= dcPrefixLen || dcPrefixLen > bits || (dcPrefixLen-commonPrefixLen) > 10 {
 		return InvalidEndpointId
 	}
 
 	// First we'll compute the datacenter id as an IP address, and
 	// extract the raw bytes from it.
-	mask := net.CIDRMask(dcPrefixLen, 32)
+	mask := addr.mask(dcPrefixLen)
 	dcBytes := []byte(ip.Mask(mask))
 
 	// integer division by 8 gives us the index of the byte that
@@ -105,15 +214,56 @@ func (addr Address) EndpointId() EndpointId {
 	return EndpointId(id & 0x3ff)
 }
 
-func (addr Address) TunnelInternalIPs(remoteId EndpointId) (local net.IP, remote net.IP) {
+// TunnelInternalIPs returns the addresses of the local and remote ends
+// within the tunnel between this address's endpoint and the given remote
+// endpoint. It returns an error if either endpoint id is invalid or they
+// are the same, since the result would then collide with the addresses of
+// some other tunnel.
+//
+// If TunnelSubnets is set then the two addresses are the first and second
+// host addresses of a /30 network that belongs to the pair of endpoints,
+// with the lower endpoint id taking the first.
+func (addr Address) TunnelInternalIPs(remoteId EndpointId) (local net.IP, remote net.IP, err error) {
 	localId := addr.EndpointId()
+	if !localId.Valid() {
+		return nil, nil, fmt.Errorf("local endpoint id is invalid")
+	}
+	if !remoteId.Valid() {
+		return nil, nil, fmt.Errorf("remote endpoint id %s is invalid", remoteId)
+	}
+	if localId == remoteId {
+		return nil, nil, fmt.Errorf("remote endpoint id %s is the same as the local one", remoteId)
+	}
 
-	// Start with 172.16.0.0/12. The remaining 20 bits will come from
-	// the local and remote endpoint ids, which are 10 bits each.
-	rawBaseAddr := (uint32(172) << 24) | (uint32(16) << 16)
+	// Start with the base network, which is 172.16.0.0/12 by default.
+	// The low 20 bits will come from the local and remote endpoint ids,
+	// which are 10 bits each.
+	baseNet := addr.ing.TunnelBaseNet
+	if baseNet == nil {
+		_, baseNet, _ = net.ParseCIDR(DefaultTunnelBasePrefix)
+	}
+	baseIP := baseNet.IP.To4()
+	rawBaseAddr := uint32(baseIP[0])<<24 | uint32(baseIP[1])<<16 | uint32(baseIP[2])<<8 | uint32(baseIP[3])
+
+	var rawLocalAddr, rawRemoteAddr uint32
+	if addr.ing.TunnelSubnets {
+		rawBaseAddr &^= (1 << tunnelSubnetIdBits) - 1
 
-	rawLocalAddr := rawBaseAddr | (uint32(localId) << 10) | uint32(remoteId)
-	rawRemoteAddr := rawBaseAddr | (uint32(remoteId) << 10) | uint32(localId)
+		lowId, highId := localId, remoteId
+		if lowId > highId {
+			lowId, highId = highId, lowId
+		}
+		rawNetAddr := rawBaseAddr | (uint32(lowId)<<10|uint32(highId))<<2
+		rawLocalAddr, rawRemoteAddr = rawNetAddr|1, rawNetAddr|2
+		if localId > remoteId {
+			rawLocalAddr, rawRemoteAddr = rawRemoteAddr, rawLocalAddr
+		}
+	} else {
+		rawBaseAddr &^= (1 << tunnelIdBits) - 1
+
+		rawLocalAddr = rawBaseAddr | (uint32(localId) << 10) | uint32(remoteId)
+		rawRemoteAddr = rawBaseAddr | (uint32(remoteId) << 10) | uint32(localId)
+	}
 
 	localAddr := net.IPv4(
 		byte(rawLocalAddr>>24),
@@ -128,7 +278,7 @@ func (addr Address) TunnelInternalIPs(remoteId EndpointId) (local net.IP, remote
 		byte(rawRemoteAddr>>0),
 	)
 
-	return localAddr, remoteAddr
+	return localAddr, remoteAddr, nil
 }
 
 func (addr Address) VPNEndpointPorts(remoteId EndpointId) (int, int) {
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTunnelInternalIPs(t *testing.T) {
+	// Subnets need two more bits, and so a shorter base prefix.
+	subnets := *testAddressing
+	subnets.TunnelSubnets = true
+	_, subnets.TunnelBaseNet, _ = net.ParseCIDR("100.64.0.0/10")
+
+	tests := []struct {
+		name               string
+		ing                *Addressing
+		localId, remoteId  EndpointId
+		wantLocal, wantRem string
+	}{
+		{"lowest to highest", testAddressing, 0x000, 0x3ff, "172.16.3.255", "172.31.252.0"},
+		{"highest to lowest", testAddressing, 0x3ff, 0x000, "172.31.252.0", "172.16.3.255"},
+		{"neighbors", testAddressing, 0x001, 0x002, "172.16.4.2", "172.16.8.1"},
+		{"subnet lowest to highest", &subnets, 0x000, 0x3ff, "100.64.15.253", "100.64.15.254"},
+		{"subnet highest to lowest", &subnets, 0x3ff, 0x000, "100.64.15.254", "100.64.15.253"},
+	}
+	for _, test := range tests {
+		addr := test.ing.Address(testEndpointIP(test.localId))
+		local, remote, err := addr.TunnelInternalIPs(test.remoteId)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if !local.Equal(net.ParseIP(test.wantLocal)) || !remote.Equal(net.ParseIP(test.wantRem)) {
+			t.Errorf("%s: got %s and %s; want %s and %s", test.name, local, remote, test.wantLocal, test.wantRem)
+		}
+
+		// The other end must see the same pair, the other way around.
+		other := test.ing.Address(testEndpointIP(test.remoteId))
+		otherLocal, otherRemote, err := other.TunnelInternalIPs(test.localId)
+		if err != nil {
+			t.Errorf("%s: unexpected error from the other end: %s", test.name, err)
+			continue
+		}
+		if !otherLocal.Equal(remote) || !otherRemote.Equal(local) {
+			t.Errorf("%s: other end got %s and %s; want %s and %s", test.name, otherLocal, otherRemote, remote, local)
+		}
+	}
+}
+
+func TestTunnelInternalIPsInvalid(t *testing.T) {
+	valid := testAddressing.Address(testEndpointIP(0x001))
+	tests := []struct {
+		name     string
+		addr     Address
+		remoteId EndpointId
+	}{
+		{"invalid remote", valid, InvalidEndpointId},
+		{"out of range remote", valid, 0x400},
+		{"same as local", valid, 0x001},
+		{"no local address", testAddressing.Address(""), 0x002},
+		{"invalid local override", valid.WithEndpointId(InvalidEndpointId), 0x002},
+	}
+	for _, test := range tests {
+		local, remote, err := test.addr.TunnelInternalIPs(test.remoteId)
+		if err == nil {
+			t.Errorf("%s: got %s and %s; want error", test.name, local, remote)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// This file keeps the audit log: an append-only record of every tunnel
+// state transition and every change to the cluster membership, from which
+// the timeline of an incident can be reconstructed afterwards. Unlike the
+// metrics and the notifications, it records every change, however brief.
+//
+// If audit_log is enabled, each change is written as a line of JSON to
+// the audit log in the data dir (see datadir.go). Once the file reaches
+// the maximum size it is renamed with a ".1" suffix, shifting the older
+// files along, and at most auditBackups of those are kept.
+
+// auditFilename is the name of the audit log within its subdirectory of
+// the data dir, and auditBackups is the number of rotated audit logs we
+// keep.
+const (
+	auditFilename = "audit.log"
+	auditBackups  = 3
+)
+
+// DefaultAuditLogMaxMB is the audit_log_max_mb we use when it isn't set.
+const DefaultAuditLogMaxMB = 10
+
+// The kinds of auditRecord.
+const (
+	auditTunnel = "tunnel"
+	auditMember = "member"
+)
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Time string `json:"time"`
+	Kind string `json:"kind"`
+
+	// EndpointId is the endpoint the record is about: the one at the far
+	// end of the tunnel, or the member, if it has a valid id. NodeName is
+	// the member's name, for member records.
+	EndpointId string `json:"endpoint_id,omitempty"`
+	NodeName   string `json:"node_name,omitempty"`
+
+	// OldState and NewState are the tunnel's VPNStates, or for member
+	// records NewState is the Serf event, such as "member-join".
+	OldState string `json:"old_state,omitempty"`
+	NewState string `json:"new_state"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// auditLog writes auditRecords to a file, rotating it as it grows. A nil
+// auditLog discards everything, so that callers needn't check whether
+// the audit log is enabled.
+type auditLog struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	closed  bool
+}
+
+// openAuditLog opens the audit log at the given path for appending,
+// creating it if necessary.
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	ret := &auditLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := ret.open(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %s", err)
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// TunnelTransition records that the tunnel to the given endpoint changed
+// from one state to another.
+func (a *auditLog) TunnelTransition(endpointId EndpointId, oldState, newState VPNState, reason string) {
+	a.record(&auditRecord{
+		Kind:       auditTunnel,
+		EndpointId: endpointId.String(),
+		OldState:   oldState.String(),
+		NewState:   newState.String(),
+		Reason:     reason,
+	})
+}
+
+// TunnelLaunched records that we launched a tunnel to the given endpoint.
+func (a *auditLog) TunnelLaunched(endpointId EndpointId) {
+	a.record(&auditRecord{
+		Kind:       auditTunnel,
+		EndpointId: endpointId.String(),
+		NewState:   VPNLaunching.String(),
+	})
+}
+
+// MemberEvent records a change to the cluster membership, where event is
+// the name of the Serf event. endpointId is ignored if it isn't valid.
+func (a *auditLog) MemberEvent(nodeName string, endpointId EndpointId, event string) {
+	record := &auditRecord{
+		Kind:     auditMember,
+		NodeName: nodeName,
+		NewState: event,
+	}
+	if endpointId.Valid() {
+		record.EndpointId = endpointId.String()
+	}
+	a.record(record)
+}
+
+func (a *auditLog) record(record *auditRecord) {
+	if a == nil {
+		return
+	}
+	record.Time = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.Warnf("Failed to encode audit record: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return
+	}
+	if a.file == nil {
+		// We failed to reopen it after rotating, so try again.
+		if err := a.open(); err != nil {
+			logger.Warnf("%s", err)
+			return
+		}
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			logger.Warnf("Failed to rotate audit log: %s", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logger.Warnf("Failed to write audit log: %s", err)
+	}
+}
+
+// rotate moves the current audit log aside, along with the older ones,
+// and starts a new one. The caller must hold the lock.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	for i := auditBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Close closes the audit log. Nothing more may be recorded afterwards.
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.closed = true
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// transitionReason explains why the tunnel to the given endpoint is moving
+// to the given state, as far as we know, for the audit log. The caller
+// must hold the lock.
+func (m *TunnelMgr) transitionReason(endpointId EndpointId, state VPNState) string {
+	switch {
+	case state == VPNAuthFailed:
+		return "authentication failed"
+	case state == VPNExited && m.phases[endpointId] == tunnelClosing:
+		return "closed"
+	case state == VPNExited:
+		return "exited unexpectedly"
+	case m.tunnelStates[endpointId] == VPNConnected:
+		return "connection lost"
+	}
+	return ""
+}
@@ -10,12 +10,34 @@ type ClusterState struct {
 	RemoteEndpoints []*Endpoint
 	LocalEndpoints  []*Endpoint
 	ThisEndpoint    *Endpoint
+
+	// ObserverEndpoints are the other members that are observers. These
+	// are kept separate from the local and remote endpoints so that
+	// they will never be selected for tunnels or as a next-hop.
+	ObserverEndpoints []*Endpoint
+
+	// UnknownEndpoints are the other members whose "int_ip" tag is
+	// missing or isn't a valid address under our addressing settings, so
+	// that we can't tell which region they belong to or what their
+	// endpoint id is. Like observers, they're never selected for tunnels
+	// or as a next-hop.
+	UnknownEndpoints []*Endpoint
+
+	// DuplicateEndpoints maps each endpoint id that is claimed by more
+	// than one member to all of the members that claim it. This happens
+	// when the one-endpoint-per-datacenter rule is violated. Tunnels to
+	// these ids would fight over the same tunnel addresses and ports,
+	// so we don't create them.
+	DuplicateEndpoints map[EndpointId][]*Endpoint
 }
 
 func newClusterState(gossip *Gossip, members []serf.Member) *ClusterState {
 	ret := &ClusterState{
-		RemoteEndpoints: make([]*Endpoint, 0, 5),
-		LocalEndpoints:  make([]*Endpoint, 0, 5),
+		RemoteEndpoints:    make([]*Endpoint, 0, 5),
+		LocalEndpoints:     make([]*Endpoint, 0, 5),
+		ObserverEndpoints:  make([]*Endpoint, 0),
+		UnknownEndpoints:   make([]*Endpoint, 0),
+		DuplicateEndpoints: make(map[EndpointId][]*Endpoint),
 	}
 
 	localNode := gossip.localNode()
@@ -26,13 +48,27 @@ func newClusterState(gossip *Gossip, members []serf.Member) *ClusterState {
 
 	ret.ThisEndpoint = localEndpoint
 
-	for _, member := range members {
-		if member.Name == myNodeName {
+	endpoints := make([]*Endpoint, 0, len(members))
+	for i := range members {
+		if members[i].Name == myNodeName {
 			// We already took care of our own endpoint object
 			continue
 		}
+		endpoints = append(endpoints, newEndpoint(gossip, &members[i]))
+	}
+
+	endpoints, suppressed := suppressStale(localEndpoint, endpoints)
+	gossip.noteSuppressed(suppressed)
 
-		endpoint := newEndpoint(gossip, &member)
+	for _, endpoint := range endpoints {
+		if endpoint.Observer() {
+			ret.ObserverEndpoints = append(ret.ObserverEndpoints, endpoint)
+			continue
+		}
+		if !endpoint.AddressValid() {
+			ret.UnknownEndpoints = append(ret.UnknownEndpoints, endpoint)
+			continue
+		}
 
 		if myRegionId == endpoint.RegionId() {
 			ret.LocalEndpoints = append(ret.LocalEndpoints, endpoint)
@@ -41,6 +77,10 @@ func newClusterState(gossip *Gossip, members []serf.Member) *ClusterState {
 		}
 	}
 
+	ret.findDuplicates()
+	gossip.warnDuplicates(ret.DuplicateEndpoints)
+	gossip.warnUnknown(ret.UnknownEndpoints)
+
 	sort.Stable(ret.SortByDistance(ret.LocalEndpoints))
 
 	// Don't really have any need for these to be in order, but let's
@@ -51,16 +91,215 @@ func newClusterState(gossip *Gossip, members []serf.Member) *ClusterState {
 	return ret
 }
 
+// suppressStale separates the given endpoints from the stale members
+// that Serf can briefly report alongside a node that has restarted or
+// been renamed to resolve a name conflict. When several members claim
+// the same endpoint id, we keep only those with the most live status,
+// so that an alive member wins over failed ones and a failed one over
+// those that have left. The endpoint for this node always wins, since
+// it is necessarily alive.
+//
+// Members with equally live statuses are all kept, since they are a
+// genuine conflict that findDuplicates must report, as are observers and
+// members whose addresses we don't understand.
+func suppressStale(this *Endpoint, endpoints []*Endpoint) (kept, suppressed []*Endpoint) {
+	best := make(map[EndpointId]int)
+	if this.AddressValid() {
+		best[this.Id()] = liveness(this)
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Observer() || !endpoint.AddressValid() {
+			continue
+		}
+		id := endpoint.Id()
+		if rank, ok := best[id]; !ok || liveness(endpoint) > rank {
+			best[id] = liveness(endpoint)
+		}
+	}
+
+	kept = make([]*Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if !endpoint.Observer() && endpoint.AddressValid() && liveness(endpoint) < best[endpoint.Id()] {
+			suppressed = append(suppressed, endpoint)
+			continue
+		}
+		kept = append(kept, endpoint)
+	}
+	return kept, suppressed
+}
+
+// liveness ranks the given endpoint's status for suppressStale, with
+// higher values being more live.
+func liveness(endpoint *Endpoint) int {
+	switch endpoint.Status() {
+	case serf.StatusAlive:
+		return 3
+	case serf.StatusFailed:
+		return 2
+	case serf.StatusLeaving:
+		return 1
+	}
+	return 0
+}
+
+// findDuplicates populates DuplicateEndpoints by grouping all of the
+// routable endpoints, including our own, by their ids.
+func (s *ClusterState) findDuplicates() {
+	byId := make(map[EndpointId][]*Endpoint)
+	add := func(endpoint *Endpoint) {
+		id := endpoint.Id()
+		if id == InvalidEndpointId {
+			return
+		}
+		byId[id] = append(byId[id], endpoint)
+	}
+
+	add(s.ThisEndpoint)
+	for _, endpoint := range s.LocalEndpoints {
+		add(endpoint)
+	}
+	for _, endpoint := range s.RemoteEndpoints {
+		add(endpoint)
+	}
+
+	for id, endpoints := range byId {
+		if len(endpoints) < 2 {
+			continue
+		}
+		s.DuplicateEndpoints[id] = endpoints
+	}
+}
+
+// IsDuplicate returns true if the given endpoint's id is also claimed by
+// some other endpoint.
+func (s *ClusterState) IsDuplicate(endpoint *Endpoint) bool {
+	_, ok := s.DuplicateEndpoints[endpoint.Id()]
+	return ok
+}
+
+// NearestLocalEndpoints returns the other endpoints in our region, nearest
+// first according to the network coordinates as of when the state was
+// produced.
+func (s *ClusterState) NearestLocalEndpoints() []*Endpoint {
+	ret := make([]*Endpoint, len(s.LocalEndpoints))
+	copy(ret, s.LocalEndpoints)
+	return ret
+}
+
+// RankedLocalEndpoints returns the other endpoints in our region, best
+// first according to the given scorer. See scoring.go.
+func (s *ClusterState) RankedLocalEndpoints(scorer EndpointScorer) []*Endpoint {
+	ret := s.NearestLocalEndpoints()
+	sort.Stable(s.SortByScore(ret, scorer))
+	return ret
+}
+
+// ClusterDelta describes how the cluster changed between two ClusterStates.
+type ClusterDelta struct {
+	// Added and Removed are the endpoints that joined and disappeared
+	// entirely, respectively.
+	Added   []*Endpoint
+	Removed []*Endpoint
+
+	// Changed are the endpoints whose status changed, or whose other
+	// properties that affect tunneling (addresses, endpoint id, observer
+	// flag or VPN settings) changed. These are the new versions.
+	Changed []*Endpoint
+}
+
+// Empty returns true if the delta contains no changes.
+func (d ClusterDelta) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffFrom compares the receiver with an earlier state and describes how
+// the endpoints changed. If prev is nil then all endpoints are considered
+// to be added.
+//
+// Endpoints are matched up by node name. Changes that don't affect
+// tunneling, such as to unrelated tags or to network coordinates, are
+// ignored.
+func (s *ClusterState) DiffFrom(prev *ClusterState) ClusterDelta {
+	var ret ClusterDelta
+
+	current := s.endpointsByName()
+	var previous map[string]*Endpoint
+	if prev != nil {
+		previous = prev.endpointsByName()
+	}
+
+	for _, endpoint := range s.allEndpoints() {
+		old, existed := previous[endpoint.NodeName()]
+		switch {
+		case !existed:
+			ret.Added = append(ret.Added, endpoint)
+		case !endpoint.equivalentTo(old):
+			ret.Changed = append(ret.Changed, endpoint)
+		}
+	}
+	if prev != nil {
+		for _, endpoint := range prev.allEndpoints() {
+			if _, exists := current[endpoint.NodeName()]; !exists {
+				ret.Removed = append(ret.Removed, endpoint)
+			}
+		}
+	}
+
+	return ret
+}
+
+// allEndpoints returns all of the endpoints in the state, including our
+// own, the observers and those whose addresses we don't understand.
+func (s *ClusterState) allEndpoints() []*Endpoint {
+	ret := make([]*Endpoint, 0, 1+len(s.LocalEndpoints)+len(s.RemoteEndpoints)+len(s.ObserverEndpoints)+len(s.UnknownEndpoints))
+	if s.ThisEndpoint != nil {
+		ret = append(ret, s.ThisEndpoint)
+	}
+	ret = append(ret, s.LocalEndpoints...)
+	ret = append(ret, s.RemoteEndpoints...)
+	ret = append(ret, s.ObserverEndpoints...)
+	ret = append(ret, s.UnknownEndpoints...)
+	return ret
+}
+
+// Unknown returns the members whose internal addresses we don't
+// understand, ordered by name. See UnknownEndpoints.
+func (s *ClusterState) Unknown() []*Endpoint {
+	ret := make([]*Endpoint, len(s.UnknownEndpoints))
+	copy(ret, s.UnknownEndpoints)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].NodeName() < ret[j].NodeName()
+	})
+	return ret
+}
+
+func (s *ClusterState) endpointsByName() map[string]*Endpoint {
+	endpoints := s.allEndpoints()
+	ret := make(map[string]*Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		ret[endpoint.NodeName()] = endpoint
+	}
+	return ret
+}
+
 func (s *ClusterState) SortByDistance(endpoints []*Endpoint) EndpointSorter {
+	return s.SortByScore(endpoints, DistanceScorer)
+}
+
+// SortByScore returns a sorter that orders the given endpoints best first
+// according to the given scorer.
+func (s *ClusterState) SortByScore(endpoints []*Endpoint, scorer EndpointScorer) EndpointSorter {
 	return EndpointSorter{
 		local:     s.ThisEndpoint,
 		endpoints: endpoints,
+		scorer:    scorer,
 	}
 }
 
 type EndpointSorter struct {
 	local     *Endpoint
 	endpoints []*Endpoint
+	scorer    EndpointScorer
 }
 
 func (s EndpointSorter) Len() int {
@@ -68,7 +307,19 @@ func (s EndpointSorter) Len() int {
 }
 
 func (s EndpointSorter) Less(i, j int) bool {
-	return s.local.DistanceTo(s.endpoints[i]) < s.local.DistanceTo(s.endpoints[j])
+	a, b := s.endpoints[i], s.endpoints[j]
+	scoreA, scoreB := s.scorer(s.local, a), s.scorer(s.local, b)
+	if scoreA != scoreB {
+		return scoreA < scoreB
+	}
+
+	// Equally-scored endpoints, including those whose distance we don't yet
+	// know, are ordered by id and then by name so that the ordering is
+	// stable from one refresh to the next.
+	if a.Id() != b.Id() {
+		return a.Id() < b.Id()
+	}
+	return a.NodeName() < b.NodeName()
 }
 
 func (s EndpointSorter) Swap(i, j int) {
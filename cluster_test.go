@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// testAddressing is the addressing scheme of the endpoints made by
+// testEndpoint: the endpoint id is the ten bits after 10.0.0.0/8, and the
+// region is the first four of those.
+var testAddressing = &Addressing{
+	CommonPrefixLen:      8,
+	RegionPrefixLen:      12,
+	DCPrefixLen:          18,
+	VPNEndpointStartPort: 7000,
+}
+
+// testEndpointIP returns the internal address of the endpoint with the
+// given id under testAddressing.
+func testEndpointIP(id EndpointId) string {
+	return fmt.Sprintf("10.%d.%d.1", id>>2, (id&3)<<6)
+}
+
+// testEndpoint returns an endpoint with the given name, id and status
+// under testAddressing, advertising the given tags as well as its
+// internal address.
+func testEndpoint(name string, id EndpointId, status serf.MemberStatus, tags map[string]string) *Endpoint {
+	intIP := testEndpointIP(id)
+	memberTags := map[string]string{"int_ip": intIP}
+	for key, value := range tags {
+		memberTags[key] = value
+	}
+	return &Endpoint{
+		addr: testAddressing.Address(intIP),
+		member: &serf.Member{
+			Name:   name,
+			Addr:   net.ParseIP(fmt.Sprintf("192.0.2.%d", id&0xff)),
+			Port:   7946,
+			Tags:   memberTags,
+			Status: status,
+		},
+	}
+}
+
+// endpointNames returns the names of the given endpoints, in order.
+func endpointNames(endpoints []*Endpoint) []string {
+	ret := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		ret = append(ret, endpoint.NodeName())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestTestEndpointIds(t *testing.T) {
+	for _, id := range []EndpointId{0x000, 0x001, 0x0c5, 0x3ff} {
+		endpoint := testEndpoint("a", id, serf.StatusAlive, nil)
+		if got := endpoint.Id(); got != id {
+			t.Errorf("endpoint at %s has id %s; want %s", testEndpointIP(id), got, id)
+		}
+	}
+}
+
+func TestClusterStateDiffFrom(t *testing.T) {
+	this := testEndpoint("this", 0x001, serf.StatusAlive, nil)
+	local := testEndpoint("local", 0x002, serf.StatusAlive, nil)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	other := testEndpoint("other", 0x081, serf.StatusAlive, nil)
+
+	state := func(remotes ...*Endpoint) *ClusterState {
+		return &ClusterState{
+			ThisEndpoint:    this,
+			LocalEndpoints:  []*Endpoint{local},
+			RemoteEndpoints: remotes,
+		}
+	}
+	withStatus := func(endpoint *Endpoint, status serf.MemberStatus) *Endpoint {
+		return testEndpoint(endpoint.NodeName(), endpoint.Id(), status, nil)
+	}
+
+	type names struct {
+		Added, Removed, Changed []string
+	}
+	tests := []struct {
+		name      string
+		prev, cur *ClusterState
+		want      names
+	}{
+		{
+			"first state",
+			nil,
+			state(remote),
+			names{Added: []string{"local", "remote", "this"}},
+		},
+		{
+			"unchanged",
+			state(remote),
+			state(testEndpoint("remote", 0x041, serf.StatusAlive, nil)),
+			names{},
+		},
+		{
+			"added",
+			state(remote),
+			state(remote, other),
+			names{Added: []string{"other"}},
+		},
+		{
+			"removed",
+			state(remote, other),
+			state(remote),
+			names{Removed: []string{"other"}},
+		},
+		{
+			"failed",
+			state(remote, other),
+			state(remote, withStatus(other, serf.StatusFailed)),
+			names{Changed: []string{"other"}},
+		},
+		{
+			"recovered",
+			state(remote, withStatus(other, serf.StatusFailed)),
+			state(remote, other),
+			names{Changed: []string{"other"}},
+		},
+		{
+			"tag changed",
+			state(remote),
+			state(testEndpoint("remote", 0x041, serf.StatusAlive, map[string]string{drainingTag: "1"})),
+			names{Changed: []string{"remote"}},
+		},
+		{
+			"replaced",
+			state(remote),
+			state(other),
+			names{Added: []string{"other"}, Removed: []string{"remote"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delta := test.cur.DiffFrom(test.prev)
+			got := names{
+				Added:   endpointNames(delta.Added),
+				Removed: endpointNames(delta.Removed),
+				Changed: endpointNames(delta.Changed),
+			}
+			want := test.want
+			for _, list := range []*[]string{&want.Added, &want.Removed, &want.Changed} {
+				if *list == nil {
+					*list = []string{}
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("wrong delta\ngot:  %+v\nwant: %+v", got, want)
+			}
+			if empty := len(test.want.Added)+len(test.want.Removed)+len(test.want.Changed) == 0; delta.Empty() != empty {
+				t.Errorf("Empty returned %t; want %t", delta.Empty(), empty)
+			}
+		})
+	}
+}
+
+func TestClusterStateDiffFromFlap(t *testing.T) {
+	this := testEndpoint("this", 0x001, serf.StatusAlive, nil)
+	states := make([]*ClusterState, 0, 3)
+	for _, status := range []serf.MemberStatus{serf.StatusAlive, serf.StatusFailed, serf.StatusAlive} {
+		states = append(states, &ClusterState{
+			ThisEndpoint:    this,
+			RemoteEndpoints: []*Endpoint{testEndpoint("remote", 0x041, status, nil)},
+		})
+	}
+
+	// Each step of the flap is a change, even though the endpoint ends
+	// up as it started.
+	for i := 1; i < len(states); i++ {
+		delta := states[i].DiffFrom(states[i-1])
+		if got := endpointNames(delta.Changed); !reflect.DeepEqual(got, []string{"remote"}) {
+			t.Errorf("step %d: changed %q; want [remote]", i, got)
+		}
+	}
+	if delta := states[2].DiffFrom(states[0]); !delta.Empty() {
+		t.Errorf("alive to alive isn't empty: %+v", delta)
+	}
+}
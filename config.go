@@ -3,24 +3,330 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl"
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Config struct {
-	NodeName             string   `hcl:"node_name" envconfig:"OPENVPN_PEER_NODE_NAME"`
-	LocalInterface       string   `hcl:"local_interface" envconfig:"OPENVPN_PEER_INTERFACE"`
-	CommonPrefixLen      int      `hcl:"common_prefix_length" envconfig:"OPENVPN_PEER_COMMON_PREFIX_LEN"`
-	RegionPrefixLen      int      `hcl:"region_prefix_length" envconfig:"OPENVPN_PEER_REGION_PREFIX_LEN"`
-	DCPrefixLen          int      `hcl:"datacenter_prefix_length" envconfig:"OPENVPN_PEER_DC_PREFIX_LEN"`
-	PublicIPAddress      string   `hcl:"public_ip_address" envconfig:"OPENVPN_PEER_PUBLIC_IP"`
-	VPNKeyFilename       string   `hcl:"vpn_key_file" envconfig:"OPENVPN_PEER_KEY_FILE"`
-	VPNEndpointStartPort int      `hcl:"vpn_endpoint_start_port" envconfig:"OPENVPN_PEER_START_PORT"`
-	GossipPort           int      `hcl:"gossip_port" envconfig:"OPENVPN_PEER_GOSSIP_PORT"`
-	GossipEncryptionKey  string   `hcl:"gossip_encryption_key" envconfig:"OPENVPN_PEER_GOSSIP_KEY"`
-	DataDir              string   `hcl:"data_dir" envconfig:"OPENVPN_PEER_DATA_DIR"`
-	InitialPeers         []string `hcl:"initial_peers"`
+	NodeName               string            `hcl:"node_name" envconfig:"OPENVPN_PEER_NODE_NAME"`
+	LocalInterface         string            `hcl:"local_interface" envconfig:"OPENVPN_PEER_INTERFACE"`
+	LocalAddressCIDR       string            `hcl:"local_address_cidr" envconfig:"OPENVPN_PEER_LOCAL_ADDRESS_CIDR"`
+	AddressFamily          string            `hcl:"address_family" envconfig:"OPENVPN_PEER_ADDRESS_FAMILY"`
+	EndpointIdOverride     string            `hcl:"endpoint_id_override" envconfig:"OPENVPN_PEER_ENDPOINT_ID_OVERRIDE"`
+	CommonPrefixLen        int               `hcl:"common_prefix_length" envconfig:"OPENVPN_PEER_COMMON_PREFIX_LEN"`
+	RegionPrefixLen        int               `hcl:"region_prefix_length" envconfig:"OPENVPN_PEER_REGION_PREFIX_LEN"`
+	DCPrefixLen            int               `hcl:"datacenter_prefix_length" envconfig:"OPENVPN_PEER_DC_PREFIX_LEN"`
+	PublicIPAddress        string            `hcl:"public_ip_address" envconfig:"OPENVPN_PEER_PUBLIC_IP"`
+	OpenVPNPath            string            `hcl:"openvpn_path" envconfig:"OPENVPN_PEER_OPENVPN_PATH"`
+	VPNKeyFilename         string            `hcl:"vpn_key_file" envconfig:"OPENVPN_PEER_KEY_FILE"`
+	VPNKeyDir              string            `hcl:"vpn_key_dir" envconfig:"OPENVPN_PEER_KEY_DIR"`
+	RegionPairKeys         map[string]string `hcl:"region_pair_keys"`
+	ServedNetworks         []string          `hcl:"served_networks"`
+	SecretPassphrase       string            `hcl:"secret_passphrase" envconfig:"OPENVPN_PEER_SECRET_PASSPHRASE"`
+	VPNEndpointStartPort   int               `hcl:"vpn_endpoint_start_port" envconfig:"OPENVPN_PEER_START_PORT"`
+	TunnelBasePrefix       string            `hcl:"tunnel_base_prefix" envconfig:"OPENVPN_PEER_TUNNEL_BASE_PREFIX"`
+	GossipPort             int               `hcl:"gossip_port" envconfig:"OPENVPN_PEER_GOSSIP_PORT"`
+	GossipPortRange        int               `hcl:"gossip_port_range" envconfig:"OPENVPN_PEER_GOSSIP_PORT_RANGE"`
+	GossipBindRetries      int               `hcl:"gossip_bind_retries" envconfig:"OPENVPN_PEER_GOSSIP_BIND_RETRIES"`
+	GossipEncryptionKey    string            `hcl:"gossip_encryption_key" envconfig:"OPENVPN_PEER_GOSSIP_KEY"`
+	GossipEncryptionKeys   []string          `hcl:"gossip_encryption_keys"`
+	GossipKeyringFile      string            `hcl:"gossip_keyring_file" envconfig:"OPENVPN_PEER_GOSSIP_KEYRING_FILE"`
+	GossipProfile          string            `hcl:"gossip_profile" envconfig:"OPENVPN_PEER_GOSSIP_PROFILE"`
+	GossipProbeInterval    string            `hcl:"gossip_probe_interval" envconfig:"OPENVPN_PEER_GOSSIP_PROBE_INTERVAL"`
+	GossipProbeTimeout     string            `hcl:"gossip_probe_timeout" envconfig:"OPENVPN_PEER_GOSSIP_PROBE_TIMEOUT"`
+	GossipSuspicionMult    int               `hcl:"gossip_suspicion_mult" envconfig:"OPENVPN_PEER_GOSSIP_SUSPICION_MULT"`
+	DataDir                string            `hcl:"data_dir" envconfig:"OPENVPN_PEER_DATA_DIR"`
+	RuntimeDir             string            `hcl:"runtime_dir" envconfig:"OPENVPN_PEER_RUNTIME_DIR"`
+	VPNPort                int               `hcl:"vpn_port" envconfig:"OPENVPN_PEER_VPN_PORT"`
+	ManagementPortBase     int               `hcl:"management_port_base" envconfig:"OPENVPN_PEER_MANAGEMENT_PORT_BASE"`
+	ManagementPasswordFile string            `hcl:"management_password_file" envconfig:"OPENVPN_PEER_MANAGEMENT_PASSWORD_FILE"`
+	PersistTunnels         bool              `hcl:"persist_tunnels" envconfig:"OPENVPN_PEER_PERSIST_TUNNELS"`
+	InitialPeers           []string          `hcl:"initial_peers" envconfig:"OPENVPN_PEER_INITIAL_PEERS"`
+	Observer               bool              `hcl:"observer" envconfig:"OPENVPN_PEER_OBSERVER"`
+	Mode                   string            `hcl:"mode" envconfig:"OPENVPN_PEER_MODE"`
+	TunnelTopology         string            `hcl:"tunnel_topology" envconfig:"OPENVPN_PEER_TUNNEL_TOPOLOGY"`
+	Hub                    bool              `hcl:"hub" envconfig:"OPENVPN_PEER_HUB"`
+	Tags                   map[string]string `hcl:"tags"`
+	PeerSelector           string            `hcl:"peer_selector" envconfig:"OPENVPN_PEER_PEER_SELECTOR"`
+	HTTPAddr               string            `hcl:"http_addr" envconfig:"OPENVPN_PEER_HTTP_ADDR"`
+	ControlSocket          string            `hcl:"control_socket" envconfig:"OPENVPN_PEER_CONTROL_SOCKET"`
+	ConsulKVSnapshot       bool              `hcl:"consul_kv_snapshot" envconfig:"OPENVPN_PEER_CONSUL_KV_SNAPSHOT"`
+	ConsulAddr             string            `hcl:"consul_addr" envconfig:"OPENVPN_PEER_CONSUL_ADDR"`
+	ConsulToken            string            `hcl:"consul_token" envconfig:"OPENVPN_PEER_CONSUL_TOKEN"`
+	ConsulKVPrefix         string            `hcl:"consul_kv_prefix" envconfig:"OPENVPN_PEER_CONSUL_KV_PREFIX"`
+	RefreshInterval        string            `hcl:"refresh_interval" envconfig:"OPENVPN_PEER_REFRESH_INTERVAL"`
+	VPNCipher              string            `hcl:"vpn_cipher" envconfig:"OPENVPN_PEER_VPN_CIPHER"`
+	VPNAuth                string            `hcl:"vpn_auth" envconfig:"OPENVPN_PEER_VPN_AUTH"`
+	VPNCompression         string            `hcl:"vpn_compression" envconfig:"OPENVPN_PEER_VPN_COMPRESSION"`
+	VPNTransport           string            `hcl:"vpn_transport" envconfig:"OPENVPN_PEER_VPN_TRANSPORT"`
+	VPNKeyMode             string            `hcl:"vpn_key_mode" envconfig:"OPENVPN_PEER_VPN_KEY_MODE"`
+	VPNDCO                 bool              `hcl:"vpn_dco" envconfig:"OPENVPN_PEER_VPN_DCO"`
+	TLSCAFile              string            `hcl:"tls_ca_file" envconfig:"OPENVPN_PEER_TLS_CA_FILE"`
+	TLSCertFile            string            `hcl:"tls_cert_file" envconfig:"OPENVPN_PEER_TLS_CERT_FILE"`
+	TLSKeyFile             string            `hcl:"tls_key_file" envconfig:"OPENVPN_PEER_TLS_KEY_FILE"`
+	TLSCRLFile             string            `hcl:"tls_crl_file" envconfig:"OPENVPN_PEER_TLS_CRL_FILE"`
+	VPNTopology            string            `hcl:"vpn_topology" envconfig:"OPENVPN_PEER_VPN_TOPOLOGY"`
+	TunMTU                 int               `hcl:"tun_mtu" envconfig:"OPENVPN_PEER_TUN_MTU"`
+	MSSFix                 int               `hcl:"mssfix" envconfig:"OPENVPN_PEER_MSSFIX"`
+	Fragment               int               `hcl:"fragment" envconfig:"OPENVPN_PEER_FRAGMENT"`
+	OpenVPNUser            string            `hcl:"openvpn_user" envconfig:"OPENVPN_PEER_OPENVPN_USER"`
+	OpenVPNGroup           string            `hcl:"openvpn_group" envconfig:"OPENVPN_PEER_OPENVPN_GROUP"`
+	OpenVPNExtraArgs       []string          `hcl:"openvpn_extra_args"`
+	LogLevel               string            `hcl:"log_level" envconfig:"OPENVPN_PEER_LOG_LEVEL"`
+	LogFormat              string            `hcl:"log_format" envconfig:"OPENVPN_PEER_LOG_FORMAT"`
+	DryRun                 bool              `hcl:"dry_run" envconfig:"OPENVPN_PEER_DRY_RUN"`
+	TunnelStartTimeout     string            `hcl:"tunnel_start_timeout" envconfig:"OPENVPN_PEER_TUNNEL_START_TIMEOUT"`
+	TunnelStartJitter      string            `hcl:"tunnel_start_jitter" envconfig:"OPENVPN_PEER_TUNNEL_START_JITTER"`
+	MaxTunnelStarts        int               `hcl:"max_concurrent_tunnel_starts" envconfig:"OPENVPN_PEER_MAX_CONCURRENT_TUNNEL_STARTS"`
+	MaxTunnels             int               `hcl:"max_tunnels" envconfig:"OPENVPN_PEER_MAX_TUNNELS"`
+	KeepaliveInterval      string            `hcl:"keepalive_interval" envconfig:"OPENVPN_PEER_KEEPALIVE_INTERVAL"`
+	KeepaliveTimeout       string            `hcl:"keepalive_timeout" envconfig:"OPENVPN_PEER_KEEPALIVE_TIMEOUT"`
+	TunnelWatchdog         string            `hcl:"tunnel_watchdog_timeout" envconfig:"OPENVPN_PEER_TUNNEL_WATCHDOG_TIMEOUT"`
+	TunnelStatsInterval    string            `hcl:"tunnel_stats_interval" envconfig:"OPENVPN_PEER_TUNNEL_STATS_INTERVAL"`
+	TunnelEstablishSLA     string            `hcl:"tunnel_establish_sla" envconfig:"OPENVPN_PEER_TUNNEL_ESTABLISH_SLA"`
+	FallbackRouteMetric    int               `hcl:"fallback_route_metric" envconfig:"OPENVPN_PEER_FALLBACK_ROUTE_METRIC"`
+	FallbackRouteRealm     int               `hcl:"fallback_route_realm" envconfig:"OPENVPN_PEER_FALLBACK_ROUTE_REALM"`
+	NeighborScoring        string            `hcl:"neighbor_scoring" envconfig:"OPENVPN_PEER_NEIGHBOR_SCORING"`
+	RouteFailoverDelay     string            `hcl:"route_failover_delay" envconfig:"OPENVPN_PEER_ROUTE_FAILOVER_DELAY"`
+	RouteRecoveryDelay     string            `hcl:"route_recovery_delay" envconfig:"OPENVPN_PEER_ROUTE_RECOVERY_DELAY"`
+	RouteMinMembers        int               `hcl:"route_min_members" envconfig:"OPENVPN_PEER_ROUTE_MIN_MEMBERS"`
+	RouteSettleTime        string            `hcl:"route_settle_time" envconfig:"OPENVPN_PEER_ROUTE_SETTLE_TIME"`
+	ReadyTunnelPercent     int               `hcl:"ready_tunnel_percent" envconfig:"OPENVPN_PEER_READY_TUNNEL_PERCENT"`
+	NotifyWebhookURL       string            `hcl:"notify_webhook_url" envconfig:"OPENVPN_PEER_NOTIFY_WEBHOOK_URL"`
+	NotifyGracePeriod      string            `hcl:"notify_grace_period" envconfig:"OPENVPN_PEER_NOTIFY_GRACE_PERIOD"`
+	AuditLog               bool              `hcl:"audit_log" envconfig:"OPENVPN_PEER_AUDIT_LOG"`
+	AuditLogMaxMB          int               `hcl:"audit_log_max_mb" envconfig:"OPENVPN_PEER_AUDIT_LOG_MAX_MB"`
+
+	// set holds the hcl names of the settings that were given explicitly
+	// when the config was loaded, so that Override can tell a setting
+	// that was set to its zero value from one that wasn't set at all. It
+	// is nil for a config that wasn't loaded from a file or environment.
+	set map[string]bool
+}
+
+// DefaultOpenVPNPath is where we expect to find the OpenVPN executable if
+// openvpn_path isn't set.
+const DefaultOpenVPNPath = "/usr/sbin/openvpn"
+
+// DefaultTunnelBasePrefix is the network that the addresses within
+// tunnels are allocated from if tunnel_base_prefix isn't set. All
+// endpoints must use the same network.
+const DefaultTunnelBasePrefix = "172.16.0.0/12"
+
+// maxEndpointId is the largest endpoint id, since ids are 10 bits long.
+const maxEndpointId = 0x3ff
+
+// DefaultLauncherPath is the program we use to run OpenVPN and ip with
+// the privileges they need.
+const DefaultLauncherPath = "/usr/bin/sudo"
+
+// DefaultKillPath is the program we have the launcher run to kill OpenVPN
+// processes that have dropped their privileges. See VPNConfig.User.
+const DefaultKillPath = "/bin/kill"
+
+// DefaultVPNCipher and DefaultVPNAuth are the OpenVPN data channel cipher
+// and HMAC digest we use when none are configured. We always pass these
+// explicitly, since OpenVPN's own defaults differ between versions and
+// all peers must agree.
+//
+// Static key mode (--secret) does not support AEAD ciphers such as
+// AES-256-GCM, so we must use a CBC cipher with a separate HMAC.
+const (
+	DefaultVPNCipher = "AES-256-CBC"
+	DefaultVPNAuth   = "SHA256"
+)
+
+// The supported values of the vpn_compression setting.
+//
+// Compression is off by default, both because compressing links that
+// aren't short of bandwidth just costs CPU and because compressing data
+// that an attacker partly controls before encrypting it can leak the
+// rest of it (the "VORACLE" attack). A tunnel is compressed only if both
+// of its endpoints use the same algorithm, so compression can be enabled
+// for just the nodes in the regions whose links need it.
+const (
+	CompressionOff = "off"
+	CompressionLZ4 = "lz4"
+	CompressionLZO = "lzo"
+)
+
+// The supported values of the vpn_transport setting.
+//
+// Tunnels use UDP by default. A node whose UDP traffic is blocked or
+// mangled by middleboxes can use TCP instead, in which case all of the
+// tunnels to it use TCP while tunnels elsewhere are unaffected.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+)
+
+// The supported values of the vpn_key_mode setting.
+//
+// In static key mode, the default, every tunnel is keyed directly by the
+// pre-shared keys in the keyring, so the only way to shut a node out is to
+// replace the key everywhere. In TLS mode each node instead has its own
+// certificate, issued by a CA that all nodes share, and a node can be
+// shut out by revoking its certificate in tls_crl_file. The keyring's keys
+// are still needed in TLS mode, as OpenVPN's --tls-auth keys, so that
+// peers drop packets from anyone without them before doing any TLS work.
+//
+// A node's certificate must have its node_name as its common name, since
+// peers refuse any other, and must allow both TLS server and client use
+// (the serverAuth and clientAuth extended key usages), since a node plays
+// each role in some of its tunnels. TLS mode also allows OpenVPN to use
+// data channel offload; see vpn_dco.
+//
+// Both ends of a tunnel must use the same mode.
+const (
+	KeyModeStatic = "static"
+	KeyModeTLS    = "tls"
+)
+
+// The supported values of the address_family setting, which selects
+// whether we gossip and run tunnels over the IPv4 or IPv6 address of
+// local_interface. IPv4 is the default.
+//
+// The prefix length settings apply to whichever family is selected, so
+// with IPv6 they're typically much longer. Every node in the cluster
+// should use the same family. The addresses within the tunnels are
+// IPv4 either way, so the kernel can't yet route IPv6 datacenter
+// networks through them.
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// The supported values of the vpn_topology setting, which controls how the
+// addresses within each tunnel are configured.
+//
+// By default each end of a tunnel gets a host address, and OpenVPN sets
+// up the tun device as point-to-point between them. With the "subnet"
+// topology each tunnel instead gets its own /30 network, which some
+// kernels and OpenVPN versions handle more consistently. That needs four
+// addresses per pair of endpoints, so tunnel_base_prefix must then be set
+// to a /10 or shorter, such as 100.64.0.0/10. All endpoints must use the
+// same topology, since the two ends of each tunnel choose its addresses
+// independently, so we advertise ours and refuse tunnels to endpoints
+// that use the other.
+const (
+	VPNTopologyP2P    = "p2p"
+	VPNTopologySubnet = "subnet"
+)
+
+// DefaultMSSFix is the packet size we ask OpenVPN to limit TCP
+// connections to when the mssfix setting isn't set. This is OpenVPN's own
+// traditional default, which we pass explicitly because newer versions
+// of OpenVPN interpret the setting differently. Setting mssfix to -1
+// disables the adjustment altogether. See VPNConfig.MSSFix.
+const DefaultMSSFix = 1450
+
+// DefaultRefreshInterval is how often the manager re-evaluates its
+// configuration when nothing else has prompted it to.
+//
+// This is far too often for a production system, but is useful at
+// this early stage while we're debugging. In practice probably
+// something more like 15 minutes would make sense, just to ensure
+// we detect any configuration drift somewhat close to its cause.
+const DefaultRefreshInterval = 10 * time.Second
+
+// DefaultGossipBindRetries is how many times we retry binding the gossip
+// port when gossip_bind_retries isn't set. This gives a previous instance
+// that is still shutting down a few seconds to release its port.
+const DefaultGossipBindRetries = 3
+
+// DefaultMaxTunnels is the most tunnels we'll run at once when max_tunnels
+// isn't set. It's a guard against a mistake in the addressing settings or
+// a glitch in cluster membership making many more endpoints look live
+// than really are, which would otherwise have us start an OpenVPN process
+// for each of them. A real cluster can have at most 1023 other endpoints,
+// but few want anywhere near that many tunnels from a single node.
+const DefaultMaxTunnels = 256
+
+// DefaultKeepaliveInterval and DefaultKeepaliveTimeout are the OpenVPN
+// keepalive timings we use when none are configured.
+//
+// A tunnel failure is detected after the timeout, and a keepalive is sent
+// every interval so that we minimize the chance of false positives. This
+// also implies that OpenVPN retries connecting once per timeout period in
+// case of problems.
+//
+// Since the "VPNRetrying" state is used to signal a critical error, and
+// that state is entered on the second consecutive connection attempt, a
+// tunnel gets two timeout periods (60 seconds by default) to recover before
+// it is considered to be in a critical state. It also means that there can
+// be up to one timeout period of packet loss before we notice a down
+// tunnel and start forwarding to a neighbor.
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveTimeout  = 30 * time.Second
+)
+
+// DefaultTunnelStartTimeout is how long we wait for a newly-launched
+// OpenVPN process to connect to its management socket. Launching via
+// sudo on a heavily-loaded host can take a while.
+const DefaultTunnelStartTimeout = 10 * time.Second
+
+// DefaultMaxConcurrentTunnelStarts and DefaultTunnelStartJitter limit how
+// quickly we launch OpenVPN processes when many tunnels need starting at
+// once, such as after a network partition heals. Launching too many at
+// once overloads the host and can trip sudo's rate limits.
+const (
+	DefaultMaxConcurrentTunnelStarts = 4
+	DefaultTunnelStartJitter         = 2 * time.Second
+)
+
+// DefaultRouteFailoverDelay and DefaultRouteRecoveryDelay are how long a
+// tunnel must stay down before we route around it, and then stay up
+// before we route through it again. See routeDamper.
+//
+// These come on top of the keepalive timeout it takes to notice that a
+// tunnel is down in the first place, so the failover delay is short. The
+// recovery delay is longer, since it costs little to keep using the
+// fallback for a while and a link that has just recovered is the one most
+// likely to fail again.
+const (
+	DefaultRouteFailoverDelay = 10 * time.Second
+	DefaultRouteRecoveryDelay = 60 * time.Second
+)
+
+// DefaultRouteMinMembers and DefaultRouteSettleTime are how many live
+// cluster members, counting ourselves, we must see after starting before
+// we change any routes, and how long we wait for them before changing
+// routes anyway. See routeGate.
+//
+// Two members is enough to show that we've joined the cluster. The
+// settle time allows for retrying initial_peers a few times.
+const (
+	DefaultRouteMinMembers = 2
+	DefaultRouteSettleTime = 2 * time.Minute
+)
+
+// reloadableSettings are the settings (identified by their hcl names)
+// that can be changed by reloading the configuration at runtime. Any
+// other change requires a restart to take effect.
+var reloadableSettings = map[string]bool{
+	"initial_peers":    true,
+	"refresh_interval": true,
+	"log_level":        true,
+
+	// The keys are always re-read on reload, so that new keys can be
+	// rolled out without a restart. See keyring.go.
+	"vpn_key_file":      true,
+	"vpn_key_dir":       true,
+	"region_pair_keys":  true,
+	"secret_passphrase": true,
+
+	// Gossip keys are rotated across the cluster on reload. See
+	// gossipkeys.go.
+	"gossip_encryption_key":  true,
+	"gossip_encryption_keys": true,
+	"gossip_keyring_file":    true,
 }
 
 func ConfigFromFile(filename string) (*Config, error) {
@@ -35,20 +341,69 @@ func ConfigFromFile(filename string) (*Config, error) {
 		return nil, fmt.Errorf("error parsing %s: %s", filename, err)
 	}
 
+	// Decoding again into a map tells us which settings are present.
+	var present map[string]interface{}
+	err = hcl.Unmarshal(sourceBytes, &present)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", filename, err)
+	}
+	ret.set = make(map[string]bool, len(present))
+	for name := range present {
+		ret.set[name] = true
+	}
+
 	return ret, nil
 }
 
 func ConfigFromEnv() (*Config, error) {
 	ret := &Config{}
 	err := envconfig.Process("openvpn-peer", ret)
-	return ret, err
+	if err != nil {
+		return ret, err
+	}
+
+	// Lists in the environment are comma-separated, and envconfig leaves
+	// any spaces after the commas in place.
+	ret.InitialPeers = trimList(ret.InitialPeers)
+
+	ret.set = make(map[string]bool)
+	ty := reflect.TypeOf(ret).Elem()
+	for i := 0; i < ty.NumField(); i++ {
+		key := ty.Field(i).Tag.Get("envconfig")
+		if key == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			ret.set[ty.Field(i).Tag.Get("hcl")] = true
+		}
+	}
+	return ret, nil
+}
+
+// trimList returns the given list with the whitespace trimmed from each
+// item and any empty items removed.
+func trimList(list []string) []string {
+	var ret []string
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
 }
 
+// LoadConfig reads the configuration from the environment and then, if
+// filename isn't empty, from the given file. Settings in the file take
+// precedence over the same settings in the environment.
 func LoadConfig(filename string) (*Config, error) {
 	envCfg, err := ConfigFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	if filename == "" {
+		return envCfg, nil
+	}
 
 	fileCfg, err := ConfigFromFile(filename)
 	if err != nil {
@@ -59,38 +414,569 @@ func LoadConfig(filename string) (*Config, error) {
 	return envCfg, nil
 }
 
+// Override copies into the receiver each of the settings that is set in
+// other, replacing whatever the receiver had. A list or map from other
+// replaces the whole of the receiver's, rather than adding to it.
+//
+// A setting counts as set if it was given explicitly when other was
+// loaded, even if it was set to its zero value. For a config that wasn't
+// loaded by ConfigFromFile or ConfigFromEnv, only the settings with
+// non-zero values count as set.
 func (c *Config) Override(other *Config) {
-	if other.NodeName != "" {
-		c.NodeName = other.NodeName
+	set := make(map[string]bool)
+
+	cv := reflect.ValueOf(c).Elem()
+	ov := reflect.ValueOf(other).Elem()
+	ty := cv.Type()
+	for i := 0; i < ty.NumField(); i++ {
+		name := ty.Field(i).Tag.Get("hcl")
+		if name == "" {
+			continue
+		}
+		if other.isSet(name, ov.Field(i)) {
+			cv.Field(i).Set(ov.Field(i))
+			set[name] = true
+		} else if c.isSet(name, cv.Field(i)) {
+			set[name] = true
+		}
 	}
-	if other.LocalInterface != "" {
-		c.LocalInterface = other.LocalInterface
+
+	// The set map may be shared with a copy of the receiver, so we
+	// replace it rather than updating it.
+	c.set = set
+}
+
+// isSet returns whether the setting with the given hcl name, whose value
+// is v, counts as set for the purposes of Override.
+func (c *Config) isSet(name string, v reflect.Value) bool {
+	if c.set != nil {
+		return c.set[name]
 	}
-	if other.CommonPrefixLen != 0 {
-		c.CommonPrefixLen = other.CommonPrefixLen
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() > 0
+	default:
+		return v.Interface() != reflect.Zero(v.Type()).Interface()
 	}
-	if other.RegionPrefixLen != 0 {
-		c.RegionPrefixLen = other.RegionPrefixLen
+}
+
+// ConfigureLogging applies the log_level and log_format settings to
+// the global logger.
+func (c *Config) ConfigureLogging() error {
+	level, err := ParseLogLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	return logger.Configure(level, c.LogFormat)
+}
+
+// RefreshIntervalDuration returns the parsed RefreshInterval setting, or
+// DefaultRefreshInterval if it isn't set.
+func (c *Config) RefreshIntervalDuration() (time.Duration, error) {
+	return parseDurationSetting("refresh_interval", c.RefreshInterval, DefaultRefreshInterval)
+}
+
+// TunnelStartTimeoutDuration returns the parsed TunnelStartTimeout setting,
+// or DefaultTunnelStartTimeout if it isn't set.
+func (c *Config) TunnelStartTimeoutDuration() (time.Duration, error) {
+	return parseDurationSetting("tunnel_start_timeout", c.TunnelStartTimeout, DefaultTunnelStartTimeout)
+}
+
+// NotifyGracePeriodDuration returns the parsed NotifyGracePeriod setting,
+// or DefaultNotifyGracePeriod if it isn't set.
+func (c *Config) NotifyGracePeriodDuration() (time.Duration, error) {
+	return parseDurationSetting("notify_grace_period", c.NotifyGracePeriod, DefaultNotifyGracePeriod)
+}
+
+// TunnelStartJitterDuration returns the parsed TunnelStartJitter setting,
+// or DefaultTunnelStartJitter if it isn't set.
+func (c *Config) TunnelStartJitterDuration() (time.Duration, error) {
+	return parseDurationSetting("tunnel_start_jitter", c.TunnelStartJitter, DefaultTunnelStartJitter)
+}
+
+// RouteDampingDelays returns the parsed RouteFailoverDelay and
+// RouteRecoveryDelay settings, or their defaults if they aren't set.
+func (c *Config) RouteDampingDelays() (failover, recovery time.Duration, err error) {
+	failover, err = parseDurationSetting("route_failover_delay", c.RouteFailoverDelay, DefaultRouteFailoverDelay)
+	if err != nil {
+		return 0, 0, err
+	}
+	recovery, err = parseDurationSetting("route_recovery_delay", c.RouteRecoveryDelay, DefaultRouteRecoveryDelay)
+	if err != nil {
+		return 0, 0, err
 	}
-	if other.DCPrefixLen != 0 {
-		c.DCPrefixLen = other.DCPrefixLen
+	return failover, recovery, nil
+}
+
+// TunnelWatchdogTimeoutDuration returns the parsed TunnelWatchdog setting,
+// or DefaultTunnelWatchdogTimeout if it isn't set. Setting it to "0" or
+// "off" disables the watchdog, which is reported as a zero timeout.
+func (c *Config) TunnelWatchdogTimeoutDuration() (time.Duration, error) {
+	timeout, err := parseOptionalDurationSetting("tunnel_watchdog_timeout", c.TunnelWatchdog, DefaultTunnelWatchdogTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout == 0 {
+		return 0, nil
+	}
+
+	// OpenVPN should notice a dead tunnel itself after the keepalive
+	// timeout, so the watchdog is only for when it doesn't.
+	_, keepaliveTimeout, err := c.KeepaliveDurations()
+	if err != nil {
+		return 0, err
 	}
-	if other.PublicIPAddress != "" {
-		c.PublicIPAddress = other.PublicIPAddress
+	if timeout <= keepaliveTimeout {
+		return 0, fmt.Errorf("tunnel_watchdog_timeout (%s) must be longer than keepalive_timeout (%s)", timeout, keepaliveTimeout)
 	}
-	if other.VPNEndpointStartPort != 0 {
-		c.VPNEndpointStartPort = other.VPNEndpointStartPort
+
+	// The watchdog sees the statistics only as often as they're polled.
+	statsInterval, err := c.TunnelStatsIntervalDuration()
+	if err != nil {
+		return 0, err
 	}
-	if other.GossipPort != 0 {
-		c.GossipPort = other.GossipPort
+	if timeout < 2*statsInterval {
+		return 0, fmt.Errorf("tunnel_watchdog_timeout (%s) must be at least twice tunnel_stats_interval (%s)", timeout, statsInterval)
 	}
-	if other.GossipEncryptionKey != "" {
-		c.GossipEncryptionKey = other.GossipEncryptionKey
+	return timeout, nil
+}
+
+// TunnelStatsIntervalDuration returns the parsed TunnelStatsInterval
+// setting, or DefaultTunnelStatsInterval if it isn't set.
+func (c *Config) TunnelStatsIntervalDuration() (time.Duration, error) {
+	interval, err := parseDurationSetting("tunnel_stats_interval", c.TunnelStatsInterval, DefaultTunnelStatsInterval)
+	if err != nil {
+		return 0, err
 	}
-	if other.DataDir != "" {
-		c.DataDir = other.DataDir
+
+	// OpenVPN only deals in whole seconds.
+	if interval < time.Second || interval%time.Second != 0 {
+		return 0, fmt.Errorf("invalid tunnel_stats_interval %q: must be a whole number of seconds", c.TunnelStatsInterval)
+	}
+	return interval, nil
+}
+
+// TunnelEstablishSLADuration returns the parsed TunnelEstablishSLA
+// setting, or DefaultTunnelEstablishSLA if it isn't set. Setting it to "0"
+// or "off" disables the reporting of slow tunnels, which is reported as a
+// zero SLA.
+func (c *Config) TunnelEstablishSLADuration() (time.Duration, error) {
+	return parseOptionalDurationSetting("tunnel_establish_sla", c.TunnelEstablishSLA, DefaultTunnelEstablishSLA)
+}
+
+// GossipTimings returns the failure detection timings set by the
+// GossipProbeInterval, GossipProbeTimeout and GossipSuspicionMult
+// settings, taking the defaults of the GossipProfile setting for any that
+// aren't set.
+func (c *Config) GossipTimings() (*GossipTimings, error) {
+	defaults := memberlistProfile(c.GossipProfile)
+
+	probeInterval, err := parseDurationSetting("gossip_probe_interval", c.GossipProbeInterval, defaults.ProbeInterval)
+	if err != nil {
+		return nil, err
+	}
+	probeTimeout, err := parseDurationSetting("gossip_probe_timeout", c.GossipProbeTimeout, defaults.ProbeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	suspicionMult := c.GossipSuspicionMult
+	if suspicionMult == 0 {
+		suspicionMult = defaults.SuspicionMult
+	}
+
+	// Memberlist waits for a probe to time out before starting the next,
+	// and doesn't check these itself.
+	if probeTimeout <= 0 {
+		return nil, fmt.Errorf("gossip_probe_timeout must be positive")
+	}
+	if probeInterval <= probeTimeout {
+		return nil, fmt.Errorf("gossip_probe_interval (%s) must be longer than gossip_probe_timeout (%s)", probeInterval, probeTimeout)
+	}
+	if suspicionMult < 1 {
+		return nil, fmt.Errorf("gossip_suspicion_mult must be at least 1")
+	}
+
+	return &GossipTimings{
+		ProbeInterval: probeInterval,
+		ProbeTimeout:  probeTimeout,
+		SuspicionMult: suspicionMult,
+	}, nil
+}
+
+// RouteSettleTimeDuration returns the parsed RouteSettleTime setting, or
+// DefaultRouteSettleTime if it isn't set.
+func (c *Config) RouteSettleTimeDuration() (time.Duration, error) {
+	return parseDurationSetting("route_settle_time", c.RouteSettleTime, DefaultRouteSettleTime)
+}
+
+// KeepaliveDurations returns the parsed KeepaliveInterval and
+// KeepaliveTimeout settings, or their defaults if they aren't set.
+func (c *Config) KeepaliveDurations() (interval, timeout time.Duration, err error) {
+	interval, err = parseDurationSetting("keepalive_interval", c.KeepaliveInterval, DefaultKeepaliveInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+	timeout, err = parseDurationSetting("keepalive_timeout", c.KeepaliveTimeout, DefaultKeepaliveTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// OpenVPN only deals in whole seconds.
+	if interval%time.Second != 0 {
+		return 0, 0, fmt.Errorf("invalid keepalive_interval %q: must be a whole number of seconds", c.KeepaliveInterval)
+	}
+	if timeout%time.Second != 0 {
+		return 0, 0, fmt.Errorf("invalid keepalive_timeout %q: must be a whole number of seconds", c.KeepaliveTimeout)
+	}
+
+	// OpenVPN itself requires this, since otherwise a single lost
+	// keepalive would be enough to cause a restart.
+	if timeout < 2*interval {
+		return 0, 0, fmt.Errorf("keepalive_timeout (%s) must be at least twice keepalive_interval (%s)", timeout, interval)
+	}
+
+	return interval, timeout, nil
+}
+
+// Validate checks that the addressing settings are consistent with one
+// another, so that every endpoint will get a valid id and set of ports,
+// and that the other settings that can be checked up front are valid.
+func (c *Config) Validate() error {
+	switch c.AddressFamily {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("address_family must be either %q or %q", AddressFamilyIPv4, AddressFamilyIPv6)
+	}
+
+	common, region, dc := c.CommonPrefixLen, c.RegionPrefixLen, c.DCPrefixLen
+	bits := c.AddressBits()
+
+	// The endpoint id is extracted from the two bytes that follow the
+	// common prefix, so there must be at least that many below it.
+	if common <= 0 || common >= bits-8 {
+		return fmt.Errorf("common_prefix_length must be between 1 and %d", bits-9)
+	}
+	if region < common || region > dc {
+		return fmt.Errorf("region_prefix_length must be between common_prefix_length (%d) and datacenter_prefix_length (%d)", common, dc)
+	}
+	if dc <= common || dc > bits {
+		return fmt.Errorf("datacenter_prefix_length must be greater than common_prefix_length (%d) and no more than %d", common, bits)
+	}
+
+	// Endpoint ids are the 10 bits after the common prefix, so any more
+	// bits than that would not distinguish between datacenters.
+	if dc-common > 10 {
+		return fmt.Errorf("datacenter_prefix_length may be at most 10 bits longer than common_prefix_length (%d)", common)
+	}
+
+	// Each endpoint listens on one port per possible remote endpoint id.
+	if c.VPNEndpointStartPort <= 0 || c.VPNEndpointStartPort+maxEndpointId > 65535 {
+		return fmt.Errorf("vpn_endpoint_start_port must be between 1 and %d", 65535-maxEndpointId)
+	}
+
+	if c.VPNPort < 0 || c.VPNPort > 65535 {
+		return fmt.Errorf("vpn_port must be between 1 and 65535, or 0 to use the port derived from the endpoint id")
+	}
+
+	// Likewise each tunnel's management interface, if we share it on a
+	// port at all, which must then be protected by a password.
+	if c.ManagementPortBase != 0 {
+		if c.ManagementPortBase < 0 || c.ManagementPortBase+maxEndpointId > 65535 {
+			return fmt.Errorf("management_port_base must be between 1 and %d", 65535-maxEndpointId)
+		}
+		if c.ManagementPasswordFile == "" {
+			return fmt.Errorf("management_port_base requires management_password_file to be set")
+		}
+	}
+
+	if c.AuditLogMaxMB < 0 {
+		return fmt.Errorf("audit_log_max_mb must not be negative")
+	}
+
+	if _, err := c.TunnelBaseNet(); err != nil {
+		return err
+	}
+	if _, err := c.EndpointIdOverrideValue(); err != nil {
+		return err
+	}
+
+	for _, raw := range c.ServedNetworks {
+		ip, _, err := net.ParseCIDR(raw)
+		if err != nil {
+			return fmt.Errorf("invalid served_networks entry %q: %s", raw, err)
+		}
+		if (ip.To4() == nil) != c.IPv6() {
+			return fmt.Errorf("invalid served_networks entry %q: must be of the same address family as address_family", raw)
+		}
+	}
+
+	pairs := make(map[regionPair]string, len(c.RegionPairKeys))
+	for raw := range c.RegionPairKeys {
+		pair, err := parseRegionPair(raw)
+		if err != nil {
+			return fmt.Errorf("invalid region_pair_keys: %s", err)
+		}
+		if other, ok := pairs[pair]; ok {
+			return fmt.Errorf("invalid region_pair_keys: %q and %q are the same pair", other, raw)
+		}
+		pairs[pair] = raw
+	}
+
+	if c.GossipEncryptionKey != "" {
+		if _, err := decodeGossipKey(c.GossipEncryptionKey); err != nil {
+			return err
+		}
+	}
+	for _, key := range c.GossipEncryptionKeys {
+		if _, err := decodeGossipKey(key); err != nil {
+			return err
+		}
+	}
+
+	switch c.VPNCompression {
+	case "", CompressionOff, CompressionLZ4, CompressionLZO:
+	default:
+		return fmt.Errorf("vpn_compression must be one of %q, %q or %q", CompressionOff, CompressionLZ4, CompressionLZO)
+	}
+
+	switch c.VPNTransport {
+	case "", TransportUDP, TransportTCP:
+	default:
+		return fmt.Errorf("vpn_transport must be either %q or %q", TransportUDP, TransportTCP)
+	}
+
+	switch c.VPNKeyMode {
+	case "", KeyModeStatic:
+	case KeyModeTLS:
+		if c.TLSCAFile == "" || c.TLSCertFile == "" || c.TLSKeyFile == "" {
+			return fmt.Errorf("tls_ca_file, tls_cert_file and tls_key_file are required when vpn_key_mode is %q", KeyModeTLS)
+		}
+	default:
+		return fmt.Errorf("vpn_key_mode must be either %q or %q", KeyModeStatic, KeyModeTLS)
+	}
+	if c.VPNDCO && c.VPNKeyMode != KeyModeTLS {
+		return fmt.Errorf("vpn_dco requires vpn_key_mode %q, since data channel offload doesn't support static keys", KeyModeTLS)
+	}
+
+	switch c.GossipProfile {
+	case "", GossipProfileLAN, GossipProfileWAN, GossipProfileLocal:
+	default:
+		return fmt.Errorf("gossip_profile must be one of %q, %q or %q", GossipProfileLAN, GossipProfileWAN, GossipProfileLocal)
+	}
+
+	if err := checkExtraArgs(c.OpenVPNExtraArgs); err != nil {
+		return fmt.Errorf("invalid openvpn_extra_args: %s", err)
+	}
+
+	switch c.VPNTopology {
+	case "", VPNTopologyP2P:
+	case VPNTopologySubnet:
+		if c.TunnelBasePrefix == "" {
+			return fmt.Errorf("vpn_topology %q requires tunnel_base_prefix to be set to a /%d or shorter", VPNTopologySubnet, 32-tunnelSubnetIdBits)
+		}
+	default:
+		return fmt.Errorf("vpn_topology must be either %q or %q", VPNTopologyP2P, VPNTopologySubnet)
+	}
+
+	if c.ReadyTunnelPercent < 0 || c.ReadyTunnelPercent > 100 {
+		return fmt.Errorf("ready_tunnel_percent must be between 1 and 100, or 0 for the default of %d", DefaultReadyTunnelPercent)
+	}
+	if c.RouteMinMembers < 0 {
+		return fmt.Errorf("route_min_members must not be negative")
+	}
+	if c.MaxTunnels < 0 {
+		return fmt.Errorf("max_tunnels must not be negative")
+	}
+
+	if c.TunMTU != 0 && (c.TunMTU < 576 || c.TunMTU > 65535) {
+		return fmt.Errorf("tun_mtu must be between 576 and 65535")
+	}
+	if c.MSSFix < -1 || c.MSSFix > 65535 {
+		return fmt.Errorf("mssfix must be between 0 and 65535, or -1 to disable it")
+	}
+	if c.Fragment < 0 || c.Fragment > 65535 {
+		return fmt.Errorf("fragment must be between 0 and 65535")
+	}
+	if c.Fragment != 0 && c.VPNTransport == TransportTCP {
+		return fmt.Errorf("fragment can't be used with the tcp transport")
+	}
+
+	switch c.Mode {
+	case "", ModeFull, ModeTunnelsOnly, ModeObserve:
+	default:
+		return fmt.Errorf("mode must be %q, %q or %q", ModeFull, ModeTunnelsOnly, ModeObserve)
+	}
+	if c.Observer && c.Mode != "" && c.Mode != ModeObserve {
+		return fmt.Errorf("observer can't be used with mode %q", c.Mode)
+	}
+
+	switch c.TunnelTopology {
+	case "", TopologyMesh, TopologyHub:
+	default:
+		return fmt.Errorf("tunnel_topology must be either %q or %q", TopologyMesh, TopologyHub)
+	}
+
+	switch c.NeighborScoring {
+	case "", ScoringDistance, ScoringStability:
+	default:
+		return fmt.Errorf("neighbor_scoring must be either %q or %q", ScoringDistance, ScoringStability)
+	}
+
+	for key := range c.Tags {
+		if key == "" {
+			return fmt.Errorf("tags may not have an empty key")
+		}
+		if reservedTags[key] {
+			return fmt.Errorf("tag %q is reserved for internal use", key)
+		}
+	}
+	if _, err := ParsePeerSelector(c.PeerSelector); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RunMode returns the value of the "mode" setting, which is ModeObserve
+// if the "observer" setting is set and otherwise defaults to ModeFull.
+// See mode.go.
+func (c *Config) RunMode() string {
+	switch {
+	case c.Mode != "":
+		return c.Mode
+	case c.Observer:
+		return ModeObserve
+	}
+	return ModeFull
+}
+
+// Topology returns the value of the "tunnel_topology" setting, which
+// defaults to TopologyMesh. See topology.go.
+func (c *Config) Topology() string {
+	if c.TunnelTopology == "" {
+		return TopologyMesh
+	}
+	return c.TunnelTopology
+}
+
+// TunnelBaseNet returns the parsed value of the "tunnel_base_prefix"
+// setting, or nil if it isn't set. The network must be IPv4 and large
+// enough to hold the tunnel addresses for every pair of endpoint ids under
+// the configured vpn_topology.
+func (c *Config) TunnelBaseNet() (*net.IPNet, error) {
+	if c.TunnelBasePrefix == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(c.TunnelBasePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel_base_prefix %q: %s", c.TunnelBasePrefix, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("invalid tunnel_base_prefix %q: must be an IPv4 network", c.TunnelBasePrefix)
+	}
+	idBits := tunnelIdBits
+	if c.VPNTopology == VPNTopologySubnet {
+		idBits = tunnelSubnetIdBits
+	}
+	if bits-ones < idBits {
+		return nil, fmt.Errorf("invalid tunnel_base_prefix %q: must be /%d or shorter, to leave %d bits for endpoint ids", c.TunnelBasePrefix, bits-idBits, idBits)
+	}
+	return ipNet, nil
+}
+
+// LocalAddressNet returns the parsed value of the "local_address_cidr"
+// setting, or nil if it is not set.
+func (c *Config) LocalAddressNet() (*net.IPNet, error) {
+	if c.LocalAddressCIDR == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(c.LocalAddressCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local_address_cidr %q: %s", c.LocalAddressCIDR, err)
+	}
+	return ipNet, nil
+}
+
+// EndpointIdOverrideValue returns the parsed value of the
+// "endpoint_id_override" setting, or nil if it isn't set.
+//
+// The override replaces the endpoint id derived from our internal address,
+// and is advertised to the other endpoints so that they use it too. It is
+// meant only for running several nodes in one datacenter during
+// development, which the addressing scheme otherwise forbids; routes to
+// the datacenter's network still can't tell those nodes apart.
+func (c *Config) EndpointIdOverrideValue() (*EndpointId, error) {
+	if c.EndpointIdOverride == "" {
+		return nil, nil
+	}
+	id, err := ParseEndpointId(c.EndpointIdOverride)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint_id_override: %s", err)
+	}
+	return &id, nil
+}
+
+// IPv6 returns true if the "address_family" setting selects IPv6.
+func (c *Config) IPv6() bool {
+	return c.AddressFamily == AddressFamilyIPv6
+}
+
+// AddressBits returns the length in bits of the addresses that the prefix
+// length settings apply to.
+func (c *Config) AddressBits() int {
+	if c.IPv6() {
+		return 128
+	}
+	return 32
+}
+
+// RestartRequiredChanges returns the names of any settings that differ
+// between the receiver and the given other config but that cannot be
+// changed without a restart.
+func (c *Config) RestartRequiredChanges(other *Config) []string {
+	var ret []string
+
+	cv := reflect.ValueOf(c).Elem()
+	ov := reflect.ValueOf(other).Elem()
+	ty := cv.Type()
+	for i := 0; i < ty.NumField(); i++ {
+		name := ty.Field(i).Tag.Get("hcl")
+		if name == "" || reloadableSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(cv.Field(i).Interface(), ov.Field(i).Interface()) {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+func parseDurationSetting(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	ret, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, value, err)
+	}
+	if ret <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, value)
+	}
+	return ret, nil
+}
+
+// parseOptionalDurationSetting is like parseDurationSetting, but for a
+// setting that can be turned off by setting it to "0" or "off", in which
+// case it returns zero.
+func parseOptionalDurationSetting(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "off" {
+		return 0, nil
 	}
-	if other.InitialPeers != nil && len(other.InitialPeers) > 0 {
-		c.InitialPeers = other.InitialPeers
+	if d, err := time.ParseDuration(value); err == nil && d == 0 {
+		return 0, nil
 	}
+	return parseDurationSetting(name, value, def)
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFromEnvOnly(t *testing.T) {
+	t.Setenv("OPENVPN_PEER_NODE_NAME", "this")
+	t.Setenv("OPENVPN_PEER_COMMON_PREFIX_LEN", "8")
+	t.Setenv("OPENVPN_PEER_REGION_PREFIX_LEN", "12")
+	t.Setenv("OPENVPN_PEER_DC_PREFIX_LEN", "18")
+	t.Setenv("OPENVPN_PEER_START_PORT", "7000")
+	t.Setenv("OPENVPN_PEER_PERSIST_TUNNELS", "false")
+	t.Setenv("OPENVPN_PEER_INITIAL_PEERS", " 10.0.0.1, 10.16.0.1:7946 ,,")
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	if got, want := config.NodeName, "this"; got != want {
+		t.Errorf("got node_name %q; want %q", got, want)
+	}
+	if got, want := config.InitialPeers, []string{"10.0.0.1", "10.16.0.1:7946"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got initial_peers %q; want %q", got, want)
+	}
+
+	// A setting given as its zero value still counts as set, so that it
+	// can override a non-zero one.
+	if !config.set["persist_tunnels"] {
+		t.Errorf("persist_tunnels not recorded as set")
+	}
+	if config.set["vpn_port"] {
+		t.Errorf("vpn_port recorded as set, but isn't in the environment")
+	}
+	other := &Config{PersistTunnels: true, VPNPort: 1194}
+	other.Override(config)
+	if other.PersistTunnels {
+		t.Errorf("persist_tunnels from the environment didn't override")
+	}
+	if other.VPNPort != 1194 {
+		t.Errorf("unset vpn_port overrode the existing value")
+	}
+}
+
+func TestTunnelWatchdogTimeoutDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", DefaultTunnelWatchdogTimeout, false},
+		{"5m", 5 * time.Minute, false},
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"off", 0, false},
+		{"-1m", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		config := &Config{TunnelWatchdog: test.value}
+		got, err := config.TunnelWatchdogTimeoutDuration()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %s; want error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %s; want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestTunnelEstablishSLADuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", DefaultTunnelEstablishSLA, false},
+		{"2m", 2 * time.Minute, false},
+		{"0", 0, false},
+		{"off", 0, false},
+		{"-1m", 0, true},
+	}
+	for _, test := range tests {
+		config := &Config{TunnelEstablishSLA: test.value}
+		got, err := config.TunnelEstablishSLADuration()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %s; want error", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %s; want %s", test.value, got, test.want)
+		}
+	}
+}
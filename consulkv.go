@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file publishes our view of the cluster to the Consul KV store, so
+// that other tooling can read the topology without talking to us.
+//
+// Each endpoint we know about, including our own, is written as JSON to
+// the key <prefix>/<node>/<endpoint id>, where <node> is our own node
+// name, and keys for endpoints that have gone away are deleted. We only
+// ever write under our own node's prefix, and never read anything back
+// except to clean up keys left over from a previous run.
+//
+// We talk to Consul's HTTP API directly rather than using its client
+// library, since we need only a tiny part of it.
+
+// DefaultConsulAddr and DefaultConsulKVPrefix are used when consul_addr
+// and consul_kv_prefix aren't set.
+const (
+	DefaultConsulAddr     = "127.0.0.1:8500"
+	DefaultConsulKVPrefix = "openvpn-peer"
+)
+
+// consulKVTimeout limits how long each request to Consul may take.
+const consulKVTimeout = 10 * time.Second
+
+// kvEndpointRecord is the JSON value we write for each endpoint.
+type kvEndpointRecord struct {
+	*endpointStatus
+
+	VPNEndpointIP string `json:"vpn_endpoint_ip"`
+}
+
+// consulKV is a minimal client for the Consul KV HTTP API.
+type consulKV struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func (c *consulKV) request(method, key string, query string, body []byte) ([]byte, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     c.addr,
+		Path:     "/v1/kv/" + key,
+		RawQuery: query,
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// Keys returns all of the keys under the given prefix.
+func (c *consulKV) Keys(prefix string) ([]string, error) {
+	body, err := c.request(http.MethodGet, prefix, "keys", nil)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	var keys []string
+	err = json.Unmarshal(body, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response listing %s: %s", prefix, err)
+	}
+	return keys, nil
+}
+
+func (c *consulKV) Put(key string, value []byte) error {
+	_, err := c.request(http.MethodPut, key, "", value)
+	return err
+}
+
+func (c *consulKV) Delete(key string) error {
+	_, err := c.request(http.MethodDelete, key, "", nil)
+	return err
+}
+
+// kvSnapshotter writes snapshots of the cluster state to Consul KV in the
+// background, so that a slow or unavailable Consul agent can't hold up the
+// Run loop. If snapshots arrive faster than they can be written then only
+// the latest is written.
+type kvSnapshotter struct {
+	kv     *consulKV
+	prefix string
+
+	snapshotCh chan *kvSnapshot
+
+	// written holds the values we've written by key, so that we only
+	// write values that have changed. It is nil until we've cleaned up
+	// after any previous run. Used only by run.
+	written map[string][]byte
+}
+
+func newKVSnapshotter(addr, token, prefix string) *kvSnapshotter {
+	return &kvSnapshotter{
+		kv: &consulKV{
+			addr:  addr,
+			token: token,
+			client: &http.Client{
+				Timeout: consulKVTimeout,
+			},
+		},
+		prefix:     strings.Trim(prefix, "/"),
+		snapshotCh: make(chan *kvSnapshot, 1),
+	}
+}
+
+// Start begins writing snapshots in the background, until stopCh is
+// closed.
+func (s *kvSnapshotter) Start(stopCh <-chan struct{}) {
+	go s.run(stopCh)
+}
+
+// Update queues a snapshot of the given cluster and tunnel states to be
+// written, replacing any earlier snapshot that hasn't been written yet.
+func (s *kvSnapshotter) Update(cluster *ClusterState, tunnels *TunnelsState) {
+	snapshot := s.snapshot(cluster, tunnels)
+	for {
+		select {
+		case s.snapshotCh <- snapshot:
+			return
+		default:
+		}
+		select {
+		case <-s.snapshotCh:
+		default:
+		}
+	}
+}
+
+// kvSnapshot is the set of keys and values that we want under NodePrefix.
+type kvSnapshot struct {
+	NodePrefix string
+	Values     map[string][]byte
+}
+
+// snapshot produces the keys and values that describe the given states.
+func (s *kvSnapshotter) snapshot(cluster *ClusterState, tunnels *TunnelsState) *kvSnapshot {
+	vpnStates := make(map[EndpointId]VPNState, len(tunnels.Tunnels))
+	for _, tunnel := range tunnels.Tunnels {
+		vpnStates[tunnel.EndpointId] = tunnel.State
+	}
+
+	ret := &kvSnapshot{
+		NodePrefix: s.prefix + "/" + cluster.ThisEndpoint.NodeName() + "/",
+		Values:     make(map[string][]byte),
+	}
+	add := func(endpoint *Endpoint) {
+		if cluster.IsDuplicate(endpoint) {
+			// They'd all want the same key.
+			return
+		}
+		record := &kvEndpointRecord{
+			endpointStatus: newEndpointStatus(cluster, endpoint, vpnStates),
+			VPNEndpointIP:  endpoint.VPNEndpointAddr().String(),
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			logger.Errorf("Failed to encode KV record for endpoint %s: %s", endpoint.Id(), err)
+			return
+		}
+		ret.Values[ret.NodePrefix+endpoint.Id().String()] = value
+	}
+
+	add(cluster.ThisEndpoint)
+	for _, endpoint := range cluster.LocalEndpoints {
+		add(endpoint)
+	}
+	for _, endpoint := range cluster.RemoteEndpoints {
+		add(endpoint)
+	}
+	return ret
+}
+
+func (s *kvSnapshotter) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case snapshot := <-s.snapshotCh:
+			s.write(snapshot)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// write brings the KV store in line with the given snapshot. Failures are
+// logged, and the affected keys are retried with the next snapshot.
+func (s *kvSnapshotter) write(snapshot *kvSnapshot) {
+	if s.written == nil {
+		if err := s.loadExisting(snapshot.NodePrefix); err != nil {
+			logger.Warnf("Failed to list existing Consul KV keys: %s", err)
+			return
+		}
+	}
+
+	for key, value := range snapshot.Values {
+		if written, ok := s.written[key]; ok && bytes.Equal(written, value) {
+			continue
+		}
+		if err := s.kv.Put(key, value); err != nil {
+			logger.Warnf("Failed to write Consul KV key: %s", err)
+			continue
+		}
+		s.written[key] = value
+	}
+	for key := range s.written {
+		if _, ok := snapshot.Values[key]; ok {
+			continue
+		}
+		if err := s.kv.Delete(key); err != nil {
+			logger.Warnf("Failed to delete Consul KV key: %s", err)
+			continue
+		}
+		delete(s.written, key)
+	}
+}
+
+// loadExisting finds the keys left under our node's prefix by a previous
+// run, so that write will delete them if they're no longer wanted.
+func (s *kvSnapshotter) loadExisting(nodePrefix string) error {
+	keys, err := s.kv.Keys(nodePrefix)
+	if err != nil {
+		return err
+	}
+	s.written = make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		// A nil value never matches, so these will be rewritten.
+		s.written[key] = nil
+	}
+	return nil
+}
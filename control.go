@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// This file implements the control socket, a line-based alternative to
+// the HTTP API for local tooling that avoids exposing a network port.
+//
+// Each line sent by the client is a command, and each command gets a
+// single line in response: JSON for the commands that report state, "ok"
+// for actions that succeeded, or "error: " followed by a message. The
+// commands are:
+//
+//	status          our view of the cluster, as from GET /cluster
+//	tunnels         our tunnels, as from GET /tunnels
+//	restart <eid>   restart the tunnel to the given endpoint
+//	drain           start draining; see drain.go
+//	undrain         stop draining
+//	reload          re-load the configuration, as on SIGHUP
+//
+// For example:
+//
+//	echo tunnels | socat - UNIX-CONNECT:/run/openvpn-peer/control.sock
+
+// controlCommands maps each control command to the function that handles
+// it, which is given the command's arguments.
+var controlCommands = map[string]func(m *Manager, args []string) (interface{}, error){
+	"status":  (*Manager).controlStatus,
+	"tunnels": (*Manager).controlTunnels,
+	"restart": (*Manager).controlRestart,
+	"drain":   (*Manager).controlDrain,
+	"undrain": (*Manager).controlUndrain,
+	"reload":  (*Manager).controlReload,
+}
+
+// startControl starts serving the control socket at the given path.
+// Closing the returned listener stops serving and removes the socket.
+func (m *Manager) startControl(socketPath string) (net.Listener, error) {
+	// A socket left behind by a previous run that didn't shut down
+	// cleanly would stop us from listening, but we mustn't remove
+	// anything that isn't a socket.
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	// The socket must be accessible only to us from the moment it is
+	// created, since anyone who can connect can control us. Changing its
+	// mode afterwards would leave a window in which others could connect,
+	// so we narrow the umask instead. The umask is process-wide, but
+	// anything else created in the meantime just ends up more private
+	// than intended.
+	oldUmask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logger.Infof("Control socket stopped: %s", err)
+				return
+			}
+			go m.serveControl(conn)
+		}
+	}()
+
+	return listener, nil
+}
+
+// serveControl handles the commands from a single control socket client
+// until it disconnects.
+func (m *Manager) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var response string
+		result, err := m.runControlCommand(fields[0], fields[1:])
+		if err != nil {
+			response = fmt.Sprintf("error: %s", err)
+		} else if result == nil {
+			response = "ok"
+		} else {
+			encoded, err := json.Marshal(result)
+			if err != nil {
+				response = fmt.Sprintf("error: %s", err)
+			} else {
+				response = string(encoded)
+			}
+		}
+
+		_, err = fmt.Fprintln(conn, response)
+		if err != nil {
+			logger.Warnf("Failed to write control socket response: %s", err)
+			return
+		}
+	}
+}
+
+func (m *Manager) runControlCommand(name string, args []string) (interface{}, error) {
+	command, ok := controlCommands[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	return command(m, args)
+}
+
+func (m *Manager) controlStatus(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: status")
+	}
+	cluster, tunnels := m.LatestState()
+	if cluster == nil {
+		return nil, fmt.Errorf("cluster state not yet available")
+	}
+	return newClusterStatus(cluster, tunnels), nil
+}
+
+func (m *Manager) controlTunnels(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: tunnels")
+	}
+	_, tunnels := m.LatestState()
+	if tunnels == nil {
+		return nil, fmt.Errorf("tunnel state not yet available")
+	}
+	return newTunnelsStatus(tunnels, m.tunnelMgr.Backoffs()), nil
+}
+
+func (m *Manager) controlRestart(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("usage: restart <endpoint id>")
+	}
+	endpointId, err := ParseEndpointId(args[0])
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Restart of tunnel to endpoint %s requested via the control socket", endpointId)
+	return nil, m.tunnelMgr.RestartTunnel(endpointId)
+}
+
+func (m *Manager) controlDrain(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: drain")
+	}
+	logger.Infof("Drain requested via the control socket")
+	return nil, m.Drain()
+}
+
+func (m *Manager) controlUndrain(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: undrain")
+	}
+	logger.Infof("Undrain requested via the control socket")
+	return nil, m.Undrain()
+}
+
+func (m *Manager) controlReload(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("usage: reload")
+	}
+	logger.Infof("Reload requested via the control socket")
+	return nil, m.Reload()
+}
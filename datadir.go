@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// This file defines the layout of the data dir, where we keep the state
+// that must survive a restart:
+//
+//	gossip/snapshot       Serf's snapshot; see gossipsnapshot.go
+//	tunnels/tunnels.json  our tunnels; see tunnelstore.go
+//	audit/audit.log       the audit log, and its rotations; see audit.go
+//
+// The snapshot reveals the cluster's members and addresses, and the other
+// files our tunnels and their history, so the data dir and each of its
+// subdirectories are created readable only by us. We don't change the
+// permissions of a directory that already exists, in case an operator
+// chose them deliberately, but we warn if others can read it.
+//
+// Earlier versions kept everything directly in the data dir, so files in
+// their old locations are moved into place when we prepare it.
+
+const dataDirMode = 0700
+
+// The subdirectories of the data dir.
+const (
+	gossipDataSubdir  = "gossip"
+	tunnelsDataSubdir = "tunnels"
+	auditDataSubdir   = "audit"
+)
+
+// gossipSnapshotFilename is the name of Serf's snapshot within the gossip
+// subdirectory.
+const gossipSnapshotFilename = "snapshot"
+
+func gossipSnapshotPath(dataDir string) string {
+	return path.Join(dataDir, gossipDataSubdir, gossipSnapshotFilename)
+}
+
+func tunnelsFilePath(dataDir string) string {
+	return path.Join(dataDir, tunnelsDataSubdir, tunnelsFilename)
+}
+
+func auditLogPath(dataDir string) string {
+	return path.Join(dataDir, auditDataSubdir, auditFilename)
+}
+
+// prepareDataDir creates the data dir and its subdirectories as needed,
+// and moves any files left in their old locations by earlier versions.
+func prepareDataDir(dataDir string) error {
+	for _, dir := range []string{
+		dataDir,
+		path.Join(dataDir, gossipDataSubdir),
+		path.Join(dataDir, tunnelsDataSubdir),
+		path.Join(dataDir, auditDataSubdir),
+	} {
+		err := os.MkdirAll(dir, os.ModeDir|dataDirMode)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", dir, err)
+		}
+		warnDataDirMode(dir)
+	}
+
+	moves := map[string]string{
+		path.Join(dataDir, "serf"):          gossipSnapshotPath(dataDir),
+		path.Join(dataDir, tunnelsFilename): tunnelsFilePath(dataDir),
+	}
+	auditLogs, err := filepath.Glob(path.Join(dataDir, auditFilename+"*"))
+	if err != nil {
+		return err
+	}
+	for _, oldPath := range auditLogs {
+		moves[oldPath] = path.Join(dataDir, auditDataSubdir, path.Base(oldPath))
+	}
+
+	for oldPath, newPath := range moves {
+		if info, err := os.Stat(oldPath); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if _, err := os.Stat(newPath); err == nil {
+			logger.Warnf("Ignoring %s, since %s already exists", oldPath, newPath)
+			continue
+		}
+		logger.Infof("Moving %s to %s", oldPath, newPath)
+		err := os.Rename(oldPath, newPath)
+		if err != nil {
+			return fmt.Errorf("failed to move %s to %s: %s", oldPath, newPath, err)
+		}
+	}
+	return nil
+}
+
+// warnDataDirMode logs a warning if users other than us can access the
+// given directory.
+func warnDataDirMode(dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return
+	}
+	if mode := info.Mode().Perm(); mode&^dataDirMode != 0 {
+		logger.Warnf("%s has mode %04o, so other users may be able to read our state; it should be %04o", dir, mode, dataDirMode)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// doctorCheck is a single check made by the "doctor" subcommand. Run
+// returns a short description of what it found, or an error if the
+// check failed.
+type doctorCheck struct {
+	Name string
+	Run  func(config *Config) (string, error)
+}
+
+var doctorChecks = []doctorCheck{
+	{"configuration is consistent", doctorCheckConfig},
+	{"OpenVPN is executable", doctorCheckOpenVPN},
+	{"launcher works without a password", doctorCheckLauncher},
+	{"OpenVPN runs via the launcher", doctorCheckOpenVPNVersion},
+	{"local interface has a usable address", doctorCheckInterface},
+	{"key files are present and private", doctorCheckKeys},
+	{"TLS certificates are present", doctorCheckTLSFiles},
+	{"management sockets can be created", doctorCheckRuntimeDir},
+	{"gossip snapshot is writable", doctorCheckSnapshot},
+	{"gossip port is available", doctorCheckGossipPort},
+}
+
+// runDoctor checks the local environment for the problems that most
+// commonly prevent a node from working, printing one line per check.
+func runDoctor(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	var configFile string
+	if len(args) == 1 {
+		configFile = args[0]
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, check := range doctorChecks {
+		result, err := check.Run(config)
+		if err != nil {
+			fmt.Printf("FAIL  %s: %s\n", check.Name, err)
+			failures++
+			continue
+		}
+		fmt.Printf("ok    %s: %s\n", check.Name, result)
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d checks failed", failures, len(doctorChecks))
+	}
+	return nil
+}
+
+func doctorCheckConfig(config *Config) (string, error) {
+	err := config.Validate()
+	if err != nil {
+		return "", err
+	}
+	if _, err := config.RefreshIntervalDuration(); err != nil {
+		return "", err
+	}
+	if _, err := config.TunnelStartTimeoutDuration(); err != nil {
+		return "", err
+	}
+	if _, _, err := config.KeepaliveDurations(); err != nil {
+		return "", err
+	}
+	if _, err := config.GossipTimings(); err != nil {
+		return "", err
+	}
+	if _, err := config.RouteSettleTimeDuration(); err != nil {
+		return "", err
+	}
+	if _, err := config.TunnelStatsIntervalDuration(); err != nil {
+		return "", err
+	}
+	if _, err := config.TunnelWatchdogTimeoutDuration(); err != nil {
+		return "", err
+	}
+	if _, err := config.TunnelEstablishSLADuration(); err != nil {
+		return "", err
+	}
+	if _, err := config.LocalAddressNet(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"prefixes /%d, /%d, /%d",
+		config.CommonPrefixLen, config.RegionPrefixLen, config.DCPrefixLen,
+	), nil
+}
+
+func doctorCheckOpenVPN(config *Config) (string, error) {
+	path := doctorOpenVPNPath(config)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not executable", path)
+	}
+	return path, nil
+}
+
+func doctorCheckLauncher(config *Config) (string, error) {
+	// -n makes sudo fail rather than prompt if a password is needed,
+	// which is what would happen to us when launching tunnels.
+	output, err := exec.Command(DefaultLauncherPath, "-n", "true").CombinedOutput()
+	if err != nil {
+		return "", commandError(err, output)
+	}
+	return DefaultLauncherPath, nil
+}
+
+func doctorCheckOpenVPNVersion(config *Config) (string, error) {
+	caps, err := detectOpenVPNCapabilities([]string{
+		DefaultLauncherPath, "-n", "--", doctorOpenVPNPath(config), "--version",
+	})
+	if err != nil {
+		return "", err
+	}
+	err = caps.Check(&VPNConfig{Compression: config.VPNCompression, KeyMode: config.VPNKeyMode, DCO: config.VPNDCO})
+	if err != nil {
+		return "", err
+	}
+	return caps.Version, nil
+}
+
+func doctorCheckInterface(config *Config) (string, error) {
+	localNet, err := config.LocalAddressNet()
+	if err != nil {
+		return "", err
+	}
+	ip, err := interfaceIPAddr(config.LocalInterface, localNet, config.IPv6())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s on %s", ip, config.LocalInterface), nil
+}
+
+func doctorCheckKeys(config *Config) (string, error) {
+	keyring, err := LoadVPNKeyring(config)
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]*vpnKey, 0, len(keyring.keys)+len(keyring.pairKeys))
+	gens := keyring.Generations()
+	for _, gen := range gens {
+		keys = append(keys, keyring.keys[gen])
+	}
+	for _, key := range keyring.pairKeys {
+		keys = append(keys, key)
+	}
+
+	for _, key := range keys {
+		err := checkKeyFileMode(key.Filename)
+		if err != nil {
+			return "", err
+		}
+
+		data := key.Key
+		if data == nil {
+			data, err = ioutil.ReadFile(key.Filename)
+			if err != nil {
+				return "", err
+			}
+		}
+		err = validateStaticKey(data)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a valid OpenVPN static key: %s", key.Filename, err)
+		}
+	}
+
+	if pairs := keyring.RegionPairs(); pairs > 0 {
+		return fmt.Sprintf("generations %s, and %d region pair keys", formatKeyGenerations(gens), pairs), nil
+	}
+	return fmt.Sprintf("generations %s", formatKeyGenerations(gens)), nil
+}
+
+func doctorCheckTLSFiles(config *Config) (string, error) {
+	if config.VPNKeyMode != KeyModeTLS {
+		return "not using TLS", nil
+	}
+	for _, filename := range []string{config.TLSCAFile, config.TLSCertFile, config.TLSKeyFile, config.TLSCRLFile} {
+		if filename == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(filename); err != nil {
+			return "", err
+		}
+	}
+	err := checkKeyFileMode(config.TLSKeyFile)
+	if err != nil {
+		return "", err
+	}
+	err = checkTLSCert(config.TLSCertFile, config.NodeName)
+	if err != nil {
+		return "", err
+	}
+	return config.TLSCertFile, nil
+}
+
+// checkTLSCert checks that the certificate in the given file is one that
+// our peers will accept from the node with the given name: see KeyModeTLS.
+func checkTLSCert(filename, nodeName string) error {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return fmt.Errorf("%s doesn't contain a PEM certificate", filename)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %s", filename, err)
+	}
+
+	if nodeName != "" && cert.Subject.CommonName != nodeName {
+		return fmt.Errorf("%s has common name %q, but peers will only accept %q, our node_name", filename, cert.Subject.CommonName, nodeName)
+	}
+	usages := make(map[x509.ExtKeyUsage]bool)
+	for _, usage := range cert.ExtKeyUsage {
+		usages[usage] = true
+	}
+	if !usages[x509.ExtKeyUsageServerAuth] || !usages[x509.ExtKeyUsageClientAuth] {
+		return fmt.Errorf("%s must allow both TLS server and client authentication", filename)
+	}
+	return nil
+}
+
+func doctorCheckGossipPort(config *Config) (string, error) {
+	localNet, err := config.LocalAddressNet()
+	if err != nil {
+		return "", err
+	}
+	ip, err := interfaceIPAddr(config.LocalInterface, localNet, config.IPv6())
+	if err != nil {
+		return "", fmt.Errorf("can't check without a local address")
+	}
+
+	var lastErr error
+	for port := config.GossipPort; port <= config.GossipPort+config.GossipPortRange; port++ {
+		lastErr = probePort(ip, port)
+		if lastErr == nil {
+			return fmt.Sprintf("%s port %d", ip, port), nil
+		}
+	}
+	return "", lastErr
+}
+
+func doctorOpenVPNPath(config *Config) string {
+	if config.OpenVPNPath == "" {
+		return DefaultOpenVPNPath
+	}
+	return config.OpenVPNPath
+}
+
+// commandError describes a failed command, including its output if it
+// produced any.
+func commandError(err error, output []byte) error {
+	text := strings.TrimSpace(string(output))
+	if text == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %s", err, text)
+}
+
+// doctorCheckRuntimeDir creates and listens on a socket in the same way
+// that StartOpenVPN does for each tunnel's management interface.
+func doctorCheckRuntimeDir(config *Config) (string, error) {
+	dir, err := ioutil.TempDir(config.RuntimeDir, "openvpn-peer")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", path.Join(dir, "mgmt.sock"))
+	if err != nil {
+		return "", err
+	}
+	listener.Close()
+
+	// With management ports, OpenVPN still connects to a socket in this
+	// directory, but we'll also need to read the password.
+	if config.ManagementPortBase != 0 {
+		if _, err := readMgmtPassword(config.ManagementPasswordFile); err != nil {
+			return "", err
+		}
+	}
+
+	if config.RuntimeDir == "" {
+		return fmt.Sprintf("using %s", os.TempDir()), nil
+	}
+	return fmt.Sprintf("using %s", config.RuntimeDir), nil
+}
+
+// doctorCheckSnapshot checks that Serf will be able to open its snapshot,
+// unless its directory hasn't been created yet. See datadir.go.
+func doctorCheckSnapshot(config *Config) (string, error) {
+	snapshotPath := gossipSnapshotPath(config.DataDir)
+	if _, err := os.Stat(path.Dir(snapshotPath)); os.IsNotExist(err) {
+		return fmt.Sprintf("%s will be created", path.Dir(snapshotPath)), nil
+	}
+	err := checkSnapshotPath(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	return snapshotPath, nil
+}
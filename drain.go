@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// This file implements draining, which winds an endpoint down for
+// maintenance without shutting it down entirely.
+//
+// A draining endpoint advertises the "draining" tag, which tells its peers
+// not to use it as a fallback or hub for their traffic and not to start
+// any new tunnels to it. After a grace period, during which the peers
+// move their traffic elsewhere, the draining endpoint closes its tunnels
+// a few at a time. Each peer then closes its own end of a tunnel once it
+// has gone down.
+//
+// Unlike Shutdown, draining leaves the process running and the endpoint in
+// the gossip pool, and it can be reversed with Undrain.
+
+const drainingTag = "draining"
+
+// drainGracePeriod is how long a draining endpoint waits after advertising
+// that it is draining before it starts to close its tunnels, and then it
+// closes up to drainCloseBatch tunnels every drainCloseInterval.
+const (
+	drainGracePeriod   = 10 * time.Second
+	drainCloseBatch    = 4
+	drainCloseInterval = 2 * time.Second
+)
+
+// Drain asks the Run loop to start draining this endpoint. It returns once
+// the request has been accepted, before any tunnels have been closed.
+func (m *Manager) Drain() error {
+	return m.requestDrain(true)
+}
+
+// Undrain asks the Run loop to stop draining this endpoint and return to
+// normal operation, re-establishing any tunnels that were closed.
+func (m *Manager) Undrain() error {
+	return m.requestDrain(false)
+}
+
+func (m *Manager) requestDrain(draining bool) error {
+	select {
+	case m.drainCh <- draining:
+		return nil
+	case <-m.doneCh:
+		return fmt.Errorf("manager is not running")
+	}
+}
+
+// setDraining is the Run loop's half of Drain and Undrain.
+func (m *Manager) setDraining(draining bool) {
+	if draining == !m.drainingSince.IsZero() {
+		return
+	}
+
+	var err error
+	if draining {
+		logger.Infof("Draining: no new tunnels will be started, and existing tunnels will close after %s", drainGracePeriod)
+		m.drainingSince = time.Now()
+		err = m.gossip.SetTag(drainingTag, "1")
+	} else {
+		logger.Infof("No longer draining")
+		m.drainingSince = time.Time{}
+		err = m.gossip.RemoveTag(drainingTag)
+	}
+	if err != nil {
+		logger.Errorf("Failed to update %s tag: %s", drainingTag, err)
+	}
+}
+
+// drainCloses returns the tunnels, of the given open ones, that we should
+// close on this pass of the Run loop while draining.
+func (m *Manager) drainCloses(open EndpointSet) EndpointSet {
+	ret := make(EndpointSet)
+	if time.Since(m.drainingSince) < drainGracePeriod {
+		return ret
+	}
+	for _, endpointId := range open.Sorted() {
+		if len(ret) >= drainCloseBatch {
+			break
+		}
+		ret.Add(endpointId)
+	}
+	return ret
+}
+
+// nextDrainRefresh returns how long the Run loop should wait before it
+// next closes tunnels while draining, or false if it needn't wake up for
+// that.
+func (m *Manager) nextDrainRefresh(tunnelMgr *TunnelMgr) (time.Duration, bool) {
+	if m.drainingSince.IsZero() || tunnelMgr.TunnelCount() == 0 {
+		return 0, false
+	}
+	if untilGraceEnds := time.Until(m.drainingSince.Add(drainGracePeriod)); untilGraceEnds > 0 {
+		return untilGraceEnds, true
+	}
+	return drainCloseInterval, true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
+)
+
+// dryRunLauncher is a VPNLauncher that logs the command line it would
+// have run instead of actually running it.
+//
+// The resulting process never connects, so its tunnel remains in the
+// VPNConnecting state until it is closed. This allows the manager's
+// reconcile loop to run normally against real cluster membership
+// without us touching the system.
+type dryRunLauncher struct{}
+
+func (dryRunLauncher) Launch(config *VPNConfig, eventCh chan<- openvpn.Event) (VPNProcess, error) {
+	cmdLine := config.CommandLine("/path/to/mgmt.sock")
+	logger.Infof("[dry run] Would start OpenVPN %s", strings.Join(cmdLine, " "))
+
+	return &dryRunProcess{
+		eventCh: eventCh,
+	}, nil
+}
+
+// dryRunProcess is the VPNProcess returned by dryRunLauncher. It "exits"
+// as soon as it is asked to close.
+type dryRunProcess struct {
+	eventCh   chan<- openvpn.Event
+	closeOnce sync.Once
+}
+
+func (p *dryRunProcess) HoldRelease() error {
+	return nil
+}
+
+func (p *dryRunProcess) SendSignal(name string) error {
+	if name == "SIGTERM" {
+		p.exit()
+	}
+	return nil
+}
+
+func (p *dryRunProcess) Kill() error {
+	p.exit()
+	return nil
+}
+
+func (p *dryRunProcess) AuthFailures() int {
+	return 0
+}
+
+func (p *dryRunProcess) exit() {
+	p.closeOnce.Do(func() {
+		close(p.eventCh)
+	})
+}
@@ -3,11 +3,43 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/serf/coordinate"
 	"github.com/hashicorp/serf/serf"
 )
 
+// endpointIdTag is the gossip tag in which an endpoint advertises the
+// endpoint id it uses instead of the one derived from its address, if
+// any. See Config.EndpointIdOverrideValue.
+const endpointIdTag = "endpoint_id"
+
+// servedNetworksTag is the gossip tag in which an endpoint advertises the
+// networks it serves besides its own datacenter's, as a comma-separated
+// list of CIDRs. See Endpoint.ServedNetworks.
+const servedNetworksTag = "served_networks"
+
+// vpnPortTag is the gossip tag in which an endpoint advertises the port it
+// uses for its end of every tunnel instead of the one derived from its
+// endpoint id, if any. See Endpoint.VPNPort.
+const vpnPortTag = "vpn_port"
+
+// vpnFragmentTag is the gossip tag in which an endpoint advertises the
+// size it has OpenVPN fragment packets to, if it fragments them at all.
+// See Endpoint.VPNFragment.
+const vpnFragmentTag = "vpn_fragment"
+
+// vpnTopologyTag is the gossip tag in which an endpoint advertises the
+// topology of its tunnel devices, if it isn't VPNTopologyP2P. See
+// Endpoint.VPNTopology.
+const vpnTopologyTag = "vpn_topology"
+
+// vpnKeyModeTag is the gossip tag in which an endpoint advertises how it
+// keys its tunnels. See Endpoint.VPNKeyMode.
+const vpnKeyModeTag = "vpn_key_mode"
+
 type Endpoint struct {
 	addr   Address
 	member *serf.Member
@@ -18,14 +50,25 @@ const MaxDistance = int64((1 << 63) - 1)
 
 func newEndpoint(gossip *Gossip, member *serf.Member) *Endpoint {
 	addr := gossip.config.Addressing.Address(member.Tags["int_ip"])
+	if raw, ok := member.Tags[endpointIdTag]; ok {
+		// An endpoint that advertises an invalid override gets the
+		// invalid id, rather than one that might collide with another.
+		id, err := ParseEndpointId(raw)
+		if err != nil {
+			id = InvalidEndpointId
+		}
+		addr = addr.WithEndpointId(id)
+	}
 
 	ret := &Endpoint{
 		addr:   addr,
 		member: member,
 	}
 
-	if coord, ok := gossip.serf.GetCachedCoordinate(member.Name); ok {
-		ret.coord = coord
+	if s := gossip.current(); s != nil {
+		if coord, ok := s.GetCachedCoordinate(member.Name); ok {
+			ret.coord = coord
+		}
 	}
 
 	return ret
@@ -39,6 +82,21 @@ func (e *Endpoint) GossipAddr() net.IP {
 	return e.member.Addr
 }
 
+// VPNEndpointAddr returns the address that peers should dial to reach
+// the endpoint's tunnels. This is the address the endpoint advertises in
+// its "vpn_endpoint_ip" tag, if any, and its gossip address otherwise.
+//
+// The two differ when NAT or an overlay network means that the address
+// Serf sees isn't the one other endpoints can reach.
+func (e *Endpoint) VPNEndpointAddr() net.IP {
+	if raw, ok := e.member.Tags["vpn_endpoint_ip"]; ok {
+		if ip := net.ParseIP(raw); ip != nil {
+			return ip
+		}
+	}
+	return e.GossipAddr()
+}
+
 func (e *Endpoint) GossipPort() uint16 {
 	return e.member.Port
 }
@@ -47,22 +105,279 @@ func (e *Endpoint) InternalAddr() net.IP {
 	return e.addr.IP
 }
 
+// AddressValid returns true if the endpoint's "int_ip" tag holds an
+// address from which we can derive its region, datacenter and id.
+func (e *Endpoint) AddressValid() bool {
+	return e.addr.IP != nil && e.RegionId() != "" && e.Id().Valid()
+}
+
+// equivalentTo returns true if the two endpoints agree on everything that
+// affects the tunnels we'd create for them.
+func (e *Endpoint) equivalentTo(other *Endpoint) bool {
+	return e.Status() == other.Status() &&
+		e.Id() == other.Id() &&
+		e.GossipAddr().Equal(other.GossipAddr()) &&
+		e.GossipPort() == other.GossipPort() &&
+		e.VPNEndpointAddr().Equal(other.VPNEndpointAddr()) &&
+		e.InternalAddr().Equal(other.InternalAddr()) &&
+		e.Observer() == other.Observer() &&
+		e.Hub() == other.Hub() &&
+		e.Mode() == other.Mode() &&
+		e.Topology() == other.Topology() &&
+		e.Draining() == other.Draining() &&
+		e.GoingDown() == other.GoingDown() &&
+		e.VPNCipher() == other.VPNCipher() &&
+		e.VPNAuth() == other.VPNAuth() &&
+		e.VPNCompression() == other.VPNCompression() &&
+		e.VPNTransport() == other.VPNTransport() &&
+		e.VPNKeyMode() == other.VPNKeyMode() &&
+		e.member.Tags[keyGenerationsTag] == other.member.Tags[keyGenerationsTag] &&
+		e.member.Tags[pairKeysTag] == other.member.Tags[pairKeysTag] &&
+		sameTags(e.member.Tags, other.member.Tags)
+}
+
+// sameTags returns true if the two sets of gossip tags are identical. Any
+// tag might affect peer selection; see PeerSelector.
+func sameTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if otherValue, ok := b[key]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *Endpoint) Status() serf.MemberStatus {
 	return e.member.Status
 }
 
+// Alive returns true if Serf currently believes the endpoint is alive,
+// and the endpoint hasn't told us that it's going down.
+//
+// Only live endpoints are candidates for tunnels, since if Serf can't
+// reach an endpoint we expect that OpenVPN won't be able to either.
 func (e *Endpoint) Alive() bool {
-	return e.member.Status == serf.StatusAlive
+	return e.member.Status == serf.StatusAlive && !e.GoingDown()
 }
 
+// ExpectedAlive returns true unless the endpoint has gracefully left (or
+// is leaving) the cluster, or has told us that it's going down. Failed
+// endpoints are still expected to be alive, since we assume they will
+// return.
 func (e *Endpoint) ExpectedAlive() bool {
-	return e.member.Status != serf.StatusLeft && e.member.Status != serf.StatusLeaving
+	return e.member.Status != serf.StatusLeft && e.member.Status != serf.StatusLeaving && !e.GoingDown()
 }
 
+// GoingDown returns true if the endpoint has told us that it is about to
+// die without leaving gracefully. See lastwill.go.
+func (e *Endpoint) GoingDown() bool {
+	_, ok := e.member.Tags[lastWillTag]
+	return ok
+}
+
+// Address returns the endpoint's internal IP address, bound to the
+// cluster's addressing scheme.
 func (e *Endpoint) Address() Address {
 	return e.addr
 }
 
+// DestinationNetwork returns the network that traffic for the endpoint is
+// routed to, which is the network of its datacenter, or nil if it has no
+// address. See Address.DatacenterNetwork.
+func (e *Endpoint) DestinationNetwork() *net.IPNet {
+	return e.addr.DatacenterNetwork()
+}
+
+// ServedNetworks returns the networks that the endpoint advertises that it
+// serves in addition to its DestinationNetwork, so that we route them to it
+// as well. Any that don't parse, or that are of the wrong address family,
+// are ignored.
+func (e *Endpoint) ServedNetworks() []*net.IPNet {
+	return parseServedNetworks(e.member.Tags[servedNetworksTag], e.addr.bits())
+}
+
+// parseServedNetworks parses the value of the served_networks tag, keeping
+// only the networks with addresses of the given number of bits.
+func parseServedNetworks(raw string, bits int) []*net.IPNet {
+	if raw == "" {
+		return nil
+	}
+	var ret []*net.IPNet
+	for _, str := range strings.Split(raw, ",") {
+		_, network, err := net.ParseCIDR(str)
+		if err != nil {
+			continue
+		}
+		if _, networkBits := network.Mask.Size(); networkBits != bits {
+			continue
+		}
+		ret = append(ret, network)
+	}
+	return ret
+}
+
+// Observer returns true if the endpoint is an observer, which participates
+// in gossip but never runs tunnels and must never be used as a next-hop.
+func (e *Endpoint) Observer() bool {
+	_, ok := e.member.Tags["observer"]
+	return ok
+}
+
+// Hub returns true if the endpoint is a hub, which runs tunnels to all
+// other endpoints regardless of their topology. See topology.go.
+func (e *Endpoint) Hub() bool {
+	_, ok := e.member.Tags["hub"]
+	return ok
+}
+
+// Mode returns the mode the endpoint runs in. Endpoints that don't
+// advertise one are running in ModeFull. See mode.go.
+func (e *Endpoint) Mode() string {
+	if mode, ok := e.member.Tags[modeTag]; ok {
+		return mode
+	}
+	return ModeFull
+}
+
+// InstallsRoutes returns true if the endpoint installs routes, and so can
+// forward traffic for us as a fallback or hub.
+func (e *Endpoint) InstallsRoutes() bool {
+	return modeInstallsRoutes(e.Mode())
+}
+
+// Draining returns true if the endpoint is draining, in which case we
+// mustn't route through it or start new tunnels to it. See drain.go.
+func (e *Endpoint) Draining() bool {
+	_, ok := e.member.Tags[drainingTag]
+	return ok
+}
+
+// Topology returns the tunnel topology that the endpoint uses. Endpoints
+// that don't advertise one use TopologyMesh.
+func (e *Endpoint) Topology() string {
+	if topology, ok := e.member.Tags["topology"]; ok {
+		return topology
+	}
+	return TopologyMesh
+}
+
+// VPNCipher and VPNAuth return the OpenVPN data channel cipher and HMAC
+// digest that the endpoint advertises, or the empty string if it doesn't
+// advertise them.
+func (e *Endpoint) VPNCipher() string {
+	return e.member.Tags["vpn_cipher"]
+}
+
+func (e *Endpoint) VPNAuth() string {
+	return e.member.Tags["vpn_auth"]
+}
+
+// VPNCompression returns the tunnel compression algorithm that the
+// endpoint uses. Endpoints that don't advertise one don't compress.
+func (e *Endpoint) VPNCompression() string {
+	if compression, ok := e.member.Tags["vpn_compression"]; ok {
+		return compression
+	}
+	return CompressionOff
+}
+
+// VPNTransport returns the protocol that the endpoint prefers for its
+// tunnels. Endpoints that don't advertise one use UDP.
+func (e *Endpoint) VPNTransport() string {
+	if transport, ok := e.member.Tags["vpn_transport"]; ok {
+		return transport
+	}
+	return TransportUDP
+}
+
+// VPNKeyMode returns how the endpoint keys its tunnels. Endpoints that
+// don't advertise a mode use static keys.
+func (e *Endpoint) VPNKeyMode() string {
+	if mode, ok := e.member.Tags[vpnKeyModeTag]; ok {
+		return mode
+	}
+	return KeyModeStatic
+}
+
+// VPNTopology returns the topology of the endpoint's tunnel devices,
+// which must match ours. Endpoints that don't advertise one use
+// VPNTopologyP2P.
+func (e *Endpoint) VPNTopology() string {
+	if topology, ok := e.member.Tags[vpnTopologyTag]; ok {
+		return topology
+	}
+	return VPNTopologyP2P
+}
+
+// VPNPort returns the port that the endpoint advertises it uses for its
+// end of every tunnel, or zero if it uses the one derived from its
+// endpoint id. This is an escape hatch for hosts where the derived port
+// is already in use by something else.
+func (e *Endpoint) VPNPort() int {
+	port, err := strconv.Atoi(e.member.Tags[vpnPortTag])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0
+	}
+	return port
+}
+
+// VPNFragment returns the size that the endpoint fragments UDP tunnel
+// packets to, or zero if it doesn't fragment them. Both ends of a UDP
+// tunnel must agree on this.
+func (e *Endpoint) VPNFragment() int {
+	fragment, err := strconv.Atoi(e.member.Tags[vpnFragmentTag])
+	if err != nil || fragment < 0 {
+		return 0
+	}
+	return fragment
+}
+
+// VPNEndpointPorts returns the ports that the endpoint and the given
+// remote endpoint use for the tunnel between them, which are the ones
+// derived from their endpoint ids unless they advertise others. See
+// Address.VPNEndpointPorts.
+func (e *Endpoint) VPNEndpointPorts(remote *Endpoint) (int, int) {
+	localPort, remotePort := e.addr.VPNEndpointPorts(remote.Id())
+	if port := e.VPNPort(); port != 0 {
+		localPort = port
+	}
+	if port := remote.VPNPort(); port != 0 {
+		remotePort = port
+	}
+	return localPort, remotePort
+}
+
+// Tag returns the value of the given gossip tag for the endpoint, and
+// whether it is set at all. This is mainly for the arbitrary tags set by
+// the "tags" setting; the tags we set ourselves have their own accessors.
+func (e *Endpoint) Tag(key string) (string, bool) {
+	value, ok := e.member.Tags[key]
+	return value, ok
+}
+
+// PeerSelector returns the selector that the endpoint uses to choose the
+// endpoints it runs tunnels to. Endpoints that don't advertise one use an
+// empty selector, which selects every endpoint.
+func (e *Endpoint) PeerSelector() (PeerSelector, error) {
+	return ParsePeerSelector(e.member.Tags[peerSelectorTag])
+}
+
+// KeyGenerations returns the pre-shared key generations that the endpoint
+// holds. See keyring.go.
+func (e *Endpoint) KeyGenerations() []int {
+	return parseKeyGenerations(e.member.Tags[keyGenerationsTag])
+}
+
+// PairKeys returns the fingerprints of the region pair keys that the
+// endpoint holds for its own region, keyed by the other region of each
+// pair. See keyring.go.
+func (e *Endpoint) PairKeys() map[string]string {
+	return parsePairKeys(e.member.Tags[pairKeysTag])
+}
+
 func (e *Endpoint) RegionId() string {
 	return e.addr.RegionId()
 }
@@ -71,10 +386,18 @@ func (e *Endpoint) DatacenterId() string {
 	return e.addr.DatacenterId()
 }
 
+// Id returns the endpoint's id, which is derived from its internal
+// IP address. See Address.EndpointId for details.
 func (e *Endpoint) Id() EndpointId {
 	return e.addr.EndpointId()
 }
 
+// Coordinate returns the endpoint's Serf network coordinate, or nil if
+// we don't have one for it yet.
+func (e *Endpoint) Coordinate() *coordinate.Coordinate {
+	return e.coord
+}
+
 // DistanceTo returns the "round-trip distance" to/from the other
 // given endpoint.
 //
@@ -98,19 +421,41 @@ type EndpointId uint16
 
 const InvalidEndpointId EndpointId = 0xffff
 
+// String formats the id as three hexadecimal digits, which is the form
+// used throughout our logs, APIs and device names, or as "???" if it isn't
+// valid. ParseEndpointId is its inverse for valid ids.
 func (id EndpointId) String() string {
-	if id == InvalidEndpointId {
+	if !id.Valid() {
 		return "???"
 	} else {
 		return fmt.Sprintf("%03x", uint16(id))
 	}
 }
 
+// Valid returns true if the id is one that an endpoint can actually have,
+// which is any 10-bit number.
+func (id EndpointId) Valid() bool {
+	return id <= 0x3ff
+}
+
+// ParseEndpointId parses an endpoint id in the hexadecimal form that
+// String produces, so that ParseEndpointId(id.String()) returns id for
+// any valid id. Out of range values and the "???" that String produces
+// for invalid ids are rejected.
+func ParseEndpointId(s string) (EndpointId, error) {
+	id, err := strconv.ParseUint(s, 16, 16)
+	if err != nil || !EndpointId(id).Valid() {
+		return InvalidEndpointId, fmt.Errorf("invalid endpoint id %q: must be hex between 000 and 3ff", s)
+	}
+	return EndpointId(id), nil
+}
+
 // EndpointSet represents a set of endpoints -- or rather, of endpoint ids.
+// It is mainly used to find the difference between the current state and
+// the desired state, as the first step towards implementing the latter.
 //
-// This is just a utility used to easily recognize the difference between
-// the current state and the desired state, as the first step towards
-// implementing the desired state.
+// Add and Remove change the set in place, while Union, Intersect and
+// Subtract return new sets, leaving their operands unchanged.
 type EndpointSet map[EndpointId]struct{}
 
 func (s EndpointSet) Add(id EndpointId) {
@@ -125,7 +470,7 @@ func (s EndpointSet) Remove(id EndpointId) {
 	delete(s, id)
 }
 
-func (s EndpointSet) Has(id EndpointId) bool {
+func (s EndpointSet) Contains(id EndpointId) bool {
 	_, ok := s[id]
 	return ok
 }
@@ -143,14 +488,50 @@ func (s EndpointSet) Union(other EndpointSet) EndpointSet {
 	return ret
 }
 
+// Intersect returns the ids that are in both the receiver and the other set.
+func (s EndpointSet) Intersect(other EndpointSet) EndpointSet {
+	ret := make(EndpointSet)
+
+	for k := range s {
+		if other.Contains(k) {
+			ret.Add(k)
+		}
+	}
+
+	return ret
+}
+
+// Subtract returns the ids in the receiver that are not in the other set.
 func (s EndpointSet) Subtract(other EndpointSet) EndpointSet {
 	ret := make(EndpointSet, len(s))
 
 	for k, _ := range s {
-		if !other.Has(k) {
+		if !other.Contains(k) {
 			ret.Add(k)
 		}
 	}
 
 	return ret
 }
+
+// Sorted returns the ids in the set in ascending order, which is useful
+// for producing stable log output.
+func (s EndpointSet) Sorted() []EndpointId {
+	ret := make([]EndpointId, 0, len(s))
+	for k := range s {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i] < ret[j]
+	})
+	return ret
+}
+
+func (s EndpointSet) String() string {
+	ids := s.Sorted()
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return "{" + strings.Join(strs, ", ") + "}"
+}
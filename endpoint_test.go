@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newEndpointSet(ids ...EndpointId) EndpointSet {
+	ret := make(EndpointSet)
+	for _, id := range ids {
+		ret.Add(id)
+	}
+	return ret
+}
+
+func TestEndpointSetAddRemove(t *testing.T) {
+	s := newEndpointSet(1, 2)
+	s.Add(3)
+	s.Add(2)
+	s.Add(InvalidEndpointId)
+	s.Remove(1)
+	s.Remove(5)
+
+	if got, want := s.Sorted(), []EndpointId{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s; want %s", got, want)
+	}
+	if !s.Contains(3) || s.Contains(1) || s.Contains(InvalidEndpointId) {
+		t.Errorf("wrong membership: %s", s)
+	}
+}
+
+func TestEndpointSetOperations(t *testing.T) {
+	a := newEndpointSet(1, 2, 3)
+	b := newEndpointSet(3, 4)
+
+	tests := []struct {
+		name string
+		got  EndpointSet
+		want []EndpointId
+	}{
+		{"union", a.Union(b), []EndpointId{1, 2, 3, 4}},
+		{"intersect", a.Intersect(b), []EndpointId{3}},
+		{"subtract", a.Subtract(b), []EndpointId{1, 2}},
+		{"reverse subtract", b.Subtract(a), []EndpointId{4}},
+		{"subtract self", a.Subtract(a), []EndpointId{}},
+		{"intersect empty", a.Intersect(EndpointSet{}), []EndpointId{}},
+		{"union empty", EndpointSet{}.Union(b), []EndpointId{3, 4}},
+	}
+	for _, test := range tests {
+		if got := test.got.Sorted(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %s; want %s", test.name, got, test.want)
+		}
+	}
+
+	// None of them may change their operands.
+	if got := a.Sorted(); !reflect.DeepEqual(got, []EndpointId{1, 2, 3}) {
+		t.Errorf("a changed to %s", got)
+	}
+	if got := b.Sorted(); !reflect.DeepEqual(got, []EndpointId{3, 4}) {
+		t.Errorf("b changed to %s", got)
+	}
+}
+
+// TestEndpointSetTunnelDiff checks the set arithmetic that reconcile uses
+// to decide which tunnels to start and close.
+func TestEndpointSetTunnelDiff(t *testing.T) {
+	live := newEndpointSet(1, 2, 3)
+	got := newEndpointSet(2, 3, 4, 5)
+	exiting := newEndpointSet(5)
+
+	add := live.Subtract(got)
+	del := got.Subtract(live).Subtract(exiting)
+
+	if want := []EndpointId{1}; !reflect.DeepEqual(add.Sorted(), want) {
+		t.Errorf("add %s; want %s", add.Sorted(), want)
+	}
+	if want := []EndpointId{4}; !reflect.DeepEqual(del.Sorted(), want) {
+		t.Errorf("del %s; want %s", del.Sorted(), want)
+	}
+}
+
+func TestEndpointSetString(t *testing.T) {
+	if got, want := newEndpointSet(0x3f, 0x001, 0x2a0).String(), "{001, 03f, 2a0}"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := (EndpointSet{}).String(), "{}"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestEndpointIdRoundTrip(t *testing.T) {
+	for id := EndpointId(0x000); id <= 0x3ff; id++ {
+		s := id.String()
+		if len(s) != 3 {
+			t.Errorf("id %d formats as %q; want three digits", uint16(id), s)
+		}
+		got, err := ParseEndpointId(s)
+		if err != nil || got != id {
+			t.Errorf("ParseEndpointId(%q) = %s, %v; want %d", s, got, err, uint16(id))
+		}
+	}
+
+	if got := InvalidEndpointId.String(); got != "???" {
+		t.Errorf("InvalidEndpointId formats as %q; want ???", got)
+	}
+	for _, s := range []string{"???", "400", InvalidEndpointId.String(), "ffff", "", "-1", "g00"} {
+		if got, err := ParseEndpointId(s); err == nil {
+			t.Errorf("ParseEndpointId(%q) = %s; want an error", s, got)
+		} else if got != InvalidEndpointId {
+			t.Errorf("ParseEndpointId(%q) failed but returned %d; want InvalidEndpointId", s, uint16(got))
+		}
+	}
+}
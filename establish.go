@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+)
+
+// This file times how long each tunnel takes to come up, from when we
+// first try to start it until it reaches VPNConnected, so that an operator
+// can tell when a tunnel is slow to come up.
+//
+// The per-connect timeout within StartOpenVPN and the notifications for
+// critical tunnels (see notify.go) each cover only part of this: a tunnel
+// can fail to start several times over, spending a while in backoff each
+// time, without ever reaching VPNRetrying. The establishment SLA instead
+// covers the whole journey, including any retries, and the timer is
+// stopped only once the tunnel connects or we stop wanting it.
+
+// DefaultTunnelEstablishSLA is the tunnel_establish_sla we use when it
+// isn't set.
+const DefaultTunnelEstablishSLA = 60 * time.Second
+
+// establishment tracks a tunnel that we have tried to start but that
+// hasn't yet connected. slow is set once it has exceeded the SLA.
+type establishment struct {
+	since time.Time
+	timer *time.Timer
+	slow  bool
+}
+
+// beginEstablishing starts the SLA timer for the tunnel to the given
+// endpoint, unless it is already running or the SLA is disabled. The
+// caller must hold the lock.
+func (m *TunnelMgr) beginEstablishing(endpointId EndpointId) {
+	if m.establishSLA <= 0 || m.establishing[endpointId] != nil {
+		return
+	}
+	e := &establishment{since: time.Now()}
+	e.timer = time.AfterFunc(m.establishSLA, func() {
+		m.establishSLAExpired(endpointId, e)
+	})
+	m.establishing[endpointId] = e
+}
+
+// establishSLAExpired reports that the given tunnel has taken longer than
+// the SLA to connect, unless it has connected or been abandoned since the
+// timer fired.
+func (m *TunnelMgr) establishSLAExpired(endpointId EndpointId, e *establishment) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.establishing[endpointId] != e {
+		return
+	}
+	e.slow = true
+	logger.Warnf("Tunnel to endpoint %s has not connected within %s of being started", endpointId, m.establishSLA)
+	m.metrics.Add(metricTunnelSlowStarts, 1, "endpoint_id", endpointId.String())
+	m.notify()
+}
+
+// endEstablishing stops the SLA timer for the tunnel to the given
+// endpoint, because it has connected or we no longer want it. The caller
+// must hold the lock.
+func (m *TunnelMgr) endEstablishing(endpointId EndpointId) {
+	e := m.establishing[endpointId]
+	if e == nil {
+		return
+	}
+	e.timer.Stop()
+	delete(m.establishing, endpointId)
+	if e.slow {
+		logger.Infof("Stopped timing slow tunnel to endpoint %s after %s", endpointId, time.Since(e.since).Round(time.Second))
+	}
+}
+
+// PruneEstablishing stops the SLA timer for any endpoint not in the given
+// set, so that tunnels we stopped wanting while they were waiting to
+// retry aren't reported as slow.
+func (m *TunnelMgr) PruneEstablishing(keep EndpointSet) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for endpointId := range m.establishing {
+		if !keep.Contains(endpointId) {
+			m.endEstablishing(endpointId)
+		}
+	}
+}
+
+// slowStarts returns when each tunnel that has exceeded the SLA was first
+// started. The caller must hold the lock.
+func (m *TunnelMgr) slowStarts() map[EndpointId]time.Time {
+	ret := make(map[EndpointId]time.Time)
+	for endpointId, e := range m.establishing {
+		if e.slow {
+			ret[endpointId] = e.since
+		}
+	}
+	return ret
+}
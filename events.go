@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// eventSubscriberBuffer is the number of events that can be queued for
+// a subscriber before we start dropping events for it.
+const eventSubscriberBuffer = 32
+
+// stateEvent describes a change to the cluster or tunnel state, for
+// consumption by subscribers to the /events HTTP endpoint.
+type stateEvent struct {
+	// Type is either "cluster" or "tunnels".
+	Type        string   `json:"type"`
+	EndpointIds []string `json:"endpoint_ids"`
+	Time        string   `json:"time"`
+}
+
+func newStateEvent(eventType string, endpointIds EndpointSet) *stateEvent {
+	ids := endpointIds.Sorted()
+	ret := &stateEvent{
+		Type:        eventType,
+		EndpointIds: make([]string, len(ids)),
+		Time:        time.Now().Format(time.RFC3339),
+	}
+	for i, id := range ids {
+		ret.EndpointIds[i] = id.String()
+	}
+	return ret
+}
+
+// eventBroker fans out state events to any number of subscribers.
+//
+// Publishing never blocks: if a subscriber isn't keeping up then events
+// are dropped for that subscriber, so a slow HTTP client can't hold up
+// the manager.
+type eventBroker struct {
+	lock        sync.Mutex
+	subscribers map[chan *stateEvent]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subscribers: make(map[chan *stateEvent]struct{}),
+	}
+}
+
+// Subscribe returns a channel on which future events will be delivered.
+// The caller must pass it to Unsubscribe once it's no longer reading it.
+func (b *eventBroker) Subscribe() chan *stateEvent {
+	ch := make(chan *stateEvent, eventSubscriberBuffer)
+	b.lock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+	return ch
+}
+
+func (b *eventBroker) Unsubscribe(ch chan *stateEvent) {
+	b.lock.Lock()
+	delete(b.subscribers, ch)
+	b.lock.Unlock()
+}
+
+func (b *eventBroker) Publish(event *stateEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			logger.Debugf("Dropped %s event for a slow subscriber", event.Type)
+		}
+	}
+}
+
+// changedTunnels returns the ids of the endpoints whose tunnels were added,
+// removed or changed state between the two given tunnel states.
+func changedTunnels(prev, current *TunnelsState) EndpointSet {
+	prevStates := make(map[EndpointId]VPNState)
+	if prev != nil {
+		for _, tunnel := range prev.Tunnels {
+			prevStates[tunnel.EndpointId] = tunnel.State
+		}
+	}
+
+	ret := make(EndpointSet)
+	for _, tunnel := range current.Tunnels {
+		state, existed := prevStates[tunnel.EndpointId]
+		if !existed || state != tunnel.State {
+			ret.Add(tunnel.EndpointId)
+		}
+		delete(prevStates, tunnel.EndpointId)
+	}
+	for id := range prevStates {
+		ret.Add(id)
+	}
+	return ret
+}
+
+// changedEndpoints returns the ids of all of the endpoints mentioned in
+// the given delta.
+func changedEndpoints(delta ClusterDelta) EndpointSet {
+	ret := make(EndpointSet)
+	for _, endpoints := range [][]*Endpoint{delta.Added, delta.Removed, delta.Changed} {
+		for _, endpoint := range endpoints {
+			ret.Add(endpoint.Id())
+		}
+	}
+	return ret
+}
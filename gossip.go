@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/memberlist"
@@ -10,9 +17,53 @@ import (
 )
 
 type Gossip struct {
+	// snapshotErrors is accessed atomically, so it comes first to keep
+	// it 64-bit aligned. See SnapshotErrors.
+	snapshotErrors int64
+
 	config      *GossipConfig
-	serf        *serf.Serf
 	latestState *ClusterState
+
+	// serf is the Serf instance, which Start replaces if it rebinds. It
+	// is left in place once Start returns, so that callers still see its
+	// last view of the cluster. Guarded by serfLock; see current.
+	serfLock sync.RWMutex
+	serf     *serf.Serf
+
+	// tagsLock serializes changes to our tags, and guards config.Tags
+	// and config.ListenIPAddr, which Start uses to re-create Serf with
+	// the same tags when it rebinds. See SetTag.
+	tagsLock sync.Mutex
+
+	// changeCh carries cluster states to whoever is watching them. See
+	// Changes.
+	changeCh chan *ClusterState
+
+	// rebindCh carries requests from Rebind to Start.
+	rebindCh chan string
+
+	// warnedUnknown maps the name of each member that we've warned has
+	// an unusable "int_ip" tag to the tag's value at the time, so that
+	// we warn again only if it changes. See warnUnknown.
+	warnedLock    sync.Mutex
+	warnedUnknown map[string]string
+
+	// notedSuppressed maps the name of each member that we've logged as
+	// stale to its status at the time, so that we log again only if it
+	// changes. Also guarded by warnedLock. See noteSuppressed.
+	notedSuppressed map[string]serf.MemberStatus
+
+	// warnedDuplicates maps each endpoint id that we've warned is claimed
+	// by several members to their names at the time, so that we warn
+	// again only if they change. Also guarded by warnedLock. See
+	// warnDuplicates.
+	warnedDuplicates map[EndpointId]string
+
+	// failures records, for each endpoint, the times at which Serf
+	// reported it failed within the last stabilityWindow. See
+	// RecentFailures. Guarded by failuresLock.
+	failuresLock sync.Mutex
+	failures     map[EndpointId][]time.Time
 }
 
 type GossipConfig struct {
@@ -21,85 +72,685 @@ type GossipConfig struct {
 	AdvertiseIPAddr string
 	Port            int
 	DataDir         string
-	Addressing      *Addressing
+
+	// PortRange is the number of additional ports above Port that we may
+	// bind to if Port itself is in use. BindRetries is the number of times
+	// we will retry the whole range, with exponential backoff, before
+	// giving up.
+	PortRange   int
+	BindRetries int
+
+	Addressing *Addressing
+
+	// Observer, if set, advertises this node as an observer so that
+	// other nodes will never tunnel or route through it.
+	Observer bool
+
+	// Keyring, if set, enables gossip encryption using its keys. If
+	// KeyringFile is also set then Serf saves any changes to the keyring
+	// that it receives from the cluster to that file.
+	Keyring     *memberlist.Keyring
+	KeyringFile string
+
+	// Tags are additional tags to advertise alongside the ones that
+	// are derived from the settings above.
+	Tags map[string]string
+
+	// Profile is the memberlist profile whose defaults we use, and
+	// Timings, if set, overrides its failure detection timings. See
+	// memberlistProfile.
+	Profile string
+	Timings *GossipTimings
+
+	// Audit, if set, is where we record changes to the membership. See
+	// audit.go.
+	Audit *auditLog
+}
+
+// The supported values of the gossip_profile setting, each of which selects
+// memberlist's defaults for a kind of network. The LAN and local profiles
+// detect failures and spread changes much faster than the WAN profile, but
+// expect the low latency of a single datacenter or a single host
+// respectively.
+const (
+	GossipProfileLAN   = "lan"
+	GossipProfileWAN   = "wan"
+	GossipProfileLocal = "local"
+)
+
+// DefaultGossipProfile is the profile we use if gossip_profile isn't set,
+// since our clusters usually span datacenters.
+const DefaultGossipProfile = GossipProfileWAN
+
+// memberlistProfile returns memberlist's default configuration for the
+// given profile, or for DefaultGossipProfile if it is empty.
+func memberlistProfile(profile string) *memberlist.Config {
+	switch profile {
+	case GossipProfileLAN:
+		return memberlist.DefaultLANConfig()
+	case GossipProfileLocal:
+		return memberlist.DefaultLocalConfig()
+	default:
+		return memberlist.DefaultWANConfig()
+	}
+}
+
+// GossipTimings control how quickly memberlist decides that a member has
+// failed.
+//
+// Each member probes another every ProbeInterval, and one that doesn't
+// answer within ProbeTimeout, even indirectly, becomes suspect. A suspect
+// member is declared failed unless it refutes the suspicion within
+// SuspicionMult * ceil(log10(N+1)) probe intervals, where N is the number
+// of members. With the defaults of the WAN profile that is at least 30
+// seconds, on top of the time it takes for some member to probe it.
+//
+// Until an endpoint is declared failed we keep routing through our
+// tunnel to it, which by then will usually have gone critical after two
+// keepalive timeouts (see DefaultKeepaliveInterval). Shorter timings
+// route around a dead endpoint sooner, but make it more likely that a
+// congested link gets a healthy endpoint declared failed.
+type GossipTimings struct {
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	SuspicionMult int
 }
 
 func NewGossip(config *GossipConfig) *Gossip {
 	return &Gossip{
-		config: config,
+		config:           config,
+		changeCh:         make(chan *ClusterState, 1),
+		rebindCh:         make(chan string, 1),
+		warnedUnknown:    make(map[string]string),
+		notedSuppressed:  make(map[string]serf.MemberStatus),
+		warnedDuplicates: make(map[EndpointId]string),
+		failures:         make(map[EndpointId][]time.Time),
 	}
 }
 
+// Started returns true if Serf is running.
 func (g *Gossip) Started() bool {
-	return g.serf != nil
+	s := g.current()
+	return s != nil && s.State() != serf.SerfShutdown
+}
+
+// current returns the Serf instance, or nil if Start hasn't yet created
+// it.
+func (g *Gossip) current() *serf.Serf {
+	g.serfLock.RLock()
+	defer g.serfLock.RUnlock()
+	return g.serf
+}
+
+// setCurrent replaces the Serf instance returned by current.
+func (g *Gossip) setCurrent(s *serf.Serf) {
+	g.serfLock.Lock()
+	defer g.serfLock.Unlock()
+	g.serf = s
 }
 
 // Start causes the gossip pool to be started and then starts processing
-// events for it, emitting cluster state instances on the provided
-// channel each time the cluster changes.
+// events for it, emitting cluster state instances on the channel returned
+// by Changes each time the cluster changes.
 //
 // This function returns only once we have left the gossip pool, so it
-// should usually be run in a separate goroutine.
-func (g *Gossip) Start(changeCh chan *ClusterState) error {
-	if g.serf != nil {
+// should usually be run in a separate goroutine. That happens when Stop
+// is called, when Serf shuts down for any other reason, when the given
+// context is cancelled, in which case we leave gracefully as Stop does,
+// or when we fail to restart Serf after Rebind, in which case the error
+// is returned.
+func (g *Gossip) Start(ctx context.Context) error {
+	if g.current() != nil {
 		// should never happen
 		panic("gossip alread started")
 	}
 
+	eventCh := make(chan serf.Event, 512)
+	g.tagsLock.Lock()
+	s, err := g.create(eventCh)
+	g.tagsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	shutdownCh := s.ShutdownCh()
+
+	g.setCurrent(s)
+
+	for {
+		select {
+
+		case e := <-eventCh:
+			logger.Debugf("recieved event %s", e)
+			g.auditMembers(e)
+			g.recordFailures(e)
+			g.publish(g.refreshState())
+
+		case ipAddr := <-g.rebindCh:
+			// We don't leave, since we'll be back as soon as we've
+			// started again. current keeps returning the old instance
+			// until then, so that callers see its last state rather
+			// than nothing. We hold tagsLock throughout so that any
+			// tags set in the meantime aren't lost.
+			logger.Infof("Restarting gossip on %s", ipAddr)
+			g.tagsLock.Lock()
+			err := s.Shutdown()
+			if err != nil {
+				logger.Warnf("failed to shut down serf: %s", err)
+			}
+			g.config.ListenIPAddr = ipAddr
+			eventCh = make(chan serf.Event, 512)
+			newSerf, err := g.create(eventCh)
+			if err != nil {
+				g.tagsLock.Unlock()
+				return fmt.Errorf("failed to restart gossip on %s: %s", ipAddr, err)
+			}
+			s = newSerf
+			shutdownCh = s.ShutdownCh()
+			g.setCurrent(s)
+			g.tagsLock.Unlock()
+			g.publish(g.refreshState())
+
+		case <-shutdownCh:
+			logger.Infof("serf is shutting down")
+			return nil
+
+		case <-ctx.Done():
+			logger.Infof("gossip cancelled: %s", ctx.Err())
+			return leaveAndShutdown(context.Background(), s)
+
+		}
+	}
+
+}
+
+// Rebind asks Start to restart Serf bound to the given address, which
+// also becomes our "int_ip" tag. This is for when the address we were
+// using has gone away; see Manager.checkLocalAddr.
+//
+// Serf rejoins the members in its snapshot when it starts, but they won't
+// accept our new address until they've declared the old one dead, so it
+// may take a while and some retries of the join before we're back.
+func (g *Gossip) Rebind(ipAddr string) {
+	for {
+		select {
+		case g.rebindCh <- ipAddr:
+			return
+		default:
+		}
+
+		// Only the newest address matters.
+		select {
+		case <-g.rebindCh:
+		default:
+		}
+	}
+}
+
+// create creates a Serf instance with our settings, delivering its events
+// on the given channel. tagsLock must be held.
+func (g *Gossip) create(eventCh chan serf.Event) (*serf.Serf, error) {
 	config := g.config
 
 	serfConfig := serf.DefaultConfig()
-	serfConfig.MemberlistConfig = memberlist.DefaultWANConfig()
+	profile := config.Profile
+	if profile == "" {
+		profile = DefaultGossipProfile
+	}
+	logger.Infof("Using the %s gossip profile", profile)
+
+	// Everything we set below applies on top of the profile's defaults.
+	serfConfig.MemberlistConfig = memberlistProfile(profile)
+
+	port, err := g.choosePort()
+	if err != nil {
+		return nil, err
+	}
 
+	// Memberlist shares the advertised port with other members, so
+	// peers will find us on whichever port we ended up using.
 	serfConfig.MemberlistConfig.BindAddr = config.ListenIPAddr
-	serfConfig.MemberlistConfig.BindPort = config.Port
+	serfConfig.MemberlistConfig.BindPort = port
 	serfConfig.MemberlistConfig.AdvertiseAddr = config.AdvertiseIPAddr
-	serfConfig.MemberlistConfig.AdvertisePort = config.Port
-	serfConfig.NodeName = config.NodeName
-	serfConfig.Tags = map[string]string{
-		"int_ip": config.ListenIPAddr,
+	serfConfig.MemberlistConfig.AdvertisePort = port
+	serfConfig.MemberlistConfig.Keyring = config.Keyring
+	if timings := config.Timings; timings != nil {
+		serfConfig.MemberlistConfig.ProbeInterval = timings.ProbeInterval
+		serfConfig.MemberlistConfig.ProbeTimeout = timings.ProbeTimeout
+		serfConfig.MemberlistConfig.SuspicionMult = timings.SuspicionMult
+	}
+	if config.Keyring != nil {
+		serfConfig.KeyringFile = config.KeyringFile
 	}
+	serfConfig.NodeName = config.NodeName
+	serfConfig.Tags = g.tags()
 	serfConfig.SnapshotPath = config.DataDir
+	serfConfig.LogOutput = &snapshotErrorWatcher{out: os.Stderr, gossip: g}
 	serfConfig.CoalescePeriod = 3 * time.Second
 	serfConfig.QuiescentPeriod = time.Second
 	serfConfig.UserCoalescePeriod = 3 * time.Second
 	serfConfig.UserQuiescentPeriod = time.Second
 	serfConfig.EnableNameConflictResolution = true
 	serfConfig.RejoinAfterLeave = true
-
-	eventCh := make(chan serf.Event, 512)
 	serfConfig.EventCh = eventCh
 
-	log.Println("starting serf...")
-	serf, err := serf.Create(serfConfig)
+	err = waitForSnapshotPath(serfConfig.SnapshotPath)
 	if err != nil {
-		return fmt.Errorf("error initalizing serf gossip: %s", err)
+		return nil, err
 	}
 
-	shutdownCh := serf.ShutdownCh()
+	logger.Infof("starting serf...")
+	s, err := serf.Create(serfConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error initalizing serf gossip: %s", err)
+	}
 
-	g.serf = serf
+	// A configured key that somehow didn't take effect would leave our
+	// gossip in cleartext without any other sign of a problem, so we
+	// refuse to continue in that case.
+	if config.Keyring != nil && !s.EncryptionEnabled() {
+		s.Shutdown()
+		return nil, fmt.Errorf("a gossip encryption key is configured, but gossip encryption is not enabled")
+	}
+	if s.EncryptionEnabled() {
+		logger.Infof("gossip encryption is enabled")
+	} else {
+		logger.Warnf("gossip encryption is not enabled, so gossip traffic will be sent in cleartext")
+	}
+
+	return s, nil
+}
 
+// tags returns the tags we advertise: config.Tags, along with the ones
+// derived from our other settings. tagsLock must be held.
+func (g *Gossip) tags() map[string]string {
+	config := g.config
+	tags := make(map[string]string, len(config.Tags)+2)
+	for k, v := range config.Tags {
+		tags[k] = v
+	}
+	tags["int_ip"] = config.ListenIPAddr
+	if config.Observer {
+		tags["observer"] = "1"
+	}
+	return tags
+}
+
+// auditMembers records the membership changes in the given event, if
+// it is a member event, in the audit log.
+func (g *Gossip) auditMembers(e serf.Event) {
+	me, ok := e.(serf.MemberEvent)
+	if !ok || g.config.Audit == nil {
+		return
+	}
+	for i := range me.Members {
+		member := &me.Members[i]
+		g.config.Audit.MemberEvent(member.Name, newEndpoint(g, member).Id(), me.Type.String())
+	}
+}
+
+// recordFailures records the failures in the given event, if it is a
+// member failure event. See RecentFailures.
+func (g *Gossip) recordFailures(e serf.Event) {
+	me, ok := e.(serf.MemberEvent)
+	if !ok || me.Type != serf.EventMemberFailed {
+		return
+	}
+	g.failuresLock.Lock()
+	defer g.failuresLock.Unlock()
+
+	now := time.Now()
+	for i := range me.Members {
+		endpointId := newEndpoint(g, &me.Members[i]).Id()
+		if !endpointId.Valid() {
+			continue
+		}
+		g.failures[endpointId] = append(recentTimes(g.failures[endpointId], now.Add(-stabilityWindow)), now)
+	}
+}
+
+// RecentFailures returns, for each endpoint that Serf has reported as
+// failed within the last stabilityWindow, the number of times it has
+// done so. Unlike TunnelMgr.RecentDrops, this covers the endpoints in our
+// own region, to which we have no tunnels.
+func (g *Gossip) RecentFailures() map[EndpointId]int {
+	g.failuresLock.Lock()
+	defer g.failuresLock.Unlock()
+
+	since := time.Now().Add(-stabilityWindow)
+	ret := make(map[EndpointId]int)
+	for endpointId, failures := range g.failures {
+		recent := recentTimes(failures, since)
+		if len(recent) == 0 {
+			delete(g.failures, endpointId)
+			continue
+		}
+		g.failures[endpointId] = recent
+		ret[endpointId] = len(recent)
+	}
+	return ret
+}
+
+// Changes returns the channel on which Start delivers cluster states.
+//
+// Only the latest state is kept: if the previous one hasn't been received
+// by the time the cluster changes again then it is replaced, so that a
+// slow reader can never hold up our processing of Serf's events. The
+// reader may therefore miss intermediate states, but it will always
+// eventually receive the newest one.
+func (g *Gossip) Changes() <-chan *ClusterState {
+	return g.changeCh
+}
+
+// publish delivers the given state on changeCh without blocking,
+// replacing any earlier state that hasn't yet been received. It must be
+// called only by Start's event loop, so that states are delivered in the
+// order they were produced.
+func (g *Gossip) publish(state *ClusterState) {
 	for {
 		select {
+		case g.changeCh <- state:
+			return
+		default:
+		}
 
-		case e := <-eventCh:
-			log.Printf("recieved event %s", e)
-			newState := g.refreshState()
-			changeCh <- newState
+		// The buffer is full, so discard the stale state that's in
+		// it. The reader might beat us to it, so this mustn't block.
+		select {
+		case <-g.changeCh:
+		default:
+		}
+	}
+}
 
-		case <-shutdownCh:
-			log.Println("serf is shutting down")
-			g.serf = nil
-			return nil
+// Stop gracefully departs the gossip pool, so that other members will
+// see that we left rather than that we failed, and then shuts down Serf,
+// which makes Start return. If the given context is done before we've
+// finished leaving then Serf is shut down anyway.
+func (g *Gossip) Stop(ctx context.Context) error {
+	s := g.current()
+	if s == nil {
+		return fmt.Errorf("gossip not started")
+	}
+	return leaveAndShutdown(ctx, s)
+}
+
+// leaveAndShutdown is the implementation of Stop.
+func leaveAndShutdown(ctx context.Context, s *serf.Serf) error {
+	leaveErrCh := make(chan error, 1)
+	go func() {
+		leaveErrCh <- s.Leave()
+	}()
+
+	var leaveErr error
+	select {
+	case leaveErr = <-leaveErrCh:
+	case <-ctx.Done():
+		leaveErr = ctx.Err()
+	}
+	if leaveErr != nil {
+		leaveErr = fmt.Errorf("failed to leave gracefully: %s", leaveErr)
+	}
+
+	err := s.Shutdown()
+	if err != nil {
+		return fmt.Errorf("failed to shut down serf: %s", err)
+	}
+	return leaveErr
+}
+
+// choosePort finds a port in the configured range that we are able to
+// bind to, retrying with backoff in case a previous instance of this
+// program is still holding its port while exiting.
+//
+// We probe the ports ourselves rather than just retrying serf.Create,
+// because a failed serf.Create can leave its snapshotter running.
+func (g *Gossip) choosePort() (int, error) {
+	config := g.config
+	firstPort := config.Port
+	lastPort := config.Port + config.PortRange
+
+	delay := time.Second
+	var lastErr error
+	for attempt := 0; attempt <= config.BindRetries; attempt++ {
+		if attempt > 0 {
+			logger.Warnf("no gossip port is available (%s); retrying in %s", lastErr, delay)
+			time.Sleep(delay)
+			delay = delay * 2
+		}
+
+		for port := firstPort; port <= lastPort; port++ {
+			lastErr = probePort(config.ListenIPAddr, port)
+			if lastErr == nil {
+				if port != config.Port {
+					logger.Warnf("gossip port %d is in use, so using port %d instead", config.Port, port)
+				}
+				return port, nil
+			}
+			logger.Debugf("can't use gossip port %d: %s", port, lastErr)
+		}
+	}
+
+	if firstPort == lastPort {
+		return 0, fmt.Errorf("gossip port %d is not available: %s", firstPort, lastErr)
+	}
+	return 0, fmt.Errorf("no gossip port between %d and %d is available: %s", firstPort, lastPort, lastErr)
+}
+
+// probePort checks whether we can bind to both the TCP and UDP port of the
+// given number, as memberlist will need to.
+func probePort(ipAddr string, port int) error {
+	addr := net.JoinHostPort(ipAddr, strconv.Itoa(port))
 
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer tcpListener.Close()
+
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return udpConn.Close()
+}
+
+// Join attempts to contact the given peers in order to join their gossip
+// pool, returning the number of peers successfully contacted.
+//
+// As well as literal addresses, each peer may be given as "dns:name" or
+// "dns:name:port" to use all of the addresses that name resolves to, or as
+// "srv:name" to use the targets and ports of the SRV records for name.
+// These are resolved on each call, so that a set of seeds that has been
+// completely replaced will still be found.
+func (g *Gossip) Join(peers []string) (int, error) {
+	addrs, err := resolvePeers(peers)
+	if err != nil && len(addrs) == 0 {
+		return 0, err
+	}
+	if err != nil {
+		// We have some addresses, so we'll try those anyway.
+		logger.Warnf("%s", err)
+	}
+	s := g.current()
+	if s == nil {
+		return 0, fmt.Errorf("gossip not started")
+	}
+	return s.Join(addrs, false)
+}
+
+// resolvePeers expands any DNS-based peer entries (see Join) into
+// addresses. Errors resolving individual entries are combined into the
+// returned error, but don't prevent the others from being returned.
+func resolvePeers(peers []string) ([]string, error) {
+	var addrs []string
+	var errs []string
+
+	for _, peer := range peers {
+		switch {
+		case strings.HasPrefix(peer, "dns:"):
+			name := strings.TrimPrefix(peer, "dns:")
+			port := ""
+			if host, p, err := net.SplitHostPort(name); err == nil {
+				name, port = host, p
+			}
+			hosts, err := net.LookupHost(name)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("failed to resolve %s: %s", peer, err))
+				continue
+			}
+			for _, host := range hosts {
+				if port != "" {
+					host = net.JoinHostPort(host, port)
+				} else {
+					host = bracketIPv6(host)
+				}
+				addrs = append(addrs, host)
+			}
+
+		case strings.HasPrefix(peer, "srv:"):
+			name := strings.TrimPrefix(peer, "srv:")
+			_, records, err := net.LookupSRV("", "", name)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("failed to resolve %s: %s", peer, err))
+				continue
+			}
+			for _, record := range records {
+				host := strings.TrimSuffix(record.Target, ".")
+				addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+			}
+
+		default:
+			addrs = append(addrs, bracketIPv6(peer))
 		}
 	}
 
+	if len(errs) > 0 {
+		return addrs, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return addrs, nil
 }
 
-func (g *Gossip) Join(addrs []string) (int, error) {
-	return g.serf.Join(addrs, false)
+// bracketIPv6 wraps a bare IPv6 address in square brackets, as in a URL.
+// Memberlist takes everything after the last colon of a join address as
+// its port unless that colon is inside brackets, so it would otherwise
+// misread the address. Anything else is returned unchanged.
+func bracketIPv6(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return "[" + addr + "]"
+	}
+	return addr
+}
+
+// Leave gracefully departs the gossip pool, so that other members will
+// see that we left rather than that we failed.
+func (g *Gossip) Leave() error {
+	s := g.current()
+	if s == nil {
+		return fmt.Errorf("gossip not started")
+	}
+	return s.Leave()
+}
+
+// NumMembers returns the number of members of the gossip pool that we
+// know about, including ourselves.
+func (g *Gossip) NumMembers() int {
+	s := g.current()
+	if s == nil {
+		return 0
+	}
+	return s.NumNodes()
+}
+
+// SetTag changes the value of one of the tags we advertise to the
+// other members.
+//
+// The tag is also recorded in our configuration, so that we keep
+// advertising it if Start has to re-create Serf. See Rebind.
+func (g *Gossip) SetTag(name, value string) error {
+	g.tagsLock.Lock()
+	defer g.tagsLock.Unlock()
+	s := g.current()
+	if s == nil {
+		return fmt.Errorf("gossip not started")
+	}
+
+	if g.config.Tags == nil {
+		g.config.Tags = make(map[string]string)
+	}
+	g.config.Tags[name] = value
+	return s.SetTags(g.tags())
+}
+
+// RemoveTag stops advertising one of our tags to the other members.
+func (g *Gossip) RemoveTag(name string) error {
+	g.tagsLock.Lock()
+	defer g.tagsLock.Unlock()
+	s := g.current()
+	if s == nil {
+		return fmt.Errorf("gossip not started")
+	}
+
+	delete(g.config.Tags, name)
+	return s.SetTags(g.tags())
+}
+
+// UpdateKeys changes the gossip encryption keys across the whole cluster
+// so that they match the given keys: new keys are installed, the primary
+// key is changed if necessary, and any other keys are removed.
+func (g *Gossip) UpdateKeys(keys *GossipKeys) error {
+	s := g.current()
+	if s == nil {
+		return fmt.Errorf("gossip not started")
+	}
+	keyring := g.config.Keyring
+	if keyring == nil || keys == nil {
+		if keyring == nil && keys == nil {
+			return nil
+		}
+		return fmt.Errorf("gossip encryption can only be enabled or disabled by restarting")
+	}
+
+	// Check that the keys are valid before we distribute any of them.
+	if _, err := keys.Keyring(); err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, raw := range keyring.GetKeys() {
+		current[base64.StdEncoding.EncodeToString(raw)] = true
+	}
+	currentPrimary := base64.StdEncoding.EncodeToString(keyring.GetPrimaryKey())
+	wanted := make(map[string]bool)
+	for _, key := range keys.All() {
+		wanted[key] = true
+	}
+
+	manager := s.KeyManager()
+	for _, key := range keys.All() {
+		if current[key] {
+			continue
+		}
+		logger.Infof("Installing a new gossip encryption key across the cluster")
+		if _, err := manager.InstallKey(key); err != nil {
+			return fmt.Errorf("failed to install gossip key: %s", err)
+		}
+	}
+	if keys.Primary != currentPrimary {
+		logger.Infof("Switching to a new primary gossip encryption key across the cluster")
+		if _, err := manager.UseKey(keys.Primary); err != nil {
+			return fmt.Errorf("failed to change primary gossip key: %s", err)
+		}
+	}
+	for key := range current {
+		if wanted[key] {
+			continue
+		}
+		logger.Infof("Removing an old gossip encryption key across the cluster")
+		if _, err := manager.RemoveKey(key); err != nil {
+			return fmt.Errorf("failed to remove gossip key: %s", err)
+		}
+	}
+	return nil
 }
 
 func (g *Gossip) LatestClusterState() *ClusterState {
@@ -107,12 +758,96 @@ func (g *Gossip) LatestClusterState() *ClusterState {
 }
 
 func (g *Gossip) localNode() *serf.Member {
-	member := g.serf.LocalMember()
+	member := g.current().LocalMember()
 	return &member
 }
 
+// CurrentClusterState produces a new cluster state from Serf's current
+// view of the cluster, including its latest network coordinates. Unlike
+// the states delivered by Start, this doesn't wait for a membership event.
+func (g *Gossip) CurrentClusterState() *ClusterState {
+	return newClusterState(g, g.current().Members())
+}
+
+// warnUnknown logs a warning for each of the given endpoints, which have
+// unusable internal addresses, unless we've already warned about the same
+// problem with it.
+func (g *Gossip) warnUnknown(endpoints []*Endpoint) {
+	g.warnedLock.Lock()
+	defer g.warnedLock.Unlock()
+
+	current := make(map[string]string, len(endpoints))
+	for _, endpoint := range endpoints {
+		name := endpoint.NodeName()
+		raw, ok := endpoint.Tag("int_ip")
+		if !ok {
+			raw = "(missing)"
+		}
+		current[name] = raw
+
+		if warned, ok := g.warnedUnknown[name]; ok && warned == raw {
+			continue
+		}
+		logger.Warnf(
+			"Member %s has int_ip tag %s, which isn't a valid address under our addressing settings, so it will be ignored until that's fixed",
+			name, raw,
+		)
+	}
+	g.warnedUnknown = current
+}
+
+// warnDuplicates logs a warning for each of the given endpoint ids, which
+// are claimed by more than one endpoint, unless we've already warned about
+// the same endpoints claiming it.
+func (g *Gossip) warnDuplicates(duplicates map[EndpointId][]*Endpoint) {
+	g.warnedLock.Lock()
+	defer g.warnedLock.Unlock()
+
+	current := make(map[EndpointId]string, len(duplicates))
+	for id, endpoints := range duplicates {
+		names := make([]string, len(endpoints))
+		for i, endpoint := range endpoints {
+			names[i] = endpoint.NodeName()
+		}
+		sort.Strings(names)
+		claimants := strings.Join(names, ", ")
+		current[id] = claimants
+
+		if warned, ok := g.warnedDuplicates[id]; ok && warned == claimants {
+			continue
+		}
+		logger.Warnf(
+			"Endpoint id %s is claimed by %s; only one endpoint is allowed per datacenter, so no tunnels will be created for this id",
+			id, claimants,
+		)
+	}
+	g.warnedDuplicates = current
+}
+
+// noteSuppressed logs each of the given endpoints, which suppressStale
+// found to be stale, unless we've already logged it with the same status.
+func (g *Gossip) noteSuppressed(endpoints []*Endpoint) {
+	g.warnedLock.Lock()
+	defer g.warnedLock.Unlock()
+
+	current := make(map[string]serf.MemberStatus, len(endpoints))
+	for _, endpoint := range endpoints {
+		name := endpoint.NodeName()
+		current[name] = endpoint.Status()
+
+		if noted, ok := g.notedSuppressed[name]; ok && noted == endpoint.Status() {
+			continue
+		}
+		logger.Infof(
+			"Ignoring %s member %s, since a more live member also claims endpoint id %s",
+			endpoint.Status(), name, endpoint.Id(),
+		)
+	}
+	g.notedSuppressed = current
+}
+
 func (g *Gossip) refreshState() *ClusterState {
-	members := g.serf.Members()
+	members := g.current().Members()
 	newState := newClusterState(g, members)
 	g.latestState = newState
 	return newState
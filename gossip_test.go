@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGossipPublishLatestWins(t *testing.T) {
+	g := NewGossip(&GossipConfig{Addressing: testAddressing})
+	states := make([]*ClusterState, 5)
+	for i := range states {
+		states[i] = &ClusterState{}
+	}
+
+	// Nobody is reading, so none of these may block, and only the last
+	// is kept.
+	done := make(chan struct{})
+	go func() {
+		for _, state := range states {
+			g.publish(state)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publish blocked on a stalled reader")
+	}
+
+	select {
+	case got := <-g.Changes():
+		if got != states[len(states)-1] {
+			t.Errorf("received a stale state")
+		}
+	default:
+		t.Fatalf("no state delivered")
+	}
+	select {
+	case <-g.Changes():
+		t.Errorf("more than one state delivered")
+	default:
+	}
+}
+
+func TestGossipPublishSlowReader(t *testing.T) {
+	g := NewGossip(&GossipConfig{Addressing: testAddressing})
+	const count = 1000
+	states := make([]*ClusterState, count)
+	index := make(map[*ClusterState]int, count)
+	for i := range states {
+		states[i] = &ClusterState{}
+		index[states[i]] = i
+	}
+
+	// A reader that keeps falling behind must see states in order, and
+	// must end up with the newest one.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var received []int
+	go func() {
+		defer wg.Done()
+		for state := range g.Changes() {
+			received = append(received, index[state])
+			if index[state] == count-1 {
+				return
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+	for _, state := range states {
+		g.publish(state)
+	}
+	wg.Wait()
+
+	for i := 1; i < len(received); i++ {
+		if received[i] <= received[i-1] {
+			t.Fatalf("received state %d after %d", received[i], received[i-1])
+		}
+	}
+	if last := received[len(received)-1]; last != count-1 {
+		t.Errorf("last state received was %d; want %d", last, count-1)
+	}
+}
+
+func TestGossipRebindKeepsTags(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	g := NewGossip(&GossipConfig{
+		NodeName:     "this",
+		ListenIPAddr: "127.0.0.1",
+		Port:         port,
+		PortRange:    10,
+		DataDir:      filepath.Join(t.TempDir(), "serf.snapshot"),
+		Addressing:   testAddressing,
+		Profile:      GossipProfileLocal,
+		Tags:         map[string]string{"vpn_cipher": DefaultVPNCipher},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- g.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-errCh
+	}()
+	select {
+	case <-g.Changes():
+	case err := <-errCh:
+		t.Fatalf("Start failed: %s", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for gossip to start")
+	}
+
+	if err := g.SetTag(drainingTag, "1"); err != nil {
+		t.Fatalf("SetTag failed: %s", err)
+	}
+	old := g.current()
+	g.Rebind("127.0.0.1")
+	deadline := time.Now().Add(10 * time.Second)
+	for g.current() == old {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for gossip to restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !g.Started() {
+		t.Fatalf("gossip isn't running after the rebind")
+	}
+
+	tags := g.localNode().Tags
+	for key, want := range map[string]string{
+		drainingTag:  "1",
+		"vpn_cipher": DefaultVPNCipher,
+		"int_ip":     "127.0.0.1",
+	} {
+		if got := tags[key]; got != want {
+			t.Errorf("after the rebind, tag %s is %q; want %q", key, got, want)
+		}
+	}
+	state := g.CurrentClusterState()
+	if state == nil || state.ThisEndpoint == nil {
+		t.Errorf("no cluster state after the rebind")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// This file deals with the keys that encrypt gossip traffic.
+//
+// Serf holds a keyring of keys, one of which is the primary key that is
+// used to encrypt outgoing messages. Incoming messages are accepted if
+// they are encrypted with any key in the keyring, which allows the key
+// to be rotated without interrupting gossip:
+//
+//  1. Add the new key to gossip_encryption_keys on any node and send it
+//     SIGHUP. The key is installed on every member of the cluster.
+//  2. Make the new key the gossip_encryption_key, moving the old key into
+//     gossip_encryption_keys, and send SIGHUP. Every member then switches
+//     to using the new key as its primary key.
+//  3. Remove the old key and send SIGHUP, which removes the old key from
+//     every member.
+//
+// The configuration of the other nodes should be updated to match, so
+// that they'll use the new key when they next start. Alternatively, if
+// gossip_keyring_file is set then Serf keeps that file up to date with
+// the keyring changes it receives from the cluster, and we prefer the
+// file over the configured keys when we start. In that case the keys are
+// rotated by editing the file on one node and sending it SIGHUP; the first
+// key in the file is the primary key.
+
+// GossipKeys is a set of base64-encoded gossip encryption keys.
+type GossipKeys struct {
+	Primary string
+	Others  []string
+}
+
+// LoadGossipKeys returns the gossip encryption keys described by the
+// given configuration, or nil if gossip encryption isn't configured.
+func LoadGossipKeys(config *Config) (*GossipKeys, error) {
+	if config.GossipKeyringFile != "" {
+		keys, err := readGossipKeyringFile(config.GossipKeyringFile)
+		if err == nil {
+			return keys, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// If the file doesn't exist yet then Serf will create it once
+		// the keyring first changes.
+	}
+
+	if config.GossipEncryptionKey == "" {
+		if len(config.GossipEncryptionKeys) != 0 {
+			return nil, fmt.Errorf("gossip_encryption_keys requires gossip_encryption_key to be set too")
+		}
+		return nil, nil
+	}
+	return &GossipKeys{
+		Primary: config.GossipEncryptionKey,
+		Others:  config.GossipEncryptionKeys,
+	}, nil
+}
+
+// readGossipKeyringFile reads a keyring file in the format that Serf
+// writes: a JSON array of base64-encoded keys, primary key first.
+func readGossipKeyringFile(filename string) (*GossipKeys, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip keyring file %s: %s", filename, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("gossip keyring file %s has no keys", filename)
+	}
+	return &GossipKeys{
+		Primary: keys[0],
+		Others:  keys[1:],
+	}, nil
+}
+
+// All returns all of the keys, primary key first.
+func (k *GossipKeys) All() []string {
+	return append([]string{k.Primary}, k.Others...)
+}
+
+// Keyring builds a memberlist keyring containing the keys.
+func (k *GossipKeys) Keyring() (*memberlist.Keyring, error) {
+	primary, err := decodeGossipKey(k.Primary)
+	if err != nil {
+		return nil, err
+	}
+	others := make([][]byte, len(k.Others))
+	for i, key := range k.Others {
+		others[i], err = decodeGossipKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyring, err := memberlist.NewKeyring(others, primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gossip encryption key: %s", err)
+	}
+	return keyring, nil
+}
+
+// decodeGossipKey decodes a base64-encoded gossip key, checking that it
+// is of a length that memberlist accepts. Memberlist would otherwise
+// reject it only once we try to start gossip, with a less helpful error.
+func decodeGossipKey(key string) ([]byte, error) {
+	ret, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || memberlist.ValidateKey(ret) != nil {
+		return nil, fmt.Errorf("gossip key must be base64 of 16, 24, or 32 bytes")
+	}
+	return ret, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// This file looks after Serf's snapshot, the file in which Serf records
+// the members it knows about so that a restarted node can rejoin them
+// without help from initial_peers.
+//
+// Serf can't start at all if it can't open the snapshot, so we check
+// that first and explain the problem. Once running, Serf just logs any
+// failure to update the snapshot and carries on gossiping without it, so
+// we watch its log for those failures and count them. See
+// Gossip.SnapshotErrors.
+//
+// Serf offers no other way to learn of these failures, so this depends on
+// the exact wording of its log messages, which snapshotErrorMessages
+// records. TestSnapshotErrorMessages checks them against the vendored
+// copy of Serf, so that updating Serf can't silently break this.
+
+// snapshotCheckRetries is how many times we retry opening the snapshot,
+// starting snapshotCheckDelay apart and doubling each time, in case the
+// problem is only momentary.
+const (
+	snapshotCheckRetries = 3
+	snapshotCheckDelay   = time.Second
+)
+
+// checkSnapshotPath opens the snapshot file at the given path the same
+// way Serf will, to make sure that it can.
+func checkSnapshotPath(snapshotPath string) error {
+	f, err := os.OpenFile(snapshotPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return fmt.Errorf("gossip snapshot %s is not writable, so we couldn't rejoin the cluster after a restart: %s", snapshotPath, err)
+	}
+	return f.Close()
+}
+
+// waitForSnapshotPath runs checkSnapshotPath, retrying with backoff if it
+// fails.
+func waitForSnapshotPath(snapshotPath string) error {
+	delay := snapshotCheckDelay
+	var err error
+	for attempt := 0; attempt <= snapshotCheckRetries; attempt++ {
+		if attempt > 0 {
+			logger.Warnf("%s; retrying in %s", err, delay)
+			time.Sleep(delay)
+			delay = delay * 2
+		}
+		err = checkSnapshotPath(snapshotPath)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// SnapshotErrors returns the number of times that Serf has failed to
+// update its snapshot since we started.
+func (g *Gossip) SnapshotErrors() int64 {
+	return atomic.LoadInt64(&g.snapshotErrors)
+}
+
+// snapshotErrorMessages are the messages that Serf logs, each followed by
+// ": " and the error, when it fails to write its snapshot. See the
+// snapshotter in serf/snapshot.go.
+var snapshotErrorMessages = []string{
+	"[ERR] serf: failed to flush leave to snapshot",
+	"[ERR] serf: failed to sync leave to snapshot",
+	"[ERR] serf: failed to flush snapshot",
+	"[ERR] serf: failed to sync snapshot",
+	"[ERR] serf: Failed to update snapshot",
+}
+
+// isSnapshotError returns true if the given line of Serf's log output
+// reports a failure to write its snapshot.
+func isSnapshotError(line string) bool {
+	for _, message := range snapshotErrorMessages {
+		if strings.Contains(line, message+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotErrorWatcher passes Serf's log output through to out, counting
+// the failures to update the snapshot as it goes.
+type snapshotErrorWatcher struct {
+	out    io.Writer
+	gossip *Gossip
+}
+
+func (w *snapshotErrorWatcher) Write(p []byte) (int, error) {
+	// Serf's logger writes one whole line at a time.
+	if isSnapshotError(string(p)) {
+		if atomic.AddInt64(&w.gossip.snapshotErrors, 1) == 1 {
+			logger.Warnf("Serf failed to update its snapshot, so this node may need initial_peers to rejoin the cluster after a restart")
+		}
+	}
+	return w.out.Write(p)
+}
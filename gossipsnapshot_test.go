@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestSnapshotErrorMessages checks that the vendored Serf still logs each
+// of the messages that we look for, since nothing else would notice if
+// their wording changed.
+func TestSnapshotErrorMessages(t *testing.T) {
+	src, err := ioutil.ReadFile("vendor/github.com/hashicorp/serf/serf/snapshot.go")
+	if err != nil {
+		t.Skipf("can't read vendored Serf: %s", err)
+	}
+	for _, message := range snapshotErrorMessages {
+		if !strings.Contains(string(src), `"`+message+`: %v"`) {
+			t.Errorf("Serf no longer logs %q", message)
+		}
+	}
+}
+
+func TestSnapshotErrorWatcher(t *testing.T) {
+	g := NewGossip(&GossipConfig{Addressing: testAddressing})
+	var out bytes.Buffer
+	w := &snapshotErrorWatcher{out: &out, gossip: g}
+
+	lines := []string{
+		"2017/07/14 12:00:00 [INFO] serf: EventMemberJoin: a 192.0.2.1\n",
+		"2017/07/14 12:00:01 [ERR] serf: failed to flush snapshot: write /data/serf.snapshot: no space left on device\n",
+		"2017/07/14 12:00:02 [ERR] serf: Unknown event to snapshot: &serf.UserEvent{}\n",
+		"2017/07/14 12:00:03 [WARN] serf: snapshot is getting large\n",
+		"2017/07/14 12:00:04 [ERR] serf: Failed to update snapshot: rename: permission denied\n",
+	}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+	}
+
+	if got := g.SnapshotErrors(); got != 2 {
+		t.Errorf("counted %d snapshot errors; want 2", got)
+	}
+	if got, want := out.String(), strings.Join(lines, ""); got != want {
+		t.Errorf("output not passed through\ngot:  %q\nwant: %q", got, want)
+	}
+}
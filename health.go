@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// This file provides the health checks that load balancers and
+// orchestrators probe, which answer with a status code rather than the
+// rich JSON of the rest of the HTTP API:
+//
+// GET /healthz succeeds once we're running and have started gossiping.
+// It says nothing about our tunnels, since restarting us wouldn't help
+// with those.
+//
+// GET /readyz succeeds while we're ready to carry traffic: we aren't
+// draining, we've seen enough of the cluster to manage routes (see
+// routeGate), and at least ready_tunnel_percent of the tunnels we want
+// are connected. The Run loop decides this on each pass, so the probe
+// itself is cheap.
+
+// DefaultReadyTunnelPercent is the ready_tunnel_percent we use when it
+// isn't set.
+const DefaultReadyTunnelPercent = 100
+
+// readiness is the Run loop's latest decision as to whether we're ready
+// to carry traffic. reason explains why not, if we aren't.
+type readiness struct {
+	ready  bool
+	reason string
+}
+
+// checkReadiness decides whether we're ready to carry traffic, given the
+// tunnels we want and the current tunnel states. Only the Run loop may
+// call it.
+func (m *Manager) checkReadiness(wantTunnels EndpointSet, tunnelState *TunnelsState) readiness {
+	if !m.drainingSince.IsZero() {
+		return readiness{reason: "draining"}
+	}
+	if m.routeGate != nil && !m.routeGate.Opened() {
+		return readiness{reason: "waiting for the cluster to form"}
+	}
+
+	connected := 0
+	for _, tunnel := range tunnelState.Tunnels {
+		if tunnel.State == VPNConnected && wantTunnels.Contains(tunnel.EndpointId) {
+			connected++
+		}
+	}
+	if connected*100 < len(wantTunnels)*m.readyTunnelPercent {
+		return readiness{
+			reason: fmt.Sprintf("%d of %d tunnels connected, but %d%% must be", connected, len(wantTunnels), m.readyTunnelPercent),
+		}
+	}
+	return readiness{ready: true}
+}
+
+func (m *Manager) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	cluster, _ := m.LatestState()
+	if cluster == nil || !m.gossip.Started() {
+		http.Error(w, "not yet gossiping", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (m *Manager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	m.stateLock.RLock()
+	ready := m.readiness
+	m.stateLock.RUnlock()
+
+	if !ready.ready {
+		reason := ready.reason
+		if reason == "" {
+			reason = "not yet started"
+		}
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
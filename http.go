@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// This file contains the HTTP API that exposes the manager's
+// view of the cluster and its tunnels as JSON, along with our metrics and
+// a stream of state change events. See status.go for the form of the
+// JSON, and health.go for the health checks.
+
+// startHTTP begins serving the HTTP API on the given address in a
+// background goroutine. The caller should close the returned listener
+// to stop serving.
+func (m *Manager) startHTTP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", m.handleCluster)
+	mux.HandleFunc("/tunnels", m.handleTunnels)
+	mux.HandleFunc("/tunnels/", m.handleTunnelAction)
+	mux.HandleFunc("/drain", m.handleDrain)
+	mux.HandleFunc("/undrain", m.handleUndrain)
+	mux.Handle("/metrics", m.metrics)
+	mux.HandleFunc("/events", m.handleEvents)
+	mux.HandleFunc("/healthz", m.handleHealthz)
+	mux.HandleFunc("/readyz", m.handleReadyz)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		logger.Infof("HTTP API stopped: %s", err)
+	}()
+
+	return listener, nil
+}
+
+func (m *Manager) handleCluster(w http.ResponseWriter, r *http.Request) {
+	cluster, tunnels := m.LatestState()
+	if cluster == nil {
+		http.Error(w, "cluster state not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, newClusterStatus(cluster, tunnels))
+}
+
+func (m *Manager) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	_, tunnels := m.LatestState()
+	if tunnels == nil {
+		http.Error(w, "tunnel state not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, newTunnelsStatus(tunnels, m.tunnelMgr.Backoffs()))
+}
+
+// handleTunnelAction handles requests to act on a single tunnel, which
+// currently means only "POST /tunnels/<eid>/restart".
+func (m *Manager) handleTunnelAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tunnels/"), "/")
+	if len(parts) != 2 || parts[1] != "restart" {
+		http.NotFound(w, r)
+		return
+	}
+	if !requirePost(w, r) {
+		return
+	}
+	endpointId, err := ParseEndpointId(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Restart of tunnel to endpoint %s requested via the HTTP API", endpointId)
+	err = m.tunnelMgr.RestartTunnel(endpointId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleDrain and handleUndrain start and stop draining this endpoint.
+// See drain.go.
+func (m *Manager) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	logger.Infof("Drain requested via the HTTP API")
+	err := m.Drain()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (m *Manager) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	logger.Infof("Undrain requested via the HTTP API")
+	err := m.Undrain()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// requirePost responds with an error and returns false if the given
+// request isn't a POST, for handlers that change our state.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// handleEvents streams state change events to the client as
+// server-sent events, until the client disconnects.
+func (m *Manager) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := m.events.Subscribe()
+	defer m.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Warnf("Failed to encode event: %s", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(v)
+	if err != nil {
+		logger.Warnf("Failed to write HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,304 @@
+//go:build integration
+
+package main
+
+// This file holds an end-to-end test that runs two complete nodes, each in
+// its own network namespace, and checks that they gossip, build a tunnel
+// and pass traffic through it. It needs root, OpenVPN, sudo and iproute2,
+// and so is built only with the "integration" tag:
+//
+//	go test -tags integration -run Integration -v
+//
+// Each node is this test binary run again inside its namespace, where
+// TestIntegrationNode runs a Manager configured from the environment just
+// as main does.
+//
+// The two namespaces are joined by a veth pair whose ends have /32
+// addresses in different regions. The resulting host routes are more
+// specific than the datacenter routes that each node installs via its
+// tunnel, so OpenVPN's own traffic never loops into the tunnel.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// integrationNodeEnv is set in the environment of the node processes, to
+// tell TestIntegrationNode to run a node rather than skip.
+const integrationNodeEnv = "OPENVPN_PEER_INTEGRATION_NODE"
+
+// integrationNode is one of the nodes run by runIntegrationPair.
+type integrationNode struct {
+	name      string
+	netns     string
+	ip        string
+	link      string
+	socket    string
+	cmd       *exec.Cmd
+	output    bytes.Buffer
+	endpoint  EndpointId
+	addresses *Addressing
+}
+
+func TestIntegrationNode(t *testing.T) {
+	if os.Getenv(integrationNodeEnv) == "" {
+		t.Skip("run only as a node of the integration tests")
+	}
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("failed to load configuration: %s", err)
+	}
+	err = config.ConfigureLogging()
+	if err != nil {
+		t.Fatalf("failed to configure logging: %s", err)
+	}
+	mgr, err := NewManager(config)
+	if err != nil {
+		t.Fatalf("NewManager failed: %s", err)
+	}
+	err = mgr.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+}
+
+func TestIntegrationTunnel(t *testing.T) {
+	runIntegrationPair(t, nil)
+}
+
+func TestIntegrationTunnelSubnet(t *testing.T) {
+	// Subnets need two more bits, and so a shorter base prefix.
+	runIntegrationPair(t, map[string]string{
+		"OPENVPN_PEER_VPN_TOPOLOGY":       VPNTopologySubnet,
+		"OPENVPN_PEER_TUNNEL_BASE_PREFIX": "100.64.0.0/10",
+	})
+}
+
+// runIntegrationPair runs two nodes in their own network namespaces, with
+// the given settings in their environments, and checks that they connect
+// a tunnel that carries traffic in both directions.
+func runIntegrationPair(t *testing.T, env map[string]string) {
+	skipUnlessIntegration(t)
+
+	keyFile := filepath.Join(t.TempDir(), "vpn.key")
+	genKey := exec.Command(integrationOpenVPNPath(), "--genkey", "--secret", keyFile)
+	if output, err := genKey.CombinedOutput(); err != nil {
+		t.Fatalf("failed to generate a VPN key: %s\n%s", err, output)
+	}
+
+	prefix := fmt.Sprintf("ovpit%d", os.Getpid()%100000)
+	a := &integrationNode{name: "a", ip: "10.0.0.1"}
+	b := &integrationNode{name: "b", ip: "10.16.0.1"}
+	for _, node := range []*integrationNode{a, b} {
+		node.netns = prefix + node.name
+		node.link = prefix + node.name
+		runIP(t, "netns", "add", node.netns)
+		netns := node.netns
+		t.Cleanup(func() {
+			exec.Command("ip", "netns", "del", netns).Run()
+		})
+	}
+	runIP(t, "link", "add", a.link, "netns", a.netns, "type", "veth", "peer", "name", b.link, "netns", b.netns)
+	for _, pair := range [][2]*integrationNode{{a, b}, {b, a}} {
+		node, peer := pair[0], pair[1]
+		runIP(t, "-n", node.netns, "link", "set", "lo", "up")
+		runIP(t, "-n", node.netns, "addr", "add", node.ip+"/32", "peer", peer.ip+"/32", "dev", node.link)
+		runIP(t, "-n", node.netns, "link", "set", node.link, "up")
+	}
+
+	for _, pair := range [][2]*integrationNode{{a, b}, {b, a}} {
+		node, peer := pair[0], pair[1]
+		dir := t.TempDir()
+		node.socket = filepath.Join(dir, "control.sock")
+
+		settings := map[string]string{
+			"OPENVPN_PEER_NODE_NAME":         node.name,
+			"OPENVPN_PEER_INTERFACE":         node.link,
+			"OPENVPN_PEER_COMMON_PREFIX_LEN": "8",
+			"OPENVPN_PEER_REGION_PREFIX_LEN": "12",
+			"OPENVPN_PEER_DC_PREFIX_LEN":     "18",
+			"OPENVPN_PEER_START_PORT":        "7000",
+			"OPENVPN_PEER_OPENVPN_PATH":      integrationOpenVPNPath(),
+			"OPENVPN_PEER_KEY_FILE":          keyFile,
+			"OPENVPN_PEER_DATA_DIR":          filepath.Join(dir, "data"),
+			"OPENVPN_PEER_RUNTIME_DIR":       filepath.Join(dir, "run"),
+			"OPENVPN_PEER_CONTROL_SOCKET":    node.socket,
+			"OPENVPN_PEER_INITIAL_PEERS":     peer.ip,
+			"OPENVPN_PEER_LOG_LEVEL":         "debug",
+		}
+		for key, value := range env {
+			settings[key] = value
+		}
+
+		// The prefix lengths give the two nodes different regions.
+		config := &Config{
+			CommonPrefixLen:      8,
+			RegionPrefixLen:      12,
+			DCPrefixLen:          18,
+			VPNEndpointStartPort: 7000,
+			VPNTopology:          settings["OPENVPN_PEER_VPN_TOPOLOGY"],
+			TunnelBasePrefix:     settings["OPENVPN_PEER_TUNNEL_BASE_PREFIX"],
+		}
+		var err error
+		node.addresses, err = NewAddressing(config, net.ParseIP(node.ip))
+		if err != nil {
+			t.Fatalf("invalid addressing for node %s: %s", node.name, err)
+		}
+		node.endpoint = node.addresses.LocalAddress().EndpointId()
+
+		node.cmd = exec.Command("ip", "netns", "exec", node.netns, os.Args[0], "-test.run=^TestIntegrationNode$", "-test.v")
+		node.cmd.Env = append(os.Environ(), integrationNodeEnv+"=1")
+		for key, value := range settings {
+			node.cmd.Env = append(node.cmd.Env, key+"="+value)
+		}
+		node.cmd.Stdout = &node.output
+		node.cmd.Stderr = &node.output
+		if err := node.cmd.Start(); err != nil {
+			t.Fatalf("failed to start node %s: %s", node.name, err)
+		}
+		t.Cleanup(node.stop(t))
+	}
+
+	for _, pair := range [][2]*integrationNode{{a, b}, {b, a}} {
+		node, peer := pair[0], pair[1]
+		node.awaitConnected(t, peer.endpoint, 90*time.Second)
+	}
+
+	for _, pair := range [][2]*integrationNode{{a, b}, {b, a}} {
+		node, peer := pair[0], pair[1]
+		_, remote, err := node.addresses.LocalAddress().TunnelInternalIPs(peer.endpoint)
+		if err != nil {
+			t.Fatalf("no tunnel addresses from %s to %s: %s", node.name, peer.name, err)
+		}
+		ping := exec.Command("ip", "netns", "exec", node.netns, "ping", "-c", "3", "-W", "2", remote.String())
+		if output, err := ping.CombinedOutput(); err != nil {
+			t.Errorf("%s can't ping %s at %s through the tunnel: %s\n%s", node.name, peer.name, remote, err, output)
+		}
+	}
+}
+
+// skipUnlessIntegration skips the test unless we can create network
+// namespaces and run OpenVPN in them.
+func skipUnlessIntegration(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root")
+	}
+	for _, path := range []string{"ip", DefaultLauncherPath} {
+		if _, err := exec.LookPath(path); err != nil {
+			t.Skipf("%s is not available", path)
+		}
+	}
+	if _, err := exec.LookPath("openvpn"); err != nil {
+		if _, err := os.Stat(DefaultOpenVPNPath); err != nil {
+			t.Skip("openvpn is not available")
+		}
+	}
+}
+
+// integrationOpenVPNPath returns the path of the OpenVPN binary to test
+// with.
+func integrationOpenVPNPath() string {
+	if path, err := exec.LookPath("openvpn"); err == nil {
+		return path
+	}
+	return DefaultOpenVPNPath
+}
+
+// runIP runs ip with the given arguments, failing the test if it fails.
+func runIP(t *testing.T, args ...string) {
+	t.Helper()
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip %s failed: %s\n%s", strings.Join(args, " "), err, output)
+	}
+}
+
+// stop returns a function that shuts the node down, killing it if it
+// doesn't exit promptly, and logs its output if the test failed.
+func (n *integrationNode) stop(t *testing.T) func() {
+	return func() {
+		done := make(chan struct{})
+		go func() {
+			n.cmd.Wait()
+			close(done)
+		}()
+		n.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			n.cmd.Process.Kill()
+			<-done
+		}
+		if t.Failed() {
+			t.Logf("output of node %s:\n%s", n.name, n.output.String())
+		}
+	}
+}
+
+// awaitConnected waits until the node reports that its tunnel to the
+// given endpoint is connected, failing the test if it doesn't within the
+// given time.
+func (n *integrationNode) awaitConnected(t *testing.T, endpointId EndpointId, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	var last string
+	for time.Now().Before(deadline) {
+		state, err := n.tunnelState(endpointId)
+		if err != nil {
+			last = err.Error()
+		} else if state == VPNConnected.String() {
+			return
+		} else {
+			last = state
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatalf("tunnel from %s to endpoint %s didn't connect; last saw %s", n.name, endpointId, last)
+}
+
+// tunnelState asks the node, via its control socket, for the state of its
+// tunnel to the given endpoint.
+func (n *integrationNode) tunnelState(endpointId EndpointId) (string, error) {
+	conn, err := net.DialTimeout("unix", n.socket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = fmt.Fprintln(conn, "tunnels")
+	if err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(response, "error: ") {
+		return "", fmt.Errorf("%s", strings.TrimSpace(response[len("error: "):]))
+	}
+
+	var status tunnelsStatus
+	err = json.Unmarshal([]byte(response), &status)
+	if err != nil {
+		return "", err
+	}
+	for _, tunnel := range status.Tunnels {
+		if tunnel.EndpointId == endpointId.String() {
+			return tunnel.State, nil
+		}
+	}
+	return "no tunnel", nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file deals with rotating the pre-shared key.
+//
+// Each key has a "generation" number, and each endpoint advertises the
+// generations it holds in its "key_gens" tag. A tunnel always uses the
+// highest generation that both of its endpoints hold, so the two ends
+// always agree without any further coordination.
+//
+// To rotate to a new key:
+//
+//  1. Install the new key, with the next generation number, in the key
+//     directory of each node in turn and send that node SIGHUP. Each time,
+//     only the tunnels between that node and the nodes that already have
+//     the new key restart, and both ends of each of those tunnels restart
+//     within moments of each other as soon as the updated tag is gossiped.
+//     Doing this one node at a time means that only one node per region
+//     is ever re-keying its tunnels, so a region never loses a majority
+//     of its tunnels at once.
+//  2. Once all nodes have the new key, remove the old key from each node
+//     and send SIGHUP again. Nothing is using the old key by then, so no
+//     tunnels are disturbed.
+//
+// When only a single key file is configured, it is generation 0. Endpoints
+// that don't advertise the tag are assumed to hold only generation 0.
+//
+// So that a compromised key exposes only some of the tunnels, a separate
+// key can also be configured for the tunnels between a pair of regions
+// (region_pair_keys). Each endpoint advertises a fingerprint of each pair
+// key for its own region in its "pair_keys" tag, and a tunnel uses its
+// pair's key instead of the generations above only if both ends advertise
+// the same fingerprint for it. Adding, changing or removing a pair key is
+// therefore done just like a rotation: change it on each node in turn and
+// send SIGHUP. The tunnels fall back to the generation key while the two
+// ends disagree, and move to the new pair key once they agree again.
+//
+// A pair key's generation is negative, so as not to collide with the
+// keyring's, and is derived from its fingerprint, so that a tunnel is
+// re-keyed whenever its pair key changes.
+
+const (
+	keyGenerationsTag = "key_gens"
+	pairKeysTag       = "pair_keys"
+)
+
+// VPNKeyring is the set of pre-shared keys available to this node.
+type VPNKeyring struct {
+	keys     map[int]*vpnKey
+	pairKeys map[regionPair]*vpnKey
+}
+
+// regionPair identifies a pair of regions by their ids, in sorted order
+// so that both ends of a tunnel agree on it.
+type regionPair [2]string
+
+func newRegionPair(a, b string) regionPair {
+	if b < a {
+		a, b = b, a
+	}
+	return regionPair{a, b}
+}
+
+// parseRegionPair parses a key of the region_pair_keys setting, which is
+// two region ids separated by a comma.
+func parseRegionPair(raw string) (regionPair, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 2 {
+		return regionPair{}, fmt.Errorf("invalid region pair %q: must be two region ids separated by a comma", raw)
+	}
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+		if net.ParseIP(parts[i]) == nil {
+			return regionPair{}, fmt.Errorf("invalid region pair %q: %q is not a region id", raw, parts[i])
+		}
+	}
+	return newRegionPair(parts[0], parts[1]), nil
+}
+
+type vpnKey struct {
+	// Filename is the path to the key file. OpenVPN reads this file
+	// directly, unless Key is set.
+	Filename string
+
+	// Key is the decrypted key, if the key file is encrypted.
+	Key []byte
+
+	// Fingerprint identifies the key's contents without revealing them;
+	// see keyFingerprint.
+	Fingerprint string
+}
+
+// keyFingerprint returns a short fingerprint of the given key. It is the
+// first 32 bits of the key's SHA-256 hash, which is enough to tell two
+// keys apart but says nothing useful about either.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// pairKeyGeneration returns the key generation of the pair key with the
+// given fingerprint, which is always negative.
+func pairKeyGeneration(fingerprint string) int {
+	raw, err := strconv.ParseUint(fingerprint, 16, 32)
+	if err != nil {
+		return -1
+	}
+	return -1 - int(raw&0x7fffffff)
+}
+
+// LoadVPNKeyring loads the keys described by the given configuration.
+//
+// If VPNKeyDir is set, each file named "<generation>.key" in that directory
+// is a key. Otherwise VPNKeyFilename is the only key, with generation 0.
+// If SecretPassphrase is set then all of the key files are encrypted.
+func LoadVPNKeyring(config *Config) (*VPNKeyring, error) {
+	ret := &VPNKeyring{
+		keys:     make(map[int]*vpnKey),
+		pairKeys: make(map[regionPair]*vpnKey),
+	}
+
+	for raw, filename := range config.RegionPairKeys {
+		pair, err := parseRegionPair(raw)
+		if err != nil {
+			return nil, err
+		}
+		key, err := loadVPNKey(filename, config.SecretPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key for region pair %q: %s", raw, err)
+		}
+		ret.pairKeys[pair] = key
+	}
+
+	if config.VPNKeyDir == "" {
+		key, err := loadVPNKey(config.VPNKeyFilename, config.SecretPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		ret.keys[0] = key
+		return ret, nil
+	}
+
+	entries, err := ioutil.ReadDir(config.VPNKeyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory: %s", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".key") {
+			continue
+		}
+		gen, err := strconv.Atoi(strings.TrimSuffix(name, ".key"))
+		if err != nil || gen < 0 {
+			logger.Warnf("Ignoring %s in key directory: name must be a key generation number", name)
+			continue
+		}
+
+		key, err := loadVPNKey(filepath.Join(config.VPNKeyDir, name), config.SecretPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		ret.keys[gen] = key
+	}
+
+	if len(ret.keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", config.VPNKeyDir)
+	}
+	return ret, nil
+}
+
+func loadVPNKey(filename, passphrase string) (*vpnKey, error) {
+	// If the file isn't encrypted then OpenVPN will read it itself, but
+	// we still read it so that we'll fail early if it's missing.
+	key, err := ReadSecretKeyFile(filename, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	ret := &vpnKey{
+		Filename:    filename,
+		Fingerprint: keyFingerprint(key),
+	}
+	if passphrase != "" {
+		ret.Key = key
+	}
+	return ret, nil
+}
+
+// Generations returns the key generations in the keyring, in ascending
+// order.
+func (k *VPNKeyring) Generations() []int {
+	ret := make([]int, 0, len(k.keys))
+	for gen := range k.keys {
+		ret = append(ret, gen)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// CommonGeneration returns the highest generation that is both in the
+// keyring and in the given set, or false if there isn't one.
+func (k *VPNKeyring) CommonGeneration(gens []int) (int, bool) {
+	best := -1
+	for _, gen := range gens {
+		if _, ok := k.keys[gen]; ok && gen > best {
+			best = gen
+		}
+	}
+	return best, best >= 0
+}
+
+// TunnelGeneration returns the key generation that a tunnel between the
+// given regions should use, given the generations and pair keys that the
+// remote endpoint advertises, or false if there isn't one. This is the
+// pair key's generation if both ends have the same key for the regions.
+func (k *VPNKeyring) TunnelGeneration(localRegion, remoteRegion string, gens []int, remotePairKeys map[string]string) (int, bool) {
+	if key, ok := k.pairKeys[newRegionPair(localRegion, remoteRegion)]; ok && remotePairKeys[localRegion] == key.Fingerprint {
+		return pairKeyGeneration(key.Fingerprint), true
+	}
+	return k.CommonGeneration(gens)
+}
+
+// RegionPairs returns the number of region pairs that have keys of their
+// own.
+func (k *VPNKeyring) RegionPairs() int {
+	return len(k.pairKeys)
+}
+
+// PairKeys returns the fingerprints of the keys for the region pairs that
+// include the given region, keyed by the other region of each pair, as
+// advertised in the pair_keys tag.
+func (k *VPNKeyring) PairKeys(region string) map[string]string {
+	ret := make(map[string]string)
+	for pair, key := range k.pairKeys {
+		switch region {
+		case pair[0]:
+			ret[pair[1]] = key.Fingerprint
+		case pair[1]:
+			ret[pair[0]] = key.Fingerprint
+		}
+	}
+	return ret
+}
+
+// KeyFile returns the path of a file containing the key of the given
+// generation for a tunnel between the given regions, along with a
+// function that the caller must call once the file is no longer needed.
+func (k *VPNKeyring) KeyFile(localRegion, remoteRegion string, gen int) (string, func(), error) {
+	var key *vpnKey
+	var ok bool
+	if gen < 0 {
+		key, ok = k.pairKeys[newRegionPair(localRegion, remoteRegion)]
+		if !ok || pairKeyGeneration(key.Fingerprint) != gen {
+			return "", nil, fmt.Errorf("no key of generation %d for regions %s and %s", gen, localRegion, remoteRegion)
+		}
+	} else {
+		key, ok = k.keys[gen]
+		if !ok {
+			return "", nil, fmt.Errorf("no key for generation %d", gen)
+		}
+	}
+
+	if key.Key == nil {
+		return key.Filename, func() {}, nil
+	}
+
+	filename, err := writeTempSecretKey(key.Key)
+	if err != nil {
+		return "", nil, err
+	}
+	return filename, func() {
+		err := os.Remove(filename)
+		if err != nil {
+			logger.Warnf("Failed to remove temporary key file: %s", err)
+		}
+	}, nil
+}
+
+// formatKeyGenerations and parseKeyGenerations convert between a list of
+// key generations and the value of the key_gens tag.
+func formatKeyGenerations(gens []int) string {
+	strs := make([]string, len(gens))
+	for i, gen := range gens {
+		strs[i] = strconv.Itoa(gen)
+	}
+	return strings.Join(strs, ",")
+}
+
+func parseKeyGenerations(raw string) []int {
+	if raw == "" {
+		return []int{0}
+	}
+	var ret []int
+	for _, str := range strings.Split(raw, ",") {
+		gen, err := strconv.Atoi(str)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, gen)
+	}
+	return ret
+}
+
+// formatPairKeys and parsePairKeys convert between the fingerprints of the
+// pair keys, keyed by the other region of each pair, and the value of the
+// pair_keys tag, which is a comma-separated list of "region=fingerprint".
+func formatPairKeys(pairKeys map[string]string) string {
+	entries := make([]string, 0, len(pairKeys))
+	for region, fingerprint := range pairKeys {
+		entries = append(entries, region+"="+fingerprint)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func parsePairKeys(raw string) map[string]string {
+	ret := make(map[string]string)
+	if raw == "" {
+		return ret
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret
+}
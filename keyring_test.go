@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadTestKeyring writes a generation key and a key for the region pair
+// of 10.0.0.0 and 10.16.0.0 with the given contents, and loads them.
+func loadTestKeyring(t *testing.T, pairKey string) *VPNKeyring {
+	t.Helper()
+	dir := t.TempDir()
+	genFile := filepath.Join(dir, "0.key")
+	pairFile := filepath.Join(dir, "pair.key")
+	for filename, contents := range map[string]string{genFile: "generation key", pairFile: pairKey} {
+		if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", filename, err)
+		}
+	}
+	keyring, err := LoadVPNKeyring(&Config{
+		VPNKeyFilename: genFile,
+		RegionPairKeys: map[string]string{"10.16.0.0, 10.0.0.0": pairFile},
+	})
+	if err != nil {
+		t.Fatalf("LoadVPNKeyring failed: %s", err)
+	}
+	return keyring
+}
+
+func TestTunnelGenerationPairKeys(t *testing.T) {
+	keyring := loadTestKeyring(t, "pair key")
+	other := loadTestKeyring(t, "another pair key")
+	ours := keyring.PairKeys("10.0.0.0")
+	theirs := keyring.PairKeys("10.16.0.0")
+	if !reflect.DeepEqual(ours, map[string]string{"10.16.0.0": keyFingerprint([]byte("pair key"))}) {
+		t.Fatalf("wrong pair keys %q", ours)
+	}
+	if got := keyring.PairKeys("10.32.0.0"); len(got) != 0 {
+		t.Errorf("got pair keys %q for an unrelated region", got)
+	}
+
+	pairGen := pairKeyGeneration(keyFingerprint([]byte("pair key")))
+	tests := []struct {
+		name           string
+		local, remote  string
+		remotePairKeys map[string]string
+		want           int
+	}{
+		{"both ends", "10.0.0.0", "10.16.0.0", theirs, pairGen},
+		{"both ends, other way", "10.16.0.0", "10.0.0.0", ours, pairGen},
+		{"remote hasn't one", "10.0.0.0", "10.16.0.0", nil, 0},
+		{"remote has another", "10.0.0.0", "10.16.0.0", other.PairKeys("10.16.0.0"), 0},
+		{"other regions", "10.0.0.0", "10.32.0.0", map[string]string{"10.0.0.0": ours["10.16.0.0"]}, 0},
+	}
+	for _, test := range tests {
+		got, ok := keyring.TunnelGeneration(test.local, test.remote, []int{0}, test.remotePairKeys)
+		if !ok || got != test.want {
+			t.Errorf("%s: got generation %d (%v); want %d", test.name, got, ok, test.want)
+		}
+	}
+
+	// Changing the key's contents changes its generation, so that the
+	// tunnels using it are re-keyed.
+	otherGen := pairKeyGeneration(keyFingerprint([]byte("another pair key")))
+	if pairGen >= 0 || otherGen >= 0 || pairGen == otherGen {
+		t.Errorf("got pair key generations %d and %d; want two different negative ones", pairGen, otherGen)
+	}
+
+	if _, _, err := keyring.KeyFile("10.0.0.0", "10.16.0.0", pairGen); err != nil {
+		t.Errorf("KeyFile failed for the current pair key: %s", err)
+	}
+	if _, _, err := keyring.KeyFile("10.0.0.0", "10.16.0.0", otherGen); err == nil {
+		t.Errorf("KeyFile succeeded for a pair key we no longer have")
+	}
+}
+
+func TestPairKeysTag(t *testing.T) {
+	pairKeys := map[string]string{"10.16.0.0": "0123abcd", "fd00:10::": "89abcdef"}
+	raw := formatPairKeys(pairKeys)
+	if raw != "10.16.0.0=0123abcd,fd00:10::=89abcdef" {
+		t.Errorf("got tag %q", raw)
+	}
+	if got := parsePairKeys(raw); !reflect.DeepEqual(got, pairKeys) {
+		t.Errorf("got %q back from %q; want %q", got, raw, pairKeys)
+	}
+	if got := parsePairKeys(""); len(got) != 0 {
+		t.Errorf("got %q from an empty tag", got)
+	}
+}
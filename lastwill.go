@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// This file implements our "last will": when we're about to die without
+// the chance to leave the gossip pool gracefully, we first advertise the
+// "going_down" tag on a best-effort basis. Our peers then stop treating
+// us as alive right away (see Endpoint.GoingDown), and so route around
+// us, rather than waiting for Serf's failure detector to notice.
+//
+// We do this if the Run loop panics, or if we receive SIGQUIT or SIGABRT,
+// after which the signal gets its usual treatment of dumping the
+// goroutines and exiting. A panic in any other goroutine, or a signal we
+// can't catch such as SIGKILL, still leaves it to the failure detector.
+// The tag vanishes when we restart, since we start out with a fresh set
+// of tags.
+
+const lastWillTag = "going_down"
+
+// lastWillTimeout is how long we wait for the last will to be gossiped
+// before dying anyway.
+const lastWillTimeout = 2 * time.Second
+
+// lastWillSignals are the signals that make us send our last will before
+// dying.
+var lastWillSignals = []os.Signal{syscall.SIGQUIT, syscall.SIGABRT}
+
+// sendLastWill advertises that we're going down for the given reason,
+// waiting at most lastWillTimeout.
+func (m *Manager) sendLastWill(reason string) {
+	logger.Errorf("Going down due to %s; telling our peers", reason)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.gossip.SetTag(lastWillTag, reason)
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			logger.Errorf("Failed to tell our peers that we're going down: %s", err)
+			return
+		}
+		// Setting the tag only queues it to be gossiped, so we give
+		// it a moment to get out.
+		time.Sleep(lastWillTimeout / 2)
+	case <-time.After(lastWillTimeout):
+		logger.Errorf("Timed out telling our peers that we're going down")
+	}
+}
+
+// recoverLastWill sends our last will if the Run loop is panicking, and
+// then carries on panicking. It must be deferred directly by Run.
+func (m *Manager) recoverLastWill() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	m.sendLastWill(fmt.Sprintf("panic: %v", r))
+	panic(r)
+}
+
+// watchLastWillSignals sends our last will when we receive any of
+// lastWillSignals, and then has the signal kill us as usual. It stops
+// watching once doneCh is closed.
+func (m *Manager) watchLastWillSignals(doneCh <-chan struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, lastWillSignals...)
+	go func() {
+		defer signal.Stop(sigCh)
+		select {
+		case sig := <-sigCh:
+			m.sendLastWill(sig.String())
+			signal.Reset(sig)
+			syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+		case <-doneCh:
+		}
+	}()
+}
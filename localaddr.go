@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// This file notices when the address of our local interface changes, as
+// it can when DHCP or a cloud provider's failover assigns the host a new
+// primary address, and moves us over to the new one.
+//
+// The address we choose at startup (see interfaceIPAddr) is the one that
+// Serf binds to and advertises in our "int_ip" tag, and the one our
+// tunnels listen on, so once it has gone away we can neither gossip nor
+// accept tunnels. When we see it change we therefore restart Serf bound
+// to the new address (see Gossip.Rebind), and tunnels started from then
+// on listen on the new address. Tunnels that are already running are left
+// alone: if they still work then there's no reason to disturb them, and if
+// they don't then they'll be restarted on the new address in the usual
+// way once OpenVPN gives up on them.
+//
+// Our region, datacenter and endpoint id all derive from our address, so
+// we can't move to an address that changes any of them without becoming
+// a different endpoint. That needs a restart, which we leave to an
+// operator.
+
+// localAddrCheckInterval is how often we re-check our local interface's
+// address.
+const localAddrCheckInterval = 30 * time.Second
+
+// checkLocalAddr re-checks our local interface's address, moving gossip
+// over to it if it has changed. It is used only by the Run loop.
+func (m *Manager) checkLocalAddr() {
+	localIP, err := interfaceIPAddr(m.localInterface, m.localNet, m.localIPv6)
+	if err != nil {
+		// The interface may be between addresses, so we'll look again
+		// next time.
+		logger.Debugf("Can't check local address: %s", err)
+		return
+	}
+	if localIP == m.localIP || localIP == m.rejectedLocalIP {
+		return
+	}
+
+	oldAddr := m.addressing.Address(m.localIP)
+	newAddr := m.addressing.Address(localIP)
+	if id := m.addressing.LocalEndpointId; id != nil {
+		oldAddr = oldAddr.WithEndpointId(*id)
+		newAddr = newAddr.WithEndpointId(*id)
+	}
+	if newAddr.RegionId() != oldAddr.RegionId() || newAddr.DatacenterId() != oldAddr.DatacenterId() || newAddr.EndpointId() != oldAddr.EndpointId() {
+		logger.Errorf(
+			"The address of %s has changed from %s to %s, which is in a different datacenter; restart to use the new address",
+			m.localInterface, m.localIP, localIP,
+		)
+		m.rejectedLocalIP = localIP
+		return
+	}
+
+	logger.Warnf("The address of %s has changed from %s to %s, so moving gossip and new tunnels to it", m.localInterface, m.localIP, localIP)
+	m.localIP = localIP
+	m.rejectedLocalIP = ""
+	m.gossip.Rebind(localIP)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message. Messages below the
+// configured level are discarded.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug: "DEBUG",
+	LogInfo:  "INFO",
+	LogWarn:  "WARN",
+	LogError: "ERROR",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel parses a level name as used in the log_level setting.
+// The empty string selects LogInfo.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return LogDebug, nil
+	case "", "INFO":
+		return LogInfo, nil
+	case "WARN", "WARNING":
+		return LogWarn, nil
+	case "ERROR":
+		return LogError, nil
+	default:
+		return LogInfo, fmt.Errorf("invalid log level %q; must be debug, info, warn or error", s)
+	}
+}
+
+// Logger is the interface through which all of our log output is written.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// Enabled returns true if messages at the given level will be written,
+	// so that callers can skip preparing expensive debug output.
+	Enabled(level LogLevel) bool
+}
+
+// logger is the Logger used throughout this program. main configures it
+// once the settings have been loaded.
+var logger = NewLevelLogger(os.Stderr)
+
+// LevelLogger is the standard Logger implementation, which writes either
+// human-friendly text or one JSON object per line to an io.Writer.
+//
+// The text format matches that of the standard "log" package, with
+// a level prefix on all but INFO messages.
+type LevelLogger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level LogLevel
+	json  bool
+}
+
+func NewLevelLogger(out io.Writer) *LevelLogger {
+	return &LevelLogger{
+		out:   out,
+		level: LogInfo,
+	}
+}
+
+// Configure sets the minimum level and the output format, which must be
+// either "text" or "json". The empty string selects "text".
+func (l *LevelLogger) Configure(level LogLevel, format string) error {
+	var useJSON bool
+	switch format {
+	case "", "text":
+		useJSON = false
+	case "json":
+		useJSON = true
+	default:
+		return fmt.Errorf("invalid log format %q; must be text or json", format)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.level = level
+	l.json = useJSON
+	return nil
+}
+
+func (l *LevelLogger) Enabled(level LogLevel) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return level >= l.level
+}
+
+func (l *LevelLogger) Debugf(format string, args ...interface{}) {
+	l.write(LogDebug, format, args)
+}
+
+func (l *LevelLogger) Infof(format string, args ...interface{}) {
+	l.write(LogInfo, format, args)
+}
+
+func (l *LevelLogger) Warnf(format string, args ...interface{}) {
+	l.write(LogWarn, format, args)
+}
+
+func (l *LevelLogger) Errorf(format string, args ...interface{}) {
+	l.write(LogError, format, args)
+}
+
+func (l *LevelLogger) write(level LogLevel, format string, args []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	var line []byte
+	if l.json {
+		line, _ = json.Marshal(struct {
+			Time    string `json:"time"`
+			Level   string `json:"level"`
+			Message string `json:"msg"`
+		}{
+			Time:    now.Format(time.RFC3339Nano),
+			Level:   strings.ToLower(level.String()),
+			Message: msg,
+		})
+	} else {
+		prefix := ""
+		if level != LogInfo {
+			prefix = "[" + level.String() + "] "
+		}
+		line = []byte(now.Format("2006/01/02 15:04:05 ") + prefix + strings.TrimSuffix(msg, "\n"))
+	}
+	line = append(line, '\n')
+
+	l.out.Write(line)
+}
@@ -3,28 +3,62 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"sort"
 )
 
 func main() {
-
 	flag.Parse()
 	args := flag.Args()
+
+	if len(args) > 0 {
+		if cmd, ok := subcommands[args[0]]; ok {
+			err := cmd.Run(args[1:])
+			if err == errUsage {
+				fmt.Fprintf(os.Stderr, "Usage: openvpn-peer %s\n", cmd.Usage)
+				os.Exit(2)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	if len(args) > 1 {
 		fmt.Fprintf(os.Stderr, "Usage: openvpn-peer [config-file]\n")
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "All settings may also be set via environment variables.\n\n")
+		fmt.Fprintf(os.Stderr, "All settings may also be set via environment variables. A setting\n")
+		fmt.Fprintf(os.Stderr, "given in the config file takes precedence over the environment.\n\n")
+		fmt.Fprintf(os.Stderr, "Other commands:\n")
+		names := make([]string, 0, len(subcommands))
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  openvpn-peer %s\n", subcommands[name].Usage)
+		}
+		fmt.Fprintf(os.Stderr, "\n")
 		os.Exit(2)
 	}
-	var config *Config
-	var err error
+	var configFile string
 	if len(args) == 1 {
-		config, err = ConfigFromFile(args[0])
-	} else {
-		config, err = ConfigFromEnv()
+		configFile = args[0]
+	}
+	loadConfig := func() (*Config, error) {
+		return LoadConfig(configFile)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
 	}
+
+	err = config.ConfigureLogging()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(2)
@@ -36,19 +70,18 @@ func main() {
 		os.Exit(2)
 	}
 
-	mgr.Run()
+	mgr.SetConfigLoader(loadConfig)
+	err = mgr.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n\n", err)
+		os.Exit(1)
+	}
 
 }
 
 func othermain() {
-	remoteAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1195")
-	if err != nil {
-		panic(err)
-	}
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1194")
-	if err != nil {
-		panic(err)
-	}
+	remoteAddr := &VPNAddr{IP: net.ParseIP("127.0.0.1"), Port: 1195}
+	localAddr := &VPNAddr{IP: net.ParseIP("127.0.0.1"), Port: 1194}
 	tunnelRemoteAddr := net.ParseIP("10.8.0.2")
 	tunnelLocalAddr := net.ParseIP("10.8.0.1")
 
@@ -81,6 +114,6 @@ func othermain() {
 	var state VPNState
 	for state != VPNExited {
 		state = openVPN.AwaitStateChange()
-		log.Printf("VPN state is now %d", state)
+		logger.Infof("VPN state is now %d", state)
 	}
 }
@@ -1,40 +1,421 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"os"
-	"path"
+	"os/signal"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// shutdownTimeout is how long we will wait for our OpenVPN processes to
+// exit after politely asking them to, before we resort to killing them.
+// The same timeout then applies again to waiting for the killed processes.
+const shutdownTimeout = 10 * time.Second
+
+// If the initial join fails then we retry it, doubling the wait after
+// each failure up to initialJoinRetryMax.
+const (
+	initialJoinRetryBase = time.Second
+	initialJoinRetryMax  = time.Minute
 )
 
 type Manager struct {
 	gossip             *Gossip
 	initialGossipPeers []string
-	secretFilename     string
+	refreshInterval    time.Duration
+	tunnelStartTimeout time.Duration
+	tunnelStartJitter  time.Duration
+	tunnelWatchdog     time.Duration
+	tunnelStats        time.Duration
+	tunnelSLA          time.Duration
+	maxTunnelStarts    int
+	maxTunnels         int
+	openVPNPath        string
+	openVPNCaps        *OpenVPNCapabilities
+	keepaliveInterval  time.Duration
+	keepaliveTimeout   time.Duration
+	fallbackRouteOpts  FallbackRouteOptions
+	routeFailoverDelay time.Duration
+	neighborScoring    string
+	routeRecoveryDelay time.Duration
+	routeMinMembers    int
+	routeSettleTime    time.Duration
+	readyTunnelPercent int
+	keyring            *VPNKeyring
+	vpnCipher          string
+	vpnAuth            string
+	vpnCompression     string
+	vpnTransport       string
+	vpnKeyMode         string
+	vpnDCO             bool
+	tlsCAFile          string
+	tlsCertFile        string
+	tlsKeyFile         string
+	tlsCRLFile         string
+	vpnTopology        string
+	tunMTU             int
+	mssFix             int
+	fragment           int
+	runtimeDir         string
+	mgmtPortBase       int
+	mgmtPasswordFile   string
+	openVPNUser        string
+	openVPNExtraArgs   []string
+	openVPNGroup       string
+	mode               string
+	dryRun             bool
+	httpAddr           string
+	controlSocket      string
+	metrics            *Metrics
+
+	// tunnelsFile is where we record our tunnels, or empty if we don't.
+	// savedTunnels is what we most recently recorded there. See
+	// tunnelstore.go.
+	tunnelsFile  string
+	savedTunnels []savedTunnel
+
+	events *eventBroker
+
+	// kvSnapshotter publishes our view of the cluster to Consul KV, or
+	// is nil if that isn't enabled. See consulkv.go.
+	kvSnapshotter *kvSnapshotter
+
+	// notifyTracker tells an operator about significant changes, or is
+	// nil if notifications aren't enabled. See notify.go.
+	notifyTracker *notifyTracker
+
+	// audit records tunnel state transitions and membership changes, or
+	// is nil if the audit log isn't enabled. See audit.go.
+	audit *auditLog
+
+	// tunnelMgr is created by the Run loop before the HTTP API starts,
+	// and never changes after that.
+	tunnelMgr *TunnelMgr
+
+	// routeMgr is created by the Run loop alongside tunnelMgr. It is nil
+	// unless we're in full mode, since we otherwise never install routes.
+	// See mode.go. routeDamper and
+	// routeGate are used only by the Run loop, and are nil whenever
+	// routeMgr is.
+	routeMgr    *RouteMgr
+	routeDamper *routeDamper
+	routeGate   *routeGate
+
+	// config is the configuration we're currently running with, and
+	// loadConfig, if set, re-loads it from its source when we receive
+	// SIGHUP. These are used only by the Run loop.
+	config     *Config
+	loadConfig func() (*Config, error)
+
+	// stateLock guards the latest states below, which are written by
+	// the Run loop and read by the HTTP API. See health.go for readiness.
+	stateLock    sync.RWMutex
+	clusterState *ClusterState
+	tunnelState  *TunnelsState
+	readiness    readiness
+
+	// shutdownCh is closed to ask the Run loop to tear everything down,
+	// and doneCh is closed by the Run loop once it has finished doing so.
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+	doneCh       chan struct{}
+
+	// drainCh carries requests from Drain and Undrain to the Run loop.
+	// drainingSince is when we started draining, or zero if we aren't,
+	// and is used only by the Run loop. See drain.go.
+	drainCh       chan bool
+	drainingSince time.Time
+
+	// reloadCh carries requests from Reload to the Run loop.
+	reloadCh chan struct{}
+
+	// localIP is the address of localInterface that we're using, chosen
+	// as described by interfaceIPAddr, and rejectedLocalIP is an address
+	// it has since changed to that we can't use. These are used only by
+	// the Run loop. See localaddr.go.
+	localInterface  string
+	localNet        *net.IPNet
+	localIPv6       bool
+	localIP         string
+	rejectedLocalIP string
+	addressing      *Addressing
 }
 
 func NewManager(config *Config) (*Manager, error) {
 
-	var err error
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshInterval, err := config.RefreshIntervalDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelStartTimeout, err := config.TunnelStartTimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelStartJitter, err := config.TunnelStartJitterDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	keepaliveInterval, keepaliveTimeout, err := config.KeepaliveDurations()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelWatchdogTimeout, err := config.TunnelWatchdogTimeoutDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelStatsInterval, err := config.TunnelStatsIntervalDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelEstablishSLA, err := config.TunnelEstablishSLADuration()
+	if err != nil {
+		return nil, err
+	}
+
+	routeFailoverDelay, routeRecoveryDelay, err := config.RouteDampingDelays()
+	if err != nil {
+		return nil, err
+	}
+
+	routeMinMembers := config.RouteMinMembers
+	if routeMinMembers == 0 {
+		routeMinMembers = DefaultRouteMinMembers
+	}
+	readyTunnelPercent := config.ReadyTunnelPercent
+	if readyTunnelPercent == 0 {
+		readyTunnelPercent = DefaultReadyTunnelPercent
+	}
+	routeSettleTime, err := config.RouteSettleTimeDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	localNet, err := config.LocalAddressNet()
+	if err != nil {
+		return nil, err
+	}
 
-	localIP, err := interfaceIPAddr(config.LocalInterface)
+	localIP, err := interfaceIPAddr(config.LocalInterface, localNet, config.IPv6())
 	if err != nil {
 		return nil, err
 	}
 
-	err = os.MkdirAll(config.DataDir, os.ModeDir|0755)
+	err = prepareDataDir(config.DataDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create %s: %s", config.DataDir, err)
+		return nil, err
 	}
 
-	addressing := &Addressing{
-		CommonPrefixLen:      config.CommonPrefixLen,
-		RegionPrefixLen:      config.RegionPrefixLen,
-		DCPrefixLen:          config.DCPrefixLen,
-		LocalIPAddr:          net.ParseIP(localIP),
-		VPNEndpointStartPort: config.VPNEndpointStartPort,
+	// Only we and the root-owned OpenVPN processes need access to the
+	// management sockets in the runtime directory.
+	if config.RuntimeDir != "" {
+		err = os.MkdirAll(config.RuntimeDir, os.ModeDir|0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %s", config.RuntimeDir, err)
+		}
+	}
+
+	addressing, err := NewAddressing(config, net.ParseIP(localIP))
+	if err != nil {
+		return nil, err
+	}
+
+	vpnCipher := config.VPNCipher
+	if vpnCipher == "" {
+		vpnCipher = DefaultVPNCipher
+	}
+	vpnAuth := config.VPNAuth
+	if vpnAuth == "" {
+		vpnAuth = DefaultVPNAuth
+	}
+	vpnCompression := config.VPNCompression
+	if vpnCompression == "" {
+		vpnCompression = CompressionOff
+	}
+	vpnTransport := config.VPNTransport
+	if vpnTransport == "" {
+		vpnTransport = TransportUDP
+	}
+	vpnKeyMode := config.VPNKeyMode
+	if vpnKeyMode == "" {
+		vpnKeyMode = KeyModeStatic
+	}
+	logger.Infof("Tunnels will use cipher %s with auth digest %s", vpnCipher, vpnAuth)
+	if vpnKeyMode == KeyModeTLS {
+		logger.Infof("Tunnels will use TLS with the certificate in %s", config.TLSCertFile)
+	}
+	if vpnCompression != CompressionOff {
+		logger.Infof("Tunnels to endpoints that also use %s compression will be compressed", vpnCompression)
+	}
+
+	openVPNPath := config.OpenVPNPath
+	if openVPNPath == "" {
+		openVPNPath = DefaultOpenVPNPath
+	}
+
+	// If the key files are encrypted then we decrypt them once here and
+	// keep them in memory, so the passphrase isn't needed again.
+	keyring, err := LoadVPNKeyring(config)
+	if err != nil {
+		return nil, err
+	}
+
+	gossipKeys, err := LoadGossipKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	var gossipKeyring *memberlist.Keyring
+	if gossipKeys != nil {
+		gossipKeyring, err = gossipKeys.Keyring()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var audit *auditLog
+	if config.AuditLog {
+		auditLogMaxMB := config.AuditLogMaxMB
+		if auditLogMaxMB == 0 {
+			auditLogMaxMB = DefaultAuditLogMaxMB
+		}
+		audit, err = openAuditLog(auditLogPath(config.DataDir), int64(auditLogMaxMB)<<20)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var tunnelsFile string
+	if config.PersistTunnels {
+		tunnelsFile = tunnelsFilePath(config.DataDir)
+	}
+
+	gossipTimings, err := config.GossipTimings()
+	if err != nil {
+		return nil, err
+	}
+
+	gossipBindRetries := config.GossipBindRetries
+	if gossipBindRetries == 0 {
+		gossipBindRetries = DefaultGossipBindRetries
+	}
+
+	maxTunnels := config.MaxTunnels
+	if maxTunnels == 0 {
+		maxTunnels = DefaultMaxTunnels
+	}
+
+	// Our own tags are merged with any arbitrary ones that the
+	// operator has set, which Validate has already checked don't
+	// collide with ours.
+	gossipTags := make(map[string]string, len(config.Tags))
+	for key, value := range config.Tags {
+		gossipTags[key] = value
+	}
+	for key, value := range map[string]string{
+		// We advertise our cipher settings so that peers can
+		// detect a mismatch before trying to connect.
+		"vpn_cipher": vpnCipher,
+		"vpn_auth":   vpnAuth,
+
+		// Compression must match too, but a mismatch just means we
+		// don't compress.
+		"vpn_compression": vpnCompression,
+
+		// Tunnels to us will use TCP if we prefer it.
+		"vpn_transport": vpnTransport,
+
+		// Tunnels can't be established at all unless the key mode
+		// matches.
+		vpnKeyModeTag: vpnKeyMode,
+
+		keyGenerationsTag: formatKeyGenerations(keyring.Generations()),
+	} {
+		gossipTags[key] = value
+	}
+	if len(config.ServedNetworks) != 0 {
+		// Peers route these networks to us as well as our datacenter's.
+		// Validate has already checked that they parse.
+		networks := make([]string, len(config.ServedNetworks))
+		for i, raw := range config.ServedNetworks {
+			_, network, _ := net.ParseCIDR(raw)
+			networks[i] = network.String()
+		}
+		gossipTags[servedNetworksTag] = strings.Join(networks, ",")
+	}
+	if config.PeerSelector != "" {
+		// Peers use this to decide whether we want a tunnel to them.
+		// See wantTunnel. Validate has already checked that it parses.
+		selector, _ := ParsePeerSelector(config.PeerSelector)
+		if len(selector) > 0 {
+			gossipTags[peerSelectorTag] = selector.String()
+		}
+	}
+	if addressing.LocalEndpointId != nil {
+		logger.Warnf(
+			"endpoint_id_override is set, so using endpoint id %s instead of the one derived from %s; this is a development mode that must not be used in production",
+			*addressing.LocalEndpointId, localIP,
+		)
+		gossipTags[endpointIdTag] = addressing.LocalEndpointId.String()
+	}
+	if config.VPNPort != 0 {
+		// Peers dial this port for tunnels instead of the one derived
+		// from our endpoint id. See Endpoint.VPNEndpointPorts.
+		logger.Infof("Using port %d for our end of every tunnel", config.VPNPort)
+		gossipTags[vpnPortTag] = strconv.Itoa(config.VPNPort)
+	}
+	if config.VPNTopology == VPNTopologySubnet {
+		// The two ends of a tunnel choose its addresses independently,
+		// so peers refuse tunnels to us unless they use it too.
+		gossipTags[vpnTopologyTag] = config.VPNTopology
+	}
+	if pairKeys := keyring.PairKeys(addressing.LocalAddress().RegionId()); len(pairKeys) != 0 {
+		// Peers use a region pair's key only once both ends have the
+		// same one. See keyring.go.
+		gossipTags[pairKeysTag] = formatPairKeys(pairKeys)
+	}
+	if config.Fragment != 0 {
+		// Fragmenting only works if both ends do it, so peers refuse
+		// UDP tunnels to us unless they fragment to the same size.
+		gossipTags[vpnFragmentTag] = strconv.Itoa(config.Fragment)
+	}
+	if config.PublicIPAddress != "" {
+		// Peers dial this address for tunnels, even if Serf ends up
+		// seeing us at a different one.
+		gossipTags["vpn_endpoint_ip"] = config.PublicIPAddress
+	}
+	if topology := config.Topology(); topology != TopologyMesh {
+		// Endpoints that don't advertise a topology are using mesh.
+		gossipTags["topology"] = topology
+	}
+	if config.Hub {
+		gossipTags["hub"] = "1"
+	}
+	if mode := config.RunMode(); mode != ModeFull {
+		// Peers don't route through us unless we install routes.
+		gossipTags[modeTag] = mode
 	}
 
 	gossip := NewGossip(&GossipConfig{
@@ -42,206 +423,1142 @@ func NewManager(config *Config) (*Manager, error) {
 		ListenIPAddr:    localIP,
 		AdvertiseIPAddr: config.PublicIPAddress,
 		Port:            config.GossipPort,
-		DataDir:         path.Join(config.DataDir, "serf"),
+		PortRange:       config.GossipPortRange,
+		BindRetries:     gossipBindRetries,
+		DataDir:         gossipSnapshotPath(config.DataDir),
 		Addressing:      addressing,
+		Observer:        config.RunMode() == ModeObserve,
+		Keyring:         gossipKeyring,
+		KeyringFile:     config.GossipKeyringFile,
+		Tags:            gossipTags,
+		Profile:         config.GossipProfile,
+		Timings:         gossipTimings,
+		Audit:           audit,
 	})
 
+	notifyGracePeriod, err := config.NotifyGracePeriodDuration()
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := NewNotifier(config)
+	if err != nil {
+		return nil, err
+	}
+	var tracker *notifyTracker
+	if notifier != nil {
+		tracker = newNotifyTracker(notifier, notifyGracePeriod)
+	}
+
+	var snapshotter *kvSnapshotter
+	if config.ConsulKVSnapshot && modeInstallsRoutes(config.RunMode()) {
+		consulAddr := config.ConsulAddr
+		if consulAddr == "" {
+			consulAddr = DefaultConsulAddr
+		}
+		kvPrefix := config.ConsulKVPrefix
+		if kvPrefix == "" {
+			kvPrefix = DefaultConsulKVPrefix
+		}
+		snapshotter = newKVSnapshotter(consulAddr, config.ConsulToken, kvPrefix)
+	}
+
 	return &Manager{
 		gossip:             gossip,
 		initialGossipPeers: config.InitialPeers,
-		secretFilename:     config.VPNKeyFilename,
+		refreshInterval:    refreshInterval,
+		tunnelStartTimeout: tunnelStartTimeout,
+		tunnelStartJitter:  tunnelStartJitter,
+		tunnelWatchdog:     tunnelWatchdogTimeout,
+		tunnelStats:        tunnelStatsInterval,
+		tunnelSLA:          tunnelEstablishSLA,
+		maxTunnelStarts:    config.MaxTunnelStarts,
+		maxTunnels:         maxTunnels,
+		openVPNPath:        openVPNPath,
+		keepaliveInterval:  keepaliveInterval,
+		keepaliveTimeout:   keepaliveTimeout,
+		fallbackRouteOpts: FallbackRouteOptions{
+			Metric: config.FallbackRouteMetric,
+			Realm:  config.FallbackRouteRealm,
+		},
+		routeFailoverDelay: routeFailoverDelay,
+		neighborScoring:    config.NeighborScoring,
+		routeRecoveryDelay: routeRecoveryDelay,
+		routeMinMembers:    routeMinMembers,
+		routeSettleTime:    routeSettleTime,
+		readyTunnelPercent: readyTunnelPercent,
+		keyring:            keyring,
+		vpnCipher:          vpnCipher,
+		vpnAuth:            vpnAuth,
+		vpnCompression:     vpnCompression,
+		vpnTransport:       vpnTransport,
+		vpnKeyMode:         vpnKeyMode,
+		vpnDCO:             config.VPNDCO,
+		tlsCAFile:          config.TLSCAFile,
+		tlsCertFile:        config.TLSCertFile,
+		tlsKeyFile:         config.TLSKeyFile,
+		tlsCRLFile:         config.TLSCRLFile,
+		vpnTopology:        config.VPNTopology,
+		tunMTU:             config.TunMTU,
+		mssFix:             config.MSSFix,
+		fragment:           config.Fragment,
+		runtimeDir:         config.RuntimeDir,
+		mgmtPortBase:       config.ManagementPortBase,
+		mgmtPasswordFile:   config.ManagementPasswordFile,
+		openVPNUser:        config.OpenVPNUser,
+		openVPNExtraArgs:   config.OpenVPNExtraArgs,
+		openVPNGroup:       config.OpenVPNGroup,
+		mode:               config.RunMode(),
+		dryRun:             config.DryRun,
+		httpAddr:           config.HTTPAddr,
+		controlSocket:      config.ControlSocket,
+		tunnelsFile:        tunnelsFile,
+		metrics:            NewMetrics(),
+		events:             newEventBroker(),
+		kvSnapshotter:      snapshotter,
+		notifyTracker:      tracker,
+		audit:              audit,
+		config:             config,
+		shutdownCh:         make(chan struct{}),
+		doneCh:             make(chan struct{}),
+		drainCh:            make(chan bool),
+		reloadCh:           make(chan struct{}),
+		localInterface:     config.LocalInterface,
+		localNet:           localNet,
+		localIPv6:          config.IPv6(),
+		localIP:            localIP,
+		addressing:         addressing,
 	}, nil
 }
 
-// Run begins the process of managing the local tunnel configuration.
+// SetConfigLoader registers a function that the manager will use to
+// re-load its configuration when it receives SIGHUP.
 //
-// This function returns only if there is an error while starting up.
-func (m *Manager) Run() {
-	clusterStateCh := make(chan *ClusterState)
-	go m.gossip.Start(clusterStateCh)
+// The newly-loaded configuration is merged over the current one using
+// Config.Override. Only the settings named in reloadableSettings are
+// applied at runtime; changes to any others are logged as requiring
+// a restart.
+func (m *Manager) SetConfigLoader(load func() (*Config, error)) {
+	m.loadConfig = load
+}
 
-	// Wait for initial state so we know that Serf is ready to join
-	clusterState := <-clusterStateCh
+// Run manages the local tunnel configuration until the manager is shut
+// down, returning once the shutdown process has completed. It installs a
+// handler for SIGINT and SIGTERM that calls Shutdown, and returns an
+// error only if it was unable to start or gossip later failed.
+func (m *Manager) Run() error {
+	defer close(m.doneCh)
+	defer m.audit.Close()
+	defer m.recoverLastWill()
 
-	if len(m.initialGossipPeers) != 0 {
-		joined, err := m.gossip.Join(m.initialGossipPeers)
+	// Tunnels would only fail later, and more confusingly, if OpenVPN
+	// isn't up to the job.
+	if modeRunsTunnels(m.mode) && !m.dryRun {
+		caps, err := DetectOpenVPNCapabilities(DefaultLauncherPath, m.openVPNPath)
 		if err != nil {
-			log.Printf("Initial join failed: %s", err)
-		} else {
-			log.Printf("Joined a cluster by contacting %d nodes", joined)
+			return err
+		}
+		err = caps.Check(&VPNConfig{Compression: m.vpnCompression, KeyMode: m.vpnKeyMode, DCO: m.vpnDCO})
+		if err != nil {
+			return err
+		}
+		logger.Infof("Using %s", caps.Version)
+		switch {
+		case m.vpnDCO:
+			logger.Infof("Tunnels will use OpenVPN data channel offload where they can")
+		case caps.DCO:
+			logger.Infof("OpenVPN data channel offload is available, but tunnels won't use it unless vpn_dco is set")
+		}
+		m.openVPNCaps = caps
+
+		// A crashed earlier run may have left tunnels behind, which
+		// would conflict with the ones we're about to start.
+		m.reapOrphans()
+
+		// It may also have left decrypted copies of the keys behind,
+		// which its tunnels no longer need now that they're gone.
+		removeStaleSecretKeys()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case sig := <-sigCh:
+			logger.Infof("Received %s, shutting down", sig)
+			m.Shutdown()
+		case <-m.doneCh:
 		}
+	}()
+
+	if m.kvSnapshotter != nil {
+		m.kvSnapshotter.Start(m.doneCh)
+	}
+	if m.notifyTracker != nil {
+		m.notifyTracker.Start(m.doneCh)
+	}
+
+	// If we return without shutting down properly then cancelling this
+	// makes us leave the gossip pool regardless.
+	gossipCtx, cancelGossip := context.WithCancel(context.Background())
+	defer cancelGossip()
+
+	clusterStateCh := m.gossip.Changes()
+	gossipErrCh := make(chan error, 1)
+	go func() {
+		gossipErrCh <- m.gossip.Start(gossipCtx)
+	}()
+
+	// Wait for initial state so we know that Serf is ready to join
+	var clusterState *ClusterState
+	select {
+	case clusterState = <-clusterStateCh:
+	case err := <-gossipErrCh:
+		return fmt.Errorf("failed to start gossip: %s", err)
+	}
+	m.watchLastWillSignals(m.doneCh)
+
+	if len(m.initialGossipPeers) != 0 {
+		go m.joinInitialPeers(m.initialGossipPeers)
+	}
+
+	switch m.mode {
+	case ModeObserve:
+		logger.Infof("Running as an observer, so no tunnels or routes will be created")
+	case ModeTunnelsOnly:
+		logger.Infof("Running in tunnels-only mode, so no routes will be installed and nothing will be published to Consul")
+	}
+	if m.dryRun {
+		logger.Warnf("Running in dry run mode, so tunnel and route changes will only be logged")
 	}
 
-	tunnelStateCh := make(chan *TunnelsState)
 	tunnelState := &TunnelsState{
 		Tunnels: []*Tunnel{},
 	}
 	tunnelMgr := NewTunnelMgr(&TunnelMgrConfig{
-		SecretFilename: m.secretFilename,
-		LocalEndpoint:  clusterState.ThisEndpoint,
-	}, tunnelStateCh)
-
-	// For now we'll re-evaluate things every 10 seconds.
-	// This is far too often for a production system, but is useful at
-	// this early stage while we're debugging. In practice probably
-	// something more like 15 minutes would make sense, just to ensure
-	// we detect any configuration drift somewhat close to its cause.
+		Keyring:       m.keyring,
+		LocalEndpoint: clusterState.ThisEndpoint,
+		Metrics:       m.metrics,
+		VPNConfig: VPNConfig{
+			OpenVPNPath:  m.openVPNPath,
+			Capabilities: m.openVPNCaps,
+			// TODO: Make this configurable, like openvpn_path.
+			LauncherPath: DefaultLauncherPath,
+
+			Cipher:       m.vpnCipher,
+			Auth:         m.vpnAuth,
+			Compression:  m.vpnCompression,
+			Transport:    m.vpnTransport,
+			KeyMode:      m.vpnKeyMode,
+			DCO:          m.vpnDCO,
+			CAFilename:   m.tlsCAFile,
+			CertFilename: m.tlsCertFile,
+			KeyFilename:  m.tlsKeyFile,
+			CRLFilename:  m.tlsCRLFile,
+			Topology:     m.vpnTopology,
+			TunMTU:       m.tunMTU,
+			MSSFix:       m.mssFix,
+			Fragment:     m.fragment,
+			RuntimeDir:   m.runtimeDir,
+			User:         m.openVPNUser,
+			Group:        m.openVPNGroup,
+			StartTimeout: m.tunnelStartTimeout,
+			ExtraArgs:    m.openVPNExtraArgs,
+
+			StatsInterval: m.tunnelStats,
+
+			ManagementPasswordFile: m.mgmtPasswordFile,
+
+			KeepaliveInterval: m.keepaliveInterval,
+			KeepaliveTimeout:  m.keepaliveTimeout,
+		},
+		MaxConcurrentStarts: m.maxTunnelStarts,
+		StartJitter:         m.tunnelStartJitter,
+		WatchdogTimeout:     m.tunnelWatchdog,
+		EstablishSLA:        m.tunnelSLA,
+		Audit:               m.audit,
+		ManagementPortBase:  m.mgmtPortBase,
+		DryRun:              m.dryRun,
+	})
+	m.tunnelMgr = tunnelMgr
+	tunnelStateCh := tunnelMgr.Changes()
+	if m.tunnelsFile != "" && modeRunsTunnels(m.mode) {
+		m.restoreTunnels(tunnelMgr, clusterState.ThisEndpoint.Address())
+	}
+
+	if modeInstallsRoutes(m.mode) {
+		var routeBackend RouteBackend = &ipRouteBackend{
+			IPPath: "/sbin/ip",
+			// TODO: Make this configurable, like the OpenVPN launcher.
+			LauncherPath: DefaultLauncherPath,
+		}
+		if m.dryRun {
+			routeBackend = dryRunRouteBackend{}
+		}
+		m.routeMgr = NewRouteMgr(routeBackend)
+		m.routeDamper = newRouteDamper(m.routeFailoverDelay, m.routeRecoveryDelay)
+		m.routeGate = newRouteGate(m.routeMinMembers, m.routeSettleTime, time.Now())
+	}
+
+	m.setLatestState(clusterState, tunnelState)
+	if m.httpAddr != "" {
+		listener, err := m.startHTTP(m.httpAddr)
+		if err != nil {
+			logger.Errorf("Failed to start HTTP API: %s", err)
+		} else {
+			logger.Infof("HTTP API listening on %s", listener.Addr())
+			defer listener.Close()
+		}
+	}
+	if m.controlSocket != "" {
+		listener, err := m.startControl(m.controlSocket)
+		if err != nil {
+			logger.Errorf("Failed to start control socket: %s", err)
+		} else {
+			logger.Infof("Control socket listening on %s", m.controlSocket)
+			defer listener.Close()
+		}
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	// We re-evaluate things periodically even if nothing has changed,
+	// as a backstop against any configuration drift.
 	//
 	// This ticking also gives us an opportunity to re-evaluate our
 	// closest nodes as Serf gets updated data about node round-trip times.
-	refreshTime := 10 * time.Second
-	timeout := time.NewTimer(refreshTime)
+	timeout := time.NewTimer(m.refreshInterval)
+
+	// Our local address is re-checked less often, since it rarely
+	// changes. See localaddr.go.
+	localAddrTicker := time.NewTicker(localAddrCheckInterval)
+	defer localAddrTicker.Stop()
+
+	// reconciledCluster is the cluster state we most recently acted on.
+	var reconciledCluster *ClusterState
 
 	for {
-		// There are actually several different things we're managing
-		// here:
-		//
-		// - The set of all known remote endpoints from Serf becomes our
-		//   set of Consul tunnel services. Their health is determined by
-		//   the Serf health status, whether we have an OpenVPN process
-		//   running at all, and whether the OpenVPN process is connected:
-		//       - If OpenVPN isn't running at all or if it's in the
-		//         "VPNRetrying" state then the service is Critical.
-		//       - If OpenVPN is running and it's in any state other than
-		//         "VPNConnected" or "VPNRetrying" then the service is Warning.
-		//       - If OpenVPN is running and its state is "VPNConnected"
-		//         then the service is passing.
-		//
-		// - The set of all *live* remote endpoints from Serf becomes our
-		//   *target* set of OpenVPN processes. We don't bother to run
-		//   OpenVPN processes for dead peers.
-		//
-		// - The set of all known remote endpoints from Serf is *also* used
-		//   to produce the set of destination networks to include in the
-		//   route table. The next-hop of each route entry depends on
-		//   the OpenVPN status:
-		//       - If Serf shows the remote has not alive then the next-hop
-		//         is always blackhole, because the remote endpoint is
-		//         assumed to be down for everyone (due to Serf Lifeguard).
-		//
-		//       - If OpenVPN isn't running at all or it isn't in state
-		//         VPNConnected then our next-hop gateway is the local IP
-		//         address of the nearest endpoint in the local region, which
-		//         is presumed to be usable as a fallback.
-		//         (If two neighboring endpoints both have the same tunnel
-		//         down, they will likely create a route cycle between
-		//         each other. The impact of this can be reduced by using
-		//         short TTLs on packets to local destinations.)
-		//
-		//       - If OpenVPN is in state VPNConnected then our next-hop
-		//         gateway is the *tunnel* IP address of the remote endpoint.
-		//
-		//       - If OpenVPN isn't running and there are no other endpoints
-		//         in the local region then the next-hop is blackhole.
+		clusterState = m.reconcile(clusterState, tunnelState, tunnelMgr)
+
+		if !timeout.Stop() {
+			// The timer may already have fired and been consumed by
+			// the select below, so we mustn't block here.
+			select {
+			case <-timeout.C:
+			default:
+			}
+		}
+		timeout.Reset(m.nextRefresh(tunnelMgr))
+
+		reconciledCluster = clusterState
+
+		// Now block here until the situation changes somehow.
+		// Both the Serf cluster and the OpenVPN tunnel statuses can change;
+		// either will cause us to re-evaluate our whole configuration and
+		// make changes to "repair" any inconsistencies between expected
+		// and actual states. Serf emits events for many changes that
+		// don't affect us, though, so we ignore cluster state changes that
+		// don't alter any endpoint in a way that matters.
+	Wait:
+		for {
+			changed := true
+			select {
+			case clusterState = <-clusterStateCh:
+				logger.Debugf("Cluster state changed %#v", clusterState)
+				changed = false
+			case tunnelState = <-tunnelStateCh:
+				logger.Debugf("Tunnel state changed %#v", tunnelState)
+			case <-timeout.C:
+				logger.Debugf("Periodic refresh")
+			case <-localAddrTicker.C:
+				m.checkLocalAddr()
+				changed = false
+			case <-hupCh:
+				logger.Infof("Received SIGHUP")
+				m.reload()
+			case <-m.reloadCh:
+				m.reload()
+			case draining := <-m.drainCh:
+				m.setDraining(draining)
+			case <-m.shutdownCh:
+				m.shutdown(tunnelMgr, tunnelStateCh)
+				return nil
+			case err := <-gossipErrCh:
+				// Gossip only stops of its own accord if Serf failed,
+				// and without it we'd be acting on a frozen view of
+				// the cluster, so we give up.
+				if err == nil {
+					err = fmt.Errorf("serf shut down unexpectedly")
+				}
+				logger.Errorf("Gossip has stopped: %s", err)
+				m.shutdown(tunnelMgr, tunnelStateCh)
+				return fmt.Errorf("gossip stopped: %s", err)
+			}
+
+			// We only really care about the *latest* state, so we'll suck
+			// a few more state updates out of the pipeline if we can, such
+			// that if a bunch of things change in quick succession we can
+			// act on them all at once.
+		Coalescing:
+			for i := 0; i < 16; i++ {
+				// Keep doing non-blocking reads from our channels until
+				// there's nothing left to read or until we've processed
+				// (arbitrarily) 16 events.
+				select {
+				case clusterState = <-clusterStateCh:
+				case tunnelState = <-tunnelStateCh:
+					changed = true
+
+				default:
+					// nothing left to read, so we're done for now
+					break Coalescing
+				}
+			}
+
+			if changed || !clusterState.DiffFrom(reconciledCluster).Empty() {
+				break Wait
+			}
+			logger.Debugf("Cluster state changed in ways that don't affect us")
+			m.setLatestState(clusterState, tunnelState)
+		}
+	}
+}
+
+// reconcile makes one pass of the Run loop, acting on the given states,
+// and returns the cluster state it acted on.
+//
+// A panic here would take down every tunnel along with us, so instead it
+// is logged along with the states that caused it, and the Run loop then
+// carries on as though the pass had finished. See reconcilePanicked.
+func (m *Manager) reconcile(clusterState *ClusterState, tunnelState *TunnelsState, tunnelMgr *TunnelMgr) (reconciled *ClusterState) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.reconcilePanicked(r, clusterState, tunnelState)
+			reconciled = clusterState
+		}
+	}()
+
+	// There are actually several different things we're managing
+	// here:
+	//
+	// - The set of all known remote endpoints from Serf becomes our
+	//   set of Consul tunnel services. Their health is determined by
+	//   the Serf health status, whether we have an OpenVPN process
+	//   running at all, and whether the OpenVPN process is connected:
+	//       - If OpenVPN isn't running at all or if it's in the
+	//         "VPNRetrying" or "VPNAuthFailed" state then the service
+	//         is Critical.
+	//       - If OpenVPN is running and it's in any other state than
+	//         those or "VPNConnected" then the service is Warning.
+	//       - If OpenVPN is running and its state is "VPNConnected"
+	//         then the service is passing.
+	//   With this scheme a tunnel that loses connectivity becomes
+	//   Critical after two keepalive timeout periods; see
+	//   DefaultKeepaliveInterval.
+	//
+	// - The set of all *live* remote endpoints from Serf becomes our
+	//   *target* set of OpenVPN processes. We don't bother to run
+	//   OpenVPN processes for dead peers.
+	//
+	// - The set of all known remote endpoints from Serf is *also* used
+	//   to produce the set of destination networks to include in the
+	//   route table: each endpoint's datacenter network (see
+	//   Endpoint.DestinationNetwork) and any other networks it serves
+	//   (see Endpoint.ServedNetworks). The next-hop of each route entry
+	//   depends on the OpenVPN status:
+	//       - If Serf shows the remote has not alive then the next-hop
+	//         is always blackhole, because the remote endpoint is
+	//         assumed to be down for everyone (due to Serf Lifeguard).
+	//
+	//       - If OpenVPN isn't running at all or it isn't in state
+	//         VPNConnected then our next-hop gateway is the local IP
+	//         address of the best endpoint in the local region, which
+	//         is presumed to be usable as a fallback.
+	//         (If two neighboring endpoints both have the same tunnel
+	//         down, they will likely create a route cycle between
+	//         each other. The impact of this can be reduced by using
+	//         short TTLs on packets to local destinations; see
+	//         FallbackRouteOptions.)
+	//
+	//       - If OpenVPN is in state VPNConnected then our next-hop
+	//         gateway is the *tunnel* IP address of the remote endpoint.
+	//
+	//       - If our topology means we don't run a tunnel to the remote
+	//         at all then our next-hop gateway is the tunnel IP address
+	//         of the best hub in its region that we're connected to.
+	//         See topology.go.
+	//
+	//       - If OpenVPN isn't running and there are no other endpoints
+	//         in the local region then the next-hop is blackhole.
+	//
+	//   So that a marginal link doesn't make its route flap, a tunnel
+	//   must stay down for a while before we stop routing through it
+	//   and then stay up for a while before we route through it
+	//   again. See routeDamper.
 
+	// Serf refines its network coordinates continuously without
+	// emitting events, so we take a fresh snapshot each time in order
+	// to re-evaluate which of our neighbors are nearest.
+	clusterState = m.gossip.CurrentClusterState()
+	tunnelMgr.SetLocalEndpoint(clusterState.ThisEndpoint)
+
+	m.setLatestState(clusterState, tunnelState)
+	if m.kvSnapshotter != nil {
+		m.kvSnapshotter.Update(clusterState, tunnelState)
+	}
+	if m.notifyTracker != nil {
+		m.notifyTracker.Update(clusterState, tunnelState, time.Now())
+	}
+	m.metrics.UpdateCluster(clusterState)
+	m.metrics.UpdateSnapshotErrors(m.gossip.SnapshotErrors())
+	m.metrics.UpdateTunnels(tunnelState)
+	m.metrics.UpdateBackoffs(tunnelMgr.Backoffs())
+
+	if logger.Enabled(LogDebug) {
 		PrintClusterState(clusterState)
 		PrintTunnelState(tunnelState)
+	}
 
-		endpoints := make(map[EndpointId]*Endpoint)
-		remoteEndpoints := make(EndpointSet, len(clusterState.RemoteEndpoints))
-		liveRemoteEndpoints := make(EndpointSet, len(remoteEndpoints))
-		for _, endpoint := range clusterState.RemoteEndpoints {
-			id := endpoint.Id()
-			endpoints[id] = endpoint
-			if endpoint.ExpectedAlive() {
-				remoteEndpoints.Add(id)
-			}
-			if endpoint.Alive() {
-				liveRemoteEndpoints.Add(id)
+	endpoints := make(map[EndpointId]*Endpoint)
+	remoteEndpoints := make(EndpointSet, len(clusterState.RemoteEndpoints))
+	liveRemoteEndpoints := make(EndpointSet, len(remoteEndpoints))
+	for _, endpoint := range clusterState.RemoteEndpoints {
+		id := endpoint.Id()
+		endpoints[id] = endpoint
+		if endpoint.ExpectedAlive() {
+			remoteEndpoints.Add(id)
+		}
+		// Endpoints we don't run tunnels to under our topology
+		// don't count as live for our purposes here.
+		if endpoint.Alive() && !clusterState.IsDuplicate(endpoint) && wantTunnel(clusterState.ThisEndpoint, endpoint) {
+			liveRemoteEndpoints.Add(id)
+		}
+	}
+
+	// A Consul service is registered for each remote endpoints that
+	// hasn't gracefully left the cluster, including ones that
+	// appear to have failed.
+	//gotServices := make(EndpointSet)
+	//addServices := remoteEndpoints.Subtract(gotServices)
+	//delServices := gotServices.Subtract(remoteEndpoints)
+
+	// We only create tunnels for remote endpoints that Serf believes
+	// to be alive, since if Serf isn't working we expect that OpenVPN
+	// won't work either. Observers never create tunnels at all.
+	if !modeRunsTunnels(m.mode) {
+		liveRemoteEndpoints = make(EndpointSet)
+	}
+	gotTunnels := make(EndpointSet)
+	exitingTunnels := make(EndpointSet)
+
+	for _, tunnel := range tunnelState.Tunnels {
+		id := tunnel.EndpointId
+		gotTunnels.Add(id)
+		if tunnel.State == VPNExiting {
+			exitingTunnels.Add(id)
+		}
+	}
+
+	// We need tunnels to live endpoints we don't already have tunnels
+	// for, and we must close tunnels to any other endpoints unless
+	// they are already on their way out.
+	addTunnels := liveRemoteEndpoints.Subtract(gotTunnels)
+	delTunnels := gotTunnels.Subtract(liveRemoteEndpoints).Subtract(exitingTunnels)
+
+	// Everything below looks up the endpoints we add tunnels for in
+	// endpoints, which is built from the same snapshot as
+	// liveRemoteEndpoints and so should have them all. We'd rather skip
+	// an endpoint than crash if it somehow doesn't.
+	dropMissingEndpoints(addTunnels, endpoints)
+
+	// We don't start new tunnels to endpoints that are draining, and
+	// we close our end of any tunnel to one once it has gone down.
+	// If we're draining ourselves then we start no tunnels at all,
+	// and close ours a few at a time. See drain.go.
+	for _, tunnel := range tunnelState.Tunnels {
+		id := tunnel.EndpointId
+		if endpoint := endpoints[id]; endpoint != nil && endpoint.Draining() && tunnel.State != VPNConnected && !exitingTunnels.Contains(id) {
+			delTunnels.Add(id)
+		}
+	}
+	wantTunnels := make(EndpointSet, len(liveRemoteEndpoints))
+	for id := range liveRemoteEndpoints {
+		if !endpoints[id].Draining() {
+			wantTunnels.Add(id)
+		}
+	}
+	for id := range addTunnels {
+		if endpoints[id].Draining() {
+			addTunnels.Remove(id)
+		}
+	}
+	if !m.drainingSince.IsZero() {
+		addTunnels = make(EndpointSet)
+		for id := range m.drainCloses(gotTunnels.Subtract(exitingTunnels)) {
+			delTunnels.Add(id)
+		}
+	}
+
+	// Tunnels that aren't using the key generation, compression or
+	// transport they ought to be are closed, and will then be
+	// recreated with the right settings on a subsequent pass. See
+	// keyring.go for how re-keying is coordinated.
+	for _, tunnel := range tunnelState.Tunnels {
+		id := tunnel.EndpointId
+		if !liveRemoteEndpoints.Contains(id) || exitingTunnels.Contains(id) {
+			continue
+		}
+		keyGen, ok := tunnelMgr.KeyGeneration(endpoints[id])
+		if !ok {
+			logger.Warnf("Endpoint %s no longer has a key generation in common with us, so closing its tunnel", id)
+			delTunnels.Add(id)
+		} else if keyGen != tunnel.KeyGeneration {
+			logger.Infof("Re-keying tunnel to endpoint %s from key generation %d to %d", id, tunnel.KeyGeneration, keyGen)
+			delTunnels.Add(id)
+		} else if compression := tunnelMgr.Compression(endpoints[id]); compression != tunnel.Compression {
+			logger.Infof("Restarting tunnel to endpoint %s to change compression from %s to %s", id, tunnel.Compression, compression)
+			delTunnels.Add(id)
+		} else if transport := tunnelMgr.Transport(endpoints[id]); transport != tunnel.Transport {
+			logger.Infof("Restarting tunnel to endpoint %s to change transport from %s to %s", id, tunnel.Transport, transport)
+			delTunnels.Add(id)
+		}
+	}
+
+	// We never run more than maxTunnels tunnels, as a guard against
+	// mistakes that make many more endpoints look live than really
+	// are. When we must choose, the nearest endpoints win. Our
+	// readiness then depends only on the tunnels we'll actually run.
+	skipped := 0
+	if keep := len(gotTunnels.Subtract(delTunnels)); keep+len(addTunnels) > m.maxTunnels {
+		limited := nearestEndpoints(clusterState, endpoints, addTunnels, m.maxTunnels-keep)
+		skipped = len(addTunnels) - len(limited)
+		logger.Warnf(
+			"We want %d tunnels but max_tunnels is %d, so not starting tunnels to %d endpoints; check the addressing settings and cluster membership",
+			keep+len(addTunnels), m.maxTunnels, skipped,
+		)
+		for id := range addTunnels.Subtract(limited) {
+			wantTunnels.Remove(id)
+		}
+		addTunnels = limited
+	}
+	m.metrics.UpdateTunnelLimit(skipped)
+
+	logger.Debugf("All remote endpoints: %s", remoteEndpoints)
+	logger.Debugf("All live remote endpoints: %s", liveRemoteEndpoints)
+	//logger.Debugf("Add Consul services for %s", addServices)
+	//logger.Debugf("Remove Consul services for %s", delServices)
+	logger.Debugf("Current tunnels %s", gotTunnels)
+	logger.Debugf("Add tunnels for %s", addTunnels)
+	logger.Debugf("Remove tunnels for %s", delTunnels)
+
+	// Tunnels are started in the background, a few at a time, so that
+	// we stay responsive even when many tunnels need starting.
+	tunnelMgr.PruneBackoffs(liveRemoteEndpoints)
+	tunnelMgr.PrunePendingStarts(addTunnels)
+	tunnelMgr.PruneEstablishing(addTunnels.Union(gotTunnels.Subtract(delTunnels)))
+	for _, endpointId := range addTunnels.Sorted() {
+		err := tunnelMgr.RequestStart(endpoints[endpointId])
+		if err != nil {
+			if _, ok := err.(*TunnelBackoffError); ok {
+				logger.Debugf("%s", err)
+				continue
 			}
+			logger.Errorf("Failed to start tunnel to endpoint %s: %s", endpointId, err)
+			continue
+		}
+	}
+	for _, endpointId := range delTunnels.Sorted() {
+		err := tunnelMgr.CloseTunnel(endpointId)
+		if err != nil {
+			logger.Errorf("Failed to signal endpoint %s tunnel to close: %s", endpointId, err)
+			continue
+		}
+	}
+
+	if m.tunnelsFile != "" {
+		m.saveTunnels(clusterState.ThisEndpoint.Address(), tunnelState, tunnelMgr)
+	}
+
+	// Until the cluster has had a chance to form we leave the routes
+	// alone, since we'd otherwise blackhole every network we can't
+	// yet see. Tunnels and gossip are unaffected. See routeGate.
+	if m.routeMgr != nil && m.routeGate.Open(clusterState, time.Now()) {
+		m.routeDamper.Prune(remoteEndpoints)
+		connected := m.routeDamper.Update(tunnelState.Connected(), time.Now())
+		for _, err := range m.routeMgr.Sync(desiredRoutes(clusterState, connected, m.scorer(tunnelMgr), m.fallbackRouteOpts)) {
+			logger.Errorf("%s", err)
 		}
+	}
+
+	ready := m.checkReadiness(wantTunnels, tunnelState)
+	m.stateLock.Lock()
+	m.readiness = ready
+	m.stateLock.Unlock()
+
+	return clusterState
+}
+
+// reconcilePanicked reports a panic recovered by reconcile, with the
+// stack trace and the states it was acting on.
+func (m *Manager) reconcilePanicked(r interface{}, clusterState *ClusterState, tunnelState *TunnelsState) {
+	m.metrics.Add(metricReconcilePanics, 1)
+	logger.Errorf("Recovered from panic while reconciling: %v\n%s", r, debug.Stack())
+
+	clusterJSON, err := json.Marshal(clusterState)
+	if err != nil {
+		clusterJSON = []byte(err.Error())
+	}
+	tunnelsJSON, err := json.Marshal(tunnelState)
+	if err != nil {
+		tunnelsJSON = []byte(err.Error())
+	}
+	logger.Errorf("Cluster state at the time of the panic: %s", clusterJSON)
+	logger.Errorf("Tunnel state at the time of the panic: %s", tunnelsJSON)
+}
 
-		// A Consul service is registered for each remote endpoints that
-		// hasn't gracefully left the cluster, including ones that
-		// appear to have failed.
-		//gotServices := make(EndpointSet)
-		//addServices := remoteEndpoints.Union(gotServices).Subtract(gotServices)
-		//delServices := remoteEndpoints.Union(gotServices).Subtract(remoteEndpoints)
-
-		// We only create tunnels for remote endpoints that Serf believes
-		// to be alive, since if Serf isn't working we expect that OpenVPN
-		// won't work either.
-		gotTunnels := make(EndpointSet)
-		exitingTunnels := make(EndpointSet)
-
-		for _, tunnel := range tunnelState.Tunnels {
-			id := tunnel.EndpointId
-			gotTunnels.Add(id)
-			if tunnel.State == VPNExiting {
-				exitingTunnels.Add(id)
+// scorer returns the EndpointScorer to use for choosing next-hops,
+// according to the "neighbor_scoring" setting. See scoring.go.
+func (m *Manager) scorer(tunnelMgr *TunnelMgr) EndpointScorer {
+	if m.neighborScoring == ScoringStability {
+		failures := tunnelMgr.RecentDrops()
+		for endpointId, count := range m.gossip.RecentFailures() {
+			failures[endpointId] += count
+		}
+		return StabilityScorer(failures, stabilityPenalty)
+	}
+	return DistanceScorer
+}
+
+// nextRefresh returns how long to wait before re-evaluating things if
+// nothing else changes. This is usually the refresh interval, but can be
+// sooner if a tunnel we declined to start will become ready to start.
+func (m *Manager) nextRefresh(tunnelMgr *TunnelMgr) time.Duration {
+	ret := m.refreshInterval
+	if next, ok := tunnelMgr.NextStartTime(); ok {
+		if untilNext := time.Until(next); untilNext < ret {
+			ret = untilNext
+		}
+	}
+	if m.routeDamper != nil {
+		if next, ok := m.routeDamper.NextChange(); ok {
+			if untilNext := time.Until(next); untilNext < ret {
+				ret = untilNext
 			}
 		}
+	}
+	if m.routeGate != nil {
+		if next, ok := m.routeGate.NextChange(); ok {
+			if untilNext := time.Until(next); untilNext < ret {
+				ret = untilNext
+			}
+		}
+	}
+	if m.notifyTracker != nil {
+		if next, ok := m.notifyTracker.NextChange(); ok {
+			if untilNext := time.Until(next); untilNext < ret {
+				ret = untilNext
+			}
+		}
+	}
+	if untilNext, ok := m.nextDrainRefresh(tunnelMgr); ok && untilNext < ret {
+		ret = untilNext
+	}
+	return ret
+}
+
+// restoreTunnels arranges for the tunnels we had before we were last
+// restarted to be re-established gradually over the refresh interval,
+// so that a restart doesn't make all of their remote ends reconnect at
+// once.
+func (m *Manager) restoreTunnels(tunnelMgr *TunnelMgr, local Address) {
+	saved, err := loadTunnels(m.tunnelsFile)
+	if err != nil {
+		logger.Warnf("%s", err)
+		return
+	}
+	m.savedTunnels = saved
+	if len(saved) == 0 {
+		return
+	}
+
+	endpointIds := make([]EndpointId, len(saved))
+	for i, tunnel := range saved {
+		endpointIds[i] = tunnel.EndpointId
+		localPort, remotePort := local.VPNEndpointPorts(tunnel.EndpointId)
+		if localPort != tunnel.LocalPort || remotePort != tunnel.RemotePort {
+			logger.Warnf(
+				"Tunnel to endpoint %s previously used ports %d and %d, but will now use %d and %d",
+				tunnel.EndpointId, tunnel.LocalPort, tunnel.RemotePort, localPort, remotePort,
+			)
+		}
+	}
+
+	logger.Infof("Re-establishing %d previous tunnels over the next %s", len(saved), m.refreshInterval)
+	tunnelMgr.DelayStarts(endpointIds, m.refreshInterval)
+}
+
+// saveTunnels records the given tunnels in the tunnels file, if they
+// differ from what we last recorded there. Tunnels that we're still
+// waiting to restore are included, so that they aren't forgotten if we
+// restart again before restoring them.
+func (m *Manager) saveTunnels(local Address, tunnels *TunnelsState, tunnelMgr *TunnelMgr) {
+	endpointIds := tunnelMgr.DelayedStarts()
+	for _, tunnel := range tunnels.Tunnels {
+		endpointIds.Add(tunnel.EndpointId)
+	}
+	current := newSavedTunnels(local, endpointIds)
+	if reflect.DeepEqual(current, m.savedTunnels) {
+		return
+	}
+	err := saveTunnels(m.tunnelsFile, current)
+	if err != nil {
+		logger.Warnf("%s", err)
+		return
+	}
+	m.savedTunnels = current
+}
 
-		addTunnels := liveRemoteEndpoints.Union(gotTunnels).Subtract(gotTunnels)
-		delTunnels := liveRemoteEndpoints.Union(gotTunnels).Subtract(liveRemoteEndpoints).Subtract(exitingTunnels)
+// joinInitialPeers tries to join the cluster via the given peers, retrying
+// with backoff until it succeeds, until we discover other members some
+// other way (such as them joining us), or until we're shut down.
+func (m *Manager) joinInitialPeers(peers []string) {
+	delay := initialJoinRetryBase
+	for {
+		joined, err := m.gossip.Join(peers)
+		if err == nil && joined > 0 {
+			logger.Infof("Joined a cluster by contacting %d nodes", joined)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("no peers could be contacted")
+		}
+		logger.Errorf("Initial join failed: %s; retrying in %s", err, delay)
 
-		log.Printf("All remote endpoints: %#v", remoteEndpoints)
-		log.Printf("All live remote endpoints: %#v", liveRemoteEndpoints)
-		//log.Printf("Add Consul services for %#v", addServices)
-		//log.Printf("Remove Consul services for %#v", delServices)
-		log.Printf("Current tunnels %#v", gotTunnels)
-		log.Printf("Add tunnels for %#v", addTunnels)
-		log.Printf("Remove tunnels for %#v", delTunnels)
+		select {
+		case <-time.After(delay):
+		case <-m.shutdownCh:
+			return
+		}
+
+		if m.gossip.NumMembers() > 1 {
+			logger.Infof("Discovered other cluster members, so no longer retrying the initial join")
+			return
+		}
 
-		for endpointId := range addTunnels {
-			err := tunnelMgr.StartTunnel(endpoints[endpointId])
+		delay = delay * 2
+		if delay > initialJoinRetryMax {
+			delay = initialJoinRetryMax
+		}
+	}
+}
+
+// Reload asks the Run loop to re-load the configuration, just as if we'd
+// received SIGHUP. It returns once the request has been accepted; any
+// problems with the new configuration are logged.
+func (m *Manager) Reload() error {
+	select {
+	case m.reloadCh <- struct{}{}:
+		return nil
+	case <-m.doneCh:
+		return fmt.Errorf("manager is not running")
+	}
+}
+
+// reload re-loads the configuration and applies any changes that can
+// be made at runtime. Tunnels are not disturbed by a reload.
+func (m *Manager) reload() {
+	if m.loadConfig == nil {
+		logger.Warnf("Configuration reloading is not available")
+		return
+	}
+
+	logger.Infof("Reloading configuration")
+	loaded, err := m.loadConfig()
+	if err != nil {
+		logger.Errorf("Failed to reload configuration: %s", err)
+		return
+	}
+
+	newConfig := *m.config
+	newConfig.Override(loaded)
+
+	refreshInterval, err := newConfig.RefreshIntervalDuration()
+	if err != nil {
+		logger.Errorf("Failed to reload configuration: %s", err)
+		return
+	}
+	logLevel, err := ParseLogLevel(newConfig.LogLevel)
+	if err != nil {
+		logger.Errorf("Failed to reload configuration: %s", err)
+		return
+	}
+
+	for _, name := range m.config.RestartRequiredChanges(&newConfig) {
+		logger.Warnf("Setting %s has changed, but this will take effect only after a restart", name)
+	}
+
+	if refreshInterval != m.refreshInterval {
+		logger.Infof("Refresh interval is now %s", refreshInterval)
+		m.refreshInterval = refreshInterval
+	}
+
+	if newConfig.LogLevel != m.config.LogLevel {
+		logger.Infof("Log level is now %s", logLevel)
+		logger.Configure(logLevel, m.config.LogFormat)
+	}
+
+	keyring, err := LoadVPNKeyring(&newConfig)
+	if err != nil {
+		logger.Errorf("Failed to reload keys: %s", err)
+	} else {
+		m.setKeyring(keyring)
+	}
+
+	// The configured gossip keys may be stale if another node has rotated
+	// them since we started, so we distribute them only if they've changed.
+	// A keyring file is kept up to date by Serf, so is always safe to use.
+	gossipKeysChanged := newConfig.GossipKeyringFile != "" ||
+		newConfig.GossipEncryptionKey != m.config.GossipEncryptionKey ||
+		!reflect.DeepEqual(newConfig.GossipEncryptionKeys, m.config.GossipEncryptionKeys)
+	if gossipKeysChanged {
+		gossipKeys, err := LoadGossipKeys(&newConfig)
+		if err != nil {
+			logger.Errorf("Failed to reload gossip keys: %s", err)
+		} else {
+			err := m.gossip.UpdateKeys(gossipKeys)
 			if err != nil {
-				log.Printf("Failed to start tunnel to endpoint %s: %s", endpointId, err)
-				continue
+				logger.Errorf("Failed to update gossip keys: %s", err)
 			}
 		}
-		for endpointId := range delTunnels {
-			err := tunnelMgr.CloseTunnel(endpointId)
+	}
+
+	if !reflect.DeepEqual(newConfig.InitialPeers, m.initialGossipPeers) {
+		m.initialGossipPeers = newConfig.InitialPeers
+		if len(m.initialGossipPeers) != 0 {
+			joined, err := m.gossip.Join(m.initialGossipPeers)
 			if err != nil {
-				log.Printf("Failed to signal endpoint %s tunnel to close: %s", endpointId, err)
-				continue
+				logger.Errorf("Join with new initial peers failed: %s", err)
+			} else {
+				logger.Infof("Contacted %d of the new initial peers", joined)
 			}
 		}
+	}
 
-		if !timeout.Stop() {
-			<-timeout.C
+	// We retain only the reloadable settings, so that any other changes
+	// will be reported again on the next reload until we're restarted.
+	m.config.RefreshInterval = newConfig.RefreshInterval
+	m.config.InitialPeers = newConfig.InitialPeers
+	m.config.LogLevel = newConfig.LogLevel
+	m.config.VPNKeyFilename = newConfig.VPNKeyFilename
+	m.config.VPNKeyDir = newConfig.VPNKeyDir
+	m.config.SecretPassphrase = newConfig.SecretPassphrase
+	m.config.GossipEncryptionKey = newConfig.GossipEncryptionKey
+	m.config.GossipEncryptionKeys = newConfig.GossipEncryptionKeys
+	m.config.GossipKeyringFile = newConfig.GossipKeyringFile
+}
+
+// setKeyring switches to a new set of pre-shared keys, advertising the
+// change to the other members so that tunnels can be re-keyed.
+func (m *Manager) setKeyring(keyring *VPNKeyring) {
+	oldGens := formatKeyGenerations(m.keyring.Generations())
+	newGens := formatKeyGenerations(keyring.Generations())
+	region := m.addressing.LocalAddress().RegionId()
+	oldPairKeys := formatPairKeys(m.keyring.PairKeys(region))
+	newPairKeys := formatPairKeys(keyring.PairKeys(region))
+
+	m.keyring = keyring
+	m.tunnelMgr.SetKeyring(keyring)
+
+	if newGens != oldGens {
+		logger.Infof("Key generations are now %s", newGens)
+		err := m.gossip.SetTag(keyGenerationsTag, newGens)
+		if err != nil {
+			logger.Errorf("Failed to advertise new key generations: %s", err)
+		}
+	}
+	if newPairKeys != oldPairKeys {
+		logger.Infof("Region pair keys are now %q", newPairKeys)
+		var err error
+		if newPairKeys == "" {
+			err = m.gossip.RemoveTag(pairKeysTag)
+		} else {
+			err = m.gossip.SetTag(pairKeysTag, newPairKeys)
+		}
+		if err != nil {
+			logger.Errorf("Failed to advertise new region pair keys: %s", err)
 		}
-		timeout.Reset(refreshTime)
+	}
+}
 
-		// Now block here until the situation changes somehow.
-		// Both the Serf cluster and the OpenVPN tunnel statuses can change;
-		// either will cause us to re-evaluate our whole configuration and
-		// make changes to "repair" any inconsistencies between expected
-		// and actual states.
-		select {
-		case clusterState = <-clusterStateCh:
-			log.Printf("Cluster state changed %#v", clusterState)
-		case tunnelState = <-tunnelStateCh:
-			log.Printf("Tunnel state changed %#v", tunnelState)
-		case <-timeout.C:
-			log.Println("Periodic refresh")
-		}
-
-		// We only really care about the *latest* state, so we'll suck
-		// a few more state updates out of the pipeline if we can, such
-		// that if a bunch of things change in quick succession we can
-		// act on them all at once.
-		Coalescing: for i := 0; i < 16; i++ {
-			// Keep doing non-blocking reads from our channels until
-			// there's nothing left to read or until we've processed
-			// (arbitrarily) 16 events.
-			select {
-			case clusterState = <-clusterStateCh:
-			case tunnelState = <-tunnelStateCh:
+// LatestState returns the cluster and tunnel states that the Run loop
+// most recently acted on. The returned objects must not be modified.
+func (m *Manager) LatestState() (*ClusterState, *TunnelsState) {
+	m.stateLock.RLock()
+	defer m.stateLock.RUnlock()
 
-			default:
-				// nothing left to read, so we're done for now
-				break Coalescing
+	return m.clusterState, m.tunnelState
+}
+
+func (m *Manager) setLatestState(clusterState *ClusterState, tunnelState *TunnelsState) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	if clusterState != m.clusterState {
+		delta := clusterState.DiffFrom(m.clusterState)
+		if !delta.Empty() {
+			m.events.Publish(newStateEvent("cluster", changedEndpoints(delta)))
+		}
+	}
+	if tunnelState != m.tunnelState {
+		changed := changedTunnels(m.tunnelState, tunnelState)
+		if len(changed) != 0 {
+			m.events.Publish(newStateEvent("tunnels", changed))
+		}
+	}
+
+	m.clusterState = clusterState
+	m.tunnelState = tunnelState
+}
+
+// Shutdown asks the Run loop to leave the gossip pool and close all of
+// the active tunnels, and then blocks until that process is complete and
+// Run has returned.
+//
+// Shutdown must be called only while Run is running. It is safe to call
+// it multiple times and from multiple goroutines.
+func (m *Manager) Shutdown() {
+	m.shutdownOnce.Do(func() {
+		close(m.shutdownCh)
+	})
+	<-m.doneCh
+}
+
+// shutdown is the Run loop's half of Shutdown, which actually tears
+// down our gossip membership and tunnels.
+func (m *Manager) shutdown(tunnelMgr *TunnelMgr, tunnelStateCh <-chan *TunnelsState) {
+	// We leave first so that our neighbors see a graceful departure,
+	// rather than our tunnels going down and then us failing.
+	logger.Infof("Leaving the gossip pool")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err := m.gossip.Stop(ctx)
+	cancel()
+	if err != nil {
+		logger.Errorf("Error leaving the gossip pool: %s", err)
+	}
+
+	// Our routes would otherwise outlive us. Those via our tunnels will
+	// go away along with the tunnels, but the others wouldn't.
+	if m.routeMgr != nil {
+		logger.Infof("Removing routes")
+		for _, err := range m.routeMgr.RemoveAll() {
+			logger.Errorf("%s", err)
+		}
+	}
+
+	logger.Infof("Closing %d tunnels", tunnelMgr.TunnelCount())
+	tunnelMgr.CloseAll()
+
+	// Whatever happens below, we'll make sure the tunnel monitoring
+	// goroutines don't stay blocked once we've returned.
+	defer tunnelMgr.Stop()
+
+	deadline := time.NewTimer(shutdownTimeout)
+	defer deadline.Stop()
+	forced := false
+
+	// Each tunnel's monitoring goroutine notifies us as it exits, so we
+	// must keep reading the state channel until they're all gone.
+	for tunnelMgr.TunnelCount() > 0 {
+		select {
+		case <-tunnelStateCh:
+		case <-deadline.C:
+			if forced {
+				logger.Errorf("Giving up waiting for %d tunnels to exit", tunnelMgr.TunnelCount())
+				return
 			}
+			logger.Warnf("Timed out waiting for tunnels to close, so killing the remaining OpenVPN processes")
+			tunnelMgr.ForceCloseAll()
+			forced = true
+			deadline.Reset(shutdownTimeout)
+		}
+	}
+
+	logger.Infof("Shutdown complete")
+}
+
+// dropMissingEndpoints removes from ids, logging an error for each, any
+// endpoint that isn't in endpoints.
+func dropMissingEndpoints(ids EndpointSet, endpoints map[EndpointId]*Endpoint) {
+	for id := range ids {
+		if endpoints[id] == nil {
+			logger.Errorf("Not starting tunnel to endpoint %s, which is missing from the cluster state", id)
+			ids.Remove(id)
 		}
+	}
+}
 
+// nearestEndpoints returns up to limit of the given endpoints, choosing
+// the nearest to us.
+func nearestEndpoints(cluster *ClusterState, endpoints map[EndpointId]*Endpoint, ids EndpointSet, limit int) EndpointSet {
+	ret := make(EndpointSet)
+	if limit <= 0 {
+		return ret
 	}
+
+	candidates := make([]*Endpoint, 0, len(ids))
+	for id := range ids {
+		candidates = append(candidates, endpoints[id])
+	}
+	sort.Sort(cluster.SortByDistance(candidates))
+	for _, endpoint := range candidates {
+		if len(ret) >= limit {
+			break
+		}
+		ret.Add(endpoint.Id())
+	}
+	return ret
+}
+
+// NoInterfaceError is returned by interfaceIPAddr when the requested
+// network interface doesn't exist or can't be read.
+type NoInterfaceError struct {
+	Name string
+	Err  error
+}
+
+func (e *NoInterfaceError) Error() string {
+	return fmt.Sprintf("failed to read %s interface config: %s", e.Name, e.Err)
+}
+
+// NoInterfaceAddrError is returned by interfaceIPAddr when the requested
+// network interface exists but has no address we can use.
+type NoInterfaceAddrError struct {
+	Name   string
+	Reason string
 }
 
-func interfaceIPAddr(name string) (string, error) {
+func (e *NoInterfaceAddrError) Error() string {
+	return fmt.Sprintf("%s has %s", e.Name, e.Reason)
+}
+
+// interfaceIPAddr selects the address of the given interface that we will
+// use for gossip and tunnels: an IPv6 address if ipv6 is true, and an IPv4
+// address otherwise. Link-local IPv6 addresses are never used, since they
+// can't be reached from other datacenters. If within is non-nil, only
+// addresses in that network are considered. If more than one address
+// remains, the lowest is chosen so that the selection is stable across
+// restarts.
+func interfaceIPAddr(name string, within *net.IPNet, ipv6 bool) (string, error) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
 	iface, err := net.InterfaceByName(name)
 	if err != nil {
-		return "", fmt.Errorf("failed to read %s interface config: %s", name)
+		return "", &NoInterfaceError{Name: name, Err: err}
 	}
 
 	localAddrs, err := iface.Addrs()
@@ -249,31 +1566,50 @@ func interfaceIPAddr(name string) (string, error) {
 		return "", fmt.Errorf("failed to enumerate addresses for %s: %s", name, err)
 	}
 	if len(localAddrs) == 0 {
-		return "", fmt.Errorf("%s has no addresses: %s", name, err)
+		return "", &NoInterfaceAddrError{Name: name, Reason: "no addresses"}
 	}
 
-	ipv4AddrCount := 0
-	var localAddr string
+	var candidates []net.IP
 	for _, addr := range localAddrs {
 		if ipNet, ok := addr.(*net.IPNet); ok {
-			ipv4Addr := ipNet.IP.To4()
-			if ipv4Addr == nil {
+			ip := ipNet.IP.To4()
+			if ipv6 {
+				if ip != nil || ipNet.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				ip = ipNet.IP.To16()
+			}
+			if ip == nil {
 				continue
 			}
-			if localAddr == "" {
-				localAddr = ipv4Addr.String()
+			if within != nil && !within.Contains(ip) {
+				continue
 			}
-			ipv4AddrCount = ipv4AddrCount + 1
+			candidates = append(candidates, ip)
 		}
 	}
 
-	if ipv4AddrCount == 0 {
-		return "", fmt.Errorf("%s has no IPv4 addresses: %s", name, err)
+	if len(candidates) == 0 {
+		if within != nil {
+			return "", &NoInterfaceAddrError{
+				Name:   name,
+				Reason: fmt.Sprintf("no %s addresses within %s", family, within),
+			}
+		}
+		return "", &NoInterfaceAddrError{Name: name, Reason: fmt.Sprintf("no %s addresses", family)}
 	}
 
-	log.Printf("%s address is %s", name, localAddr)
-	if ipv4AddrCount > 1 {
-		log.Printf("%s has multiple IPv4 addresses, so I just picked one arbitrarily", name)
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i], candidates[j]) < 0
+	})
+	localAddr := candidates[0].String()
+
+	logger.Infof("%s address is %s", name, localAddr)
+	if len(candidates) > 1 {
+		logger.Warnf(
+			"%s has %d eligible %s addresses, so I picked the lowest; set local_address_cidr to choose explicitly",
+			name, len(candidates), family,
+		)
 	}
 
 	return localAddr, nil
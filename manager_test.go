@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+func TestDropMissingEndpoints(t *testing.T) {
+	present := testEndpoint("present", 0x041, serf.StatusAlive, nil)
+	endpoints := map[EndpointId]*Endpoint{present.Id(): present}
+
+	// 0x081 is in the set but not in the map, as could happen if they
+	// came from different snapshots.
+	ids := newEndpointSet(0x041, 0x081)
+	dropMissingEndpoints(ids, endpoints)
+	if want := newEndpointSet(0x041); !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %s; want %s", ids, want)
+	}
+
+	// Nothing downstream can start a tunnel to a missing endpoint either.
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	if err := m.StartTunnel(endpoints[0x081]); err == nil {
+		t.Errorf("StartTunnel succeeded for a missing endpoint")
+	}
+	if err := m.RequestStart(endpoints[0x081]); err == nil {
+		t.Errorf("RequestStart succeeded for a missing endpoint")
+	}
+	select {
+	case <-launcher.launched:
+		t.Errorf("launched a tunnel to a missing endpoint")
+	default:
+	}
+}
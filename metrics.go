@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// This file contains a minimal metrics registry that can render itself
+// in the Prometheus text exposition format. We only need a handful of
+// gauges and counters, so this is simpler than pulling in a full client.
+
+const (
+	metricTunnelsTotal     = "openvpn_peer_tunnels_total"
+	metricTunnelsConnected = "openvpn_peer_tunnels_connected"
+	metricTunnelsRetrying  = "openvpn_peer_tunnels_retrying"
+	metricTunnelState      = "openvpn_peer_tunnel_state"
+	metricTunnelStateTime  = "openvpn_peer_tunnel_state_seconds"
+	metricClusterMembers   = "openvpn_peer_cluster_members"
+	metricTunnelRestarts   = "openvpn_peer_tunnel_restarts_total"
+	metricTunnelRetries    = "openvpn_peer_tunnel_retries_total"
+	metricTunnelAuthFails  = "openvpn_peer_tunnel_auth_failures_total"
+	metricTunnelWatchdog   = "openvpn_peer_tunnel_watchdog_restarts_total"
+	metricTunnelSlowStarts = "openvpn_peer_tunnel_slow_establishments_total"
+	metricTunnelBytesIn    = "openvpn_peer_tunnel_received_bytes"
+	metricTunnelBytesOut   = "openvpn_peer_tunnel_sent_bytes"
+	metricTunnelsBackoff   = "openvpn_peer_tunnels_backoff"
+	metricTunnelBackoff    = "openvpn_peer_tunnel_backoff_seconds"
+	metricTunnelsPending   = "openvpn_peer_tunnels_pending_start"
+	metricTunnelsOverLimit = "openvpn_peer_tunnels_over_limit"
+	metricSnapshotErrors   = "openvpn_peer_gossip_snapshot_errors_total"
+	metricReconcilePanics  = "openvpn_peer_reconcile_panics_total"
+)
+
+type Metrics struct {
+	lock     sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	kind string
+	help string
+
+	// series maps the rendered label set (e.g. `endpoint_id="001"`) to
+	// the current value of the series with those labels.
+	series map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		families: make(map[string]*metricFamily),
+	}
+
+	m.declare(metricTunnelsTotal, "gauge", "Number of tunnels with a running OpenVPN process.")
+	m.declare(metricTunnelsConnected, "gauge", "Number of tunnels in the VPNConnected state.")
+	m.declare(metricTunnelsRetrying, "gauge", "Number of tunnels in the VPNRetrying state.")
+	m.declare(metricTunnelState, "gauge", "Current VPNState of each tunnel, as its numeric value.")
+	m.declare(metricTunnelStateTime, "gauge", "Seconds that each tunnel has been in its current VPNState.")
+	m.declare(metricTunnelBytesIn, "gauge", "Bytes each tunnel has received since OpenVPN last connected.")
+	m.declare(metricTunnelBytesOut, "gauge", "Bytes each tunnel has sent since OpenVPN last connected.")
+	m.declare(metricClusterMembers, "gauge", "Number of gossip pool members in each Serf status.")
+	m.declare(metricTunnelRestarts, "counter", "Number of times a tunnel was started for an endpoint that previously had one.")
+	m.declare(metricTunnelRetries, "counter", "Number of times a tunnel entered the VPNRetrying state.")
+	m.declare(metricTunnelAuthFails, "counter", "Number of times a tunnel failed because the peers could not authenticate each other.")
+	m.declare(metricTunnelWatchdog, "counter", "Number of times the watchdog restarted a tunnel that was connected but not receiving anything.")
+	m.declare(metricTunnelSlowStarts, "counter", "Number of times a tunnel took longer than tunnel_establish_sla to connect.")
+	m.declare(metricTunnelsBackoff, "gauge", "Number of tunnels waiting to retry after failing to start.")
+	m.declare(metricTunnelBackoff, "gauge", "Seconds remaining until each failed tunnel will be retried.")
+	m.declare(metricTunnelsPending, "gauge", "Number of tunnels queued to start, including those starting now.")
+	m.declare(metricSnapshotErrors, "counter", "Number of times Serf failed to update its snapshot of the cluster members.")
+	m.declare(metricTunnelsOverLimit, "gauge", "Number of wanted tunnels not started because max_tunnels has been reached.")
+	m.declare(metricReconcilePanics, "counter", "Number of times a pass of the reconcile loop panicked and was recovered.")
+
+	return m
+}
+
+func (m *Metrics) declare(name, kind, help string) {
+	m.families[name] = &metricFamily{
+		kind:   kind,
+		help:   help,
+		series: make(map[string]float64),
+	}
+}
+
+// Set sets the value of the series with the given name and labels. The
+// labels are given as alternating names and values.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.families[name].series[renderLabels(labels)] = value
+}
+
+// Add adds the given delta to the value of the series with the given name
+// and labels. The labels are given as alternating names and values.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.families[name].series[renderLabels(labels)] += delta
+}
+
+// Reset discards all of the series with the given name, so that a
+// labelled gauge can be rebuilt from scratch without leaving behind
+// series for things that no longer exist.
+func (m *Metrics) Reset(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.families[name].series = make(map[string]float64)
+}
+
+// UpdateCluster refreshes the gauges that are derived from cluster state.
+func (m *Metrics) UpdateCluster(state *ClusterState) {
+	counts := make(map[serf.MemberStatus]int)
+	counts[state.ThisEndpoint.Status()]++
+	for _, endpoints := range [][]*Endpoint{state.LocalEndpoints, state.RemoteEndpoints, state.ObserverEndpoints, state.UnknownEndpoints} {
+		for _, endpoint := range endpoints {
+			counts[endpoint.Status()]++
+		}
+	}
+
+	m.Reset(metricClusterMembers)
+	for status, count := range counts {
+		m.Set(metricClusterMembers, float64(count), "status", status.String())
+	}
+}
+
+// UpdateTunnels refreshes the gauges that are derived from tunnel state.
+func (m *Metrics) UpdateTunnels(state *TunnelsState) {
+	connected := 0
+	retrying := 0
+
+	m.Reset(metricTunnelState)
+	m.Reset(metricTunnelStateTime)
+	m.Reset(metricTunnelBytesIn)
+	m.Reset(metricTunnelBytesOut)
+	for _, tunnel := range state.Tunnels {
+		switch tunnel.State {
+		case VPNConnected:
+			connected++
+		case VPNRetrying:
+			retrying++
+		}
+		m.Set(metricTunnelState, float64(tunnel.State), "endpoint_id", tunnel.EndpointId.String())
+		m.Set(metricTunnelStateTime, time.Since(tunnel.Since).Seconds(), "endpoint_id", tunnel.EndpointId.String())
+		m.Set(metricTunnelBytesIn, float64(tunnel.BytesIn), "endpoint_id", tunnel.EndpointId.String())
+		m.Set(metricTunnelBytesOut, float64(tunnel.BytesOut), "endpoint_id", tunnel.EndpointId.String())
+	}
+
+	m.Set(metricTunnelsTotal, float64(len(state.Tunnels)))
+	m.Set(metricTunnelsConnected, float64(connected))
+	m.Set(metricTunnelsRetrying, float64(retrying))
+}
+
+// UpdateBackoffs refreshes the gauges that describe tunnels that are
+// waiting to retry after failing to start.
+func (m *Metrics) UpdateBackoffs(backoffs []*TunnelBackoff) {
+	now := time.Now()
+
+	m.Reset(metricTunnelBackoff)
+	for _, backoff := range backoffs {
+		remaining := backoff.RetryAt.Sub(now).Seconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		m.Set(metricTunnelBackoff, remaining, "endpoint_id", backoff.EndpointId.String())
+	}
+	m.Set(metricTunnelsBackoff, float64(len(backoffs)))
+}
+
+// UpdateSnapshotErrors records the number of failures to update the gossip
+// snapshot. See Gossip.SnapshotErrors.
+func (m *Metrics) UpdateSnapshotErrors(count int64) {
+	m.Set(metricSnapshotErrors, float64(count))
+}
+
+// UpdateTunnelLimit records how many of the tunnels we want we aren't
+// running because of the max_tunnels limit.
+func (m *Metrics) UpdateTunnelLimit(skipped int) {
+	m.Set(metricTunnelsOverLimit, float64(skipped))
+}
+
+// WritePrometheus writes all of the metrics to the given writer in the Prometheus
+// text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := m.families[name]
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			labels := key
+			if labels != "" {
+				labels = "{" + labels + "}"
+			}
+			_, err := fmt.Fprintf(w, "%s%s %g\n", name, labels, family.series[key])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		// should never happen
+		panic("labels must be name/value pairs")
+	}
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
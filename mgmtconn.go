@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
+)
+
+// This file provides our connection to each OpenVPN process's management
+// interface, and optionally shares it with an operator.
+//
+// OpenVPN connects to a unix socket that we listen on in a private
+// directory (--management-client), so nothing else can reach the
+// interface. OpenVPN serves only that one connection for the whole life
+// of the process, so for troubleshooting VPNConfig.ManagementPort has us
+// also listen on that port on the loopback interface, with a password,
+// so that the standard OpenVPN management tools can be pointed at a
+// running tunnel. Their commands are passed along our connection one at
+// a time, interleaved with our own, and each reply goes back to whoever
+// sent the command. Real-time notifications go to everyone, so operators
+// also see the state and byte count notifications that we turn on.
+//
+// Operators may not send the few commands that would break our own use
+// of the connection; see mgmtDeniedCommands.
+
+// mgmtAuthTimeout limits how long an operator may take to give the
+// password, and mgmtCommandTimeout how long OpenVPN may take to reply to
+// an operator's command before we stop waiting and let others have a
+// turn. mgmtSessionBuffer is how many lines may be waiting to be sent to
+// an operator before we decide that they aren't reading and disconnect.
+const (
+	mgmtAuthTimeout    = 5 * time.Second
+	mgmtCommandTimeout = 10 * time.Second
+	mgmtSessionBuffer  = 256
+)
+
+// mgmtDeniedCommands are the commands, or command prefixes, that operators
+// may not send: they would stop the notifications that we depend on, or
+// leave OpenVPN waiting for a release that we won't send.
+var mgmtDeniedCommands = []string{
+	"bytecount",
+	"state off",
+	"hold on",
+}
+
+// mgmtConn is a connection to an OpenVPN process's management interface,
+// which becomes a client once it is opened.
+type mgmtConn interface {
+	Open(eventCh chan<- openvpn.Event) *openvpn.MgmtClient
+	Close() error
+}
+
+// newMgmtConn returns the management connection for the given connection
+// from OpenVPN, shared with the operators who connect to the given
+// listener, with the given password, unless the listener is nil.
+func newMgmtConn(conn net.Conn, operators net.Listener, password string) mgmtConn {
+	if operators == nil {
+		return directMgmtConn{conn}
+	}
+	return &mgmtProxy{
+		conn:      conn,
+		operators: operators,
+		password:  password,
+		sessions:  make(map[*mgmtSession]bool),
+		closedCh:  make(chan struct{}),
+	}
+}
+
+// directMgmtConn is a management connection used only by us.
+type directMgmtConn struct {
+	net.Conn
+}
+
+func (c directMgmtConn) Open(eventCh chan<- openvpn.Event) *openvpn.MgmtClient {
+	return openvpn.NewClient(c.Conn, eventCh)
+}
+
+// listenMgmtPort starts listening for operators on the given port on the
+// loopback interface.
+func listenMgmtPort(port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on management port: %s", err)
+	}
+	return listener, nil
+}
+
+// mgmtPeer is one of the parties sharing a management connection, to
+// which lines from OpenVPN are delivered.
+type mgmtPeer interface {
+	deliver(line string)
+}
+
+// mgmtProxy shares a management connection between us and the operators
+// who connect to its listener.
+type mgmtProxy struct {
+	conn      net.Conn
+	operators net.Listener
+	password  string
+
+	// ours is our end of the pipe to our own client, once opened.
+	ours net.Conn
+
+	// cmdLock is held while a command is in flight, from when it is sent
+	// to OpenVPN until its reply is complete.
+	cmdLock sync.Mutex
+
+	// lock guards the fields below. replyTo is who sent the latest
+	// command, and so gets any reply lines, and replyDone is closed once
+	// its reply is complete. untilEnd is set if the reply ends only at
+	// "END", even if it has a "SUCCESS:" line first.
+	lock      sync.Mutex
+	sessions  map[*mgmtSession]bool
+	replyTo   mgmtPeer
+	replyDone chan struct{}
+	untilEnd  bool
+
+	// closedCh is closed once the connection to OpenVPN has closed.
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *mgmtProxy) Open(eventCh chan<- openvpn.Event) *openvpn.MgmtClient {
+	ours, client := net.Pipe()
+	p.ours = ours
+
+	go p.readOpenVPN()
+	go p.serveOurs()
+	go p.acceptOperators()
+	return openvpn.NewClient(client, eventCh)
+}
+
+// Close closes the connection to OpenVPN, disconnecting everyone sharing
+// it.
+func (p *mgmtProxy) Close() error {
+	err := p.conn.Close()
+	p.closeOnce.Do(func() {
+		p.operators.Close()
+		close(p.closedCh)
+	})
+	return err
+}
+
+// readOpenVPN delivers each line from OpenVPN to whoever it is for, until
+// the connection closes.
+func (p *mgmtProxy) readOpenVPN() {
+	defer func() {
+		p.Close()
+		p.ours.Close()
+		p.lock.Lock()
+		for session := range p.sessions {
+			session.close()
+		}
+		p.lock.Unlock()
+	}()
+
+	ourPeer := ourMgmtPeer{p.ours}
+	scanner := bufio.NewScanner(p.conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ">") {
+			ourPeer.deliver(line)
+			p.lock.Lock()
+			for session := range p.sessions {
+				session.deliver(line)
+			}
+			p.lock.Unlock()
+			continue
+		}
+
+		// Lines that arrive after a reply is complete still belong to
+		// whoever sent the latest command.
+		p.lock.Lock()
+		to, done := p.replyTo, p.replyDone
+		complete := done != nil && mgmtReplyComplete(line, p.untilEnd)
+		if complete {
+			p.replyDone = nil
+		}
+		p.lock.Unlock()
+
+		if to != nil {
+			to.deliver(line)
+		}
+		if complete {
+			close(done)
+		}
+	}
+}
+
+// serveOurs passes the commands from our own client to OpenVPN.
+func (p *mgmtProxy) serveOurs() {
+	ourPeer := ourMgmtPeer{p.ours}
+	scanner := bufio.NewScanner(p.ours)
+	for scanner.Scan() {
+		err := p.command(ourPeer, scanner.Text(), 0)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// command sends the given command to OpenVPN on behalf of the given peer,
+// once any other command in flight has had its reply, and then waits for
+// the reply to be delivered to the peer. If timeout isn't zero then it
+// gives up waiting after that long.
+func (p *mgmtProxy) command(from mgmtPeer, cmd string, timeout time.Duration) error {
+	p.cmdLock.Lock()
+	defer p.cmdLock.Unlock()
+
+	done := make(chan struct{})
+	fields := strings.Fields(cmd)
+	p.lock.Lock()
+	p.replyTo = from
+	p.replyDone = done
+	p.untilEnd = len(fields) > 1 && fields[len(fields)-1] == "all"
+	p.lock.Unlock()
+
+	_, err := fmt.Fprintf(p.conn, "%s\n", cmd)
+	if err != nil {
+		return err
+	}
+
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-done:
+		return nil
+	case <-p.closedCh:
+		return fmt.Errorf("management connection closed")
+	case <-timeoutCh:
+		p.lock.Lock()
+		if p.replyDone == done {
+			p.replyDone = nil
+		}
+		p.lock.Unlock()
+		return fmt.Errorf("no reply after %s", timeout)
+	}
+}
+
+// acceptOperators serves the operators who connect to the management
+// port, until the listener is closed.
+func (p *mgmtProxy) acceptOperators() {
+	for {
+		conn, err := p.operators.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveOperator(conn)
+	}
+}
+
+// serveOperator asks the operator on the given connection for the
+// password, as OpenVPN would, and then passes along their commands until
+// they disconnect.
+func (p *mgmtProxy) serveOperator(conn net.Conn) {
+	session := &mgmtSession{
+		conn:   conn,
+		out:    make(chan string, mgmtSessionBuffer),
+		doneCh: make(chan struct{}),
+	}
+	defer session.close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(mgmtAuthTimeout))
+	fmt.Fprint(conn, "ENTER PASSWORD:")
+	password, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if subtle.ConstantTimeCompare([]byte(password), []byte(p.password)) != 1 {
+		logger.Warnf("Rejected management client %s with the wrong password", conn.RemoteAddr())
+		fmt.Fprintln(conn, "ERROR: bad password")
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	logger.Infof("Management client %s connected", conn.RemoteAddr())
+	defer logger.Infof("Management client %s disconnected", conn.RemoteAddr())
+
+	go session.write()
+	session.deliver("SUCCESS: password is correct")
+	session.deliver(">INFO:OpenVPN Management Interface, shared by openvpn-peer -- type 'help' for more info")
+
+	p.lock.Lock()
+	p.sessions[session] = true
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.sessions, session)
+		p.lock.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		switch {
+		case cmd == "":
+			continue
+		case cmd == "quit" || cmd == "exit":
+			// These would close our connection too.
+			return
+		case mgmtDenied(cmd):
+			session.deliver(fmt.Sprintf("ERROR: %q is not allowed, since openvpn-peer depends on it", cmd))
+			continue
+		}
+
+		err := p.command(session, cmd, mgmtCommandTimeout)
+		if err != nil {
+			logger.Warnf("Disconnecting management client %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// mgmtDenied returns whether operators may not send the given command;
+// see mgmtDeniedCommands.
+func mgmtDenied(cmd string) bool {
+	normalized := strings.Join(strings.Fields(strings.ToLower(cmd)), " ") + " "
+	for _, denied := range mgmtDeniedCommands {
+		if strings.HasPrefix(normalized, denied+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// mgmtReplyComplete returns whether the given line ends the reply to a
+// command. Most replies are a single "SUCCESS:" or "ERROR:" line, and the
+// others, such as to "status", end with "END". A command ending in "all",
+// such as "state on all", gets a "SUCCESS:" line and then a history that
+// ends with "END".
+func mgmtReplyComplete(line string, untilEnd bool) bool {
+	switch {
+	case line == "END":
+		return true
+	case strings.HasPrefix(line, "ERROR:"):
+		return true
+	case strings.HasPrefix(line, "SUCCESS:"):
+		return !untilEnd
+	}
+	return false
+}
+
+// ourMgmtPeer delivers lines to our own client, through its pipe.
+type ourMgmtPeer struct {
+	conn net.Conn
+}
+
+func (p ourMgmtPeer) deliver(line string) {
+	fmt.Fprintf(p.conn, "%s\n", line)
+}
+
+// mgmtSession is an operator's connection to the management port.
+type mgmtSession struct {
+	conn      net.Conn
+	out       chan string
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// deliver queues the given line to be sent to the operator, disconnecting
+// them if too many are already waiting.
+func (s *mgmtSession) deliver(line string) {
+	select {
+	case s.out <- line:
+	case <-s.doneCh:
+	default:
+		logger.Warnf("Disconnecting management client %s, which isn't reading", s.conn.RemoteAddr())
+		s.close()
+	}
+}
+
+// write sends the queued lines to the operator until the session closes.
+func (s *mgmtSession) write() {
+	for {
+		select {
+		case line := <-s.out:
+			if _, err := fmt.Fprintf(s.conn, "%s\r\n", line); err != nil {
+				s.close()
+				return
+			}
+		case <-s.doneCh:
+			return
+		}
+	}
+}
+
+func (s *mgmtSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.doneCh)
+		s.conn.Close()
+	})
+}
+
+// readMgmtPassword returns the management password from the given file,
+// which, as OpenVPN expects, is its first line.
+func readMgmtPassword(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read management password file: %s", err)
+	}
+	password := strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	if password == "" {
+		return "", fmt.Errorf("management password file %s is empty", filename)
+	}
+	return password, nil
+}
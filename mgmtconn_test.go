@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
+)
+
+// fakeMgmtReplies are the replies of fakeMgmtServer to each command.
+var fakeMgmtReplies = map[string][]string{
+	"state on":     {"SUCCESS: real-time state notification set to ON"},
+	"state on all": {"SUCCESS: real-time state notification set to ON", "1500000001,CONNECTED,SUCCESS,,", "END"},
+	"pid":          {"SUCCESS: pid=42"},
+	"status":       {"OpenVPN STATISTICS", "TUN/TAP read bytes,0", "END"},
+}
+
+// fakeMgmtServer plays OpenVPN on the given end of a management
+// connection, answering each command from fakeMgmtReplies.
+type fakeMgmtServer struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+func (s *fakeMgmtServer) serve() {
+	scanner := bufio.NewScanner(s.conn)
+	for scanner.Scan() {
+		reply, ok := fakeMgmtReplies[scanner.Text()]
+		if !ok {
+			reply = []string{"ERROR: unknown command, enter 'help' for more options"}
+		}
+		for _, line := range reply {
+			s.send(line)
+		}
+	}
+}
+
+func (s *fakeMgmtServer) send(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fmt.Fprintf(s.conn, "%s\n", line)
+}
+
+// newTestMgmtProxy returns a management connection shared on a loopback
+// port with the password "secret", the address of that port, and the
+// fake OpenVPN at the other end.
+func newTestMgmtProxy(t *testing.T) (mgmtConn, string, *fakeMgmtServer) {
+	ours, theirs := net.Pipe()
+	operators, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	server := &fakeMgmtServer{conn: theirs}
+	go server.serve()
+	conn := newMgmtConn(ours, operators, "secret")
+	t.Cleanup(func() {
+		conn.Close()
+		theirs.Close()
+	})
+	return conn, operators.Addr().String(), server
+}
+
+// mgmtOperator is a test client of the management port.
+type mgmtOperator struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialMgmt connects to the management port at the given address and
+// gives the given password, returning the response.
+func dialMgmt(t *testing.T, addr, password string) (*mgmtOperator, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	op := &mgmtOperator{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	prompt := make([]byte, len("ENTER PASSWORD:"))
+	if _, err := io.ReadFull(op.reader, prompt); err != nil || string(prompt) != "ENTER PASSWORD:" {
+		t.Fatalf("got prompt %q (%v); want the password prompt", prompt, err)
+	}
+	fmt.Fprintf(conn, "%s\r\n", password)
+	return op, op.readLine()
+}
+
+func (op *mgmtOperator) readLine() string {
+	op.t.Helper()
+	line, err := op.reader.ReadString('\n')
+	if err != nil {
+		op.t.Fatalf("failed to read from the management port: %s", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// command sends the given command and returns the reply lines, up to and
+// including the one for which last returns true, skipping notifications.
+func (op *mgmtOperator) command(cmd string, last func(string) bool) []string {
+	op.t.Helper()
+	fmt.Fprintf(op.conn, "%s\n", cmd)
+	var ret []string
+	for {
+		line := op.readLine()
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		ret = append(ret, line)
+		if last(line) {
+			return ret
+		}
+	}
+}
+
+func isEnd(line string) bool {
+	return line == "END"
+}
+
+func isResult(line string) bool {
+	return strings.HasPrefix(line, "SUCCESS:") || strings.HasPrefix(line, "ERROR:")
+}
+
+func TestMgmtProxy(t *testing.T) {
+	conn, addr, server := newTestMgmtProxy(t)
+	eventCh := make(chan openvpn.Event, 16)
+	client := conn.Open(eventCh)
+
+	op, resp := dialMgmt(t, addr, "secret")
+	if resp != "SUCCESS: password is correct" {
+		t.Fatalf("got %q after the password", resp)
+	}
+	if line := op.readLine(); !strings.HasPrefix(line, ">INFO:") {
+		t.Errorf("got %q; want an INFO notification", line)
+	}
+
+	// Our commands and the operator's are interleaved, and each gets
+	// its own reply.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			pid, err := client.Pid()
+			if err != nil || pid != 42 {
+				t.Errorf("got pid %d (%v); want 42", pid, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		got := op.command("status", isEnd)
+		if want := fakeMgmtReplies["status"]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Fatalf("got status %q; want %q", got, want)
+		}
+	}
+	wg.Wait()
+
+	// A reply that continues after its SUCCESS line goes to the operator
+	// in full.
+	if got := op.command("state on all", isEnd); len(got) != 3 {
+		t.Errorf("got %q; want the whole state history", got)
+	}
+
+	if got := op.command("bytecount 1", isResult); !strings.HasPrefix(got[0], "ERROR:") {
+		t.Errorf("bytecount was allowed: %q", got)
+	}
+	if got := op.command("Hold  on", isResult); !strings.HasPrefix(got[0], "ERROR:") {
+		t.Errorf("hold on was allowed: %q", got)
+	}
+
+	// Notifications go to everyone.
+	server.send(">STATE:1500000001,CONNECTED,SUCCESS,,")
+	if line := op.readLine(); line != ">STATE:1500000001,CONNECTED,SUCCESS,," {
+		t.Errorf("operator got %q; want the state notification", line)
+	}
+	select {
+	case event := <-eventCh:
+		if state, ok := event.(*openvpn.StateEvent); !ok || state.NewState() != "CONNECTED" {
+			t.Errorf("got event %s; want the state notification", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("we didn't get the state notification")
+	}
+
+	// An operator quitting leaves our connection open.
+	fmt.Fprintf(op.conn, "quit\n")
+	if _, err := op.reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v after quit; want EOF", err)
+	}
+	if pid, err := client.Pid(); err != nil || pid != 42 {
+		t.Errorf("got pid %d (%v) after the operator quit; want 42", pid, err)
+	}
+}
+
+func TestMgmtProxyWrongPassword(t *testing.T) {
+	conn, addr, _ := newTestMgmtProxy(t)
+	conn.Open(make(chan openvpn.Event, 16))
+
+	op, resp := dialMgmt(t, addr, "guess")
+	if !strings.HasPrefix(resp, "ERROR:") {
+		t.Fatalf("got %q after the wrong password", resp)
+	}
+	if _, err := op.reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v after the wrong password; want EOF", err)
+	}
+}
+
+func TestMgmtProxyClosesWithOpenVPN(t *testing.T) {
+	conn, addr, server := newTestMgmtProxy(t)
+	eventCh := make(chan openvpn.Event, 16)
+	conn.Open(eventCh)
+
+	op, _ := dialMgmt(t, addr, "secret")
+	op.readLine()
+
+	server.conn.Close()
+	for range eventCh {
+		// eventCh is closed once our client sees the connection close.
+	}
+	if _, err := op.reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("got %v once OpenVPN disconnected; want EOF", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("still listening once OpenVPN disconnected")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+// This file defines the modes that the manager can run in, which decide
+// which of its side effects it performs. They allow it to be introduced
+// alongside an existing routing setup a step at a time:
+//
+// In the default "full" mode it does everything: it joins the gossip
+// cluster, runs tunnels, installs routes and publishes to Consul.
+//
+// In "tunnels-only" mode it joins the cluster and runs tunnels as usual,
+// so that the tunnels and its view of the cluster can be compared with
+// reality, but it leaves the route table and Consul alone.
+//
+// In "observe" mode it only joins the cluster, advertising itself as an
+// observer so that other endpoints don't try to run tunnels to it. This
+// is what the observer setting has always done, and that setting is now
+// the same as choosing this mode.
+//
+// Unlike dry run, which logs the changes it would make to tunnels and
+// routes, the side effects that a mode leaves out aren't considered at
+// all.
+//
+// Other endpoints would otherwise route through a tunnels-only node as
+// though it forwarded traffic, so each node advertises any mode other than
+// the default in modeTag, and peers never choose one that doesn't install
+// routes as a fallback or hub. See Endpoint.InstallsRoutes.
+
+const (
+	ModeFull        = "full"
+	ModeTunnelsOnly = "tunnels-only"
+	ModeObserve     = "observe"
+)
+
+// modeTag is the gossip tag in which an endpoint advertises its mode, if
+// it isn't ModeFull.
+const modeTag = "mode"
+
+// modeRunsTunnels returns true if we run tunnels in the given mode.
+func modeRunsTunnels(mode string) bool {
+	return mode != ModeObserve
+}
+
+// modeInstallsRoutes returns true if we install routes, and publish to
+// Consul, in the given mode.
+func modeInstallsRoutes(mode string) bool {
+	return mode == ModeFull
+}
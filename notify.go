@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// This file tells an operator about significant changes in the cluster:
+// a tunnel becoming critical and then recovering, and endpoints joining
+// and leaving. The changes are detected by notifyTracker in the Run loop,
+// and delivered in the background by a Notifier.
+//
+// Intermittent disconnections are normal, so nothing is sent for a blip.
+// A tunnel is critical once it has been retrying (see VPNRetrying) for the
+// whole of the grace period, and an endpoint has joined or left only once
+// it has stayed that way for the grace period too. A tunnel that takes
+// longer than the establishment SLA to come up is reported as slow, once
+// each time it is started; see establish.go.
+
+// DefaultNotifyGracePeriod is the notify_grace_period we use when it isn't
+// set. Since a tunnel reaches VPNRetrying only after failing to reconnect
+// once, this is on top of at least one keepalive timeout.
+const DefaultNotifyGracePeriod = 2 * time.Minute
+
+// notifyQueueSize is the number of notifications that can be waiting for
+// delivery before we start dropping them, and notifyTimeout limits how
+// long each delivery may take.
+const (
+	notifyQueueSize = 64
+	notifyTimeout   = 10 * time.Second
+)
+
+// The kinds of Notification.
+const (
+	NotifyTunnelCritical  = "tunnel_critical"
+	NotifyTunnelRecovered = "tunnel_recovered"
+	NotifyTunnelClosed    = "tunnel_closed"
+	NotifyTunnelSlow      = "tunnel_slow"
+	NotifyEndpointJoined  = "endpoint_joined"
+	NotifyEndpointLeft    = "endpoint_left"
+)
+
+// Notification describes a single significant change.
+type Notification struct {
+	Kind string `json:"kind"`
+
+	// NodeName is the name of the node sending the notification.
+	NodeName string `json:"node_name"`
+
+	// EndpointId and EndpointName identify the endpoint that the
+	// notification is about, which for tunnel notifications is the one
+	// at the far end of the tunnel.
+	EndpointId   string `json:"endpoint_id"`
+	EndpointName string `json:"endpoint_name,omitempty"`
+
+	// Since is when the change began, which is a grace period or more
+	// before the notification was sent.
+	Since string `json:"since"`
+
+	Message string `json:"message"`
+}
+
+// A Notifier delivers notifications to wherever an operator will see
+// them. Notify is called from a single goroutine, so it needn't be safe
+// for concurrent use, and it may block for a while without holding up
+// anything but later notifications.
+type Notifier interface {
+	Notify(notification *Notification) error
+}
+
+// NewNotifier returns the Notifier described by the given configuration,
+// or nil if notifications aren't enabled.
+func NewNotifier(config *Config) (Notifier, error) {
+	if config.NotifyWebhookURL == "" {
+		return nil, nil
+	}
+	return &webhookNotifier{
+		url: config.NotifyWebhookURL,
+		client: &http.Client{
+			Timeout: notifyTimeout,
+		},
+	}, nil
+}
+
+// webhookNotifier POSTs each notification as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyTracker watches the states that the Run loop sees for the
+// significant changes described at the top of this file, and queues a
+// notification for each. It is used only by the Run loop, so it isn't
+// safe for concurrent use.
+type notifyTracker struct {
+	notifier    Notifier
+	gracePeriod time.Duration
+	queue       chan *Notification
+
+	// nodeName is our own node name, as of the latest Update.
+	nodeName string
+
+	// tunnels holds the tunnels that are retrying, and endpoints holds
+	// every endpoint that is alive or whose departure we have yet to
+	// notify, keyed by node name. endpoints is nil until the first
+	// Update, so that we don't announce the whole cluster as joining.
+	tunnels   map[EndpointId]*trackedTunnel
+	endpoints map[string]*trackedEndpoint
+
+	// slowStarts holds the slow tunnels we have notified about, with
+	// when each was started. See TunnelsState.SlowStarts.
+	slowStarts map[EndpointId]time.Time
+}
+
+type trackedTunnel struct {
+	name          string
+	retryingSince time.Time
+	notified      bool
+}
+
+type trackedEndpoint struct {
+	id EndpointId
+
+	// notified is whether the endpoint was alive as of the last
+	// notification about it (or the first Update), and alive is whether
+	// it is now. changingSince is when alive began to differ from
+	// notified, or zero if it doesn't.
+	notified      bool
+	alive         bool
+	changingSince time.Time
+}
+
+func newNotifyTracker(notifier Notifier, gracePeriod time.Duration) *notifyTracker {
+	return &notifyTracker{
+		notifier:    notifier,
+		gracePeriod: gracePeriod,
+		queue:       make(chan *Notification, notifyQueueSize),
+		tunnels:     make(map[EndpointId]*trackedTunnel),
+		slowStarts:  make(map[EndpointId]time.Time),
+	}
+}
+
+// Start begins delivering notifications in the background, until stopCh
+// is closed.
+func (t *notifyTracker) Start(stopCh <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case notification := <-t.queue:
+				err := t.notifier.Notify(notification)
+				if err != nil {
+					logger.Warnf("Failed to send %s notification for endpoint %s: %s", notification.Kind, notification.EndpointId, err)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Update compares the given states with those from earlier calls, and
+// queues notifications for any changes that have lasted for the grace
+// period.
+func (t *notifyTracker) Update(cluster *ClusterState, tunnels *TunnelsState, now time.Time) {
+	t.nodeName = cluster.ThisEndpoint.NodeName()
+	t.updateTunnels(cluster, tunnels, now)
+	t.updateEndpoints(cluster, now)
+}
+
+func (t *notifyTracker) updateTunnels(cluster *ClusterState, tunnels *TunnelsState, now time.Time) {
+	names := make(map[EndpointId]string)
+	for _, endpoint := range cluster.RemoteEndpoints {
+		names[endpoint.Id()] = endpoint.NodeName()
+	}
+
+	open := make(EndpointSet)
+	for _, tunnel := range tunnels.Tunnels {
+		id := tunnel.EndpointId
+		open.Add(id)
+		tracked := t.tunnels[id]
+
+		switch tunnel.State {
+		case VPNRetrying:
+			if tracked == nil {
+				tracked = &trackedTunnel{retryingSince: tunnel.Since}
+				t.tunnels[id] = tracked
+			}
+			tracked.name = names[id]
+			if !tracked.notified && !now.Before(tracked.retryingSince.Add(t.gracePeriod)) {
+				tracked.notified = true
+				t.send(NotifyTunnelCritical, id, tracked.name, tracked.retryingSince,
+					fmt.Sprintf("Tunnel to endpoint %s has been failing to connect for %s", id, t.gracePeriod))
+			}
+		case VPNConnected:
+			if tracked != nil && tracked.notified {
+				t.send(NotifyTunnelRecovered, id, tracked.name, tunnel.Since,
+					fmt.Sprintf("Tunnel to endpoint %s has reconnected", id))
+			}
+			delete(t.tunnels, id)
+		}
+	}
+
+	for id, tracked := range t.tunnels {
+		if open.Contains(id) {
+			continue
+		}
+		if tracked.notified {
+			t.send(NotifyTunnelClosed, id, tracked.name, now,
+				fmt.Sprintf("Tunnel to endpoint %s was closed before it reconnected", id))
+		}
+		delete(t.tunnels, id)
+	}
+
+	for id, since := range tunnels.SlowStarts {
+		if notified, ok := t.slowStarts[id]; !ok || !notified.Equal(since) {
+			t.send(NotifyTunnelSlow, id, names[id], since,
+				fmt.Sprintf("Tunnel to endpoint %s is slow to come up: still not connected after %s", id, now.Sub(since).Round(time.Second)))
+		}
+	}
+	t.slowStarts = tunnels.SlowStarts
+}
+
+func (t *notifyTracker) updateEndpoints(cluster *ClusterState, now time.Time) {
+	alive := make(map[string]*Endpoint)
+	for _, endpoints := range [][]*Endpoint{cluster.LocalEndpoints, cluster.RemoteEndpoints} {
+		for _, endpoint := range endpoints {
+			if endpoint.Alive() {
+				alive[endpoint.NodeName()] = endpoint
+			}
+		}
+	}
+
+	if t.endpoints == nil {
+		t.endpoints = make(map[string]*trackedEndpoint, len(alive))
+		for name, endpoint := range alive {
+			t.endpoints[name] = &trackedEndpoint{
+				id:       endpoint.Id(),
+				notified: true,
+				alive:    true,
+			}
+		}
+		return
+	}
+
+	for name, endpoint := range alive {
+		if _, ok := t.endpoints[name]; !ok {
+			t.endpoints[name] = &trackedEndpoint{id: endpoint.Id()}
+		}
+	}
+
+	for name, tracked := range t.endpoints {
+		_, isAlive := alive[name]
+		if isAlive != tracked.alive {
+			tracked.alive = isAlive
+			tracked.changingSince = now
+		}
+		if tracked.alive == tracked.notified {
+			tracked.changingSince = time.Time{}
+		} else if !now.Before(tracked.changingSince.Add(t.gracePeriod)) {
+			tracked.notified = tracked.alive
+			if tracked.alive {
+				t.send(NotifyEndpointJoined, tracked.id, name, tracked.changingSince,
+					fmt.Sprintf("Endpoint %s (%s) joined the cluster", tracked.id, name))
+			} else {
+				t.send(NotifyEndpointLeft, tracked.id, name, tracked.changingSince,
+					fmt.Sprintf("Endpoint %s (%s) left the cluster", tracked.id, name))
+			}
+			tracked.changingSince = time.Time{}
+		}
+
+		if !tracked.alive && !tracked.notified {
+			delete(t.endpoints, name)
+		}
+	}
+}
+
+// NextChange returns the earliest time at which a subsequent Update might
+// send a notification without any change to the states, or false if there
+// is no such time.
+func (t *notifyTracker) NextChange() (time.Time, bool) {
+	var ret time.Time
+	consider := func(since time.Time) {
+		at := since.Add(t.gracePeriod)
+		if ret.IsZero() || at.Before(ret) {
+			ret = at
+		}
+	}
+	for _, tracked := range t.tunnels {
+		if !tracked.notified {
+			consider(tracked.retryingSince)
+		}
+	}
+	for _, tracked := range t.endpoints {
+		if !tracked.changingSince.IsZero() {
+			consider(tracked.changingSince)
+		}
+	}
+	return ret, !ret.IsZero()
+}
+
+// send queues a notification for delivery, dropping it if the queue is
+// full so that a slow Notifier can't hold up the Run loop.
+func (t *notifyTracker) send(kind string, endpointId EndpointId, endpointName string, since time.Time, message string) {
+	notification := &Notification{
+		Kind:         kind,
+		NodeName:     t.nodeName,
+		EndpointId:   endpointId.String(),
+		EndpointName: endpointName,
+		Since:        since.Format(time.RFC3339),
+		Message:      message,
+	}
+	logger.Infof("Notifying: %s", message)
+
+	select {
+	case t.queue <- notification:
+	default:
+		logger.Warnf("Dropped %s notification for endpoint %s, since too many are waiting to be sent", kind, endpointId)
+	}
+}
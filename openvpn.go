@@ -1,26 +1,48 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
 )
 
 type OpenVPN struct {
-	cmd     *exec.Cmd
-	mgmt    *openvpn.MgmtClient
+	proc    VPNProcess
 	eventCh <-chan openvpn.Event
 
 	stateCh chan VPNState
+
+	// stats is the latest of the tunnel's statistics, and exited is set
+	// once the management connection has closed. Both are guarded by
+	// statsLock. See Stats.
+	statsLock sync.Mutex
+	stats     TunnelStats
+	exited    bool
+}
+
+// TunnelStats are the statistics that OpenVPN reports for a tunnel.
+type TunnelStats struct {
+	// BytesIn and BytesOut count the bytes received from and sent to the
+	// far end, including keepalive pings. OpenVPN restarts them from zero
+	// each time it reconnects.
+	BytesIn  int64
+	BytesOut int64
+
+	// LastReceived is when BytesIn last increased, or when the tunnel
+	// last connected if that was more recent. It is zero if the tunnel
+	// has never connected.
+	LastReceived time.Time
 }
 
 type VPNState int
@@ -45,6 +67,7 @@ const (
 	//
 	// The intent is that "Connecting" would be a "Warning" condition
 	// for monitoring purposes, while "Retrying" would be "Critical".
+	// See notify.go for how we tell an operator about the latter.
 	// VPNRetrying will be emitted repeatedly if the OpenVPN process
 	// retries multiple times without success.
 
@@ -61,9 +84,31 @@ const (
 	// VPNExited will always be the new state of the final state
 	// change event before the event channel is closed.
 	VPNExited
+
+	// VPNAuthFailed indicates that the connection attempt failed because
+	// the peers could not authenticate each other, which in static key
+	// mode almost certainly means that they have different keys. Unlike
+	// the other failure states this will not fix itself, so it should be
+	// treated as Critical.
+	//
+	// This was added after the others, so it's at the end to keep the
+	// existing values stable.
+	VPNAuthFailed
 )
+
 //go:generate stringer -type=VPNState
 
+// VPNAddr is the address of one end of a tunnel's transport, which may be
+// either UDP or TCP according to VPNConfig.Transport.
+type VPNAddr struct {
+	IP   net.IP
+	Port int
+}
+
+func (a *VPNAddr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
 type VPNConfig struct {
 
 	// OpenVPNPath is the path to the OpenVPN executable
@@ -81,10 +126,19 @@ type VPNConfig struct {
 	// LocalAddr is used to instruct OpenVPN where to listen for incoming
 	// connections.
 	//
-	// The tunnels we create are peer-to-peer, so both sides will actively
-	// try to reach the other until one succeeds.
-	RemoteAddr *net.UDPAddr
-	LocalAddr  *net.UDPAddr
+	// Over UDP, the tunnels we create are peer-to-peer, so both sides will
+	// actively try to reach the other until one succeeds.
+	RemoteAddr *VPNAddr
+	LocalAddr  *VPNAddr
+
+	// Transport is the protocol that carries the tunnel: TransportUDP (or
+	// empty) or TransportTCP. TCP is a fallback for paths where UDP is
+	// blocked or mangled, since tunnelling TCP over TCP performs poorly.
+	//
+	// A TCP connection has a client and a server, so TCPServer says which
+	// this end is. The other end must be the opposite.
+	Transport string
+	TCPServer bool
 
 	// SecretFilename is the path to the file where the pre-shared key is
 	// stored.
@@ -94,12 +148,415 @@ type VPNConfig struct {
 	//    openvpn --genkey --secret secret.key
 	//
 	// All endpoints must use the same key.
+	//
+	// In TLS mode the key is used only for --tls-auth, which makes OpenVPN
+	// ignore any packet not signed with it.
 	SecretFilename string
 
+	// KeyMode is how the tunnel is keyed: KeyModeStatic (or empty), with
+	// the key in SecretFilename, or KeyModeTLS, with a TLS handshake
+	// using the certificates below. Both peers must use the same mode.
+	//
+	// A TLS handshake has a client and a server, so TLSServer says which
+	// this end is. The other end must be the opposite.
+	//
+	// Every node's certificate comes from the same CA, so any of them
+	// would otherwise do for any tunnel. TLSRemoteName is therefore the
+	// common name that the remote end's certificate must have, which is
+	// its gossip node name.
+	KeyMode       string
+	TLSServer     bool
+	TLSRemoteName string
+
+	// CAFilename, CertFilename and KeyFilename are the paths to the CA
+	// certificate, this node's certificate and its private key, as passed
+	// to OpenVPN's --ca, --cert and --key options, and CRLFilename is the
+	// path to an optional certificate revocation list for --crl-verify.
+	// They're used only in TLS mode.
+	CAFilename   string
+	CertFilename string
+	KeyFilename  string
+	CRLFilename  string
+
+	// Cipher and Auth are the data channel cipher and HMAC digest
+	// algorithm, as passed to OpenVPN's --cipher and --auth options.
+	// If either is empty then OpenVPN's default is used, but since that
+	// default varies between OpenVPN versions it's better to always
+	// set these explicitly. Both peers must use the same settings.
+	Cipher string
+	Auth   string
+
+	// Compression is the algorithm used to compress the tunnel's traffic:
+	// one of CompressionOff (or empty), CompressionLZ4 or CompressionLZO.
+	// Both peers must use the same setting.
+	Compression string
+
+	// DCO allows OpenVPN to use data channel offload, where the kernel
+	// encrypts and decrypts the tunnel's traffic. OpenVPN 2.6 and later
+	// use it by default whenever they can, so unless this is set we turn
+	// it off. Even if it is set, OpenVPN uses it only if dcoUnavailable
+	// finds nothing to stop it.
+	DCO bool
+
+	// TunMTU, MSSFix and Fragment control the sizes of the packets in and
+	// around the tunnel, as passed to OpenVPN's --tun-mtu, --mssfix and
+	// --fragment options:
+	//
+	//  - TunMTU is the MTU of the tun device, and so the largest packet
+	//    that can enter the tunnel. If zero, OpenVPN's default of 1500
+	//    is used. OpenVPN's encapsulation then adds its own overhead, so
+	//    the encrypted packets are larger than this.
+	//  - MSSFix makes OpenVPN lower the MSS of TCP connections through the
+	//    tunnel so that their encrypted packets are no larger than this
+	//    many bytes, which avoids fragmentation of the common case without
+	//    changing the tun device's MTU. If zero, DefaultMSSFix is used;
+	//    if negative, no MSS adjustment is made.
+	//  - Fragment, if non-zero, makes OpenVPN fragment encrypted packets
+	//    larger than this many bytes itself, for non-TCP traffic that
+	//    MSSFix can't help with. It works only over UDP, and both peers
+	//    must use the same setting, so we advertise it to our peers and
+	//    refuse UDP tunnels to any that don't match.
+	TunMTU   int
+	MSSFix   int
+	Fragment int
+
+	// DeviceName is the name to give the tun device for this tunnel. If
+	// empty, OpenVPN asks the kernel to pick the next free tunN name.
+	DeviceName string
+
+	// RuntimeDir is the directory in which we create the temporary
+	// directory holding each OpenVPN process's management socket. If
+	// empty, the system's default temporary directory is used.
+	//
+	// OpenVPN connects to the socket as root, before dropping any
+	// privileges, so the directory need only be accessible to us and
+	// root. It must not be on a filesystem where sockets can't be used.
+	RuntimeDir string
+
+	// ManagementPort, if set, has us share OpenVPN's management interface
+	// by listening on that port on the loopback interface, so that other
+	// tools can connect to it too. They must then give the password in
+	// the first line of ManagementPasswordFile. See mgmtconn.go.
+	ManagementPort         int
+	ManagementPasswordFile string
+
+	// User and Group, if set, make OpenVPN drop its privileges to the
+	// given user and group once it has set up the tun device, via its
+	// --user and --group options. --persist-tun and --persist-key are
+	// then also used, since OpenVPN could no longer re-open the device or
+	// re-read the key if it restarted the connection.
+	//
+	// OpenVPN connects to our management socket before dropping its
+	// privileges, and keeps that connection, so we can still signal it
+	// through the management interface. It can't be killed with a signal
+	// from us, though, so ForceClose instead has the launcher run
+	// KillPath to kill it by pid. With sudo as the launcher, the sudoers
+	// entry must therefore allow both programs; for example:
+	//
+	//    openvpn-peer ALL=(root) NOPASSWD: /usr/sbin/openvpn, /bin/kill
+	//
+	// If KillPath is empty, DefaultKillPath is used.
+	User     string
+	Group    string
+	KillPath string
+
 	// TunnelRemoteAddr and TunnelLocalAddr specify the IP addresses that
 	// will be used to represent the two endpoints *within* the tunnel.
 	TunnelRemoteAddr net.IP
 	TunnelLocalAddr  net.IP
+
+	// Topology is how the tun device is configured with those addresses:
+	// VPNTopologyP2P (or empty) for a point-to-point device, or
+	// VPNTopologySubnet for a /30 network, in which case the two
+	// addresses must be within the same /30. See Address.TunnelInternalIPs.
+	Topology string
+
+	// KeepaliveInterval and KeepaliveTimeout are passed to OpenVPN's
+	// --keepalive option, and so must be whole numbers of seconds. If
+	// zero, DefaultKeepaliveInterval and DefaultKeepaliveTimeout are used.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// Capabilities describes the OpenVPN executable, so that we can use
+	// the options that suit it. If nil, we use options that work with
+	// all of the versions we support.
+	Capabilities *OpenVPNCapabilities
+
+	// ExtraArgs are added to the end of the OpenVPN command line, after
+	// all of the options we set ourselves, so that they can override
+	// those where OpenVPN allows. Except for checkExtraArgs, which
+	// refuses the options that would stop us from managing OpenVPN at
+	// all, they aren't validated: it's up to the operator to make sure
+	// that they work.
+	ExtraArgs []string
+
+	// StatsInterval is how often OpenVPN reports the tunnel's statistics,
+	// and so must be a whole number of seconds. If zero,
+	// DefaultTunnelStatsInterval is used. See OpenVPN.Stats.
+	StatsInterval time.Duration
+
+	// StartTimeout is how long to wait for a newly-launched OpenVPN process
+	// to connect to our management socket before giving up on it. If zero,
+	// DefaultTunnelStartTimeout is used.
+	StartTimeout time.Duration
+
+	// ProcessLauncher, if set, replaces the default behavior of launching
+	// a real OpenVPN child process. This is the seam that allows the
+	// state machine in StartOpenVPN to be driven by scripted events.
+	ProcessLauncher VPNLauncher
+}
+
+// VPNProcess is a running OpenVPN process whose management interface
+// we are connected to.
+type VPNProcess interface {
+	// HoldRelease releases OpenVPN's management hold, allowing it to
+	// begin connecting.
+	HoldRelease() error
+
+	// SendSignal asks OpenVPN to send itself the given signal, via the
+	// management interface.
+	SendSignal(name string) error
+
+	// Kill abruptly terminates the process.
+	Kill() error
+
+	// AuthFailures returns the number of packets the process has so far
+	// rejected due to failed authentication, as reported in its log.
+	AuthFailures() int
+}
+
+// VPNLauncher launches OpenVPN processes.
+type VPNLauncher interface {
+	// Launch starts an OpenVPN process for the given configuration and
+	// returns once its management interface is connected and state events
+	// have been enabled. Management events are delivered on eventCh, which
+	// is closed once the management connection closes.
+	Launch(config *VPNConfig, eventCh chan<- openvpn.Event) (VPNProcess, error)
+}
+
+func (config *VPNConfig) deviceName() string {
+	if config.DeviceName == "" {
+		// OpenVPN interprets the bare device type as a request for
+		// a dynamically-numbered device.
+		return "tun"
+	}
+	return config.DeviceName
+}
+
+// managementArgs returns the OpenVPN options that set up its management
+// interface, which connects to the management socket at the given path.
+// OpenVPN holds until we connect and release it, so that we can't miss
+// any events.
+func (config *VPNConfig) managementArgs(mgmtSocketPath string) []string {
+	return []string{
+		"--management-client",
+		"--management", mgmtSocketPath, "unix",
+		"--management-hold",
+	}
+}
+
+// keyArgs returns the OpenVPN options that key the tunnel.
+func (config *VPNConfig) keyArgs() []string {
+	if config.KeyMode != KeyModeTLS {
+		return []string{"--secret", config.SecretFilename}
+	}
+
+	// --tls-auth's direction must be the opposite at each end, so it
+	// follows the TLS roles.
+	var args []string
+	if config.TLSServer {
+		// There's no need for Diffie-Hellman parameters, since OpenVPN
+		// 2.4 and later use ECDH whenever they can.
+		args = []string{"--tls-server", "--dh", "none", "--tls-auth", config.SecretFilename, "0"}
+	} else {
+		args = []string{"--tls-client", "--tls-auth", config.SecretFilename, "1"}
+	}
+	args = append(args,
+		"--ca", config.CAFilename,
+		"--cert", config.CertFilename,
+		"--key", config.KeyFilename,
+	)
+
+	// The remote end's certificate must be issued for the role it plays
+	// in the handshake and to the node we mean to reach.
+	remoteRole := "server"
+	if config.TLSServer {
+		remoteRole = "client"
+	}
+	args = append(args,
+		"--remote-cert-tls", remoteRole,
+		"--verify-x509-name", config.TLSRemoteName, "name",
+	)
+	if config.CRLFilename != "" {
+		args = append(args, "--crl-verify", config.CRLFilename)
+	}
+	return args
+}
+
+// dcoUnavailable returns why OpenVPN won't use data channel offload for
+// this tunnel, or the empty string if it will.
+func (config *VPNConfig) dcoUnavailable() string {
+	switch {
+	case !config.DCO:
+		return "vpn_dco isn't set"
+	case config.Capabilities == nil || !config.Capabilities.DCO:
+		return "OpenVPN or the kernel doesn't support it"
+	case config.KeyMode != KeyModeTLS:
+		return "it doesn't support static keys"
+	case !aeadCipher(config.Cipher):
+		return fmt.Sprintf("it doesn't support cipher %s", config.Cipher)
+	case config.Compression != "" && config.Compression != CompressionOff:
+		return "it doesn't support compression"
+	case config.Fragment != 0 && config.Transport != TransportTCP:
+		return "it doesn't support fragment"
+	}
+	return ""
+}
+
+// aeadCipher returns whether the given OpenVPN cipher is one of the AEAD
+// ciphers, which are the only ones that data channel offload supports.
+func aeadCipher(cipher string) bool {
+	cipher = strings.ToUpper(cipher)
+	return strings.HasSuffix(cipher, "-GCM") || cipher == "CHACHA20-POLY1305"
+}
+
+// CommandLine returns the command line that will launch OpenVPN with
+// this configuration, having it connect to the management socket at
+// the given path.
+func (config *VPNConfig) CommandLine(mgmtSocketPath string) []string {
+	keepaliveInterval := config.KeepaliveInterval
+	if keepaliveInterval == 0 {
+		keepaliveInterval = DefaultKeepaliveInterval
+	}
+	keepaliveTimeout := config.KeepaliveTimeout
+	if keepaliveTimeout == 0 {
+		keepaliveTimeout = DefaultKeepaliveTimeout
+	}
+
+	var cmdLine = []string{
+		config.LauncherPath,
+		"--",
+		config.OpenVPNPath,
+
+		// ***** REMOVE THIS BEFORE RELEASING FOR PRODUCTION USE *****
+		// Allow connections from any address, which is useful in dev
+		// when running two nodes on the same machine where the IP addresses
+		// tend to get a bit tangled up. But this weakens our security
+		// for production use on the public internet.
+		"--float",
+	}
+
+	// Set up the management interface before anything else, since
+	// OpenVPN won't proceed until we have connected to it.
+	cmdLine = append(cmdLine, config.managementArgs(mgmtSocketPath)...)
+
+	cmdLine = append(cmdLine, config.keyArgs()...)
+
+	cmdLine = append(cmdLine,
+		// Network settings for the tunnel
+		"--dev-type", "tun",
+		"--dev", config.deviceName(),
+
+		// See DefaultKeepaliveInterval for how these timings affect
+		// failure detection.
+		"--keepalive", strconv.Itoa(int(keepaliveInterval/time.Second)), strconv.Itoa(int(keepaliveTimeout/time.Second)),
+	)
+
+	if config.Topology == VPNTopologySubnet {
+		cmdLine = append(
+			cmdLine,
+			"--topology", "subnet",
+			"--ifconfig", config.TunnelLocalAddr.String(), "255.255.255.252",
+		)
+	} else {
+		cmdLine = append(cmdLine, "--ifconfig", config.TunnelLocalAddr.String(), config.TunnelRemoteAddr.String())
+	}
+
+	// OpenVPN must be told explicitly when the tunnel itself runs over
+	// IPv6, even though it's given literal addresses.
+	udp, tcpServer, tcpClient := "udp", "tcp-server", "tcp-client"
+	if config.RemoteAddr.IP.To4() == nil {
+		udp, tcpServer, tcpClient = "udp6", "tcp6-server", "tcp6-client"
+	}
+
+	switch {
+	case config.Transport != TransportTCP:
+		cmdLine = append(
+			cmdLine,
+			"--proto", udp,
+			"--local", config.LocalAddr.IP.String(),
+			"--port", strconv.Itoa(config.LocalAddr.Port),
+			"--remote", config.RemoteAddr.IP.String(), strconv.Itoa(config.RemoteAddr.Port), udp,
+		)
+	case config.TCPServer:
+		cmdLine = append(
+			cmdLine,
+			"--proto", tcpServer,
+			"--local", config.LocalAddr.IP.String(),
+			"--port", strconv.Itoa(config.LocalAddr.Port),
+		)
+	default:
+		cmdLine = append(
+			cmdLine,
+			"--proto", tcpClient,
+			"--nobind",
+			"--remote", config.RemoteAddr.IP.String(), strconv.Itoa(config.RemoteAddr.Port), tcpClient,
+		)
+	}
+
+	if config.Cipher != "" {
+		cmdLine = append(cmdLine, "--cipher", config.Cipher)
+	}
+	if config.Auth != "" {
+		cmdLine = append(cmdLine, "--auth", config.Auth)
+	}
+	if config.TunMTU != 0 {
+		cmdLine = append(cmdLine, "--tun-mtu", strconv.Itoa(config.TunMTU))
+	}
+	switch {
+	case config.MSSFix < 0:
+		cmdLine = append(cmdLine, "--mssfix", "0")
+	case config.MSSFix == 0:
+		cmdLine = append(cmdLine, "--mssfix", strconv.Itoa(DefaultMSSFix))
+	default:
+		cmdLine = append(cmdLine, "--mssfix", strconv.Itoa(config.MSSFix))
+	}
+	if config.Fragment != 0 && config.Transport != TransportTCP {
+		cmdLine = append(cmdLine, "--fragment", strconv.Itoa(config.Fragment))
+	}
+
+	switch config.Compression {
+	case CompressionLZ4:
+		cmdLine = append(cmdLine, "--compress", "lz4")
+	case CompressionLZO:
+		cmdLine = append(cmdLine, "--comp-lzo", "yes")
+	}
+	if config.Compression != "" && config.Compression != CompressionOff && config.Capabilities != nil && config.Capabilities.AllowCompression() {
+		cmdLine = append(cmdLine, "--allow-compression", "yes")
+	}
+
+	if !config.DCO && config.Capabilities != nil && config.Capabilities.DisableDCOOption() {
+		cmdLine = append(cmdLine, "--disable-dco")
+	}
+
+	if config.User != "" {
+		cmdLine = append(cmdLine, "--user", config.User)
+	}
+	if config.Group != "" {
+		cmdLine = append(cmdLine, "--group", config.Group)
+	}
+	if config.User != "" || config.Group != "" {
+		cmdLine = append(cmdLine, "--persist-tun", "--persist-key")
+	}
+
+	cmdLine = append(cmdLine, config.ExtraArgs...)
+
+	// If we don't actually have a launcher, we'll run OpenVPN directly.
+	if cmdLine[0] == "" {
+		cmdLine = cmdLine[2:]
+	}
+
+	return cmdLine
 }
 
 // StartOpenVPN launches OpenVPN as a child process and instructs it
@@ -107,7 +564,7 @@ type VPNConfig struct {
 // notified when the connection status changes.
 //
 // This function returns once the OpenVPN process has launched and
-// successfully connected to the management port. Thus any returned
+// successfully connected to the management socket. Thus any returned
 // instance is ready to be "managed" and the returned error will
 // signal any problems that occur during startup.
 //
@@ -115,6 +572,54 @@ type VPNConfig struct {
 // this function returns, until it either exits of its own accord
 // or it is explicitly terminated with the Close method.
 func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
+	launcher := config.ProcessLauncher
+	if launcher == nil {
+		launcher = execLauncher{}
+	}
+
+	eventCh := make(chan openvpn.Event, 16)
+	proc, err := launcher.Launch(config, eventCh)
+	if err != nil {
+		return nil, err
+	}
+
+	return newOpenVPN(proc, eventCh), nil
+}
+
+// deniedExtraArgs are the OpenVPN options that checkExtraArgs refuses,
+// because they would disconnect OpenVPN from our management socket, hide
+// its output from us, or change the device that our routes refer to.
+var deniedExtraArgs = map[string]bool{
+	"config":     true,
+	"daemon":     true,
+	"inetd":      true,
+	"log":        true,
+	"log-append": true,
+	"syslog":     true,
+	"dev":        true,
+	"dev-type":   true,
+}
+
+// checkExtraArgs returns an error if the given extra OpenVPN arguments
+// include any options that we can't allow. See VPNConfig.ExtraArgs.
+func checkExtraArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		option := strings.TrimPrefix(arg, "--")
+		if deniedExtraArgs[option] || strings.HasPrefix(option, "management") {
+			return fmt.Errorf("%s is not allowed, since it would stop openvpn-peer from managing OpenVPN", arg)
+		}
+	}
+	return nil
+}
+
+// execLauncher is the default VPNLauncher, which launches OpenVPN as a
+// child process and has it connect to a management socket.
+type execLauncher struct{}
+
+func (execLauncher) Launch(config *VPNConfig, eventCh chan<- openvpn.Event) (VPNProcess, error) {
 
 	// Forewarning: this function is kinda hairy. Coordinating the sequence
 	// of events here and handling all the errors along the way is rather
@@ -128,7 +633,7 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 	// child processes or goroutines. If you find any in here then that's
 	// always a bug to be fixed.
 
-	mgmtSocketDir, err := ioutil.TempDir("", "openvpn-peer")
+	mgmtSocketDir, err := ioutil.TempDir(config.RuntimeDir, "openvpn-peer")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create tempdir for socket: %s", err)
 	}
@@ -138,62 +643,44 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 	// safe to remove the socket's directory entry in either case.
 	defer os.RemoveAll(mgmtSocketDir)
 
+	// Operators connecting to the management port share our connection,
+	// which we hand over along with the listener once OpenVPN connects.
+	var operators net.Listener
+	var mgmtPassword string
+	if config.ManagementPort != 0 {
+		mgmtPassword, err = readMgmtPassword(config.ManagementPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		operators, err = listenMgmtPort(config.ManagementPort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	mgmtSocketPath := path.Join(mgmtSocketDir, "mgmt.sock")
-	mgmtListener, err := openvpn.Listen(mgmtSocketPath)
+	mgmtListener, err := net.Listen("unix", mgmtSocketPath)
 	if err != nil {
+		if operators != nil {
+			operators.Close()
+		}
 		return nil, fmt.Errorf("failed to open mgmt socket: %s", err)
 	}
 
-	var cmdLine = []string{
-		config.LauncherPath,
-		"--",
-		config.OpenVPNPath,
-
-		// ***** REMOVE THIS BEFORE RELEASING FOR PRODUCTION USE *****
-		// Allow connections from any address, which is useful in dev
-		// when running two nodes on the same machine where the IP addresses
-		// tend to get a bit tangled up. But this weakens our security
-		// for production use on the public internet.
-		"--float",
-
-		// Have OpenVPN connect to our management socket, and don't try
-		// to connect until we're actively pumping the management event
-		// stream.
-		"--management-client",
-		"--management", mgmtSocketPath, "unix",
-		"--management-hold", // don't connect until we have set up mgmt conn
+	cmdLine := config.CommandLine(mgmtSocketPath)
 
-		// Secret
-		"--secret", config.SecretFilename,
-
-		// Network settings for the tunnel
-		"--dev", "tun",
-		"--local", config.LocalAddr.IP.String(),
-		"--port", strconv.Itoa(config.LocalAddr.Port),
-		"--remote", config.RemoteAddr.IP.String(), strconv.Itoa(config.RemoteAddr.Port),
-		"--ifconfig", config.TunnelLocalAddr.String(), config.TunnelRemoteAddr.String(),
-
-		// This means we will detect a tunnel failure after 30 seconds,
-		// and send a keepalive every 15 so that we minimize the chance
-		// of false positives. This also implies that we'll retry connecting
-		// every 30 seconds in case of problems.
-		//
-		// With these timings, and assuming that a caller is using the
-		// "VPNRetrying" state to signal a critical error, this means that
-		// a tunnel gets 60 seconds to recover before it is considered to
-		// be in a critical state. It also means that there can be up to
-		// 30 seconds of packet loss before we notice a down tunnel and
-		// start forwarding to a neighbor.
-		"--keepalive", "15", "30",
-	}
+	logger.Infof("Starting OpenVPN %s", strings.Join(cmdLine, " "))
 
-	// If we don't actually have a launcher, we'll run OpenVPN directly.
-	if cmdLine[0] == "" {
-		cmdLine = cmdLine[2:]
+	// We keep the last few lines of OpenVPN's output so that we can
+	// explain startup failures. OpenVPN writes most of its diagnostics
+	// to stdout, so we capture both streams together. We also watch
+	// the output for authentication failures, which OpenVPN doesn't
+	// report through the management interface in static key mode.
+	authFailures := &authFailureCounter{}
+	output := &outputTail{
+		onLine: authFailures.observe,
 	}
 
-	log.Printf("Starting OpenVPN %s", strings.Join(cmdLine, " "))
-
 	cmd := &exec.Cmd{
 		Path: cmdLine[0],
 		Args: cmdLine,
@@ -202,6 +689,14 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 		Env: []string{},
 
 		Dir: mgmtSocketDir,
+
+		Stdout: output,
+		Stderr: output,
+	}
+
+	startTimeout := config.StartTimeout
+	if startTimeout == 0 {
+		startTimeout = DefaultTunnelStartTimeout
 	}
 
 	err = cmd.Start()
@@ -210,7 +705,7 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 	}
 
 	type connMsg struct {
-		conn *openvpn.IncomingConn
+		conn mgmtConn
 		err  error
 	}
 
@@ -231,7 +726,13 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 		close(exitCh)
 	}()
 	go func() {
-		conn, err := mgmtListener.Accept()
+		var conn mgmtConn
+		raw, err := mgmtListener.Accept()
+		if err == nil {
+			conn = newMgmtConn(raw, operators, mgmtPassword)
+		} else if operators != nil {
+			operators.Close()
+		}
 		connCh <- connMsg{conn, err}
 		close(connCh)
 	}()
@@ -243,7 +744,9 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 		// then discard it, or return immediately if the channel is already
 		// closed.
 		go func() {
-			<-connCh
+			if cs, ok := <-connCh; ok && cs.conn != nil {
+				cs.conn.Close()
+			}
 		}()
 		go func() {
 			<-exitCh
@@ -259,17 +762,17 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 		mgmtListener.Close()
 	}()
 
-	var conn *openvpn.IncomingConn
+	var conn mgmtConn
 
 	select {
 	case cs := <-connCh:
-		// Either we got a connection on the management port, or there
+		// Either we got a connection on the management socket, or there
 		// was some sort of error while we were waiting.
 
 		if cs.err != nil {
 			// Don't leak a dangling child process.
 			cmd.Process.Signal(os.Kill)
-			return nil, fmt.Errorf("error awaiting mgmt connection: %s", cs.err)
+			return nil, withOutput(fmt.Errorf("error awaiting mgmt connection: %s", cs.err), output)
 		}
 
 		// This is the happy path. We can get our connection and proceed
@@ -278,21 +781,20 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 
 	case err := <-exitCh:
 		if err != nil {
-			return nil, fmt.Errorf("OpenVPN failed to start: %s", err)
+			return nil, withOutput(fmt.Errorf("OpenVPN failed to start: %s", err), output)
 		} else {
-			return nil, fmt.Errorf("OpenVPN exited prematurely")
+			return nil, withOutput(fmt.Errorf("OpenVPN exited prematurely"), output)
 		}
 
-	case <-time.After(10 * time.Second):
+	case <-time.After(startTimeout):
 		// Don't leak a dangling child process.
 		// (our goroutine is still blocking on cmd.Wait() so it will
 		// reap the process once it dies.)
 		cmd.Process.Signal(os.Kill)
 
-		return nil, fmt.Errorf("timeout waiting for OpenVPN to start up")
+		return nil, withOutput(fmt.Errorf("timeout waiting for OpenVPN to start up after %s", startTimeout), output)
 	}
 
-	eventCh := make(chan openvpn.Event, 16)
 	mgmt := conn.Open(eventCh)
 
 	err = mgmt.SetStateEvents(true)
@@ -301,47 +803,180 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 		return nil, fmt.Errorf("failed to enable state events: %s", err)
 	}
 
+	// OpenVPN then reports its byte counts periodically over this same
+	// connection, so we needn't query it; see OpenVPN.Stats.
+	statsInterval := config.StatsInterval
+	if statsInterval == 0 {
+		statsInterval = DefaultTunnelStatsInterval
+	}
+	err = mgmt.SetByteCountEvents(statsInterval)
+	if err != nil {
+		cmd.Process.Signal(os.Kill)
+		return nil, fmt.Errorf("failed to enable byte count events: %s", err)
+	}
+
+	proc := &execProcess{
+		cmd:          cmd,
+		MgmtClient:   mgmt,
+		authFailures: authFailures,
+	}
+
+	// If OpenVPN is going to drop its privileges then we'll need its pid
+	// in order to kill it; see Kill. We ask for it now, since by the time
+	// we need it the management interface may be unresponsive.
+	if config.LauncherPath != "" && (config.User != "" || config.Group != "") {
+		pid, err := mgmt.Pid()
+		if err != nil {
+			logger.Warnf("Failed to get OpenVPN's pid, so won't be able to kill it: %s", err)
+		} else {
+			proc.pid = pid
+			proc.launcherPath = config.LauncherPath
+			proc.killPath = config.KillPath
+			if proc.killPath == "" {
+				proc.killPath = DefaultKillPath
+			}
+		}
+	}
+
+	return proc, nil
+}
+
+// execProcess is the VPNProcess implementation for a real OpenVPN
+// child process.
+type execProcess struct {
+	*openvpn.MgmtClient
+	cmd          *exec.Cmd
+	authFailures *authFailureCounter
+
+	// pid, launcherPath and killPath are set if OpenVPN drops its
+	// privileges, in which case Kill has the launcher kill it by pid.
+	pid          int
+	launcherPath string
+	killPath     string
+}
+
+func (p *execProcess) Kill() error {
+	if p.pid != 0 {
+		output, err := exec.Command(p.launcherPath, "--", p.killPath, "-KILL", strconv.Itoa(p.pid)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to kill OpenVPN process %d: %s", p.pid, commandError(err, output))
+		}
+		return nil
+	}
+	return p.cmd.Process.Signal(os.Kill)
+}
+
+func (p *execProcess) AuthFailures() int {
+	return p.authFailures.count()
+}
+
+// authFailureLogMessages are substrings of OpenVPN log lines that indicate
+// that a packet from the peer failed authentication.
+var authFailureLogMessages = []string{
+	"HMAC authentication failed",
+	"AUTH_FAILED",
+}
+
+// authFailureCounter counts the OpenVPN log lines that indicate failed
+// authentication.
+type authFailureCounter struct {
+	n int32
+}
+
+func (c *authFailureCounter) observe(line string) {
+	for _, msg := range authFailureLogMessages {
+		if strings.Contains(line, msg) {
+			atomic.AddInt32(&c.n, 1)
+			return
+		}
+	}
+}
+
+func (c *authFailureCounter) count() int {
+	return int(atomic.LoadInt32(&c.n))
+}
+
+// newOpenVPN starts translating the management events from the given
+// process into VPNState changes.
+func newOpenVPN(proc VPNProcess, eventCh <-chan openvpn.Event) *OpenVPN {
 	// From this point on, since we know we have a socket connected to
 	// the OpenVPN process we assume we can detect that the process has
 	// exited by the closure of that socket, which in turn leads to
 	// the closure of eventCh.
 
 	stateCh := make(chan VPNState)
+	ret := &OpenVPN{
+		proc:    proc,
+		eventCh: eventCh,
+		stateCh: stateCh,
+	}
 
 	go func() {
 		// We write the "Launching" change first so that we'll block here
 		// until a caller begins processing state change events.
 		stateCh <- VPNLaunching
 
-		// When we first start up we are already in the CONNECTING state
-		// and on our first try.
-		connectTries := 1
+		// When we first start up we are already in the CONNECTING state.
+		// connectTries counts the CONNECTING events we've seen since we
+		// were last connected, so the first attempt (whether the initial
+		// connection or the first reconnection) is VPNConnecting and only
+		// the subsequent attempts are VPNRetrying.
+		connectTries := 0
 		stateCh <- VPNConnecting
 
+		// In static key mode OpenVPN doesn't know anything is wrong
+		// when the keys don't match; it just drops all of the peer's
+		// packets until the keepalive timeout causes it to restart.
+		// If any packets failed authentication during an attempt that
+		// then timed out, we assume that is why.
+		authFailuresBefore := 0
+
 		for event := range eventCh {
 			switch e := event.(type) {
 
 			case *openvpn.HoldEvent:
-				err = mgmt.HoldRelease()
+				err := proc.HoldRelease()
 				if err != nil {
-					log.Printf("[WARNING] failed to release management hold: %s", err)
+					logger.Warnf("failed to release management hold: %s", err)
 					continue
 				}
 
+			case *openvpn.ByteCountEvent:
+				ret.updateStats(func(stats *TunnelStats) {
+					// The count restarts from zero when OpenVPN
+					// reconnects, so any change means something arrived.
+					if int64(e.BytesIn()) != stats.BytesIn {
+						stats.LastReceived = time.Now()
+					}
+					stats.BytesIn = int64(e.BytesIn())
+					stats.BytesOut = int64(e.BytesOut())
+				})
+
 			case *openvpn.StateEvent:
 				newOpenVPNState := e.NewState()
-				log.Printf("OpenVPN process moved to state %s", newOpenVPNState)
+				logger.Debugf("OpenVPN process moved to state %s", newOpenVPNState)
 
 				switch newOpenVPNState {
 				case "CONNECTING", "RECONNECTING":
+					authFailures := proc.AuthFailures()
+					authFailed := e.Description() == "auth-failure" || (newOpenVPNState == "RECONNECTING" && authFailures > authFailuresBefore)
+					authFailuresBefore = authFailures
+					if authFailed {
+						stateCh <- VPNAuthFailed
+						continue
+					}
+
+					connectTries = connectTries + 1
 					newState := VPNConnecting
-					if connectTries > 0 {
+					if connectTries > 1 {
 						newState = VPNRetrying
 					}
-					connectTries = connectTries + 1
 					stateCh <- newState
 				case "CONNECTED":
 					connectTries = 0
+					ret.updateStats(func(stats *TunnelStats) {
+						stats.LastReceived = time.Now()
+					})
 					stateCh <- VPNConnected
 				case "EXITING":
 					stateCh <- VPNExiting
@@ -350,16 +985,37 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 
 		}
 
+		ret.statsLock.Lock()
+		ret.exited = true
+		ret.statsLock.Unlock()
+
 		stateCh <- VPNExited
 		close(stateCh)
 	}()
 
-	return &OpenVPN{
-		cmd:     cmd,
-		mgmt:    mgmt,
-		eventCh: eventCh,
-		stateCh: stateCh,
-	}, nil
+	return ret
+}
+
+// Stats returns the latest statistics that the OpenVPN process has
+// reported, which are at most one VPNConfig.StatsInterval old. It returns
+// an error if the process has exited.
+//
+// Once the tunnel is connected, the far end's keepalive pings should make
+// LastReceived advance at least once every keepalive interval.
+func (o *OpenVPN) Stats() (TunnelStats, error) {
+	o.statsLock.Lock()
+	defer o.statsLock.Unlock()
+
+	if o.exited {
+		return TunnelStats{}, fmt.Errorf("OpenVPN has exited")
+	}
+	return o.stats, nil
+}
+
+func (o *OpenVPN) updateStats(update func(stats *TunnelStats)) {
+	o.statsLock.Lock()
+	defer o.statsLock.Unlock()
+	update(&o.stats)
 }
 
 // AwaitStateChange will block until the connected OpenVPN change state
@@ -373,13 +1029,30 @@ func StartOpenVPN(config *VPNConfig) (*OpenVPN, error) {
 // return VPNExited. If called again after this, the function will
 // *immediately* return VPNExited without blocking.
 func (o *OpenVPN) AwaitStateChange() VPNState {
-	newState, stillRunning := <-o.stateCh
+	// The background context is never cancelled, so we can't get an error.
+	newState, _ := o.AwaitStateChangeContext(context.Background())
+	return newState
+}
 
-	if !stillRunning {
-		// Synthetic event to signal that the process has exited.
-		return VPNExited
-	} else {
-		return newState
+// AwaitStateChangeContext is like AwaitStateChange except that it will
+// return early with the context's error if the given context is
+// cancelled before the state changes. The returned state is meaningless
+// if the error is non-nil.
+//
+// Cancellation doesn't consume or discard any state change, so a later
+// call will still see the next state. However, the OpenVPN event pump
+// stalls while nobody is awaiting state changes, so callers that don't
+// intend to call again should make sure the process is shut down.
+func (o *OpenVPN) AwaitStateChangeContext(ctx context.Context) (VPNState, error) {
+	select {
+	case newState, stillRunning := <-o.stateCh:
+		if !stillRunning {
+			// Synthetic event to signal that the process has exited.
+			return VPNExited, nil
+		}
+		return newState, nil
+	case <-ctx.Done():
+		return VPNLaunching, ctx.Err()
 	}
 }
 
@@ -388,18 +1061,19 @@ func (o *OpenVPN) AwaitStateChange() VPNState {
 // After calling this, a goroutine must continue to wait on state change
 // events until the OpenVPNExited state is recieved.
 func (o *OpenVPN) Close() error {
-	return o.mgmt.SendSignal("SIGTERM")
+	return o.proc.SendSignal("SIGTERM")
 }
 
 // ForceClose will abruptly terminate the OpenVPN process.
 //
 // This will work only if the OpenVPN process is running as the same user
-// as the calling process, since it sends SIGKILL to the process. If
-// not running as the same user, use Close to politely request that
-// OpenVPN should shut itself down.
+// as the calling process, since it sends SIGKILL to the process, or if
+// OpenVPN was configured to drop its privileges, in which case the
+// launcher is used to kill it; see VPNConfig.User. Otherwise, use Close
+// to politely request that OpenVPN should shut itself down.
 //
 // After calling this, a goroutine must continue to wait on state change
 // events until the OpenVPNExited state is recieved.
 func (o *OpenVPN) ForceClose() error {
-	return o.cmd.Process.Signal(os.Kill)
+	return o.proc.Kill()
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
+)
+
+// scriptedLauncher is a VPNLauncher whose processes replay a fixed
+// script of management interface lines, such as ">STATE:0,CONNECTED,,,",
+// and then exit.
+type scriptedLauncher struct {
+	script []string
+
+	// procs are the processes launched so far.
+	procs []*scriptedProcess
+}
+
+func (l *scriptedLauncher) Launch(config *VPNConfig, eventCh chan<- openvpn.Event) (VPNProcess, error) {
+	proc := &scriptedProcess{}
+	l.procs = append(l.procs, proc)
+
+	// The client treats the end of the script as the management
+	// connection closing, just as it would if OpenVPN had exited.
+	conn := &scriptedConn{Reader: strings.NewReader(strings.Join(l.script, "\n") + "\n")}
+	openvpn.NewClient(conn, eventCh)
+	return proc, nil
+}
+
+// scriptedConn is the management connection of a scriptedProcess. It
+// discards anything written to it, since scriptedProcess handles the
+// commands itself.
+type scriptedConn struct {
+	io.Reader
+}
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// scriptedProcess is the VPNProcess returned by scriptedLauncher, which
+// records what it is asked to do.
+type scriptedProcess struct {
+	lock         sync.Mutex
+	holdReleases int
+	signals      []string
+	killed       bool
+}
+
+func (p *scriptedProcess) HoldRelease() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.holdReleases++
+	return nil
+}
+
+func (p *scriptedProcess) SendSignal(name string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.signals = append(p.signals, name)
+	return nil
+}
+
+func (p *scriptedProcess) Kill() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.killed = true
+	return nil
+}
+
+func (p *scriptedProcess) AuthFailures() int {
+	return 0
+}
+
+// runScript starts OpenVPN with a scriptedLauncher replaying the given
+// script, and returns every state it reports up to and including
+// VPNExited.
+func runScript(t *testing.T, script ...string) ([]VPNState, *scriptedLauncher) {
+	t.Helper()
+
+	launcher := &scriptedLauncher{script: script}
+	vpn, err := StartOpenVPN(&VPNConfig{ProcessLauncher: launcher})
+	if err != nil {
+		t.Fatalf("StartOpenVPN failed: %s", err)
+	}
+
+	var states []VPNState
+	timeout := time.After(5 * time.Second)
+	for {
+		stateCh := make(chan VPNState, 1)
+		go func() {
+			stateCh <- vpn.AwaitStateChange()
+		}()
+		select {
+		case state := <-stateCh:
+			states = append(states, state)
+			if state == VPNExited {
+				return states, launcher
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for VPNExited; got %s so far", states)
+		}
+	}
+}
+
+func TestOpenVPNStateSequence(t *testing.T) {
+	states, launcher := runScript(t,
+		">HOLD:Waiting for hold release:0",
+		">STATE:1500000000,CONNECTING,,,",
+		">STATE:1500000001,CONNECTED,SUCCESS,172.16.4.1,192.0.2.7",
+		">STATE:1500000002,EXITING,SIGTERM,,",
+	)
+
+	want := []VPNState{
+		VPNLaunching,
+		VPNConnecting,
+		VPNConnecting,
+		VPNConnected,
+		VPNExiting,
+		VPNExited,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("wrong states\ngot:  %s\nwant: %s", states, want)
+	}
+	if got := launcher.procs[0].holdReleases; got != 1 {
+		t.Errorf("hold released %d times; want 1", got)
+	}
+}
+
+func TestOpenVPNStateAuthFailure(t *testing.T) {
+	states, _ := runScript(t,
+		">STATE:1500000000,CONNECTING,,,",
+		">STATE:1500000001,RECONNECTING,auth-failure,,",
+		">STATE:1500000002,RECONNECTING,ping-restart,,",
+	)
+
+	// The auth failure isn't counted as an attempt, so the attempt after
+	// it is the second and therefore a retry.
+	want := []VPNState{
+		VPNLaunching,
+		VPNConnecting,
+		VPNConnecting,
+		VPNAuthFailed,
+		VPNRetrying,
+		VPNExited,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("wrong states\ngot:  %s\nwant: %s", states, want)
+	}
+}
+
+func TestOpenVPNStateIgnoresOtherEvents(t *testing.T) {
+	states, _ := runScript(t,
+		">INFO:OpenVPN Management Interface Version 1",
+		">ECHO:1500000000,hello",
+		">STATE:1500000001,WAIT,,,",
+		">STATE:1500000002,AUTH,,,",
+		">STATE:1500000003,GET_CONFIG,,,",
+		">STATE:1500000004,ASSIGN_IP,,172.16.4.1,",
+		">STATE:1500000005,CONNECTED,SUCCESS,172.16.4.1,192.0.2.7",
+	)
+
+	want := []VPNState{
+		VPNLaunching,
+		VPNConnecting,
+		VPNConnected,
+		VPNExited,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("wrong states\ngot:  %s\nwant: %s", states, want)
+	}
+}
+
+func TestOpenVPNClose(t *testing.T) {
+	launcher := &scriptedLauncher{}
+	vpn, err := StartOpenVPN(&VPNConfig{ProcessLauncher: launcher})
+	if err != nil {
+		t.Fatalf("StartOpenVPN failed: %s", err)
+	}
+	if err := vpn.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if err := vpn.ForceClose(); err != nil {
+		t.Fatalf("ForceClose failed: %s", err)
+	}
+	for vpn.AwaitStateChange() != VPNExited {
+	}
+
+	proc := launcher.procs[0]
+	if !reflect.DeepEqual(proc.signals, []string{"SIGTERM"}) {
+		t.Errorf("wrong signals %q; want SIGTERM", proc.signals)
+	}
+	if !proc.killed {
+		t.Errorf("process wasn't killed")
+	}
+}
+
+func TestOpenVPNConnectTries(t *testing.T) {
+	tests := []struct {
+		name   string
+		script []string
+		want   []VPNState
+	}{
+		{
+			"first connect",
+			[]string{
+				">STATE:1500000000,CONNECTING,,,",
+				">STATE:1500000001,CONNECTED,SUCCESS,,",
+			},
+			[]VPNState{VPNLaunching, VPNConnecting, VPNConnecting, VPNConnected, VPNExited},
+		},
+		{
+			"reconnect",
+			[]string{
+				">STATE:1500000000,CONNECTING,,,",
+				">STATE:1500000001,CONNECTED,SUCCESS,,",
+				">STATE:1500000002,RECONNECTING,ping-restart,,",
+				">STATE:1500000003,CONNECTED,SUCCESS,,",
+			},
+			[]VPNState{VPNLaunching, VPNConnecting, VPNConnecting, VPNConnected, VPNConnecting, VPNConnected, VPNExited},
+		},
+		{
+			"repeated retries",
+			[]string{
+				">STATE:1500000000,CONNECTING,,,",
+				">STATE:1500000001,RECONNECTING,ping-restart,,",
+				">STATE:1500000002,RECONNECTING,ping-restart,,",
+				">STATE:1500000003,CONNECTED,SUCCESS,,",
+				">STATE:1500000004,RECONNECTING,ping-restart,,",
+				">STATE:1500000005,RECONNECTING,ping-restart,,",
+			},
+			[]VPNState{
+				VPNLaunching, VPNConnecting,
+				VPNConnecting, VPNRetrying, VPNRetrying, VPNConnected,
+				VPNConnecting, VPNRetrying,
+				VPNExited,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			states, _ := runScript(t, test.script...)
+			if !reflect.DeepEqual(states, test.want) {
+				t.Errorf("wrong states\ngot:  %s\nwant: %s", states, test.want)
+			}
+		})
+	}
+}
+
+// testVPNConfig returns a tunnel configuration complete enough for
+// CommandLine, using the given transport.
+func testVPNConfig(transport string) *VPNConfig {
+	return &VPNConfig{
+		LocalAddr:        &VPNAddr{IP: net.ParseIP("192.0.2.1"), Port: 7001},
+		RemoteAddr:       &VPNAddr{IP: net.ParseIP("192.0.2.2"), Port: 7002},
+		TunnelLocalAddr:  net.ParseIP("172.16.4.2"),
+		TunnelRemoteAddr: net.ParseIP("172.16.8.1"),
+		SecretFilename:   "/etc/openvpn-peer/secret.key",
+		Transport:        transport,
+	}
+}
+
+// flagArgs returns the argument following each occurrence of the given
+// flag in cmdLine.
+func flagArgs(cmdLine []string, flag string) []string {
+	var ret []string
+	for i, arg := range cmdLine {
+		if arg == flag && i+1 < len(cmdLine) {
+			ret = append(ret, cmdLine[i+1])
+		}
+	}
+	return ret
+}
+
+func TestCommandLinePacketSizes(t *testing.T) {
+	tests := []struct {
+		name                     string
+		transport                string
+		tunMTU, mssFix, fragment int
+		wantTunMTU, wantMSSFix   []string
+		wantFragment             []string
+	}{
+		{"defaults", TransportUDP, 0, 0, 0, nil, []string{"1450"}, nil},
+		{"mssfix disabled", TransportUDP, 0, -1, 0, nil, []string{"0"}, nil},
+		{"mssfix set", TransportUDP, 0, 1300, 0, nil, []string{"1300"}, nil},
+		{"tun-mtu set", TransportUDP, 1400, 0, 0, []string{"1400"}, []string{"1450"}, nil},
+		{"fragment over udp", TransportUDP, 0, 0, 1300, nil, []string{"1450"}, []string{"1300"}},
+		{"fragment over tcp", TransportTCP, 0, 0, 1300, nil, []string{"1450"}, nil},
+		{"everything", TransportUDP, 1400, 1200, 1300, []string{"1400"}, []string{"1200"}, []string{"1300"}},
+		{"everything over tcp", TransportTCP, 1400, -1, 1300, []string{"1400"}, []string{"0"}, nil},
+	}
+
+	for _, test := range tests {
+		config := testVPNConfig(test.transport)
+		config.TunMTU = test.tunMTU
+		config.MSSFix = test.mssFix
+		config.Fragment = test.fragment
+		cmdLine := config.CommandLine("/run/openvpn-peer/mgmt.sock")
+
+		for _, check := range []struct {
+			flag string
+			want []string
+		}{
+			{"--tun-mtu", test.wantTunMTU},
+			{"--mssfix", test.wantMSSFix},
+			{"--fragment", test.wantFragment},
+		} {
+			if got := flagArgs(cmdLine, check.flag); !reflect.DeepEqual(got, check.want) {
+				t.Errorf("%s: %s is %q; want %q", test.name, check.flag, got, check.want)
+			}
+		}
+	}
+}
+
+func TestCommandLineDCO(t *testing.T) {
+	withDCO := &OpenVPNCapabilities{Version: "OpenVPN 2.6.8", Major: 2, Minor: 6, DCO: true}
+	withoutDCO := &OpenVPNCapabilities{Version: "OpenVPN 2.6.8", Major: 2, Minor: 6}
+	older := &OpenVPNCapabilities{Version: "OpenVPN 2.5.5", Major: 2, Minor: 5}
+
+	tests := []struct {
+		name        string
+		caps        *OpenVPNCapabilities
+		dco         bool
+		cipher      string
+		compression string
+		fragment    int
+		wantDisable bool
+		wantActive  bool
+	}{
+		{"not opted in", withDCO, false, "AES-256-GCM", "", 0, true, false},
+		{"opted in", withDCO, true, "AES-256-GCM", "", 0, false, true},
+		{"chacha20", withDCO, true, "CHACHA20-POLY1305", "", 0, false, true},
+		{"cbc cipher", withDCO, true, "AES-256-CBC", "", 0, false, false},
+		{"compressed", withDCO, true, "AES-256-GCM", CompressionLZ4, 0, false, false},
+		{"fragmented", withDCO, true, "AES-256-GCM", "", 1300, false, false},
+		{"no module", withoutDCO, true, "AES-256-GCM", "", 0, false, false},
+		{"no module, not opted in", withoutDCO, false, "AES-256-GCM", "", 0, true, false},
+		{"before 2.6", older, false, "AES-256-GCM", "", 0, false, false},
+	}
+	for _, test := range tests {
+		config := testVPNConfig(TransportUDP)
+		config.KeyMode = KeyModeTLS
+		config.Capabilities = test.caps
+		config.DCO = test.dco
+		config.Cipher = test.cipher
+		config.Compression = test.compression
+		config.Fragment = test.fragment
+
+		disabled := false
+		for _, arg := range config.CommandLine("/run/openvpn-peer/mgmt.sock") {
+			if arg == "--disable-dco" {
+				disabled = true
+			}
+		}
+		if disabled != test.wantDisable {
+			t.Errorf("%s: got --disable-dco %v; want %v", test.name, disabled, test.wantDisable)
+		}
+		if reason := config.dcoUnavailable(); (reason == "") != test.wantActive {
+			t.Errorf("%s: got reason %q; want DCO active %v", test.name, reason, test.wantActive)
+		}
+	}
+
+	if err := withoutDCO.Check(&VPNConfig{KeyMode: KeyModeTLS, DCO: true}); err == nil {
+		t.Errorf("Check allowed vpn_dco without DCO support")
+	}
+	if err := withDCO.Check(&VPNConfig{KeyMode: KeyModeTLS, DCO: true}); err != nil {
+		t.Errorf("Check failed with DCO support: %s", err)
+	}
+}
+
+func TestCommandLineTLSIdentity(t *testing.T) {
+	for _, test := range []struct {
+		server     bool
+		wantRole   string
+		wantTLSArg string
+	}{
+		{true, "client", "--tls-server"},
+		{false, "server", "--tls-client"},
+	} {
+		config := testVPNConfig(TransportUDP)
+		config.KeyMode = KeyModeTLS
+		config.TLSServer = test.server
+		config.TLSRemoteName = "remote"
+		cmdLine := config.CommandLine("/run/openvpn-peer/mgmt.sock")
+
+		if !strings.Contains(strings.Join(cmdLine, " "), test.wantTLSArg) {
+			t.Errorf("%s: missing from %q", test.wantTLSArg, cmdLine)
+		}
+		if got := flagArgs(cmdLine, "--remote-cert-tls"); !reflect.DeepEqual(got, []string{test.wantRole}) {
+			t.Errorf("%s: --remote-cert-tls is %q; want %s", test.wantTLSArg, got, test.wantRole)
+		}
+		if got := strings.Join(cmdLine, " "); !strings.Contains(got, "--verify-x509-name remote name") {
+			t.Errorf("%s: peer's name isn't verified in %q", test.wantTLSArg, got)
+		}
+	}
+
+	// Static keys have no certificates to check.
+	cmdLine := testVPNConfig(TransportUDP).CommandLine("/run/openvpn-peer/mgmt.sock")
+	for _, arg := range cmdLine {
+		if arg == "--remote-cert-tls" || arg == "--verify-x509-name" {
+			t.Errorf("static key tunnel has %s", arg)
+		}
+	}
+}
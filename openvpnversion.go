@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file finds out which version of OpenVPN we're running and what it
+// supports, so that we can choose the right options for it and explain
+// any that it lacks up front, rather than having every tunnel fail with
+// OpenVPN exiting prematurely.
+//
+// We do this once at startup, by running "openvpn --version" via the
+// launcher, and the result is shared by all of the tunnels through
+// VPNConfig.Capabilities.
+//
+// We also look for data channel offload (DCO), with which OpenVPN 2.6 and
+// later can have the kernel encrypt the tunnel traffic. OpenVPN turns DCO
+// on by itself whenever it can, but DCO rules out compression, fragment
+// and non-AEAD ciphers, so we pass --disable-dco unless the operator opts
+// in with vpn_dco. See VPNConfig.DCO.
+
+// OpenVPNCapabilities describes an OpenVPN executable.
+type OpenVPNCapabilities struct {
+	// Version is the first line of OpenVPN's --version output, and Major
+	// and Minor are parsed from it.
+	Version string
+	Major   int
+	Minor   int
+
+	// LZO and LZ4 are set if OpenVPN was built with those compression
+	// algorithms.
+	LZO bool
+	LZ4 bool
+
+	// DCO is set if OpenVPN supports data channel offload and the kernel
+	// module for it is loaded.
+	DCO bool
+}
+
+// dcoModulePaths are where the kernel module that provides data channel
+// offload appears once it is loaded: the out-of-tree ovpn-dco module, or
+// the ovpn module in mainline kernels.
+var dcoModulePaths = []string{
+	"/sys/module/ovpn_dco_v2",
+	"/sys/module/ovpn",
+}
+
+// openVPNVersionPattern matches the start of the first line of OpenVPN's
+// --version output, such as "OpenVPN 2.5.5 x86_64-pc-linux-gnu [SSL
+// (OpenSSL)] [LZO] [LZ4] ...".
+var openVPNVersionPattern = regexp.MustCompile(`^OpenVPN (\d+)\.(\d+)`)
+
+// DetectOpenVPNCapabilities runs the OpenVPN executable at openVPNPath
+// via the launcher at launcherPath, or directly if launcherPath is empty,
+// to find out what it supports.
+func DetectOpenVPNCapabilities(launcherPath, openVPNPath string) (*OpenVPNCapabilities, error) {
+	cmdLine := []string{launcherPath, "--", openVPNPath, "--version"}
+	if launcherPath == "" {
+		cmdLine = cmdLine[2:]
+	}
+	return detectOpenVPNCapabilities(cmdLine)
+}
+
+// detectOpenVPNCapabilities is the implementation of
+// DetectOpenVPNCapabilities, given the whole command line to run.
+func detectOpenVPNCapabilities(cmdLine []string) (*OpenVPNCapabilities, error) {
+	// OpenVPN exits with a non-zero status after printing its version,
+	// so we judge success by the output instead.
+	output, err := exec.Command(cmdLine[0], cmdLine[1:]...).CombinedOutput()
+	caps, parseErr := parseOpenVPNVersion(string(output))
+	if parseErr != nil {
+		if err == nil {
+			err = parseErr
+		}
+		return nil, fmt.Errorf("failed to get OpenVPN version: %s", commandError(err, output))
+	}
+	if caps.atLeast(2, 6) {
+		for _, path := range dcoModulePaths {
+			if _, err := os.Stat(path); err == nil {
+				caps.DCO = true
+				break
+			}
+		}
+	}
+	return caps, nil
+}
+
+func parseOpenVPNVersion(output string) (*OpenVPNCapabilities, error) {
+	firstLine := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+	match := openVPNVersionPattern.FindStringSubmatch(firstLine)
+	if match == nil {
+		return nil, fmt.Errorf("unexpected output from --version")
+	}
+
+	ret := &OpenVPNCapabilities{
+		Version: firstLine,
+	}
+	ret.Major, _ = strconv.Atoi(match[1])
+	ret.Minor, _ = strconv.Atoi(match[2])
+	ret.LZO = strings.Contains(firstLine, "[LZO]")
+	ret.LZ4 = strings.Contains(firstLine, "[LZ4]")
+	return ret, nil
+}
+
+// atLeast returns whether this is at least the given version of OpenVPN.
+func (c *OpenVPNCapabilities) atLeast(major, minor int) bool {
+	return c.Major > major || (c.Major == major && c.Minor >= minor)
+}
+
+// CompressOption returns whether OpenVPN has the --compress option, which
+// we need for LZ4 compression. It was added in OpenVPN 2.4.
+func (c *OpenVPNCapabilities) CompressOption() bool {
+	return c.atLeast(2, 4)
+}
+
+// AllowCompression returns whether OpenVPN has the --allow-compression
+// option, which was added in OpenVPN 2.5. Those versions won't compress
+// what they send unless it is set.
+func (c *OpenVPNCapabilities) AllowCompression() bool {
+	return c.atLeast(2, 5)
+}
+
+// DisableDCOOption returns whether OpenVPN has the --disable-dco option,
+// which was added in OpenVPN 2.6 along with DCO itself.
+func (c *OpenVPNCapabilities) DisableDCOOption() bool {
+	return c.atLeast(2, 6)
+}
+
+// Check returns an error if OpenVPN lacks anything needed by the given
+// tunnel settings.
+func (c *OpenVPNCapabilities) Check(config *VPNConfig) error {
+	if !c.atLeast(2, 3) {
+		return fmt.Errorf("%s is too old; we need at least OpenVPN 2.3", c.Version)
+	}
+	switch config.Compression {
+	case CompressionLZ4:
+		if !c.CompressOption() || !c.LZ4 {
+			return fmt.Errorf("vpn_compression is %q, but %s doesn't support it", config.Compression, c.Version)
+		}
+	case CompressionLZO:
+		if !c.LZO {
+			return fmt.Errorf("vpn_compression is %q, but %s doesn't support it", config.Compression, c.Version)
+		}
+	}
+	// We run the TLS server without DH parameters, which needs --dh none.
+	if config.KeyMode == KeyModeTLS && !c.atLeast(2, 4) {
+		return fmt.Errorf("vpn_key_mode is %q, but %s doesn't support it without DH parameters; we need at least OpenVPN 2.4", config.KeyMode, c.Version)
+	}
+	if config.DCO && !c.DCO {
+		return fmt.Errorf("vpn_dco is set, but %s doesn't support data channel offload or its kernel module isn't loaded", c.Version)
+	}
+	return nil
+}
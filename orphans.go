@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This file cleans up after an earlier run of the daemon that died
+// without closing its tunnels. Its OpenVPN processes would otherwise keep
+// running, holding the ports and tun device names that our new tunnels
+// need.
+//
+// We are careful to reap only processes we can confidently attribute to
+// ourselves: OpenVPN processes (or launchers running them) whose command
+// line names a management interface of ours, as set up by StartOpenVPN,
+// and that aren't descended from a running copy of this program. Since
+// OpenVPN removes its tun device on exit, that usually cleans up the
+// devices too, but we delete any of ours that remain afterwards.
+
+// orphanExitTimeout limits how long we wait for reaped processes to exit
+// before looking for leftover devices.
+const orphanExitTimeout = 5 * time.Second
+
+// procInfo is what we learn about a process from /proc.
+type procInfo struct {
+	pid  int
+	ppid int
+	comm string
+	args []string
+}
+
+// reapOrphans kills the OpenVPN processes left behind by an earlier run,
+// and deletes their tun devices if they remain afterwards. Failures are
+// logged, since they needn't stop us from starting.
+func (m *Manager) reapOrphans() {
+	procs, err := listProcs()
+	if err != nil {
+		logger.Warnf("Not checking for orphaned OpenVPN processes: %s", err)
+		return
+	}
+	self, ok := procs[os.Getpid()]
+	if !ok {
+		logger.Warnf("Not checking for orphaned OpenVPN processes: can't find ourselves in /proc")
+		return
+	}
+
+	ours := make(map[int]*procInfo)
+	for pid, proc := range procs {
+		if m.isOurOpenVPN(proc.args) {
+			ours[pid] = proc
+		}
+	}
+
+	var reaped []*procInfo
+	for pid, proc := range ours {
+		// A launcher is ours too, so we look at whoever started the
+		// first of them.
+		root := proc
+		for ours[root.ppid] != nil {
+			root = ours[root.ppid]
+		}
+		if parent := procs[root.ppid]; parent != nil && parent.comm == self.comm {
+			continue
+		}
+
+		logger.Warnf("Killing orphaned OpenVPN process %d from an earlier run: %s", pid, strings.Join(proc.args, " "))
+		err := m.killOrphan(pid)
+		if err != nil {
+			logger.Errorf("Failed to kill orphaned OpenVPN process %d: %s", pid, err)
+			continue
+		}
+		reaped = append(reaped, proc)
+	}
+	if len(reaped) == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(orphanExitTimeout)
+	for _, proc := range reaped {
+		for time.Now().Before(deadline) {
+			if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(proc.pid))); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, proc := range reaped {
+		device := argAfter(proc.args, "--dev")
+		if !strings.HasPrefix(device, "tun-") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/class/net", device)); err != nil {
+			continue
+		}
+		logger.Warnf("Deleting orphaned tun device %s", device)
+		output, err := exec.Command(DefaultLauncherPath, "--", "/sbin/ip", "link", "delete", device).CombinedOutput()
+		if err != nil {
+			logger.Errorf("Failed to delete orphaned tun device %s: %s", device, commandError(err, output))
+		}
+	}
+}
+
+// isOurOpenVPN returns whether the given command line is one that
+// StartOpenVPN would run, as far as we can tell from its management
+// options. See VPNConfig.managementArgs.
+func (m *Manager) isOurOpenVPN(args []string) bool {
+	for i, arg := range args {
+		if arg != "--management" || i+2 >= len(args) {
+			continue
+		}
+
+		if args[i+2] == "unix" {
+			runtimeDir := m.runtimeDir
+			if runtimeDir == "" {
+				runtimeDir = os.TempDir()
+			}
+			socketPath := args[i+1]
+			socketDir := filepath.Dir(socketPath)
+			return filepath.Base(socketPath) == "mgmt.sock" &&
+				strings.HasPrefix(filepath.Base(socketDir), "openvpn-peer") &&
+				filepath.Clean(filepath.Dir(socketDir)) == filepath.Clean(runtimeDir)
+		}
+
+		// Earlier versions had OpenVPN itself listen on the management
+		// port, and we may be replacing one of them.
+		if m.mgmtPortBase != 0 && args[i+1] == "127.0.0.1" && i+3 < len(args) {
+			port, err := strconv.Atoi(args[i+2])
+			return err == nil && port >= m.mgmtPortBase && port <= m.mgmtPortBase+maxEndpointId && args[i+3] == m.mgmtPasswordFile
+		}
+		return false
+	}
+	return false
+}
+
+// killOrphan kills the given process, having the launcher do it if we
+// aren't allowed to ourselves, as when OpenVPN runs as root.
+func (m *Manager) killOrphan(pid int) error {
+	err := syscall.Kill(pid, syscall.SIGKILL)
+	if err != syscall.EPERM {
+		if err == syscall.ESRCH {
+			// It has exited since we looked, probably because we
+			// killed its launcher.
+			return nil
+		}
+		return err
+	}
+	output, err := exec.Command(DefaultLauncherPath, "--", DefaultKillPath, "-KILL", strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return commandError(err, output)
+	}
+	return nil
+}
+
+// listProcs returns the processes we can see in /proc, keyed by pid.
+// Processes that exit while we're looking are skipped.
+func listProcs() (map[int]*procInfo, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[int]*procInfo)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", entry.Name())
+
+		stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name is in parentheses and may contain spaces,
+		// so the fields we want come after the last one.
+		start, end := strings.IndexByte(string(stat), '('), strings.LastIndexByte(string(stat), ')')
+		if start < 0 || end < start {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil {
+			continue
+		}
+
+		ret[pid] = &procInfo{
+			pid:  pid,
+			ppid: ppid,
+			comm: string(stat[start+1 : end]),
+			args: strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"),
+		}
+	}
+	return ret, nil
+}
+
+// argAfter returns the argument following the given option, or the empty
+// string if there is none.
+func argAfter(args []string, option string) string {
+	for i, arg := range args {
+		if arg == option && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
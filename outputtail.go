@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// outputTailLines is the number of lines of child process output that
+// an outputTail retains.
+const outputTailLines = 20
+
+// outputTailLineLen is the maximum length of a single retained line.
+// Longer lines are truncated, so that a process that writes a lot of
+// output without newlines can't cause us to buffer without bound.
+const outputTailLineLen = 512
+
+// outputTail is an io.Writer that retains only the last few lines written
+// to it, for inclusion in error messages when a child process fails.
+//
+// It is safe to write to concurrently with calls to String, since
+// os/exec copies the child's output from a separate goroutine.
+type outputTail struct {
+	// onLine, if set, is called with each complete line as it is
+	// written, while holding the lock.
+	onLine func(line string)
+
+	lock    sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+func (t *outputTail) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		nl := bytes.IndexByte(p, '\n')
+		if nl < 0 {
+			t.appendPartial(p)
+			break
+		}
+		t.appendPartial(p[:nl])
+		t.pushLine()
+		p = p[nl+1:]
+	}
+	return n, nil
+}
+
+func (t *outputTail) appendPartial(p []byte) {
+	room := outputTailLineLen - len(t.partial)
+	if room <= 0 {
+		return
+	}
+	if len(p) > room {
+		p = p[:room]
+	}
+	t.partial = append(t.partial, p...)
+}
+
+func (t *outputTail) pushLine() {
+	line := strings.TrimRight(string(t.partial), "\r")
+	t.partial = t.partial[:0]
+	if line == "" {
+		return
+	}
+	if t.onLine != nil {
+		t.onLine(line)
+	}
+
+	t.lines = append(t.lines, line)
+	if len(t.lines) > outputTailLines {
+		t.lines = t.lines[len(t.lines)-outputTailLines:]
+	}
+}
+
+// String returns the retained lines, joined with newlines, including any
+// incomplete final line.
+func (t *outputTail) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	lines := t.lines
+	if len(t.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(t.partial))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// withOutput annotates the given error with whatever output has been
+// retained by the given tail, if any.
+func withOutput(err error, output *outputTail) error {
+	text := output.String()
+	if text == "" {
+		return err
+	}
+	return fmt.Errorf("%s; last output was:\n%s", err, text)
+}
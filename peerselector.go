@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// peerSelectorTag is the gossip tag in which each endpoint advertises its
+// peer selector, so that the decision to run a tunnel can be made
+// symmetrically. See wantTunnel.
+const peerSelectorTag = "peer_selector"
+
+// reservedTags are the gossip tags that we set ourselves, which therefore
+// can't be used for the arbitrary tags set by the "tags" setting.
+var reservedTags = map[string]bool{
+	"int_ip":          true,
+	"observer":        true,
+	"hub":             true,
+	"topology":        true,
+	"vpn_cipher":      true,
+	"vpn_auth":        true,
+	"vpn_compression": true,
+	"vpn_transport":   true,
+	vpnKeyModeTag:     true,
+	"vpn_endpoint_ip": true,
+	keyGenerationsTag: true,
+	pairKeysTag:       true,
+	peerSelectorTag:   true,
+	drainingTag:       true,
+	lastWillTag:       true,
+	endpointIdTag:     true,
+	servedNetworksTag: true,
+	vpnPortTag:        true,
+	vpnFragmentTag:    true,
+	vpnTopologyTag:    true,
+	modeTag:           true,
+}
+
+// PeerSelector restricts which remote endpoints we run tunnels to, based
+// on the tags that they advertise. An endpoint is selected only if it
+// satisfies all of the requirements; an empty selector selects every
+// endpoint.
+//
+// A selector is written as a comma-separated list of requirements, each of
+// which is either "key=value", requiring that the endpoint has the given
+// tag with the given value, or "key!=value", requiring that it doesn't.
+// For example, "role=edge,zone!=eu-1".
+type PeerSelector []PeerRequirement
+
+type PeerRequirement struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+func ParsePeerSelector(raw string) (PeerSelector, error) {
+	var ret PeerSelector
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var req PeerRequirement
+		if i := strings.Index(part, "!="); i != -1 {
+			req.Key, req.Value, req.Negate = part[:i], part[i+2:], true
+		} else if i := strings.Index(part, "="); i != -1 {
+			req.Key, req.Value = part[:i], part[i+1:]
+		} else {
+			return nil, fmt.Errorf("invalid peer selector requirement %q: must be key=value or key!=value", part)
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if req.Key == "" {
+			return nil, fmt.Errorf("invalid peer selector requirement %q: key is empty", part)
+		}
+		ret = append(ret, req)
+	}
+	return ret, nil
+}
+
+// Matches returns true if the given endpoint satisfies all of the
+// selector's requirements.
+func (s PeerSelector) Matches(endpoint *Endpoint) bool {
+	for _, req := range s {
+		value, ok := endpoint.Tag(req.Key)
+		if (ok && value == req.Value) == req.Negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (s PeerSelector) String() string {
+	parts := make([]string, len(s))
+	for i, req := range s {
+		op := "="
+		if req.Negate {
+			op = "!="
+		}
+		parts[i] = req.Key + op + req.Value
+	}
+	return strings.Join(parts, ",")
+}
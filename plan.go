@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runPlan prints the addressing that this node would use according to
+// its configuration, without starting gossip or any tunnels, so that the
+// prefix lengths can be checked before deploying.
+func runPlan(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	peersFlag := flags.String("peers", "", "comma-separated endpoint ids of hypothetical peers, in hex")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	args = flags.Args()
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	var peers []EndpointId
+	if *peersFlag != "" {
+		for _, raw := range strings.Split(*peersFlag, ",") {
+			id, err := ParseEndpointId(strings.TrimSpace(raw))
+			if err != nil {
+				return err
+			}
+			peers = append(peers, id)
+		}
+	}
+
+	var configFile string
+	if len(args) == 1 {
+		configFile = args[0]
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	localNet, err := config.LocalAddressNet()
+	if err != nil {
+		return err
+	}
+	localIP, err := interfaceIPAddr(config.LocalInterface, localNet, config.IPv6())
+	if err != nil {
+		return err
+	}
+
+	addressing, err := NewAddressing(config, net.ParseIP(localIP))
+	if err != nil {
+		return err
+	}
+	PrintAddressingPlan(addressing.LocalAddress(), peers)
+	return nil
+}
+
+// PrintAddressingPlan prints the addressing derived for the given local
+// address, along with the details of tunnels to each of the given peers.
+func PrintAddressingPlan(local Address, peers []EndpointId) {
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	w.Write([]byte("\naddress\teid\tregion\tdatacenter\tdatacenter network\t\n"))
+	w.Write([]byte(fmt.Sprintf(
+		"%s\t%s\t%s\t%s\t%s\t\n",
+		local,
+		local.EndpointId(),
+		local.RegionId(),
+		local.DatacenterId(),
+		local.DatacenterNetwork(),
+	)))
+	w.Flush()
+
+	if len(peers) == 0 {
+		os.Stdout.Write([]byte("\n(use -peers to show the tunnels to particular endpoint ids)\n\n"))
+		return
+	}
+
+	w = tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	w.Write([]byte("\npeer eid\tdevice\tlocal port\tremote port\tlocal tunnel IP\tremote tunnel IP\t\n"))
+	for _, peer := range peers {
+		localPort, remotePort := local.VPNEndpointPorts(peer)
+		localTunnelIP, remoteTunnelIP, err := local.TunnelInternalIPs(peer)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("%s\t(%s)\t\n", peer, err)))
+			continue
+		}
+		w.Write([]byte(fmt.Sprintf(
+			"%s\t%s\t%d\t%d\t%s\t%s\t\n",
+			peer,
+			tunnelDeviceName(peer),
+			localPort,
+			remotePort,
+			localTunnelIP,
+			remoteTunnelIP,
+		)))
+	}
+	w.Flush()
+	os.Stdout.Write([]byte{'\n'})
+}
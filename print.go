@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"text/tabwriter"
+	"time"
 )
 
 // This file contains some functions that are able to print out
@@ -15,11 +18,10 @@ func PrintClusterState(state *ClusterState) {
 
 	printEndpoint := func(e *Endpoint) {
 		w.Write([]byte(fmt.Sprintf(
-			"%s\t%s\t%s:%d\t%s\t%s\t%s\t%d\t%s\t\n",
+			"%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t\n",
 			e.NodeName(),
 			e.Id(),
-			e.GossipAddr(),
-			e.GossipPort(),
+			net.JoinHostPort(e.GossipAddr().String(), strconv.Itoa(int(e.GossipPort()))),
 			e.InternalAddr(),
 			e.RegionId(),
 			e.DatacenterId(),
@@ -35,6 +37,12 @@ func PrintClusterState(state *ClusterState) {
 	for _, endpoint := range state.RemoteEndpoints {
 		printEndpoint(endpoint)
 	}
+	for _, endpoint := range state.ObserverEndpoints {
+		printEndpoint(endpoint)
+	}
+	for _, endpoint := range state.UnknownEndpoints {
+		printEndpoint(endpoint)
+	}
 
 	w.Flush()
 	os.Stdout.Write([]byte{'\n'})
@@ -42,13 +50,19 @@ func PrintClusterState(state *ClusterState) {
 
 func PrintTunnelState(state *TunnelsState) {
 	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
-	w.Write([]byte("\neid\tstate\t\n"))
+	w.Write([]byte("\neid\tstate\tfor\tdevice\tlocal port\tremote port\tlocal tunnel IP\tremote tunnel IP\t\n"))
 
 	for _, tunnel := range state.Tunnels {
 		w.Write([]byte(fmt.Sprintf(
-			"%s\t%s\t\n",
+			"%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t\n",
 			tunnel.EndpointId,
 			tunnel.State,
+			time.Since(tunnel.Since).Truncate(time.Second),
+			tunnel.DeviceName,
+			tunnel.LocalPort,
+			tunnel.RemotePort,
+			tunnel.LocalTunnelIP,
+			tunnel.RemoteTunnelIP,
 		)))
 	}
 
@@ -60,4 +74,3 @@ func PrintTunnelState(state *TunnelsState) {
 
 	os.Stdout.Write([]byte{'\n'})
 }
-
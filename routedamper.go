@@ -0,0 +1,115 @@
+package main
+
+import (
+	"time"
+)
+
+// routeDamper applies hysteresis to the tunnel states that our routing
+// decisions are based on, so that a marginal link doesn't make the route
+// to its destination network flap between the tunnel and the fallback.
+//
+// A tunnel that we're routing through directly must stay disconnected for
+// the failover delay before we switch to the fallback, and once we've
+// switched it must then stay connected for the recovery delay before we
+// switch back. A tunnel's first connection is used right away, since
+// there's no direct route to flap back to yet.
+//
+// routeDamper is used only by the Manager's Run loop, so it isn't safe for
+// concurrent use.
+type routeDamper struct {
+	failoverDelay time.Duration
+	recoveryDelay time.Duration
+
+	tunnels map[EndpointId]*dampedTunnel
+}
+
+type dampedTunnel struct {
+	// direct is set if we're routing directly through the tunnel.
+	direct bool
+
+	// changingSince is when the tunnel's state began to disagree with
+	// direct, or zero if it agrees.
+	changingSince time.Time
+}
+
+func newRouteDamper(failoverDelay, recoveryDelay time.Duration) *routeDamper {
+	return &routeDamper{
+		failoverDelay: failoverDelay,
+		recoveryDelay: recoveryDelay,
+		tunnels:       make(map[EndpointId]*dampedTunnel),
+	}
+}
+
+// Update takes the set of endpoints whose tunnels are currently connected
+// and returns the set that we should route directly through, which lags
+// behind as described on routeDamper.
+func (d *routeDamper) Update(connected EndpointSet, now time.Time) EndpointSet {
+	for endpointId := range connected {
+		if _, ok := d.tunnels[endpointId]; !ok {
+			d.tunnels[endpointId] = &dampedTunnel{
+				direct: true,
+			}
+		}
+	}
+
+	ret := make(EndpointSet)
+	for endpointId, tunnel := range d.tunnels {
+		isConnected := connected.Contains(endpointId)
+		if isConnected == tunnel.direct {
+			tunnel.changingSince = time.Time{}
+		} else {
+			if tunnel.changingSince.IsZero() {
+				tunnel.changingSince = now
+			}
+			if !now.Before(tunnel.changingSince.Add(d.delay(tunnel))) {
+				if isConnected {
+					logger.Infof("Tunnel to endpoint %s has been connected for %s, so routing through it again", endpointId, d.recoveryDelay)
+				} else {
+					logger.Infof("Tunnel to endpoint %s has been down for %s, so routing around it", endpointId, d.failoverDelay)
+				}
+				tunnel.direct = isConnected
+				tunnel.changingSince = time.Time{}
+			}
+		}
+
+		if tunnel.direct {
+			ret.Add(endpointId)
+		}
+	}
+	return ret
+}
+
+// NextChange returns the earliest time at which a subsequent Update might
+// change our routing decisions without any change to the tunnel states,
+// or false if there is no such time.
+func (d *routeDamper) NextChange() (time.Time, bool) {
+	var ret time.Time
+	for _, tunnel := range d.tunnels {
+		if tunnel.changingSince.IsZero() {
+			continue
+		}
+		at := tunnel.changingSince.Add(d.delay(tunnel))
+		if ret.IsZero() || at.Before(ret) {
+			ret = at
+		}
+	}
+	return ret, !ret.IsZero()
+}
+
+// Prune forgets any endpoint not in the given set.
+func (d *routeDamper) Prune(keep EndpointSet) {
+	for endpointId := range d.tunnels {
+		if !keep.Contains(endpointId) {
+			delete(d.tunnels, endpointId)
+		}
+	}
+}
+
+// delay returns how long the given tunnel's state must disagree with our
+// routing before we change it.
+func (d *routeDamper) delay(tunnel *dampedTunnel) time.Duration {
+	if tunnel.direct {
+		return d.failoverDelay
+	}
+	return d.recoveryDelay
+}
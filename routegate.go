@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// routeGate holds off route changes after we start until the cluster has
+// had a chance to form, so that a node that can't yet see its peers
+// doesn't blackhole the routes to all of their networks.
+//
+// The gate opens once we can see at least the minimum number of live
+// cluster members, counting ourselves, or once the settle time has passed
+// since we started, whichever comes first. It then stays open, since an
+// established node that loses sight of its peers should route around
+// them as usual.
+//
+// routeGate is used only by the Manager's Run loop, so it isn't safe for
+// concurrent use.
+type routeGate struct {
+	minMembers int
+	openAt     time.Time
+	open       bool
+}
+
+func newRouteGate(minMembers int, settleTime time.Duration, startedAt time.Time) *routeGate {
+	return &routeGate{
+		minMembers: minMembers,
+		openAt:     startedAt.Add(settleTime),
+	}
+}
+
+// Open returns whether we may change routes given the current cluster
+// state.
+func (g *routeGate) Open(cluster *ClusterState, now time.Time) bool {
+	if g.open {
+		return true
+	}
+
+	members := 1
+	for _, endpoints := range [][]*Endpoint{cluster.LocalEndpoints, cluster.RemoteEndpoints} {
+		for _, endpoint := range endpoints {
+			if endpoint.Alive() {
+				members++
+			}
+		}
+	}
+
+	switch {
+	case members >= g.minMembers:
+		logger.Infof("Can see %d cluster members, so now managing routes", members)
+	case !now.Before(g.openAt):
+		logger.Warnf("Can see only %d of the %d cluster members we expected, but now managing routes anyway", members, g.minMembers)
+	default:
+		logger.Debugf("Not managing routes until we can see %d cluster members (now %d) or %s passes", g.minMembers, members, g.openAt.Sub(now))
+		return false
+	}
+	g.open = true
+	return true
+}
+
+// Opened returns whether the gate has opened, without re-evaluating it.
+func (g *routeGate) Opened() bool {
+	return g.open
+}
+
+// NextChange returns the time at which the gate will open regardless of
+// the cluster state, or false if it is already open.
+func (g *routeGate) NextChange() (time.Time, bool) {
+	if g.open {
+		return time.Time{}, false
+	}
+	return g.openAt, true
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RouteKind distinguishes the different sorts of route we install.
+type RouteKind int
+
+const (
+	// RouteBlackhole discards packets for the destination, so that they
+	// won't loop around while the destination is unreachable.
+	RouteBlackhole RouteKind = iota
+
+	// RouteVia forwards packets for the destination to a gateway.
+	RouteVia
+)
+
+// Route is an entry in the routing table that we manage.
+type Route struct {
+	Destination *net.IPNet
+	Kind        RouteKind
+
+	// Gateway is the next-hop address, for RouteVia routes.
+	Gateway net.IP
+
+	// Metric is the route's priority, where lower values are preferred.
+	// The kernel treats routes to the same destination with different
+	// metrics as distinct routes.
+	Metric int
+
+	// Realm, if non-zero, tags the route with a routing realm so that
+	// packets using it can be matched by firewall rules.
+	Realm int
+}
+
+func (r *Route) Equal(other *Route) bool {
+	return r.Destination.String() == other.Destination.String() &&
+		r.Kind == other.Kind &&
+		r.Gateway.Equal(other.Gateway) &&
+		r.Metric == other.Metric &&
+		r.Realm == other.Realm
+}
+
+func (r *Route) String() string {
+	var ret string
+	switch r.Kind {
+	case RouteBlackhole:
+		ret = fmt.Sprintf("blackhole %s", r.Destination)
+	default:
+		ret = fmt.Sprintf("%s via %s", r.Destination, r.Gateway)
+	}
+	if r.Metric != 0 {
+		ret = fmt.Sprintf("%s metric %d", ret, r.Metric)
+	}
+	if r.Realm != 0 {
+		ret = fmt.Sprintf("%s realm %d", ret, r.Realm)
+	}
+	return ret
+}
+
+// RouteBackend makes changes to the system routing table.
+type RouteBackend interface {
+	// ReplaceRoute installs the given route, replacing any existing route
+	// for the same destination and metric.
+	ReplaceRoute(route *Route) error
+
+	// DeleteRoute removes the given route.
+	DeleteRoute(route *Route) error
+}
+
+// RouteMgr keeps the system routing table in sync with the routes we want.
+//
+// RouteMgr remembers the routes it has installed and only calls on its
+// backend when something actually changes, so it's safe to give it the
+// complete set of desired routes on every reconcile pass.
+type RouteMgr struct {
+	lock    sync.Mutex
+	backend RouteBackend
+	routes  map[string]*Route
+}
+
+func NewRouteMgr(backend RouteBackend) *RouteMgr {
+	return &RouteMgr{
+		backend: backend,
+		routes:  make(map[string]*Route),
+	}
+}
+
+// Sync installs, replaces and deletes routes so that the routes we manage
+// are exactly the given ones. It tries to apply all of the changes even
+// if some fail, and returns the errors for those that did.
+func (m *RouteMgr) Sync(routes []*Route) []error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var errs []error
+
+	want := make(map[string]*Route, len(routes))
+	for _, route := range routes {
+		want[route.Destination.String()] = route
+	}
+
+	for key, route := range m.routes {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		err := m.backend.DeleteRoute(route)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete route %s: %s", route, err))
+			continue
+		}
+		logger.Infof("Deleted route %s", route)
+		delete(m.routes, key)
+	}
+
+	for key, route := range want {
+		current, ok := m.routes[key]
+		if ok && current.Equal(route) {
+			continue
+		}
+		if ok && current.Metric != route.Metric {
+			// Replacing wouldn't remove the existing route, since a
+			// different metric makes it a different route.
+			err := m.backend.DeleteRoute(current)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete route %s: %s", current, err))
+				continue
+			}
+			delete(m.routes, key)
+		}
+		err := m.backend.ReplaceRoute(route)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to install route %s: %s", route, err))
+			continue
+		}
+		logger.Infof("Installed route %s", route)
+		m.routes[key] = route
+	}
+
+	return errs
+}
+
+// RemoveAll deletes all of the routes we've installed.
+func (m *RouteMgr) RemoveAll() []error {
+	return m.Sync(nil)
+}
+
+// Routes returns the routes we've installed, ordered by destination.
+func (m *RouteMgr) Routes() []*Route {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ret := make([]*Route, 0, len(m.routes))
+	for _, route := range m.routes {
+		ret = append(ret, route)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Destination.String() < ret[j].Destination.String()
+	})
+	return ret
+}
+
+// ipRouteBackend is a RouteBackend that runs the Linux "ip" command.
+type ipRouteBackend struct {
+	// IPPath is the path to the "ip" executable.
+	IPPath string
+
+	// LauncherPath is as for VPNConfig.LauncherPath.
+	LauncherPath string
+}
+
+func (b *ipRouteBackend) ReplaceRoute(route *Route) error {
+	args := []string{"route", "replace"}
+	switch route.Kind {
+	case RouteBlackhole:
+		args = append(args, "blackhole", route.Destination.String())
+	case RouteVia:
+		args = append(args, route.Destination.String(), "via", route.Gateway.String())
+	default:
+		return fmt.Errorf("unsupported route kind %d", route.Kind)
+	}
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	if route.Realm != 0 {
+		args = append(args, "realm", strconv.Itoa(route.Realm))
+	}
+	return b.run(args...)
+}
+
+func (b *ipRouteBackend) DeleteRoute(route *Route) error {
+	args := []string{"route", "del", route.Destination.String()}
+	if route.Metric != 0 {
+		args = append(args, "metric", strconv.Itoa(route.Metric))
+	}
+	return b.run(args...)
+}
+
+func (b *ipRouteBackend) run(args ...string) error {
+	cmdLine := append([]string{b.LauncherPath, "--", b.IPPath}, args...)
+	if b.LauncherPath == "" {
+		cmdLine = cmdLine[2:]
+	}
+
+	output, err := exec.Command(cmdLine[0], cmdLine[1:]...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(output))
+		if msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// dryRunRouteBackend is a RouteBackend that only logs the changes it
+// would make.
+type dryRunRouteBackend struct{}
+
+func (dryRunRouteBackend) ReplaceRoute(route *Route) error {
+	logger.Infof("[dry run] Would install route %s", route)
+	return nil
+}
+
+func (dryRunRouteBackend) DeleteRoute(route *Route) error {
+	logger.Infof("[dry run] Would delete route %s", route)
+	return nil
+}
+
+// FallbackRouteOptions customizes the routes that forward traffic via a
+// neighbor in our own region when our own tunnel is down.
+//
+// If two neighbors both have the same tunnel down then they will forward
+// each other's packets back and forth until the packets' TTL runs out.
+// Setting Realm allows a firewall rule to reduce the TTL of packets on
+// fallback routes so that looping packets die quickly; for example:
+//
+//	iptables -t mangle -A FORWARD -m realm --realm 42 -j TTL --ttl-set 4
+//
+// Setting Metric gives fallback routes a lower priority than direct tunnel
+// routes. Since we only ever install one route per destination this makes
+// no difference to our own forwarding decisions, but it makes fallback
+// routes easy to tell apart and ensures a direct route always wins if one
+// is installed by other means.
+//
+// Both default to zero, which leaves the fallback routes indistinguishable
+// from direct routes.
+type FallbackRouteOptions struct {
+	Metric int
+	Realm  int
+}
+
+// desiredRoutes decides which routes we want for the destination networks
+// of the remote endpoints, given the current cluster state and the set of
+// endpoints whose tunnels we consider to be connected. Fallbacks and hubs
+// are chosen according to scorer. See the commentary in Manager.Run for
+// the rules.
+//
+// Each endpoint's served networks (see Endpoint.ServedNetworks) are routed
+// in the same way as its DestinationNetwork. A served network never
+// displaces a datacenter network, and we ignore any that overlap our own
+// networks. If several endpoints serve the same network then we route it
+// to one that is reachable, preferring the lowest endpoint id.
+func desiredRoutes(cluster *ClusterState, connected EndpointSet, scorer EndpointScorer, fallbackOpts FallbackRouteOptions) []*Route {
+	// Our fallback is the best live endpoint in our own region that
+	// isn't draining and that would forward our traffic on.
+	var fallback *Endpoint
+	for _, endpoint := range cluster.RankedLocalEndpoints(scorer) {
+		if endpoint.Alive() && !endpoint.Draining() && endpoint.InstallsRoutes() {
+			fallback = endpoint
+			break
+		}
+	}
+
+	localAddr := cluster.ThisEndpoint.Address()
+
+	// hubs are the hubs we'd route via, by region.
+	hubs := make(map[string]*Endpoint)
+	for _, endpoint := range cluster.RemoteEndpoints {
+		regionId := endpoint.RegionId()
+		if _, ok := hubs[regionId]; !ok {
+			hubs[regionId] = bestConnectedHub(cluster, connected, regionId, scorer)
+		}
+	}
+
+	ours := append([]*net.IPNet{cluster.ThisEndpoint.DestinationNetwork()}, cluster.ThisEndpoint.ServedNetworks()...)
+
+	var ret []*Route
+	served := make(map[string]*servedRoute)
+	for _, endpoint := range cluster.RemoteEndpoints {
+		if !endpoint.ExpectedAlive() || cluster.IsDuplicate(endpoint) {
+			continue
+		}
+		dest := endpoint.DestinationNetwork()
+		if dest == nil {
+			continue
+		}
+
+		route := &Route{
+			Destination: dest,
+			Kind:        RouteBlackhole,
+		}
+		switch {
+		case !endpoint.Alive():
+			// Blackhole, since the endpoint is down for everyone.
+		case connected.Contains(endpoint.Id()):
+			_, remoteTunnelIP, err := localAddr.TunnelInternalIPs(endpoint.Id())
+			if err != nil {
+				// Can't happen, since we wouldn't have started the tunnel.
+				break
+			}
+			route.Kind = RouteVia
+			route.Gateway = remoteTunnelIP
+		case !wantTunnel(cluster.ThisEndpoint, endpoint) && hubs[endpoint.RegionId()] != nil:
+			// We deliberately have no tunnel to this endpoint, so we
+			// reach it through a hub in its region instead.
+			_, hubTunnelIP, err := localAddr.TunnelInternalIPs(hubs[endpoint.RegionId()].Id())
+			if err != nil {
+				// Can't happen, since we wouldn't have started the tunnel.
+				break
+			}
+			route.Kind = RouteVia
+			route.Gateway = hubTunnelIP
+		case fallback != nil:
+			route.Kind = RouteVia
+			route.Gateway = fallback.InternalAddr()
+			route.Metric = fallbackOpts.Metric
+			route.Realm = fallbackOpts.Realm
+		}
+		ret = append(ret, route)
+
+		for _, network := range endpoint.ServedNetworks() {
+			if overlapsAny(network, ours) {
+				continue
+			}
+			key := network.String()
+			if other := served[key]; other != nil && !other.preferTo(endpoint.Id(), route.Kind) {
+				continue
+			}
+			networkRoute := *route
+			networkRoute.Destination = network
+			served[key] = &servedRoute{route: &networkRoute, endpointId: endpoint.Id()}
+		}
+	}
+
+	taken := make(map[string]bool, len(ret))
+	for _, route := range ret {
+		taken[route.Destination.String()] = true
+	}
+	keys := make([]string, 0, len(served))
+	for key := range served {
+		if !taken[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ret = append(ret, served[key].route)
+	}
+
+	return ret
+}
+
+// servedRoute is the route that desiredRoutes has chosen so far for a
+// served network, and the endpoint serving it.
+type servedRoute struct {
+	route      *Route
+	endpointId EndpointId
+}
+
+// preferTo returns true if the chosen route should be kept rather than
+// replaced by one of the given kind to the given endpoint.
+func (r *servedRoute) preferTo(endpointId EndpointId, kind RouteKind) bool {
+	if r.route.Kind != kind {
+		return r.route.Kind == RouteVia
+	}
+	return r.endpointId < endpointId
+}
+
+// overlapsAny returns true if network overlaps any of the given networks,
+// which may include nils.
+func overlapsAny(network *net.IPNet, others []*net.IPNet) bool {
+	for _, other := range others {
+		if other != nil && (other.Contains(network.IP) || network.Contains(other.IP)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/hashicorp/serf/serf"
+)
+
+// mockRouteBackend is a RouteBackend that keeps its routing table in
+// memory and records the changes made to it.
+type mockRouteBackend struct {
+	table map[string]*Route
+	ops   []string
+
+	// fail, if set, makes every change fail.
+	fail bool
+}
+
+func newMockRouteBackend() *mockRouteBackend {
+	return &mockRouteBackend{
+		table: make(map[string]*Route),
+	}
+}
+
+func (b *mockRouteBackend) ReplaceRoute(route *Route) error {
+	if b.fail {
+		return fmt.Errorf("failed")
+	}
+	b.ops = append(b.ops, "replace "+route.String())
+	b.table[fmt.Sprintf("%s %d", route.Destination, route.Metric)] = route
+	return nil
+}
+
+func (b *mockRouteBackend) DeleteRoute(route *Route) error {
+	if b.fail {
+		return fmt.Errorf("failed")
+	}
+	b.ops = append(b.ops, "delete "+route.String())
+	key := fmt.Sprintf("%s %d", route.Destination, route.Metric)
+	if _, ok := b.table[key]; !ok {
+		return fmt.Errorf("no such route")
+	}
+	delete(b.table, key)
+	return nil
+}
+
+// routes returns the routing table, ordered by destination.
+func (b *mockRouteBackend) routes() []string {
+	ret := make([]string, 0, len(b.table))
+	for _, route := range b.table {
+		ret = append(ret, route.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// takeOps returns the changes made since it was last called.
+func (b *mockRouteBackend) takeOps() []string {
+	ret := b.ops
+	b.ops = nil
+	return ret
+}
+
+func TestRouteMgrDeadAndRecovered(t *testing.T) {
+	this := testEndpoint("this", 0x001, serf.StatusAlive, nil)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	dead := testEndpoint("remote", 0x041, serf.StatusFailed, nil)
+
+	cluster := func(remote *Endpoint) *ClusterState {
+		return &ClusterState{
+			ThisEndpoint:    this,
+			RemoteEndpoints: []*Endpoint{remote},
+		}
+	}
+
+	backend := newMockRouteBackend()
+	mgr := NewRouteMgr(backend)
+	sync := func(cluster *ClusterState, connected EndpointSet) {
+		t.Helper()
+		routes := desiredRoutes(cluster, connected, DistanceScorer, FallbackRouteOptions{})
+		if errs := mgr.Sync(routes); len(errs) != 0 {
+			t.Fatalf("Sync failed: %s", errs)
+		}
+	}
+	check := func(step string, wantRoutes, wantOps []string) {
+		t.Helper()
+		if got := backend.routes(); !reflect.DeepEqual(got, wantRoutes) {
+			t.Errorf("%s: wrong routes\ngot:  %q\nwant: %q", step, got, wantRoutes)
+		}
+		if got := backend.takeOps(); !reflect.DeepEqual(got, wantOps) {
+			t.Errorf("%s: wrong changes\ngot:  %q\nwant: %q", step, got, wantOps)
+		}
+	}
+
+	// The remote endpoint's tunnel IP, as seen from this one.
+	direct := "10.16.64.0/18 via 172.17.4.1"
+
+	sync(cluster(remote), newEndpointSet(0x041))
+	check("connected", []string{direct}, []string{"replace " + direct})
+
+	sync(cluster(dead), newEndpointSet())
+	check("dead", []string{"blackhole 10.16.64.0/18"}, []string{"replace blackhole 10.16.64.0/18"})
+
+	sync(cluster(dead), newEndpointSet())
+	check("still dead", []string{"blackhole 10.16.64.0/18"}, nil)
+
+	sync(cluster(remote), newEndpointSet(0x041))
+	check("recovered", []string{direct}, []string{"replace " + direct})
+
+	sync(cluster(remote), newEndpointSet(0x041))
+	check("still recovered", []string{direct}, nil)
+}
+
+func TestRouteMgrBlackholeToFallback(t *testing.T) {
+	this := testEndpoint("this", 0x001, serf.StatusAlive, nil)
+	local := testEndpoint("local", 0x002, serf.StatusAlive, nil)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+
+	backend := newMockRouteBackend()
+	mgr := NewRouteMgr(backend)
+	opts := FallbackRouteOptions{Metric: 100}
+	sync := func(locals ...*Endpoint) {
+		t.Helper()
+		cluster := &ClusterState{
+			ThisEndpoint:    this,
+			LocalEndpoints:  locals,
+			RemoteEndpoints: []*Endpoint{remote},
+		}
+		if errs := mgr.Sync(desiredRoutes(cluster, newEndpointSet(), DistanceScorer, opts)); len(errs) != 0 {
+			t.Fatalf("Sync failed: %s", errs)
+		}
+	}
+
+	// With no tunnel and no neighbor, there's nowhere to send it.
+	sync()
+	if got, want := backend.routes(), []string{"blackhole 10.16.64.0/18"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no neighbor: got %q; want %q", got, want)
+	}
+	backend.takeOps()
+
+	// Once a neighbor appears, the blackhole must give way to it. The
+	// metrics differ, so the blackhole is deleted rather than replaced.
+	sync(local)
+	fallback := "10.16.64.0/18 via 10.0.128.1 metric 100"
+	if got, want := backend.routes(), []string{fallback}; !reflect.DeepEqual(got, want) {
+		t.Errorf("neighbor: got %q; want %q", got, want)
+	}
+	if got, want := backend.takeOps(), []string{"delete blackhole 10.16.64.0/18", "replace " + fallback}; !reflect.DeepEqual(got, want) {
+		t.Errorf("neighbor: wrong changes\ngot:  %q\nwant: %q", got, want)
+	}
+
+	sync(local)
+	if got := backend.takeOps(); len(got) != 0 {
+		t.Errorf("repeated sync made changes %q", got)
+	}
+}
+
+func TestRouteMgrRetriesFailures(t *testing.T) {
+	backend := newMockRouteBackend()
+	mgr := NewRouteMgr(backend)
+
+	_, dest, _ := net.ParseCIDR("10.16.64.0/18")
+	routes := []*Route{{Destination: dest, Kind: RouteBlackhole}}
+
+	backend.fail = true
+	if errs := mgr.Sync(routes); len(errs) != 1 {
+		t.Fatalf("got %d errors; want 1", len(errs))
+	}
+	if got := mgr.Routes(); len(got) != 0 {
+		t.Errorf("failed route recorded as installed: %s", got)
+	}
+
+	// A route that failed to install is tried again next time.
+	backend.fail = false
+	if errs := mgr.Sync(routes); len(errs) != 0 {
+		t.Fatalf("Sync failed: %s", errs)
+	}
+	if got, want := backend.routes(), []string{"blackhole 10.16.64.0/18"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if errs := mgr.RemoveAll(); len(errs) != 0 {
+		t.Fatalf("RemoveAll failed: %s", errs)
+	}
+	if got := backend.routes(); len(got) != 0 {
+		t.Errorf("routes remain after RemoveAll: %q", got)
+	}
+}
+
+func TestDesiredRoutesSkipNonRoutingEndpoints(t *testing.T) {
+	this := testEndpoint("this", 0x001, serf.StatusAlive, map[string]string{"topology": TopologyHub})
+	tunnelsOnly := map[string]string{modeTag: ModeTunnelsOnly}
+	routes := func(cluster *ClusterState, connected EndpointSet) []string {
+		var ret []string
+		for _, route := range desiredRoutes(cluster, connected, DistanceScorer, FallbackRouteOptions{}) {
+			ret = append(ret, route.String())
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	// A tunnels-only neighbor installs no routes, so it can't be our
+	// fallback.
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, map[string]string{"hub": "1"})
+	cluster := &ClusterState{
+		ThisEndpoint:    this,
+		LocalEndpoints:  []*Endpoint{testEndpoint("local", 0x002, serf.StatusAlive, tunnelsOnly)},
+		RemoteEndpoints: []*Endpoint{remote},
+	}
+	if got, want := routes(cluster, newEndpointSet()), []string{"blackhole 10.16.64.0/18"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tunnels-only neighbor: got %q; want %q", got, want)
+	}
+	cluster.LocalEndpoints = append(cluster.LocalEndpoints, testEndpoint("full", 0x003, serf.StatusAlive, nil))
+	if got, want := routes(cluster, newEndpointSet()), []string{"10.16.64.0/18 via 10.0.192.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("full neighbor: got %q; want %q", got, want)
+	}
+
+	// Nor can a tunnels-only hub carry our traffic to the other endpoints
+	// in its region.
+	hub := testEndpoint("hub", 0x042, serf.StatusAlive, map[string]string{"hub": "1", modeTag: ModeTunnelsOnly})
+	spoke := testEndpoint("spoke", 0x043, serf.StatusAlive, map[string]string{"topology": TopologyHub})
+	cluster.RemoteEndpoints = []*Endpoint{hub, spoke}
+	want := []string{
+		"10.16.128.0/18 via " + remoteTunnelIP(t, this, hub),
+		"10.16.192.0/18 via 10.0.192.1",
+	}
+	if got := routes(cluster, newEndpointSet(hub.Id())); !reflect.DeepEqual(got, want) {
+		t.Errorf("tunnels-only hub: got %q; want %q", got, want)
+	}
+}
+
+// remoteTunnelIP returns the address of the remote end of the tunnel from
+// local to remote.
+func remoteTunnelIP(t *testing.T, local, remote *Endpoint) string {
+	t.Helper()
+	_, ip, err := local.Address().TunnelInternalIPs(remote.Id())
+	if err != nil {
+		t.Fatalf("no tunnel addresses: %s", err)
+	}
+	return ip.String()
+}
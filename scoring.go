@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+)
+
+// This file decides how we rank other endpoints when choosing one to
+// forward traffic through, which we do when choosing a fallback next-hop
+// in our own region and when choosing a hub in another region.
+//
+// By default we simply prefer the nearest endpoint according to the
+// network coordinates, but the nearest endpoint isn't the best choice if
+// it keeps failing. The "stability" scoring therefore adds a penalty to
+// the distance for each recent failure of the endpoint, counting both the
+// times that our tunnel to it dropped and the times that Serf declared it
+// failed. We run tunnels only to endpoints in other regions, so it is the
+// Serf failures that distinguish our fallback candidates.
+
+// Values for the "neighbor_scoring" setting.
+const (
+	ScoringDistance  = "distance"
+	ScoringStability = "stability"
+)
+
+// stabilityWindow is how far back we look for tunnel failures, and
+// stabilityPenalty is how much each failure adds to an endpoint's score.
+// Scores are in the same units as distances, so each failure makes an
+// endpoint look 20ms further away. See TunnelMgr.RecentDrops and
+// Gossip.RecentFailures.
+const (
+	stabilityWindow  = 10 * time.Minute
+	stabilityPenalty = 20 * time.Millisecond
+)
+
+// EndpointScorer ranks the given endpoint as a next-hop for the local
+// endpoint. Lower scores are better.
+type EndpointScorer func(local, endpoint *Endpoint) int64
+
+// DistanceScorer scores endpoints by their distance from the local
+// endpoint alone.
+func DistanceScorer(local, endpoint *Endpoint) int64 {
+	return local.DistanceTo(endpoint)
+}
+
+// StabilityScorer returns a scorer that adds penalty to an endpoint's
+// distance for each of the failures that failures records for it.
+// Endpoints whose distance we don't know stay at MaxDistance.
+func StabilityScorer(failures map[EndpointId]int, penalty time.Duration) EndpointScorer {
+	return func(local, endpoint *Endpoint) int64 {
+		dist := local.DistanceTo(endpoint)
+		extra := int64(failures[endpoint.Id()]) * int64(penalty)
+		if dist > MaxDistance-extra {
+			return MaxDistance
+		}
+		return dist + extra
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/hashicorp/serf/serf"
+)
+
+// withCoord gives the endpoint a network coordinate the given distance
+// along a line from the origin.
+func withCoord(endpoint *Endpoint, dist time.Duration) *Endpoint {
+	endpoint.coord = coordinate.NewCoordinate(coordinate.DefaultConfig())
+	endpoint.coord.Vec[0] = dist.Seconds()
+	return endpoint
+}
+
+func TestGossipRecentFailures(t *testing.T) {
+	g := NewGossip(&GossipConfig{Addressing: testAddressing})
+	near := testEndpoint("near", 0x002, serf.StatusAlive, nil)
+	far := testEndpoint("far", 0x003, serf.StatusAlive, nil)
+
+	g.recordFailures(serf.MemberEvent{Type: serf.EventMemberJoin, Members: []serf.Member{*near.member, *far.member}})
+	g.recordFailures(serf.MemberEvent{Type: serf.EventMemberFailed, Members: []serf.Member{*near.member}})
+	g.recordFailures(serf.UserEvent{Name: "unrelated"})
+	g.recordFailures(serf.MemberEvent{Type: serf.EventMemberFailed, Members: []serf.Member{*near.member}})
+
+	if got, want := g.RecentFailures(), map[EndpointId]int{0x002: 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	// Failures older than the window are forgotten.
+	g.failuresLock.Lock()
+	g.failures[0x002][0] = time.Now().Add(-stabilityWindow - time.Second)
+	g.failures[0x003] = []time.Time{time.Now().Add(-stabilityWindow - time.Second)}
+	g.failuresLock.Unlock()
+	if got, want := g.RecentFailures(), map[EndpointId]int{0x002: 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after expiry got %v; want %v", got, want)
+	}
+}
+
+func TestRankedLocalEndpointsStability(t *testing.T) {
+	this := withCoord(testEndpoint("this", 0x001, serf.StatusAlive, nil), 0)
+	near := withCoord(testEndpoint("near", 0x002, serf.StatusAlive, nil), time.Millisecond)
+	far := withCoord(testEndpoint("far", 0x003, serf.StatusAlive, nil), 5*time.Millisecond)
+	cluster := &ClusterState{
+		ThisEndpoint:   this,
+		LocalEndpoints: []*Endpoint{far, near},
+	}
+
+	g := NewGossip(&GossipConfig{Addressing: testAddressing})
+	g.recordFailures(serf.MemberEvent{Type: serf.EventMemberFailed, Members: []serf.Member{*near.member}})
+
+	tests := []struct {
+		name   string
+		scorer EndpointScorer
+		want   []string
+	}{
+		{"distance", DistanceScorer, []string{"near", "far"}},
+		{"no failures", StabilityScorer(nil, stabilityPenalty), []string{"near", "far"}},
+		{"flapping neighbor", StabilityScorer(g.RecentFailures(), stabilityPenalty), []string{"far", "near"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, endpoint := range cluster.RankedLocalEndpoints(test.scorer) {
+			got = append(got, endpoint.NodeName())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q; want %q", test.name, got, test.want)
+		}
+	}
+}
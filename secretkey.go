@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// This file deals with pre-shared key files that are encrypted at rest.
+//
+// An encrypted key file consists of secretKeyMagic, then a random salt,
+// then a random nonce, and then the original key file encrypted with
+// AES-256-GCM using a key derived from a passphrase via PBKDF2-SHA256.
+//
+// OpenVPN can only read a plaintext key file, so when a passphrase is
+// configured we hold the decrypted key in memory and write it out to a
+// temporary file for each OpenVPN process, removing the file again once
+// the process exits. The name of each such file includes our pid, so that
+// if we die without removing them then the next run can tell which files
+// are left over (see removeStaleSecretKeys).
+
+var secretKeyMagic = []byte("openvpn-peer-encrypted-key-v1\n")
+
+const (
+	secretKeySaltLen    = 16
+	secretKeyIterations = 100000
+)
+
+// secretKeyTempDir is where we write decrypted key files. It's a tmpfs on
+// most Linux systems, so the decrypted key never reaches a disk.
+const secretKeyTempDir = "/dev/shm"
+
+// secretKeyTempPrefix begins the name of each decrypted key file, and is
+// followed by the pid of the process that wrote it.
+const secretKeyTempPrefix = "openvpn-peer-key-"
+
+// ReadSecretKeyFile reads the key file at the given path, decrypting it
+// with the given passphrase. If the passphrase is empty then the file is
+// assumed to be plaintext.
+func ReadSecretKeyFile(filename, passphrase string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %s", err)
+	}
+
+	if passphrase == "" {
+		if bytes.HasPrefix(data, secretKeyMagic) {
+			return nil, fmt.Errorf("key file %s is encrypted, but no passphrase is configured", filename)
+		}
+		return data, nil
+	}
+
+	plaintext, err := decryptSecretKey(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key file %s: %s", filename, err)
+	}
+	return plaintext, nil
+}
+
+// EncryptSecretKeyFile encrypts the plaintext key file at inFilename with
+// the given passphrase, writing the result to outFilename.
+func EncryptSecretKeyFile(inFilename, outFilename, passphrase string) error {
+	plaintext, err := ioutil.ReadFile(inFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read key file: %s", err)
+	}
+	if bytes.HasPrefix(plaintext, secretKeyMagic) {
+		return fmt.Errorf("key file %s is already encrypted", inFilename)
+	}
+
+	data, err := encryptSecretKey(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(outFilename, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write encrypted key file: %s", err)
+	}
+	return nil
+}
+
+func encryptSecretKey(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, secretKeySaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err)
+	}
+
+	aead, err := secretKeyAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+
+	ret := make([]byte, 0, len(secretKeyMagic)+len(salt)+len(nonce)+len(plaintext)+aead.Overhead())
+	ret = append(ret, secretKeyMagic...)
+	ret = append(ret, salt...)
+	ret = append(ret, nonce...)
+	ret = aead.Seal(ret, nonce, plaintext, secretKeyMagic)
+	return ret, nil
+}
+
+func decryptSecretKey(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, secretKeyMagic) {
+		return nil, fmt.Errorf("file is not an encrypted key file")
+	}
+	data = data[len(secretKeyMagic):]
+
+	if len(data) < secretKeySaltLen {
+		return nil, fmt.Errorf("file is truncated")
+	}
+	salt := data[:secretKeySaltLen]
+	data = data[secretKeySaltLen:]
+
+	aead, err := secretKeyAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("file is truncated")
+	}
+	nonce := data[:aead.NonceSize()]
+	data = data[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, data, secretKeyMagic)
+	if err != nil {
+		// The only likely reason for this is a wrong passphrase, since
+		// the authentication tag covers the whole file.
+		return nil, fmt.Errorf("incorrect passphrase or corrupt file")
+	}
+	return plaintext, nil
+}
+
+func secretKeyAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, secretKeyIterations, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeTempSecretKey writes the given decrypted key to a new temporary file
+// that only we can read, returning its path. The caller must remove the
+// file once it's no longer needed.
+func writeTempSecretKey(key []byte) (string, error) {
+	dir := secretKeyTempDir
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		dir = os.TempDir()
+	}
+
+	// ioutil.TempFile creates the file with mode 0600.
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("%s%d-", secretKeyTempPrefix, os.Getpid()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary key file: %s", err)
+	}
+
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary key file: %s", err)
+	}
+
+	return f.Name(), nil
+}
+
+// removeStaleSecretKeys removes the decrypted key files left behind by
+// earlier runs that died without removing them, which are those whose
+// writers are no longer running. Failures are logged, since they needn't
+// stop us from starting.
+func removeStaleSecretKeys() {
+	for _, dir := range []string{secretKeyTempDir, os.TempDir()} {
+		filenames, err := filepath.Glob(filepath.Join(dir, secretKeyTempPrefix+"*"))
+		if err != nil {
+			continue
+		}
+		for _, filename := range filenames {
+			rest := strings.TrimPrefix(filepath.Base(filename), secretKeyTempPrefix)
+			pid, err := strconv.Atoi(strings.SplitN(rest, "-", 2)[0])
+			if err == nil && processRunning(pid) {
+				continue
+			}
+
+			logger.Warnf("Removing decrypted key file %s left behind by an earlier run", filename)
+			err = os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				logger.Errorf("Failed to remove %s: %s", filename, err)
+			}
+		}
+	}
+}
+
+// processRunning returns true if there is a process with the given pid.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
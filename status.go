@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/serf/coordinate"
+)
+
+// This file contains the JSON representations of our cluster and tunnel
+// states, which are shared by the HTTP API, the control socket and the
+// Consul KV snapshots. The states themselves are made of types that don't
+// marshal usefully, so ClusterState and TunnelsState marshal themselves
+// via these instead.
+
+type clusterStatus struct {
+	This      *endpointStatus   `json:"this"`
+	Local     []*endpointStatus `json:"local"`
+	Remote    []*endpointStatus `json:"remote"`
+	Observers []*endpointStatus `json:"observers"`
+
+	// Unknown are the members whose internal addresses we don't
+	// understand. See ClusterState.UnknownEndpoints.
+	Unknown []*unknownEndpointStatus `json:"unknown"`
+
+	// Duplicates maps each endpoint id claimed by more than one member
+	// to the names of those members.
+	Duplicates map[string][]string `json:"duplicates"`
+}
+
+type unknownEndpointStatus struct {
+	NodeName   string `json:"node_name"`
+	Status     string `json:"status"`
+	InternalIP string `json:"int_ip"`
+}
+
+type endpointStatus struct {
+	NodeName   string `json:"node_name"`
+	EndpointId string `json:"endpoint_id"`
+	GossipAddr string `json:"gossip_addr"`
+	InternalIP string `json:"internal_ip"`
+	Region     string `json:"region"`
+	Datacenter string `json:"datacenter"`
+	Distance   int64  `json:"distance"`
+	Status     string `json:"status"`
+	VPNState   string `json:"vpn_state,omitempty"`
+	Draining   bool   `json:"draining,omitempty"`
+
+	// ServedNetworks are the networks the endpoint serves besides its
+	// datacenter's. See Endpoint.ServedNetworks.
+	ServedNetworks []string `json:"served_networks,omitempty"`
+
+	// VPNPort is the port the endpoint uses for its end of every tunnel,
+	// if it advertises one. See Endpoint.VPNPort.
+	VPNPort int `json:"vpn_port,omitempty"`
+
+	Coordinate *coordinate.Coordinate `json:"coordinate,omitempty"`
+}
+
+type tunnelsStatus struct {
+	Tunnels  []*tunnelStatus  `json:"tunnels"`
+	Backoffs []*backoffStatus `json:"backoffs"`
+}
+
+type backoffStatus struct {
+	EndpointId string `json:"endpoint_id"`
+	Failures   int    `json:"failures"`
+	RetryAt    string `json:"retry_at"`
+	AuthFailed bool   `json:"auth_failed"`
+}
+
+type tunnelStatus struct {
+	EndpointId string `json:"endpoint_id"`
+	State      string `json:"state"`
+	DeviceName string `json:"device_name,omitempty"`
+
+	// Since is when the tunnel entered its current state, and
+	// StateSeconds is how long ago that was.
+	Since        string  `json:"since"`
+	StateSeconds float64 `json:"state_seconds"`
+
+	// BytesIn, BytesOut and LastHealthy are as of the latest poll of
+	// the tunnel's statistics. See Tunnel.
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	LastHealthy string `json:"last_healthy,omitempty"`
+
+	KeyGeneration int    `json:"key_generation"`
+	Compression   string `json:"compression"`
+	Transport     string `json:"transport"`
+
+	LocalPort      int    `json:"local_port"`
+	RemotePort     int    `json:"remote_port"`
+	LocalTunnelIP  string `json:"local_tunnel_ip"`
+	RemoteTunnelIP string `json:"remote_tunnel_ip"`
+}
+
+// newClusterStatus describes the given cluster state, including the state
+// of our tunnel to each endpoint if tunnels isn't nil.
+func newClusterStatus(cluster *ClusterState, tunnels *TunnelsState) *clusterStatus {
+	vpnStates := make(map[EndpointId]VPNState)
+	if tunnels != nil {
+		for _, tunnel := range tunnels.Tunnels {
+			vpnStates[tunnel.EndpointId] = tunnel.State
+		}
+	}
+
+	convert := func(endpoints []*Endpoint) []*endpointStatus {
+		ret := make([]*endpointStatus, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			ret = append(ret, newEndpointStatus(cluster, endpoint, vpnStates))
+		}
+		return ret
+	}
+
+	duplicates := make(map[string][]string, len(cluster.DuplicateEndpoints))
+	for id, endpoints := range cluster.DuplicateEndpoints {
+		names := make([]string, len(endpoints))
+		for i, endpoint := range endpoints {
+			names[i] = endpoint.NodeName()
+		}
+		duplicates[id.String()] = names
+	}
+
+	unknown := make([]*unknownEndpointStatus, 0, len(cluster.UnknownEndpoints))
+	for _, endpoint := range cluster.Unknown() {
+		raw, _ := endpoint.Tag("int_ip")
+		unknown = append(unknown, &unknownEndpointStatus{
+			NodeName:   endpoint.NodeName(),
+			Status:     endpoint.Status().String(),
+			InternalIP: raw,
+		})
+	}
+
+	return &clusterStatus{
+		This:       newEndpointStatus(cluster, cluster.ThisEndpoint, nil),
+		Local:      convert(cluster.LocalEndpoints),
+		Remote:     convert(cluster.RemoteEndpoints),
+		Observers:  convert(cluster.ObserverEndpoints),
+		Unknown:    unknown,
+		Duplicates: duplicates,
+	}
+}
+
+func newEndpointStatus(cluster *ClusterState, e *Endpoint, vpnStates map[EndpointId]VPNState) *endpointStatus {
+	ret := &endpointStatus{
+		NodeName:   e.NodeName(),
+		EndpointId: e.Id().String(),
+		GossipAddr: net.JoinHostPort(e.GossipAddr().String(), strconv.Itoa(int(e.GossipPort()))),
+		InternalIP: e.InternalAddr().String(),
+		Region:     e.RegionId(),
+		Datacenter: e.DatacenterId(),
+		Distance:   e.DistanceTo(cluster.ThisEndpoint),
+		Status:     e.Status().String(),
+		Coordinate: e.Coordinate(),
+		Draining:   e.Draining(),
+		VPNPort:    e.VPNPort(),
+	}
+	if state, ok := vpnStates[e.Id()]; ok {
+		ret.VPNState = state.String()
+	}
+	for _, network := range e.ServedNetworks() {
+		ret.ServedNetworks = append(ret.ServedNetworks, network.String())
+	}
+	return ret
+}
+
+func newTunnelsStatus(tunnels *TunnelsState, backoffs []*TunnelBackoff) *tunnelsStatus {
+	ret := &tunnelsStatus{
+		Tunnels:  make([]*tunnelStatus, 0, len(tunnels.Tunnels)),
+		Backoffs: make([]*backoffStatus, 0, len(backoffs)),
+	}
+	for _, backoff := range backoffs {
+		ret.Backoffs = append(ret.Backoffs, &backoffStatus{
+			EndpointId: backoff.EndpointId.String(),
+			Failures:   backoff.Failures,
+			RetryAt:    backoff.RetryAt.Format(time.RFC3339),
+			AuthFailed: backoff.AuthFailed,
+		})
+	}
+	for _, tunnel := range tunnels.Tunnels {
+		var lastHealthy string
+		if !tunnel.LastHealthy.IsZero() {
+			lastHealthy = tunnel.LastHealthy.Format(time.RFC3339)
+		}
+		ret.Tunnels = append(ret.Tunnels, &tunnelStatus{
+			EndpointId:    tunnel.EndpointId.String(),
+			State:         tunnel.State.String(),
+			DeviceName:    tunnel.DeviceName,
+			Since:         tunnel.Since.Format(time.RFC3339),
+			StateSeconds:  time.Since(tunnel.Since).Seconds(),
+			BytesIn:       tunnel.BytesIn,
+			BytesOut:      tunnel.BytesOut,
+			LastHealthy:   lastHealthy,
+			KeyGeneration: tunnel.KeyGeneration,
+			Compression:   tunnel.Compression,
+			Transport:     tunnel.Transport,
+
+			LocalPort:      tunnel.LocalPort,
+			RemotePort:     tunnel.RemotePort,
+			LocalTunnelIP:  tunnel.LocalTunnelIP.String(),
+			RemoteTunnelIP: tunnel.RemoteTunnelIP.String(),
+		})
+	}
+	return ret
+}
+
+// MarshalJSON encodes the state in the same form as the HTTP API's
+// GET /cluster, but without the states of our tunnels.
+func (s *ClusterState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newClusterStatus(s, nil))
+}
+
+// MarshalJSON encodes the state in the same form as the HTTP API's
+// GET /tunnels, but without any backoffs.
+func (s *TunnelsState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newTunnelsStatus(s, nil))
+}
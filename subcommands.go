@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// subcommand is a utility operation that can be selected by giving its
+// name as the first argument, instead of running the daemon.
+type subcommand struct {
+	Usage string
+	Run   func(args []string) error
+}
+
+var subcommands = map[string]*subcommand{
+	"genkey": {
+		Usage: "genkey <key-file>",
+		Run:   runGenKey,
+	},
+	"checkkey": {
+		Usage: "checkkey <key-file>",
+		Run:   runCheckKey,
+	},
+	"doctor": {
+		Usage: "doctor [config-file]",
+		Run:   runDoctor,
+	},
+	"plan": {
+		Usage: "plan [-peers <id>,...] [config-file]",
+		Run:   runPlan,
+	},
+	"encryptkey": {
+		Usage: "encryptkey <plaintext-key-file> <encrypted-key-file>",
+		Run:   runEncryptKey,
+	},
+}
+
+// errUsage is returned by a subcommand's Run function when it was given
+// the wrong arguments.
+var errUsage = fmt.Errorf("invalid arguments")
+
+// runGenKey creates a new static key using OpenVPN itself.
+func runGenKey(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	filename := args[0]
+
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s already exists", filename)
+	}
+
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	openVPNPath := config.OpenVPNPath
+	if openVPNPath == "" {
+		openVPNPath = DefaultOpenVPNPath
+	}
+
+	output, err := exec.Command(openVPNPath, "--genkey", "--secret", filename).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s\n%s", openVPNPath, err, output)
+	}
+
+	// OpenVPN respects the umask, which may have left the key readable
+	// by others.
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %s", filename, err)
+	}
+
+	fmt.Printf("Created %s\n", filename)
+	return nil
+}
+
+// runCheckKey verifies that a key file is well-formed and that only its
+// owner can read it.
+func runCheckKey(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	filename := args[0]
+
+	err := checkKeyFileMode(filename)
+	if err != nil {
+		return err
+	}
+
+	// Encrypted files can be checked only if we know the passphrase.
+	passphrase := os.Getenv("OPENVPN_PEER_SECRET_PASSPHRASE")
+	data, err := ReadSecretKeyFile(filename, passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = validateStaticKey(data)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid OpenVPN static key: %s", filename, err)
+	}
+
+	fmt.Printf("%s is a valid OpenVPN static key\n", filename)
+	return nil
+}
+
+// checkKeyFileMode returns an error if anyone other than its owner can
+// access the given key file.
+func checkKeyFileMode(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s has mode %04o, but must not be accessible by anyone other than its owner", filename, perm)
+	}
+	return nil
+}
+
+func runEncryptKey(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	passphrase := os.Getenv("OPENVPN_PEER_SECRET_PASSPHRASE")
+	if passphrase == "" {
+		return fmt.Errorf("OPENVPN_PEER_SECRET_PASSPHRASE must be set")
+	}
+	return EncryptSecretKeyFile(args[0], args[1], passphrase)
+}
+
+const (
+	staticKeyHeader = "-----BEGIN OpenVPN Static key V1-----"
+	staticKeyFooter = "-----END OpenVPN Static key V1-----"
+
+	// staticKeyLen is the length in bytes of an OpenVPN static key, which
+	// is actually four keys: a cipher key and an HMAC key for each
+	// direction.
+	staticKeyLen = 256
+)
+
+// validateStaticKey checks that the given data is in the format produced
+// by "openvpn --genkey".
+func validateStaticKey(data []byte) error {
+	var keyHex bytes.Buffer
+	inKey := false
+	sawFooter := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case line == staticKeyHeader:
+			if inKey || sawFooter {
+				return fmt.Errorf("unexpected key header")
+			}
+			inKey = true
+		case line == staticKeyFooter:
+			if !inKey {
+				return fmt.Errorf("unexpected key footer")
+			}
+			inKey = false
+			sawFooter = true
+		case inKey:
+			keyHex.WriteString(line)
+		default:
+			return fmt.Errorf("unexpected content outside of the key block")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if !sawFooter {
+		return fmt.Errorf("no complete key block")
+	}
+	key, err := hex.DecodeString(keyHex.String())
+	if err != nil {
+		return fmt.Errorf("key is not valid hex: %s", err)
+	}
+	if len(key) != staticKeyLen {
+		return fmt.Errorf("key is %d bytes, but should be %d", len(key), staticKeyLen)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+// This file decides which pairs of endpoints run tunnels between them.
+//
+// In the default "mesh" topology every endpoint runs a tunnel to every
+// other, which is O(n²) tunnels in total. An endpoint in the "hub" topology
+// instead runs tunnels only to hubs, which are endpoints configured with
+// the "hub" setting. Its traffic for other endpoints is routed via the
+// best hub in the destination's region; see desiredRoutes.
+//
+// Independently of topology, each endpoint may have a peer selector that
+// restricts which other endpoints it runs tunnels to based on their tags.
+// See PeerSelector.
+//
+// Both ends of a tunnel must agree that it should exist, so each endpoint
+// advertises its topology, whether it is a hub and its peer selector, and
+// the decision is made symmetrically by wantTunnel.
+
+const (
+	TopologyMesh = "mesh"
+	TopologyHub  = "hub"
+)
+
+// wantTunnel returns true if the given two endpoints should have a tunnel
+// between them under their advertised topologies and peer selectors. This
+// is true if each of them selects the other, and if either of them is a
+// hub or they both use the mesh topology.
+func wantTunnel(a, b *Endpoint) bool {
+	if !selects(a, b) || !selects(b, a) {
+		return false
+	}
+	if a.Hub() || b.Hub() {
+		return true
+	}
+	return a.Topology() == TopologyMesh && b.Topology() == TopologyMesh
+}
+
+// selects returns true if a's peer selector selects b. If a advertises a
+// selector that we can't parse, perhaps because it uses syntax from a
+// newer version, then we assume that it wouldn't select b.
+func selects(a, b *Endpoint) bool {
+	selector, err := a.PeerSelector()
+	if err != nil {
+		return false
+	}
+	return selector.Matches(b)
+}
+
+// bestConnectedHub returns the best hub according to the given scorer in
+// the given region that we have a connected tunnel to, that isn't
+// draining and that installs routes, or nil if there is none.
+func bestConnectedHub(cluster *ClusterState, connected EndpointSet, regionId string, scorer EndpointScorer) *Endpoint {
+	var ret *Endpoint
+	var retScore int64
+	for _, endpoint := range cluster.RemoteEndpoints {
+		if !endpoint.Hub() || endpoint.Draining() || !endpoint.InstallsRoutes() || endpoint.RegionId() != regionId || !connected.Contains(endpoint.Id()) {
+			continue
+		}
+		score := scorer(cluster.ThisEndpoint, endpoint)
+		if ret == nil || score < retScore || (score == retScore && endpoint.Id() < ret.Id()) {
+			ret, retScore = endpoint, score
+		}
+	}
+	return ret
+}
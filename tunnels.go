@@ -1,29 +1,138 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"time"
+)
+
+// When a tunnel fails to start we wait before trying it again, doubling
+// the wait after each consecutive failure up to tunnelBackoffMax. The
+// backoff is reset once the tunnel reaches VPNConnected.
+const (
+	tunnelBackoffBase = 5 * time.Second
+	tunnelBackoffMax  = 5 * time.Minute
+)
+
+// vpnStopTimeout is how long stopVPN waits for an OpenVPN process to
+// acknowledge being asked to close, or for it to be killed.
+const vpnStopTimeout = 10 * time.Second
+
+// maxDeviceNameLen is the longest network interface name that Linux
+// accepts, which is IFNAMSIZ less one byte for the null terminator.
+const maxDeviceNameLen = 15
+
+// tunnelDeviceName returns the tun device name to use for the tunnel to the
+// given endpoint, so that interfaces can be correlated with peers. Returns
+// the empty string, requesting a dynamically-named device, if a suitable
+// name cannot be produced.
+func tunnelDeviceName(endpointId EndpointId) string {
+	if endpointId == InvalidEndpointId {
+		return ""
+	}
+	name := fmt.Sprintf("tun-%s", endpointId)
+	if len(name) > maxDeviceNameLen {
+		return ""
+	}
+	return name
+}
+
+// tunnelPhase is where a tunnel is in its lifecycle, as far as the
+// TunnelMgr is concerned. This is separate from the VPNState reported by
+// OpenVPN, which we learn about only after the fact.
+type tunnelPhase int
+
+const (
+	// tunnelClosed is the zero value, for endpoints with no tunnel.
+	tunnelClosed tunnelPhase = iota
+
+	// tunnelStarting means that OpenVPN is being launched.
+	tunnelStarting
+
+	// tunnelRunning means that OpenVPN is running and hasn't been asked
+	// to close.
+	tunnelRunning
+
+	// tunnelClosing means that we've asked OpenVPN to close, or will as
+	// soon as it has launched, but it hasn't exited yet.
+	tunnelClosing
 )
 
 type TunnelsState struct {
 	Tunnels []*Tunnel
+
+	// SlowStarts holds the endpoints whose tunnels have taken longer
+	// than the establishment SLA to connect, with when we first tried
+	// to start each. Some may have no tunnel right now, having failed
+	// to start. See establish.go.
+	SlowStarts map[EndpointId]time.Time
 }
 
 type Tunnel struct {
 	EndpointId EndpointId
 	State      VPNState
+
+	// Since is when the tunnel entered its current state.
+	Since time.Time
+
+	// DeviceName is the name of the tun device for this tunnel, or the
+	// empty string if OpenVPN chose it dynamically.
+	DeviceName string
+
+	// KeyGeneration is the generation of the pre-shared key the tunnel
+	// is using, which is negative if it uses its region pair's key.
+	KeyGeneration int
+
+	// Compression is the compression algorithm the tunnel is using, or
+	// CompressionOff.
+	Compression string
+
+	// Transport is the protocol carrying the tunnel: TransportUDP or
+	// TransportTCP.
+	Transport string
+
+	// LocalPort and RemotePort are the UDP ports that OpenVPN listens on
+	// at each end, and LocalTunnelIP and RemoteTunnelIP are the addresses
+	// of each end within the tunnel. See Address.VPNEndpointPorts and
+	// Address.TunnelInternalIPs.
+	LocalPort      int
+	RemotePort     int
+	LocalTunnelIP  net.IP
+	RemoteTunnelIP net.IP
+
+	// BytesIn and BytesOut are the counts of bytes received and sent
+	// since OpenVPN last connected, and LastHealthy is when the tunnel
+	// last carried traffic from the far end, or zero if it hasn't
+	// connected yet. These are polled periodically; see tunnelstats.go.
+	BytesIn     int64
+	BytesOut    int64
+	LastHealthy time.Time
+}
+
+// Connected returns the set of endpoints whose tunnels are connected.
+func (s *TunnelsState) Connected() EndpointSet {
+	ret := make(EndpointSet)
+	for _, tunnel := range s.Tunnels {
+		if tunnel.State == VPNConnected {
+			ret.Add(tunnel.EndpointId)
+		}
+	}
+	return ret
 }
 
-func newTunnelsState(vpnStates map[EndpointId]VPNState) *TunnelsState {
+// newTunnelsState produces a snapshot of the given tunnel states, taking
+// the other details of each tunnel from infos.
+func newTunnelsState(vpnStates map[EndpointId]VPNState, infos map[EndpointId]*Tunnel) *TunnelsState {
 	tunnels := make([]*Tunnel, 0, len(vpnStates))
 
 	for endpointId, state := range vpnStates {
-		tunnels = append(tunnels, &Tunnel{
-			EndpointId: endpointId,
-			State:      state,
-		})
+		tunnel := *infos[endpointId]
+		tunnel.State = state
+		tunnels = append(tunnels, &tunnel)
 	}
 
 	return &TunnelsState{
@@ -31,119 +140,1006 @@ func newTunnelsState(vpnStates map[EndpointId]VPNState) *TunnelsState {
 	}
 }
 
+// TunnelBackoff describes an endpoint whose tunnel has failed to start
+// and that we are waiting to retry.
+type TunnelBackoff struct {
+	EndpointId EndpointId
+	Failures   int
+	RetryAt    time.Time
+
+	// AuthFailed is set if the most recent failure was an authentication
+	// failure, in which case we wait the maximum backoff period since
+	// retrying sooner is unlikely to help.
+	AuthFailed bool
+}
+
+// TunnelBackoffError is returned by StartTunnel if it declined to start
+// a tunnel because the endpoint is still in its backoff period.
+type TunnelBackoffError struct {
+	EndpointId EndpointId
+	RetryAt    time.Time
+}
+
+func (e *TunnelBackoffError) Error() string {
+	return fmt.Sprintf("tunnel for endpoint %s is waiting until %s to retry", e.EndpointId, e.RetryAt.Format(time.RFC3339))
+}
+
+// TunnelMgr runs and monitors a tunnel to each remote endpoint.
+//
+// Each tunnel has its own OpenVPN process. In static key mode a process
+// can serve only one peer, and while TLS mode would let one process serve
+// several with --mode server, that needs one end of each pair to be the
+// server and puts all of its peers on a single tun device and subnet, so
+// we'd lose the per-endpoint devices and the per-pair tunnel addresses
+// (see Address.TunnelInternalIPs) that our routes go via.
+// BenchmarkTunnelMgrTunnels measures what each tunnel costs us meanwhile.
 type TunnelMgr struct {
-	// lock must be held when reading/writing either of the
+	// lock must be held when reading/writing any of the
 	// tunnel maps below.
 	lock sync.RWMutex
 
 	tunnelVPNs   map[EndpointId]*OpenVPN
 	tunnelStates map[EndpointId]VPNState
 
-	changeCh chan<- *TunnelsState
+	// tunnelInfos holds the details of each tunnel. Most are fixed when
+	// it starts, but the monitoring goroutine updates Since and the stats
+	// poller updates BytesIn, BytesOut and LastHealthy in place, so they
+	// must be copied rather than shared; see newTunnelsState. Their State
+	// fields are unused, since tunnelStates is authoritative. Guarded by
+	// lock.
+	tunnelInfos map[EndpointId]*Tunnel
+
+	// changeCh carries snapshots of the tunnel states to whoever is
+	// watching them. See notify.
+	changeCh chan *TunnelsState
+
+	// ctx is cancelled by Stop, to make the per-tunnel monitoring
+	// goroutines give up.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	localEndpoint *Endpoint
+	keyring       *VPNKeyring
+	vpnConfig     VPNConfig
+	dryRun        bool
+
+	metrics *Metrics
+
+	// everStarted records the endpoints we've started tunnels for at
+	// some point, so that we can count restarts. Guarded by lock.
+	everStarted EndpointSet
 
-	localEndpoint  *Endpoint
-	secretFilename string
+	// backoffs tracks the endpoints whose tunnels have recently failed
+	// to start. Guarded by lock.
+	backoffs map[EndpointId]*TunnelBackoff
+
+	// startAfter holds the times before which we won't start tunnels to
+	// certain endpoints. See DelayStarts. Guarded by lock.
+	startAfter map[EndpointId]time.Time
+
+	// pendingStarts and pendingOrder are the queue of tunnels waiting to
+	// be started by RequestStart, and always hold the same endpoints.
+	// starting is the set of those being started right now, of which
+	// there may be at most maxConcurrentStarts. closing is set once CloseAll has been called,
+	// after which no more tunnels are started. Guarded by lock.
+	pendingStarts       map[EndpointId]*Endpoint
+	pendingOrder        []EndpointId
+	starting            EndpointSet
+	maxConcurrentStarts int
+	startJitter         time.Duration
+	closing             bool
+
+	// phases records where each tunnel is in its lifecycle, however it
+	// was started. Endpoints without a tunnel are absent. Guarded by
+	// lock.
+	phases map[EndpointId]tunnelPhase
+
+	// restarts holds the tunnels that are closing but that should be
+	// queued to start again as soon as their OpenVPN processes exit,
+	// either because of RestartTunnel or because we were asked to start
+	// them while they were closing. A nil value means to reuse the
+	// details of the endpoint the tunnel was started with. Guarded by
+	// lock.
+	restarts map[EndpointId]*Endpoint
+
+	// drops records, for each endpoint, the times at which its tunnel
+	// stopped being connected other than because we closed it. Entries
+	// older than stabilityWindow are discarded. Guarded by lock.
+	drops map[EndpointId][]time.Time
+
+	// establishing holds the tunnels we have tried to start that haven't
+	// yet connected. See establish.go. Guarded by lock.
+	establishing map[EndpointId]*establishment
+
+	watchdogTimeout time.Duration
+	establishSLA    time.Duration
+	mgmtPortBase    int
+
+	// audit records each tunnel's state transitions, if set.
+	audit *auditLog
 }
 
 type TunnelMgrConfig struct {
-	SecretFilename string
-	LocalEndpoint  *Endpoint
+	// Keyring is the set of pre-shared keys that tunnels may use.
+	Keyring *VPNKeyring
+
+	LocalEndpoint *Endpoint
+	Metrics       *Metrics
+
+	// VPNConfig is a template for the settings that are common to all
+	// tunnels. StartTunnel copies it and then fills in the settings that
+	// are specific to each tunnel.
+	VPNConfig VPNConfig
+
+	// MaxConcurrentStarts limits how many tunnels RequestStart will
+	// start at once, and each start is delayed by a random duration of
+	// up to StartJitter. This spreads out the load of launching many
+	// OpenVPN processes at once, such as after a partition heals. If
+	// MaxConcurrentStarts is zero, DefaultMaxConcurrentTunnelStarts
+	// is used.
+	MaxConcurrentStarts int
+	StartJitter         time.Duration
+
+	// WatchdogTimeout is how long a connected tunnel may go without
+	// receiving anything before the watchdog restarts it, or zero to
+	// disable the watchdog. It should be at least twice
+	// VPNConfig.StatsInterval. See watchdog.go.
+	WatchdogTimeout time.Duration
+
+	// EstablishSLA is how long a tunnel may take to connect, including
+	// any retries, before we report it as slow, or zero to never report
+	// it. See establish.go.
+	EstablishSLA time.Duration
+
+	// ManagementPortBase, if set, has us share each tunnel's management
+	// interface on this port plus the remote endpoint's id, so that an
+	// operator can connect to it. See VPNConfig.ManagementPort.
+	ManagementPortBase int
+
+	// Audit, if set, is where we record each tunnel's state transitions.
+	// See audit.go.
+	Audit *auditLog
+
+	// DryRun, if set, causes tunnel operations to be logged rather than
+	// performed. See dryRunLauncher.
+	DryRun bool
 }
 
-func NewTunnelMgr(config *TunnelMgrConfig, changeCh chan<- *TunnelsState) *TunnelMgr {
-	return &TunnelMgr{
-		tunnelVPNs:     make(map[EndpointId]*OpenVPN),
-		tunnelStates:   make(map[EndpointId]VPNState),
-		changeCh:       changeCh,
-		localEndpoint:  config.LocalEndpoint,
-		secretFilename: config.SecretFilename,
+// NewTunnelMgr creates a TunnelMgr. Changes to the states of its tunnels
+// are reported on the channel returned by Changes.
+func NewTunnelMgr(config *TunnelMgrConfig) *TunnelMgr {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	vpnConfig := config.VPNConfig
+	if config.DryRun {
+		vpnConfig.ProcessLauncher = dryRunLauncher{}
+	}
+
+	maxConcurrentStarts := config.MaxConcurrentStarts
+	if maxConcurrentStarts <= 0 {
+		maxConcurrentStarts = DefaultMaxConcurrentTunnelStarts
+	}
+
+	m := &TunnelMgr{
+		dryRun:        config.DryRun,
+		ctx:           ctx,
+		cancel:        cancel,
+		tunnelVPNs:    make(map[EndpointId]*OpenVPN),
+		tunnelStates:  make(map[EndpointId]VPNState),
+		tunnelInfos:   make(map[EndpointId]*Tunnel),
+		changeCh:      make(chan *TunnelsState, 1),
+		localEndpoint: config.LocalEndpoint,
+		keyring:       config.Keyring,
+		vpnConfig:     vpnConfig,
+		metrics:       config.Metrics,
+		everStarted:   make(EndpointSet),
+		backoffs:      make(map[EndpointId]*TunnelBackoff),
+		startAfter:    make(map[EndpointId]time.Time),
+
+		pendingStarts:       make(map[EndpointId]*Endpoint),
+		starting:            make(EndpointSet),
+		phases:              make(map[EndpointId]tunnelPhase),
+		restarts:            make(map[EndpointId]*Endpoint),
+		drops:               make(map[EndpointId][]time.Time),
+		establishing:        make(map[EndpointId]*establishment),
+		maxConcurrentStarts: maxConcurrentStarts,
+		startJitter:         config.StartJitter,
+		watchdogTimeout:     config.WatchdogTimeout,
+		establishSLA:        config.EstablishSLA,
+		mgmtPortBase:        config.ManagementPortBase,
+		audit:               config.Audit,
 	}
+
+	statsInterval := vpnConfig.StatsInterval
+	if statsInterval == 0 {
+		statsInterval = DefaultTunnelStatsInterval
+	}
+	go m.runStatsPoller(statsInterval)
+
+	return m
 }
 
 func (m *TunnelMgr) StartTunnel(endpoint *Endpoint) error {
 	if m == nil {
 		return fmt.Errorf("can't start tunnel on nil TunnelMgr")
 	}
+	if endpoint == nil {
+		return fmt.Errorf("can't start tunnel to nil endpoint")
+	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	return m.startTunnel(endpoint)
+}
+
+// startTunnel is the implementation of StartTunnel. The caller must hold
+// the lock, which is released while OpenVPN is being launched.
+//
+// If the tunnel is closing then rather than failing we arrange for it to
+// start again once the old OpenVPN process has exited, since the caller
+// may well have decided to start it based on a state snapshot taken
+// before it began closing.
+func (m *TunnelMgr) startTunnel(endpoint *Endpoint) error {
+	if m.closing {
+		return fmt.Errorf("tunnel manager is closing")
+	}
+
 	endpointId := endpoint.Id()
-	if m.tunnelVPNs[endpointId] != nil {
+	switch m.phases[endpointId] {
+	case tunnelStarting, tunnelRunning:
 		// We already have a tunnel for this endpoint, so there's
 		// nothing to do here.
 		return fmt.Errorf("already have tunnel for endpoint %s", endpointId)
+	case tunnelClosing:
+		logger.Debugf("Tunnel to endpoint %s is closing; will start it again once it has exited", endpointId)
+		m.restarts[endpointId] = endpoint
+		return nil
+	}
+
+	if err := m.checkDeferred(endpointId); err != nil {
+		return err
+	}
+	delete(m.startAfter, endpointId)
+	m.beginEstablishing(endpointId)
+
+	// Both ends of the tunnel must agree on the cipher settings, so we
+	// won't even try if the remote endpoint told us it uses different
+	// ones. (Older nodes don't advertise these, so we just hope for
+	// the best in that case.)
+	if cipher := endpoint.VPNCipher(); cipher != "" && cipher != m.vpnConfig.Cipher {
+		return fmt.Errorf("endpoint %s uses cipher %s, but we use %s", endpointId, cipher, m.vpnConfig.Cipher)
+	}
+	if auth := endpoint.VPNAuth(); auth != "" && auth != m.vpnConfig.Auth {
+		return fmt.Errorf("endpoint %s uses auth digest %s, but we use %s", endpointId, auth, m.vpnConfig.Auth)
+	}
+	if keyMode := endpoint.VPNKeyMode(); keyMode != m.keyMode() {
+		return fmt.Errorf("endpoint %s uses %s keys, but we use %s", endpointId, keyMode, m.keyMode())
+	}
+	if topology := endpoint.VPNTopology(); topology != m.topology() {
+		return fmt.Errorf("endpoint %s uses the %s topology, but we use %s", endpointId, topology, m.topology())
+	}
+
+	keyGen, ok := m.keyring.TunnelGeneration(m.localEndpoint.RegionId(), endpoint.RegionId(), endpoint.KeyGenerations(), endpoint.PairKeys())
+	if !ok {
+		return fmt.Errorf("endpoint %s has no key generation in common with us", endpointId)
+	}
+	compression := m.compression(endpoint)
+	transport := m.transport(endpoint)
+	if fragment := endpoint.VPNFragment(); transport != TransportTCP && fragment != m.vpnConfig.Fragment {
+		// Unlike the cipher settings, older nodes that don't advertise
+		// this can't be fragmenting.
+		return fmt.Errorf("endpoint %s has fragment set to %d, but we have it set to %d", endpointId, fragment, m.vpnConfig.Fragment)
 	}
 
 	localAddr := m.localEndpoint.Address()
 
-	localPort, remotePort := localAddr.VPNEndpointPorts(endpointId)
-	localTunnelIP, remoteTunnelIP := localAddr.TunnelInternalIPs(endpointId)
+	localPort, remotePort := m.localEndpoint.VPNEndpointPorts(endpoint)
+	localTunnelIP, remoteTunnelIP, err := localAddr.TunnelInternalIPs(endpointId)
+	if err != nil {
+		return fmt.Errorf("can't start tunnel to endpoint %s: %s", endpointId, err)
+	}
 
 	listenIPAddr := localAddr.IP
-	remoteIPAddr := endpoint.GossipAddr()
-
-	vpn, err := StartOpenVPN(&VPNConfig{
-		// TODO: These should be configurable
-		OpenVPNPath:  "/usr/sbin/openvpn",
-		LauncherPath: "/usr/bin/sudo",
-
-		RemoteAddr: &net.UDPAddr{
-			IP:   remoteIPAddr,
-			Port: remotePort,
-		},
-		LocalAddr: &net.UDPAddr{
-			IP:   listenIPAddr,
-			Port: localPort,
-		},
-
-		SecretFilename: m.secretFilename,
-
-		TunnelRemoteAddr: remoteTunnelIP,
-		TunnelLocalAddr:  localTunnelIP,
-	})
+	remoteIPAddr := endpoint.VPNEndpointAddr()
+
+	vpnConfig := m.vpnConfig
+	vpnConfig.RemoteAddr = &VPNAddr{
+		IP:   remoteIPAddr,
+		Port: remotePort,
+	}
+	vpnConfig.LocalAddr = &VPNAddr{
+		IP:   listenIPAddr,
+		Port: localPort,
+	}
+	vpnConfig.TunnelRemoteAddr = remoteTunnelIP
+	vpnConfig.TunnelLocalAddr = localTunnelIP
+	vpnConfig.DeviceName = tunnelDeviceName(endpointId)
+	vpnConfig.Compression = compression
+	vpnConfig.Transport = transport
+	if m.mgmtPortBase != 0 {
+		vpnConfig.ManagementPort = m.mgmtPortBase + int(endpointId)
+	}
+
+	// Over TCP, the endpoint with the lower id is the server, and
+	// likewise for the TLS handshake.
+	vpnConfig.TCPServer = m.localEndpoint.Id() < endpointId
+	vpnConfig.TLSServer = m.localEndpoint.Id() < endpointId
+	vpnConfig.TLSRemoteName = endpoint.NodeName()
+
+	if m.dryRun {
+		logger.Infof(
+			"[dry run] Would start %s tunnel to endpoint %s: local %s (tunnel IP %s), remote %s (tunnel IP %s)",
+			transport, endpointId, vpnConfig.LocalAddr, localTunnelIP, vpnConfig.RemoteAddr, remoteTunnelIP,
+		)
+	}
+
+	// If the key is encrypted at rest then OpenVPN gets its own decrypted
+	// copy, which must remain until the process exits because OpenVPN
+	// re-reads it whenever it restarts the connection.
+	keyFilename, removeKeyFile, err := m.keyring.KeyFile(m.localEndpoint.RegionId(), endpoint.RegionId(), keyGen)
+	if err != nil {
+		m.recordStartFailure(endpointId)
+		return err
+	}
+	vpnConfig.SecretFilename = keyFilename
+
+	// Launching OpenVPN can take a while, so we release the lock in the
+	// meantime so that other tunnels can start and be monitored. The
+	// tunnelStarting phase stops anyone else from starting this same
+	// tunnel, and CloseTunnel moves it to tunnelClosing if it wants the
+	// tunnel closed as soon as it has launched.
+	m.phases[endpointId] = tunnelStarting
+	m.lock.Unlock()
+	vpn, err := StartOpenVPN(&vpnConfig)
+	m.lock.Lock()
 	if err != nil {
+		delete(m.phases, endpointId)
+		removeKeyFile()
+		m.recordStartFailure(endpointId)
 		return err
 	}
 
+	if reason := vpnConfig.dcoUnavailable(); reason == "" {
+		logger.Infof("Tunnel to endpoint %s uses data channel offload", endpointId)
+	} else if vpnConfig.DCO {
+		logger.Infof("Tunnel to endpoint %s doesn't use data channel offload, since %s", endpointId, reason)
+	}
+
 	m.tunnelVPNs[endpointId] = vpn
 	m.tunnelStates[endpointId] = VPNLaunching
+	m.audit.TunnelLaunched(endpointId)
+	m.tunnelInfos[endpointId] = &Tunnel{
+		EndpointId:    endpointId,
+		Since:         time.Now(),
+		DeviceName:    vpnConfig.DeviceName,
+		KeyGeneration: keyGen,
+		Compression:   compression,
+		Transport:     transport,
+
+		LocalPort:      localPort,
+		RemotePort:     remotePort,
+		LocalTunnelIP:  localTunnelIP,
+		RemoteTunnelIP: remoteTunnelIP,
+	}
+
+	if m.everStarted.Contains(endpointId) {
+		m.metrics.Add(metricTunnelRestarts, 1, "endpoint_id", endpointId.String())
+	}
+	m.everStarted.Add(endpointId)
+
+	if m.closing || m.phases[endpointId] == tunnelClosing {
+		// CloseAll or CloseTunnel was called while we were launching,
+		// so it couldn't close this tunnel itself.
+		m.phases[endpointId] = tunnelClosing
+		m.closeVPN(endpointId, vpn)
+	} else {
+		m.phases[endpointId] = tunnelRunning
+	}
 
 	go func() {
+		// VPNExited is emitted once the process has exited for any reason,
+		// including crashing, so it's safe to remove the key file once
+		// we stop monitoring.
+		defer removeKeyFile()
+
 		var state VPNState
+		var err error
 		for state != VPNExited {
-			state = vpn.AwaitStateChange()
-			log.Printf("VPN to endpoint %s changed state to %s", endpointId, state)
+			state, err = vpn.AwaitStateChangeContext(m.ctx)
+			if err != nil {
+				logger.Warnf("Stopped monitoring VPN to endpoint %s: %s", endpointId, err)
+				return
+			}
+			changedAt := time.Now()
+			logger.Infof("VPN to endpoint %s changed state to %s", endpointId, state)
+			if state == VPNRetrying {
+				m.metrics.Add(metricTunnelRetries, 1, "endpoint_id", endpointId.String())
+			}
 			m.lock.Lock()
+			m.audit.TunnelTransition(endpointId, m.tunnelStates[endpointId], state, m.transitionReason(endpointId, state))
+			if state == VPNConnected {
+				delete(m.backoffs, endpointId)
+				m.endEstablishing(endpointId)
+			} else if m.tunnelStates[endpointId] == VPNConnected && m.phases[endpointId] == tunnelRunning {
+				m.recordDrop(endpointId)
+			}
+			if state == VPNAuthFailed {
+				// OpenVPN would keep retrying forever, but the key
+				// mismatch won't resolve itself until an operator
+				// intervenes, so we shut it down and wait a while.
+				logger.Errorf("VPN to endpoint %s failed to authenticate; check that both endpoints have the same key", endpointId)
+				m.metrics.Add(metricTunnelAuthFails, 1, "endpoint_id", endpointId.String())
+				m.recordAuthFailure(endpointId)
+				m.phases[endpointId] = tunnelClosing
+				delete(m.restarts, endpointId)
+				m.stopVPN(endpointId, vpn.Close, nil)
+			}
 			if state == VPNExited {
 				delete(m.tunnelVPNs, endpointId)
 				delete(m.tunnelStates, endpointId)
+				delete(m.tunnelInfos, endpointId)
+				delete(m.phases, endpointId)
+
+				// If we were asked to start the tunnel again then we
+				// queue it like any other start, so that restarts are
+				// subject to the same concurrency limit and jitter.
+				if next, ok := m.restarts[endpointId]; ok {
+					delete(m.restarts, endpointId)
+					if next == nil {
+						next = endpoint
+					}
+					logger.Infof("Restarting tunnel to endpoint %s", endpointId)
+					err := m.requestStart(next)
+					if err != nil {
+						logger.Errorf("Failed to restart tunnel to endpoint %s: %s", endpointId, err)
+					}
+				}
 			} else {
 				m.tunnelStates[endpointId] = state
+				m.tunnelInfos[endpointId].Since = changedAt
 			}
-			notification := newTunnelsState(m.tunnelStates)
+			m.notify()
 			m.lock.Unlock()
-			m.changeCh <- notification
 		}
 	}()
 
 	return nil
 }
 
-func (m *TunnelMgr) CloseTunnel(endpointId EndpointId) error {
-	// We're just going to signal the tunnel to stop, so we
-	// are just going to read our maps. Later our monitoring
-	// goroutine will see that it exited and clean up before
-	// signalling that the tunnel is closed.
+// stopVPN calls stop, which should ask the given tunnel's OpenVPN process
+// to close or kill it, in the background. If stop fails or doesn't return
+// within vpnStopTimeout then the failure is logged and failed, if not nil,
+// is called with the lock held. The caller must hold the lock, and should
+// already have moved the tunnel to tunnelClosing.
+//
+// Asking OpenVPN to close is a round trip over its management connection,
+// which mustn't happen with the lock held: a process that doesn't answer
+// would stall every other caller, and its answer can be held up behind
+// state changes that the tunnel's monitoring goroutine needs the lock to
+// deliver.
+func (m *TunnelMgr) stopVPN(endpointId EndpointId, stop func() error, failed func()) {
+	go func() {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- stop()
+		}()
+
+		var err error
+		select {
+		case err = <-errCh:
+		case <-time.After(vpnStopTimeout):
+			err = fmt.Errorf("no response after %s", vpnStopTimeout)
+		}
+		if err == nil {
+			return
+		}
+		logger.Errorf("Failed to close VPN to endpoint %s: %s", endpointId, err)
+		if failed != nil {
+			m.lock.Lock()
+			failed()
+			m.lock.Unlock()
+		}
+	}()
+}
+
+// closeVPN asks the given tunnel's OpenVPN process to close, in the
+// background via stopVPN. The caller must hold the lock, and should
+// already have moved the tunnel to tunnelClosing.
+//
+// If the process doesn't close then, unless it has since exited or been
+// replaced, the tunnel goes back to tunnelRunning and any restart that
+// was waiting for it to exit is dropped, so that it can be closed again
+// later rather than being stuck in tunnelClosing.
+func (m *TunnelMgr) closeVPN(endpointId EndpointId, vpn *OpenVPN) {
+	m.stopVPN(endpointId, vpn.Close, func() {
+		if m.phases[endpointId] == tunnelClosing && m.tunnelVPNs[endpointId] == vpn {
+			m.phases[endpointId] = tunnelRunning
+			delete(m.restarts, endpointId)
+		}
+	})
+}
+
+// Changes returns the channel on which the TunnelMgr delivers snapshots
+// of its tunnel states whenever any of them change.
+//
+// Only the latest snapshot is kept: if the previous one hasn't been
+// received by the time another change happens then it is replaced. The
+// reader may therefore miss intermediate states, but it will always
+// eventually receive the state that things settle in.
+func (m *TunnelMgr) Changes() <-chan *TunnelsState {
+	return m.changeCh
+}
+
+// notify delivers a snapshot of the current tunnel states on changeCh,
+// replacing any earlier snapshot that hasn't yet been received, so that
+// the monitoring goroutines never block on a slow reader. The caller
+// must hold the write lock, which ensures that snapshots are delivered
+// in the order they were taken.
+func (m *TunnelMgr) notify() {
+	notification := newTunnelsState(m.tunnelStates, m.tunnelInfos)
+	notification.SlowStarts = m.slowStarts()
+	for {
+		select {
+		case m.changeCh <- notification:
+			return
+		default:
+		}
+
+		// The buffer is full, so discard the stale snapshot that's in
+		// it. The reader might beat us to it, so this mustn't block.
+		select {
+		case <-m.changeCh:
+		default:
+		}
+	}
+}
+
+// checkDeferred returns a TunnelBackoffError if we must not start the
+// tunnel to the given endpoint yet. The caller must hold the lock.
+func (m *TunnelMgr) checkDeferred(endpointId EndpointId) error {
+	now := time.Now()
+	if backoff := m.backoffs[endpointId]; backoff != nil && now.Before(backoff.RetryAt) {
+		return &TunnelBackoffError{
+			EndpointId: endpointId,
+			RetryAt:    backoff.RetryAt,
+		}
+	}
+	if startAfter, ok := m.startAfter[endpointId]; ok && now.Before(startAfter) {
+		return &TunnelBackoffError{
+			EndpointId: endpointId,
+			RetryAt:    startAfter,
+		}
+	}
+	return nil
+}
+
+// RequestStart queues a tunnel to the given endpoint to be started in the
+// background, without waiting for it to start. Tunnels are started in the
+// order requested, but with no more than the configured number starting
+// at once. Failures to start are logged.
+//
+// Requesting a tunnel that is already running or queued does nothing,
+// except that a queued tunnel will use the given endpoint details when
+// it starts. If the endpoint is still in its backoff period then it
+// isn't queued and a TunnelBackoffError is returned.
+func (m *TunnelMgr) RequestStart(endpoint *Endpoint) error {
+	if endpoint == nil {
+		return fmt.Errorf("can't start tunnel to nil endpoint")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.requestStart(endpoint)
+}
+
+// requestStart is the implementation of RequestStart. The caller must
+// hold the lock.
+func (m *TunnelMgr) requestStart(endpoint *Endpoint) error {
+	endpointId := endpoint.Id()
+	switch m.phases[endpointId] {
+	case tunnelStarting, tunnelRunning:
+		return nil
+	case tunnelClosing:
+		// Start it again once it has exited; see startTunnel.
+		m.restarts[endpointId] = endpoint
+		return nil
+	}
+	if m.starting.Contains(endpointId) {
+		return nil
+	}
+	if err := m.checkDeferred(endpointId); err != nil {
+		return err
+	}
+	m.beginEstablishing(endpointId)
+
+	if _, ok := m.pendingStarts[endpointId]; !ok {
+		m.pendingOrder = append(m.pendingOrder, endpointId)
+	}
+	m.pendingStarts[endpointId] = endpoint
+	m.dispatchStarts()
+	return nil
+}
+
+// PrunePendingStarts removes from the start queue any endpoint not in
+// the given set, so that we don't start tunnels we no longer want.
+func (m *TunnelMgr) PrunePendingStarts(keep EndpointSet) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	order := m.pendingOrder[:0]
+	for _, endpointId := range m.pendingOrder {
+		if keep.Contains(endpointId) {
+			order = append(order, endpointId)
+		} else {
+			delete(m.pendingStarts, endpointId)
+		}
+	}
+	m.pendingOrder = order
+	m.dispatchStarts()
+}
+
+// dispatchStarts begins starting queued tunnels, up to the concurrency
+// limit. The caller must hold the lock.
+func (m *TunnelMgr) dispatchStarts() {
+	for len(m.starting) < m.maxConcurrentStarts && len(m.pendingOrder) > 0 && !m.closing {
+		endpointId := m.pendingOrder[0]
+		m.pendingOrder = m.pendingOrder[1:]
+		endpoint := m.pendingStarts[endpointId]
+		delete(m.pendingStarts, endpointId)
+		m.starting.Add(endpointId)
+		go m.startQueued(endpoint)
+	}
+	m.metrics.Set(metricTunnelsPending, float64(len(m.pendingStarts)+len(m.starting)))
+}
+
+// startQueued starts a tunnel that was queued by RequestStart, after
+// waiting for a random jitter period.
+func (m *TunnelMgr) startQueued(endpoint *Endpoint) {
+	endpointId := endpoint.Id()
+	defer func() {
+		m.lock.Lock()
+		m.starting.Remove(endpointId)
+		m.dispatchStarts()
+		m.lock.Unlock()
+	}()
+
+	if m.startJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(m.startJitter)))
+		select {
+		case <-time.After(jitter):
+		case <-m.ctx.Done():
+			return
+		}
+	}
+
+	err := m.StartTunnel(endpoint)
+	if err != nil {
+		if _, ok := err.(*TunnelBackoffError); ok {
+			logger.Debugf("%s", err)
+			return
+		}
+		logger.Errorf("Failed to start tunnel to endpoint %s: %s", endpointId, err)
+	}
+}
+
+// SetKeyring replaces the set of pre-shared keys that new tunnels may use.
+// Existing tunnels are not affected; use KeyGeneration to find those that
+// should be restarted to use a different key.
+func (m *TunnelMgr) SetKeyring(keyring *VPNKeyring) {
+	m.lock.Lock()
+	m.keyring = keyring
+	m.lock.Unlock()
+}
+
+// SetLocalEndpoint replaces the endpoint that tunnels are started from,
+// so that new tunnels listen on its current address. See localaddr.go.
+// Tunnels that are already running are unaffected.
+func (m *TunnelMgr) SetLocalEndpoint(endpoint *Endpoint) {
+	m.lock.Lock()
+	m.localEndpoint = endpoint
+	m.lock.Unlock()
+}
+
+// KeyGeneration returns the key generation that a tunnel to the given
+// endpoint should use, or false if we have no key in common with it.
+func (m *TunnelMgr) KeyGeneration(endpoint *Endpoint) (int, bool) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
+	return m.keyring.TunnelGeneration(m.localEndpoint.RegionId(), endpoint.RegionId(), endpoint.KeyGenerations(), endpoint.PairKeys())
+}
+
+// Compression returns the compression algorithm that a tunnel to the
+// given endpoint should use.
+func (m *TunnelMgr) Compression(endpoint *Endpoint) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.compression(endpoint)
+}
 
-	vpn := m.tunnelVPNs[endpointId]
-	if vpn == nil {
+// compression is the implementation of Compression, for callers that
+// already hold the lock.
+//
+// Both ends of a tunnel must agree on compression, so we compress only
+// if the remote endpoint advertises the same algorithm that we use.
+func (m *TunnelMgr) compression(endpoint *Endpoint) string {
+	if endpoint.VPNCompression() != m.vpnConfig.Compression {
+		return CompressionOff
+	}
+	return m.vpnConfig.Compression
+}
+
+// Transport returns the protocol that a tunnel to the given endpoint
+// should use.
+func (m *TunnelMgr) Transport(endpoint *Endpoint) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.transport(endpoint)
+}
+
+// transport is the implementation of Transport, for callers that already
+// hold the lock.
+//
+// An endpoint that prefers TCP presumably can't use UDP, so a tunnel uses
+// TCP if either of its endpoints prefers it.
+func (m *TunnelMgr) transport(endpoint *Endpoint) string {
+	if m.vpnConfig.Transport == TransportTCP || endpoint.VPNTransport() == TransportTCP {
+		return TransportTCP
+	}
+	return TransportUDP
+}
+
+// keyMode returns how our tunnels are keyed, which the remote endpoint
+// must match.
+func (m *TunnelMgr) keyMode() string {
+	if m.vpnConfig.KeyMode == "" {
+		return KeyModeStatic
+	}
+	return m.vpnConfig.KeyMode
+}
+
+// topology returns the topology of our tunnel devices, which the remote
+// endpoint must match.
+func (m *TunnelMgr) topology() string {
+	if m.vpnConfig.Topology == "" {
+		return VPNTopologyP2P
+	}
+	return m.vpnConfig.Topology
+}
+
+// recordDrop records that the tunnel to the given endpoint unexpectedly
+// stopped being connected. The caller must hold the lock.
+func (m *TunnelMgr) recordDrop(endpointId EndpointId) {
+	now := time.Now()
+	m.drops[endpointId] = append(recentTimes(m.drops[endpointId], now.Add(-stabilityWindow)), now)
+}
+
+// RecentDrops returns, for each endpoint whose tunnel has unexpectedly
+// stopped being connected within the last stabilityWindow, the number of
+// times it has done so.
+func (m *TunnelMgr) RecentDrops() map[EndpointId]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	since := time.Now().Add(-stabilityWindow)
+	ret := make(map[EndpointId]int)
+	for endpointId, drops := range m.drops {
+		recent := recentTimes(drops, since)
+		if len(recent) == 0 {
+			delete(m.drops, endpointId)
+			continue
+		}
+		m.drops[endpointId] = recent
+		ret[endpointId] = len(recent)
+	}
+	return ret
+}
+
+// recentTimes returns the suffix of the given ascending times that are
+// after since.
+func recentTimes(times []time.Time, since time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool {
+		return times[i].After(since)
+	})
+	return times[i:]
+}
+
+// recordAuthFailure puts the given endpoint into the maximum backoff
+// period after an authentication failure. The caller must hold the lock.
+func (m *TunnelMgr) recordAuthFailure(endpointId EndpointId) {
+	backoff := m.backoffs[endpointId]
+	if backoff == nil {
+		backoff = &TunnelBackoff{
+			EndpointId: endpointId,
+		}
+		m.backoffs[endpointId] = backoff
+	}
+
+	backoff.Failures++
+	backoff.RetryAt = time.Now().Add(tunnelBackoffMax)
+	backoff.AuthFailed = true
+}
+
+// recordStartFailure extends the backoff period for the given endpoint
+// after a failed start. The caller must hold the lock.
+func (m *TunnelMgr) recordStartFailure(endpointId EndpointId) {
+	backoff := m.backoffs[endpointId]
+	if backoff == nil {
+		backoff = &TunnelBackoff{
+			EndpointId: endpointId,
+		}
+		m.backoffs[endpointId] = backoff
+	}
+
+	delay := tunnelBackoffBase
+	for i := 0; i < backoff.Failures && delay < tunnelBackoffMax; i++ {
+		delay = delay * 2
+	}
+	if delay > tunnelBackoffMax {
+		delay = tunnelBackoffMax
+	}
+
+	backoff.Failures++
+	backoff.RetryAt = time.Now().Add(delay)
+	backoff.AuthFailed = false
+	logger.Warnf("Tunnel to endpoint %s has failed to start %d times; will retry in %s", endpointId, backoff.Failures, delay)
+}
+
+// Backoffs returns a snapshot of the endpoints whose tunnels are waiting
+// to retry after failing to start, ordered by endpoint id.
+func (m *TunnelMgr) Backoffs() []*TunnelBackoff {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ret := make([]*TunnelBackoff, 0, len(m.backoffs))
+	for _, backoff := range m.backoffs {
+		copied := *backoff
+		ret = append(ret, &copied)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].EndpointId < ret[j].EndpointId
+	})
+	return ret
+}
+
+// DelayStarts spreads the starts of tunnels to the given endpoints, in
+// the order given, across the given window of time from now. Until its
+// time comes, StartTunnel declines to start each tunnel with a
+// TunnelBackoffError.
+func (m *TunnelMgr) DelayStarts(endpointIds []EndpointId, window time.Duration) {
+	if len(endpointIds) == 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Each endpoint gets an equal slot of the window, and starts at a
+	// random point within its slot.
+	now := time.Now()
+	slot := window / time.Duration(len(endpointIds))
+	for i, endpointId := range endpointIds {
+		startAfter := now.Add(slot * time.Duration(i))
+		if slot > 0 {
+			startAfter = startAfter.Add(time.Duration(rand.Int63n(int64(slot))))
+		}
+		m.startAfter[endpointId] = startAfter
+	}
+}
+
+// DelayedStarts returns the endpoints whose tunnels StartTunnel will
+// decline to start until a later time because of DelayStarts.
+func (m *TunnelMgr) DelayedStarts() EndpointSet {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	ret := make(EndpointSet)
+	for endpointId, startAfter := range m.startAfter {
+		if startAfter.After(now) {
+			ret.Add(endpointId)
+		}
+	}
+	return ret
+}
+
+// NextStartTime returns the earliest time in the future at which a
+// tunnel that StartTunnel has been declining to start may be started,
+// or false if there is no such time.
+func (m *TunnelMgr) NextStartTime() (time.Time, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	now := time.Now()
+	var ret time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (ret.IsZero() || t.Before(ret)) {
+			ret = t
+		}
+	}
+	for _, backoff := range m.backoffs {
+		consider(backoff.RetryAt)
+	}
+	for _, startAfter := range m.startAfter {
+		consider(startAfter)
+	}
+	return ret, !ret.IsZero()
+}
+
+// PruneBackoffs forgets the backoff state for any endpoint not in the
+// given set, so that we don't keep reporting endpoints that we no
+// longer want tunnels for.
+func (m *TunnelMgr) PruneBackoffs(keep EndpointSet) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for endpointId := range m.backoffs {
+		if !keep.Contains(endpointId) {
+			delete(m.backoffs, endpointId)
+		}
+	}
+}
+
+// RestartTunnel closes the tunnel to the given endpoint and then starts
+// a new one as soon as the old OpenVPN process has exited, without
+// affecting any other tunnels. Like CloseTunnel, this returns before the
+// restart is complete; if the old process then can't be asked to close,
+// the restart is abandoned and the tunnel is left running.
+func (m *TunnelMgr) RestartTunnel(endpointId EndpointId) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closing {
+		return fmt.Errorf("tunnel manager is closing")
+	}
+
+	switch m.phases[endpointId] {
+	case tunnelClosed:
+		return fmt.Errorf("no tunnel for endpoint %s", endpointId)
+	case tunnelStarting:
+		return fmt.Errorf("tunnel for endpoint %s is still starting", endpointId)
+	case tunnelClosing:
+		// It'll exit soon anyway, so we just need to make sure that it
+		// starts again afterwards.
+		if _, ok := m.restarts[endpointId]; !ok {
+			m.restarts[endpointId] = nil
+		}
+		return nil
+	}
+
+	m.phases[endpointId] = tunnelClosing
+	m.restarts[endpointId] = nil
+	m.closeVPN(endpointId, m.tunnelVPNs[endpointId])
+	return nil
+}
+
+func (m *TunnelMgr) CloseTunnel(endpointId EndpointId) error {
+	// We're just going to signal the tunnel to stop. Later our
+	// monitoring goroutine will see that it exited and clean up before
+	// signalling that the tunnel is closed.
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// An explicit close overrides any earlier request to start the
+	// tunnel again.
+	delete(m.restarts, endpointId)
+	m.endEstablishing(endpointId)
+
+	switch m.phases[endpointId] {
+	case tunnelClosed, tunnelClosing:
 		// Nothing to do
 		return nil
+	case tunnelStarting:
+		// startTunnel will close it as soon as it has launched.
+		m.phases[endpointId] = tunnelClosing
+		return nil
 	}
 
-	return vpn.Close()
+	if m.dryRun {
+		logger.Infof("[dry run] Would close tunnel to endpoint %s", endpointId)
+	}
+
+	m.phases[endpointId] = tunnelClosing
+	m.closeVPN(endpointId, m.tunnelVPNs[endpointId])
+	return nil
 }
 
 func (m *TunnelMgr) HasTunnel(endpointId EndpointId) bool {
@@ -152,3 +1148,60 @@ func (m *TunnelMgr) HasTunnel(endpointId EndpointId) bool {
 
 	return m.tunnelVPNs[endpointId] != nil
 }
+
+// CloseAll signals all of the active tunnels to close.
+//
+// As with CloseTunnel, this returns before the tunnels have actually
+// closed. The tunnels are removed from the manager once their processes
+// have exited.
+func (m *TunnelMgr) CloseAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Tunnels that are still queued will now never start.
+	m.closing = true
+	m.pendingStarts = make(map[EndpointId]*Endpoint)
+	m.pendingOrder = nil
+	m.restarts = make(map[EndpointId]*Endpoint)
+	m.metrics.Set(metricTunnelsPending, float64(len(m.starting)))
+	for endpointId := range m.establishing {
+		m.endEstablishing(endpointId)
+	}
+
+	for endpointId, vpn := range m.tunnelVPNs {
+		m.phases[endpointId] = tunnelClosing
+		m.closeVPN(endpointId, vpn)
+	}
+}
+
+// ForceCloseAll abruptly terminates the OpenVPN processes for all of the
+// active tunnels. This should be used only as a last resort after CloseAll
+// has failed to shut them down in a timely manner.
+func (m *TunnelMgr) ForceCloseAll() {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	for endpointId, vpn := range m.tunnelVPNs {
+		err := vpn.ForceClose()
+		if err != nil {
+			logger.Errorf("Failed to kill endpoint %s tunnel: %s", endpointId, err)
+		}
+	}
+}
+
+// Stop makes the per-tunnel monitoring goroutines exit, even if their
+// OpenVPN processes haven't. This is a last resort for shutdown, after
+// CloseAll and ForceCloseAll have failed; the TunnelMgr must not be used
+// after calling it.
+func (m *TunnelMgr) Stop() {
+	m.cancel()
+}
+
+// TunnelCount returns the number of tunnels whose OpenVPN processes
+// have not yet exited.
+func (m *TunnelMgr) TunnelCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return len(m.tunnelVPNs)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-openvpn-mgmt/openvpn"
+	"github.com/hashicorp/serf/serf"
+)
+
+// pipeLauncher is a VPNLauncher whose processes run until the test makes
+// them exit, reporting each launch on launched.
+type pipeLauncher struct {
+	launched chan *pipeProcess
+
+	// hang, if set, makes the processes ignore being signalled or
+	// killed until it is closed.
+	hang chan struct{}
+}
+
+func newPipeLauncher() *pipeLauncher {
+	return &pipeLauncher{
+		launched: make(chan *pipeProcess, 16),
+	}
+}
+
+func (l *pipeLauncher) Launch(config *VPNConfig, eventCh chan<- openvpn.Event) (VPNProcess, error) {
+	r, w := io.Pipe()
+	proc := &pipeProcess{w: w, signalled: make(chan string, 4), hang: l.hang}
+	openvpn.NewClient(&scriptedConn{Reader: r}, eventCh)
+	l.launched <- proc
+	return proc, nil
+}
+
+// await returns the next process launched, failing the test if there
+// isn't one within a few seconds.
+func (l *pipeLauncher) await(t testing.TB) *pipeProcess {
+	t.Helper()
+	select {
+	case proc := <-l.launched:
+		return proc
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a launch")
+		return nil
+	}
+}
+
+// pipeProcess is the VPNProcess returned by pipeLauncher. Signals are
+// reported on signalled, but the process only exits when exit is called.
+type pipeProcess struct {
+	w         *io.PipeWriter
+	signalled chan string
+	hang      chan struct{}
+	exitOnce  sync.Once
+
+	// signalErr, if set, is returned by SendSignal instead of reporting
+	// the signal.
+	signalErr error
+}
+
+func (p *pipeProcess) HoldRelease() error {
+	return nil
+}
+
+func (p *pipeProcess) SendSignal(name string) error {
+	if p.hang != nil {
+		<-p.hang
+	}
+	if p.signalErr != nil {
+		return p.signalErr
+	}
+	p.signalled <- name
+	return nil
+}
+
+func (p *pipeProcess) Kill() error {
+	if p.hang != nil {
+		<-p.hang
+	}
+	p.exit()
+	return nil
+}
+
+func (p *pipeProcess) AuthFailures() int {
+	return 0
+}
+
+// send delivers a line on the process's management connection.
+func (p *pipeProcess) send(line string) {
+	fmt.Fprintf(p.w, "%s\n", line)
+}
+
+// exit makes the process exit, closing its management connection.
+func (p *pipeProcess) exit() {
+	p.exitOnce.Do(func() {
+		p.w.Close()
+	})
+}
+
+// awaitSignal fails the test unless the process is sent the given signal
+// within a few seconds.
+func (p *pipeProcess) awaitSignal(t testing.TB, want string) {
+	t.Helper()
+	select {
+	case got := <-p.signalled:
+		if got != want {
+			t.Fatalf("got signal %s; want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", want)
+	}
+}
+
+// newTestTunnelMgr returns a TunnelMgr whose tunnels are launched by the
+// given launcher, starting one tunnel at a time.
+func newTestTunnelMgr(t testing.TB, launcher VPNLauncher) *TunnelMgr {
+	m := NewTunnelMgr(&TunnelMgrConfig{
+		Keyring: &VPNKeyring{
+			keys: map[int]*vpnKey{0: {Filename: "/nonexistent/0.key"}},
+		},
+		LocalEndpoint:       testEndpoint("this", 0x001, serf.StatusAlive, nil),
+		Metrics:             NewMetrics(),
+		VPNConfig:           VPNConfig{ProcessLauncher: launcher},
+		MaxConcurrentStarts: 1,
+	})
+	t.Cleanup(m.cancel)
+	return m
+}
+
+// awaitPhase waits until the tunnel to the given endpoint reaches the
+// given phase, failing the test if it doesn't within a few seconds.
+func awaitPhase(t testing.TB, m *TunnelMgr, endpointId EndpointId, want tunnelPhase) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.lock.RLock()
+		got := m.phases[endpointId]
+		m.lock.RUnlock()
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel to endpoint %s is in phase %d; want %d", endpointId, got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// awaitState waits until the tunnel to the given endpoint reaches the
+// given state, failing the test if it doesn't within a few seconds.
+func awaitState(t *testing.T, m *TunnelMgr, endpointId EndpointId, want VPNState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.lock.RLock()
+		got := m.tunnelStates[endpointId]
+		m.lock.RUnlock()
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel to endpoint %s is in state %s; want %s", endpointId, got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// queued returns whether the tunnel to the given endpoint is waiting to
+// start or starting.
+func queued(m *TunnelMgr, endpointId EndpointId) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, pending := m.pendingStarts[endpointId]
+	return pending || m.starting.Contains(endpointId)
+}
+
+func TestTunnelMgrStartWhileClosing(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	first := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	// The start request arrives after we've begun closing the tunnel,
+	// but before its process has exited.
+	if err := m.CloseTunnel(id); err != nil {
+		t.Fatalf("CloseTunnel failed: %s", err)
+	}
+	first.awaitSignal(t, "SIGTERM")
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	if queued(m, id) {
+		t.Fatalf("tunnel queued to start before the old process exited")
+	}
+	select {
+	case <-launcher.launched:
+		t.Fatalf("tunnel launched before the old process exited")
+	default:
+	}
+
+	// Once it exits, the restart goes through the start queue.
+	first.exit()
+	second := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+	if got := m.HasTunnel(id); !got {
+		t.Errorf("no tunnel after restart")
+	}
+
+	m.CloseAll()
+	second.awaitSignal(t, "SIGTERM")
+	second.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+}
+
+func TestTunnelMgrStartAfterClosed(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	first := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	// This time the process exits before the start request arrives, so
+	// there's nothing to restart when it exits.
+	if err := m.CloseTunnel(id); err != nil {
+		t.Fatalf("CloseTunnel failed: %s", err)
+	}
+	first.awaitSignal(t, "SIGTERM")
+	first.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+	if queued(m, id) {
+		t.Fatalf("tunnel queued to start without being asked")
+	}
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	second := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	m.CloseAll()
+	second.awaitSignal(t, "SIGTERM")
+	second.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+}
+
+func TestTunnelMgrCloseCancelsRestart(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	first := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	// A start request while closing is overridden by a later close.
+	if err := m.RestartTunnel(id); err != nil {
+		t.Fatalf("RestartTunnel failed: %s", err)
+	}
+	first.awaitSignal(t, "SIGTERM")
+	if err := m.CloseTunnel(id); err != nil {
+		t.Fatalf("CloseTunnel failed: %s", err)
+	}
+	first.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+	if queued(m, id) {
+		t.Errorf("closed tunnel queued to restart")
+	}
+	select {
+	case <-launcher.launched:
+		t.Errorf("closed tunnel restarted")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestTunnelMgrRestartWaitsForQueue(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	other := testEndpoint("other", 0x081, serf.StatusAlive, nil)
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	first := launcher.await(t)
+	awaitPhase(t, m, remote.Id(), tunnelRunning)
+
+	// Hold the only start slot, so that the restart has to wait its turn
+	// rather than launching the moment the old process exits.
+	m.lock.Lock()
+	m.starting.Add(other.Id())
+	m.lock.Unlock()
+
+	if err := m.RestartTunnel(remote.Id()); err != nil {
+		t.Fatalf("RestartTunnel failed: %s", err)
+	}
+	first.awaitSignal(t, "SIGTERM")
+	first.exit()
+	awaitPhase(t, m, remote.Id(), tunnelClosed)
+	if !queued(m, remote.Id()) {
+		t.Fatalf("restart wasn't queued")
+	}
+	select {
+	case <-launcher.launched:
+		t.Fatalf("restart bypassed the start queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	m.lock.Lock()
+	m.starting.Remove(other.Id())
+	m.dispatchStarts()
+	m.lock.Unlock()
+	second := launcher.await(t)
+	awaitPhase(t, m, remote.Id(), tunnelRunning)
+
+	m.CloseAll()
+	second.awaitSignal(t, "SIGTERM")
+	second.exit()
+	awaitPhase(t, m, remote.Id(), tunnelClosed)
+}
+
+func TestTunnelMgrRefusesMismatches(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+
+	tests := []struct {
+		name string
+		tags map[string]string
+	}{
+		{"topology", map[string]string{vpnTopologyTag: VPNTopologySubnet}},
+		{"fragment", map[string]string{vpnFragmentTag: "1300"}},
+		{"key mode", map[string]string{vpnKeyModeTag: KeyModeTLS}},
+	}
+	for _, test := range tests {
+		remote := testEndpoint("remote", 0x041, serf.StatusAlive, test.tags)
+		if err := m.StartTunnel(remote); err == nil {
+			t.Errorf("%s: started tunnel despite mismatch", test.name)
+		}
+	}
+	select {
+	case <-launcher.launched:
+		t.Errorf("launched a mismatched tunnel")
+	default:
+	}
+}
+
+func TestTunnelMgrWatchdogHungProcess(t *testing.T) {
+	launcher := newPipeLauncher()
+	launcher.hang = make(chan struct{})
+	m := newTestTunnelMgr(t, launcher)
+	m.watchdogTimeout = time.Minute
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	first := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+	first.send(">STATE:1500000001,CONNECTED,SUCCESS,,")
+	awaitState(t, m, id, VPNConnected)
+
+	// The process has received nothing for far longer than the timeout,
+	// and won't respond to being killed, but that mustn't hold up the
+	// poll or anything else that needs the lock.
+	polled := make(chan struct{})
+	go func() {
+		m.pollStats(time.Now().Add(time.Hour))
+		close(polled)
+	}()
+	select {
+	case <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pollStats blocked on a hung process")
+	}
+	awaitPhase(t, m, id, tunnelClosing)
+
+	// Once the kill goes through, the tunnel starts again.
+	close(launcher.hang)
+	second := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	m.CloseAll()
+	second.awaitSignal(t, "SIGTERM")
+	second.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+}
+
+func TestTunnelMgrCloseHungProcess(t *testing.T) {
+	launcher := newPipeLauncher()
+	launcher.hang = make(chan struct{})
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	proc := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	// The process won't answer being asked to close, but that mustn't
+	// hold up CloseTunnel or anything else that needs the lock.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- m.CloseTunnel(id)
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("CloseTunnel failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CloseTunnel blocked on a hung process")
+	}
+	if got := m.TunnelCount(); got != 1 {
+		t.Errorf("got %d tunnels while closing; want 1", got)
+	}
+	awaitPhase(t, m, id, tunnelClosing)
+
+	close(launcher.hang)
+	proc.awaitSignal(t, "SIGTERM")
+	proc.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+}
+
+func TestTunnelMgrRestartFailedClose(t *testing.T) {
+	launcher := newPipeLauncher()
+	m := newTestTunnelMgr(t, launcher)
+	remote := testEndpoint("remote", 0x041, serf.StatusAlive, nil)
+	id := remote.Id()
+
+	if err := m.RequestStart(remote); err != nil {
+		t.Fatalf("RequestStart failed: %s", err)
+	}
+	proc := launcher.await(t)
+	awaitPhase(t, m, id, tunnelRunning)
+
+	// If the process can't be asked to close then the restart is
+	// abandoned, leaving the tunnel running so that it can be tried
+	// again.
+	proc.signalErr = fmt.Errorf("management connection lost")
+	if err := m.RestartTunnel(id); err != nil {
+		t.Fatalf("RestartTunnel failed: %s", err)
+	}
+	awaitPhase(t, m, id, tunnelRunning)
+	m.lock.RLock()
+	_, restarting := m.restarts[id]
+	m.lock.RUnlock()
+	if restarting {
+		t.Errorf("restart still pending after failing to close")
+	}
+
+	proc.exit()
+	awaitPhase(t, m, id, tunnelClosed)
+	select {
+	case <-launcher.launched:
+		t.Errorf("abandoned restart went ahead")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// BenchmarkTunnelMgrTunnels starts and then closes tunnels to the given
+// numbers of endpoints, reporting how many OpenVPN processes each tunnel
+// needs and how many goroutines and bytes of our own heap each one holds
+// while it's running, as a baseline for any change to how tunnels map onto
+// processes. The memory of the OpenVPN processes themselves, and of the
+// sudo wrapper that launches each of them, isn't included.
+func BenchmarkTunnelMgrTunnels(b *testing.B) {
+	for _, n := range []int{10, 50, 199} {
+		b.Run(fmt.Sprintf("endpoints=%d", n), func(b *testing.B) {
+			launcher := newPipeLauncher()
+			m := newTestTunnelMgr(b, launcher)
+			remotes := make([]*Endpoint, n)
+			for i := range remotes {
+				remotes[i] = testEndpoint(fmt.Sprintf("remote%d", i), EndpointId(0x041+i), serf.StatusAlive, nil)
+			}
+
+			var launches, goroutines int
+			var heap int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				goroutinesBefore, heapBefore := runtime.NumGoroutine(), heapInUse()
+
+				procs := make([]*pipeProcess, 0, n)
+				for _, remote := range remotes {
+					if err := m.StartTunnel(remote); err != nil {
+						b.Fatalf("StartTunnel failed: %s", err)
+					}
+					procs = append(procs, launcher.await(b))
+				}
+				launches += len(procs)
+				goroutines += runtime.NumGoroutine() - goroutinesBefore
+				heap += heapInUse() - heapBefore
+
+				for j, remote := range remotes {
+					if err := m.CloseTunnel(remote.Id()); err != nil {
+						b.Fatalf("CloseTunnel failed: %s", err)
+					}
+					procs[j].awaitSignal(b, "SIGTERM")
+					procs[j].exit()
+					awaitPhase(b, m, remote.Id(), tunnelClosed)
+				}
+			}
+
+			tunnels := float64(b.N * n)
+			b.ReportMetric(float64(launches)/tunnels, "processes/tunnel")
+			b.ReportMetric(float64(goroutines)/tunnels, "goroutines/tunnel")
+			b.ReportMetric(float64(heap)/tunnels, "heap-bytes/tunnel")
+		})
+	}
+}
+
+// heapInUse returns the size of the live heap, after a collection.
+func heapInUse() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
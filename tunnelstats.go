@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+)
+
+// This file polls the statistics of each tunnel into the tunnel states,
+// from which they are reported by the HTTP API and the metrics, and
+// passes them to the watchdog (see watchdog.go).
+//
+// OpenVPN reports the statistics over the management connection that we
+// already have open for state events, so polling doesn't involve talking
+// to the OpenVPN processes at all. See OpenVPN.Stats.
+
+// DefaultTunnelStatsInterval is the tunnel_stats_interval we use when it
+// isn't set. It is also how often OpenVPN reports its statistics, so we
+// keep it fairly long to avoid keeping many OpenVPN processes busy.
+const DefaultTunnelStatsInterval = 30 * time.Second
+
+// runStatsPoller polls the tunnels' statistics every interval until Stop
+// is called.
+func (m *TunnelMgr) runStatsPoller(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.pollStats(now)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// pollStats copies the latest statistics of each running tunnel into its
+// state, delivering a new snapshot if any have changed, and has the
+// watchdog restart any connected tunnels that have stopped receiving.
+//
+// The restarts happen only once we have released the lock, since they
+// involve the very processes that have stopped behaving.
+func (m *TunnelMgr) pollStats(now time.Time) {
+	hung := make(map[EndpointId]*OpenVPN)
+	lastReceived := make(map[EndpointId]time.Time)
+
+	m.lock.Lock()
+	changed := false
+	for endpointId, vpn := range m.tunnelVPNs {
+		if m.phases[endpointId] != tunnelRunning {
+			continue
+		}
+		stats, err := vpn.Stats()
+		if err != nil {
+			// It has just exited, and our monitoring goroutine will
+			// deal with that.
+			continue
+		}
+
+		info := m.tunnelInfos[endpointId]
+		if info.BytesIn != stats.BytesIn || info.BytesOut != stats.BytesOut || !info.LastHealthy.Equal(stats.LastReceived) {
+			info.BytesIn = stats.BytesIn
+			info.BytesOut = stats.BytesOut
+			info.LastHealthy = stats.LastReceived
+			changed = true
+		}
+
+		if m.tunnelStates[endpointId] == VPNConnected && m.watchdogExpired(stats, now) {
+			hung[endpointId] = vpn
+			lastReceived[endpointId] = stats.LastReceived
+		}
+	}
+	if changed {
+		m.notify()
+	}
+	m.lock.Unlock()
+
+	for endpointId, vpn := range hung {
+		m.restartHung(endpointId, vpn, lastReceived[endpointId])
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// We can't re-attach to our tunnels after a restart, because their
+// OpenVPN processes exit along with us. The remote ends keep trying to
+// reconnect though, so if persist_tunnels is enabled we record which
+// tunnels we had and then re-establish them gradually after restarting,
+// rather than all at once.
+
+// savedTunnel is the record of a tunnel that we keep in the data dir.
+type savedTunnel struct {
+	EndpointId EndpointId `json:"endpoint_id"`
+	LocalPort  int        `json:"local_port"`
+	RemotePort int        `json:"remote_port"`
+}
+
+// tunnelsFilename is the name of the file where we record our tunnels,
+// within its subdirectory of the data dir. See datadir.go.
+const tunnelsFilename = "tunnels.json"
+
+// newSavedTunnels produces the records of tunnels to the given endpoints,
+// ordered by endpoint id.
+func newSavedTunnels(local Address, endpointIds EndpointSet) []savedTunnel {
+	ret := make([]savedTunnel, 0, len(endpointIds))
+	for _, endpointId := range endpointIds.Sorted() {
+		localPort, remotePort := local.VPNEndpointPorts(endpointId)
+		ret = append(ret, savedTunnel{
+			EndpointId: endpointId,
+			LocalPort:  localPort,
+			RemotePort: remotePort,
+		})
+	}
+	return ret
+}
+
+// saveTunnels replaces the given file with the given tunnel records. The
+// new file is written alongside and then renamed into place, so that a
+// crash can't leave a partial file behind.
+func saveTunnels(filename string, tunnels []savedTunnel) error {
+	data, err := json.MarshalIndent(tunnels, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), ".tunnels")
+	if err != nil {
+		return fmt.Errorf("failed to save tunnels: %s", err)
+	}
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to save tunnels: %s", err)
+	}
+	return nil
+}
+
+// loadTunnels reads the tunnel records from the given file. A missing
+// file is not an error, and just means that we had no tunnels.
+func loadTunnels(filename string) ([]savedTunnel, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read saved tunnels: %s", err)
+	}
+
+	var ret []savedTunnel
+	err = json.Unmarshal(data, &ret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saved tunnels file %s: %s", filename, err)
+	}
+	return ret, nil
+}
@@ -4,9 +4,9 @@ package main
 
 import "fmt"
 
-const _VPNState_name = "VPNLaunchingVPNConnectingVPNRetryingVPNConnectedVPNExitingVPNExited"
+const _VPNState_name = "VPNLaunchingVPNConnectingVPNRetryingVPNConnectedVPNExitingVPNExitedVPNAuthFailed"
 
-var _VPNState_index = [...]uint8{0, 12, 25, 36, 48, 58, 67}
+var _VPNState_index = [...]uint8{0, 12, 25, 36, 48, 58, 67, 80}
 
 func (i VPNState) String() string {
 	if i < 0 || i >= VPNState(len(_VPNState_index)-1) {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+// This file implements the tunnel watchdog, a safety net for OpenVPN
+// processes that claim to be connected but aren't.
+//
+// OpenVPN normally notices a dead tunnel itself once the keepalive timeout
+// passes without anything arriving from the far end, and reconnects,
+// which we see as a state change. We have seen processes that stay
+// connected to the management socket but stop doing so, leaving a dead
+// tunnel in VPNConnected indefinitely. The watchdog therefore checks the
+// statistics of each connected tunnel as they are polled (see
+// tunnelstats.go), and restarts any tunnel that has received nothing for
+// the watchdog timeout.
+
+// DefaultTunnelWatchdogTimeout is the tunnel_watchdog_timeout we use when
+// it isn't set. It is long enough for OpenVPN's own keepalive timeout to
+// have had a few chances to act first.
+const DefaultTunnelWatchdogTimeout = 3 * time.Minute
+
+// watchdogExpired returns whether the given statistics of a connected
+// tunnel show that it has received nothing for the watchdog timeout.
+func (m *TunnelMgr) watchdogExpired(stats TunnelStats, now time.Time) bool {
+	return m.watchdogTimeout > 0 && now.Sub(stats.LastReceived) >= m.watchdogTimeout
+}
+
+// restartHung restarts the given tunnel, which the watchdog has found to
+// have received nothing since lastReceived, unless it has since exited or
+// been closed. The caller must not hold the lock.
+//
+// A process that has stopped passing traffic may well have stopped
+// answering on its management connection too, so it is stopped in the
+// background by stopVPN rather than with the lock held.
+func (m *TunnelMgr) restartHung(endpointId EndpointId, vpn *OpenVPN, lastReceived time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.tunnelVPNs[endpointId] != vpn || m.phases[endpointId] != tunnelRunning {
+		return
+	}
+
+	logger.Errorf("VPN to endpoint %s is connected but has received nothing since %s; restarting it", endpointId, lastReceived.Format(time.RFC3339))
+	m.metrics.Add(metricTunnelWatchdog, 1, "endpoint_id", endpointId.String())
+	m.recordDrop(endpointId)
+
+	m.phases[endpointId] = tunnelClosing
+	m.restarts[endpointId] = nil
+	m.stopVPN(endpointId, func() error {
+		// The process isn't behaving, so we don't trust it to shut down
+		// when asked, but killing it may not be possible; see
+		// OpenVPN.ForceClose.
+		err := vpn.ForceClose()
+		if err != nil {
+			logger.Warnf("Failed to kill VPN to endpoint %s, so asking it to close: %s", endpointId, err)
+			err = vpn.Close()
+		}
+		return err
+	}, func() {
+		// Unless the process has since exited, or the tunnel has been
+		// closed for some other reason, we leave it running so that the
+		// watchdog tries again at the next poll.
+		if _, restarting := m.restarts[endpointId]; restarting && m.phases[endpointId] == tunnelClosing && m.tunnelVPNs[endpointId] == vpn {
+			m.phases[endpointId] = tunnelRunning
+			delete(m.restarts, endpointId)
+		}
+	})
+}